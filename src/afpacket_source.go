@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+const (
+	// afPacketBlockSize is the size of each block of the ring, which the kernel hands over once it's full or its
+	// blockTimeout has passed
+	afPacketBlockSize = afpacket.DefaultBlockSize
+	// afPacketPollTimeout is how often reads check whether the source has been closed
+	afPacketPollTimeout = 100 * time.Millisecond
+)
+
+// afPacketBackend opens packet sources using TPACKET_V3 AF_PACKET sockets, which share a memory mapped ring with the
+// kernel so packets aren't copied through a syscall each
+type afPacketBackend struct {
+	snaplen int
+	config  afPacketConfig
+	mu      sync.Mutex
+	// fanoutGroups are the fanout groups of the open interfaces by name. Each interface's sockets need a group of their
+	// own, and a group's ID is freed once the interface's sources are closed so IDs aren't used up as pods come and go.
+	fanoutGroups map[string]*afPacketFanoutGroup
+	// ringBytes is the memory used by the rings of the open sources, which is capped at maxTotalRingSize
+	ringBytes int
+}
+
+func newAfPacketBackend(snaplen int, config afPacketConfig) *afPacketBackend {
+	return &afPacketBackend{snaplen: snaplen, config: config, fanoutGroups: map[string]*afPacketFanoutGroup{}}
+}
+
+type afPacketFanoutGroup struct {
+	id uint16
+	// sources is how many open sources use the group, as an interface can be reopened before its old source is closed
+	sources int
+}
+
+// open opens fanoutWorkers sockets on an interface, each with its own ring. If there's more than one, they join a
+// fanout group which spreads the interface's packets between them by flow hash, so both directions of a connection are
+// read by the same socket.
+func (b *afPacketBackend) open(name string, bpfExpression string) (packetSource, error) {
+	filter, err := compileAfPacketBpf(bpfExpression, b.snaplen)
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := b.reserveRing(name)
+	if err != nil {
+		return nil, err
+	}
+	fanoutGroupId, err := b.fanoutGroupId(name)
+	if err != nil {
+		b.releaseRing(blocks)
+		return nil, err
+	}
+	options := b.socketOptions(name, blocks)
+
+	release := func() {
+		b.releaseRing(blocks)
+		b.releaseFanoutGroupId(name)
+	}
+	source := &afPacketSource{snaplen: b.snaplen, release: release}
+	for range b.config.FanoutWorkers {
+		socket, err := afpacket.NewTPacket(options...)
+		if err == nil {
+			err = socket.SetBPF(filter)
+			if err == nil && b.config.FanoutWorkers > 1 {
+				err = socket.SetFanout(afpacket.FanoutHash, fanoutGroupId)
+			}
+			source.sockets = append(source.sockets, socket)
+		}
+		if err != nil {
+			for _, socket := range source.sockets {
+				socket.Close()
+			}
+			release()
+			return nil, err
+		}
+	}
+	return source, nil
+}
+
+// socketOptions returns the options for each of an interface's sockets, whose rings have the given number of blocks
+func (b *afPacketBackend) socketOptions(name string, blocks int) []interface{} {
+	options := []interface{}{
+		afpacket.OptTPacketVersion(afpacket.TPacketVersion3),
+		afpacket.OptBlockSize(afPacketBlockSize),
+		afpacket.OptNumBlocks(blocks),
+		afpacket.OptBlockTimeout(b.config.BlockTimeout),
+		afpacket.OptPollTimeout(afPacketPollTimeout),
+	}
+	// AF_PACKET sockets capture on every interface unless they're bound to one
+	if name != anyInterface {
+		options = append(options, afpacket.OptInterface(name))
+	}
+	return options
+}
+
+// fanoutGroupId returns the interface's fanout group ID if it's already open. Otherwise it allocates the first ID from
+// fanoutGroupId onwards that isn't used by another open interface, wrapping around after the largest ID.
+func (b *afPacketBackend) fanoutGroupId(name string) (uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if group, ok := b.fanoutGroups[name]; ok {
+		group.sources++
+		return group.id, nil
+	}
+	used := make(map[uint16]bool, len(b.fanoutGroups))
+	for _, group := range b.fanoutGroups {
+		used[group.id] = true
+	}
+	for offset := range math.MaxUint16 + 1 {
+		id := uint16(b.config.FanoutGroupId + offset)
+		if !used[id] {
+			b.fanoutGroups[name] = &afPacketFanoutGroup{id: id, sources: 1}
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("No AF_PACKET fanout group IDs left for interface %s", name)
+}
+
+// releaseFanoutGroupId frees the interface's fanout group ID once none of its sources are open
+func (b *afPacketBackend) releaseFanoutGroupId(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	group, ok := b.fanoutGroups[name]
+	if !ok {
+		return
+	}
+	if group.sources--; group.sources == 0 {
+		delete(b.fanoutGroups, name)
+	}
+}
+
+// reserveRing reserves the memory for an interface's rings, returning how many blocks each of its sockets' rings
+// has. Rings are shrunk below ringSize once the other interfaces' rings leave less than that under maxTotalRingSize.
+func (b *afPacketBackend) reserveRing(name string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	available := (b.config.MaxTotalRingSize - b.ringBytes) / b.config.FanoutWorkers
+	blocks := min(b.config.RingSize, available) / afPacketBlockSize
+	if blocks == 0 {
+		return 0, fmt.Errorf("No ring memory left under capture.afPacket.maxTotalRingSize of %d bytes", b.config.MaxTotalRingSize)
+	}
+	if blocks*afPacketBlockSize < b.config.RingSize {
+		slog.Warn(
+			"Shrinking AF_PACKET ring to fit under capture.afPacket.maxTotalRingSize:",
+			"Interface", name,
+			"RingSize", blocks*afPacketBlockSize,
+		)
+	}
+	b.ringBytes += blocks * afPacketBlockSize * b.config.FanoutWorkers
+	return blocks, nil
+}
+
+func (b *afPacketBackend) releaseRing(blocks int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ringBytes -= blocks * afPacketBlockSize * b.config.FanoutWorkers
+}
+
+// compileAfPacketBpf compiles a BPF expression for AF_PACKET sockets, which see Ethernet frames. The filter's return
+// value is how much of each packet the kernel keeps, so the snaplen is applied by the filter.
+func compileAfPacketBpf(bpfExpression string, snaplen int) ([]bpf.RawInstruction, error) {
+	instructions, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, snaplen, bpfExpression)
+	if err != nil {
+		return nil, fmt.Errorf("BPF expression %q is invalid for link type %s: %v", bpfExpression, layers.LinkTypeEthernet, err)
+	}
+	filter := make([]bpf.RawInstruction, len(instructions))
+	for i, instruction := range instructions {
+		filter[i] = bpf.RawInstruction{Op: instruction.Code, Jt: instruction.Jt, Jf: instruction.Jf, K: instruction.K}
+	}
+	return filter, nil
+}
+
+type afPacketSource struct {
+	snaplen int
+	sockets []*afpacket.TPacket
+	closed  atomic.Bool
+	// release returns the rings' memory to the backend once every socket has been closed
+	release func()
+}
+
+// readPackets reads every socket in its own goroutine. Sockets are closed by the goroutine reading them once the
+// source is closed, as closing a socket unmaps the ring it's reading from.
+func (s *afPacketSource) readPackets(packets chan<- gopacket.Packet) {
+	var readers sync.WaitGroup
+	for _, socket := range s.sockets {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			defer socket.Close()
+			for !s.closed.Load() {
+				data, captureInfo, err := socket.ReadPacketData()
+				if errors.Is(err, afpacket.ErrTimeout) {
+					continue
+				}
+				if err != nil {
+					slog.Error("Failed to read from AF_PACKET socket:", "Err", err.Error())
+					s.close()
+					return
+				}
+				packet := gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.NoCopy)
+				packet.Metadata().CaptureInfo = captureInfo
+				packets <- packet
+			}
+		}()
+	}
+	readers.Wait()
+	s.release()
+}
+
+func (s *afPacketSource) compileBpfExpression(bpfExpression string) error {
+	_, err := compileAfPacketBpf(bpfExpression, s.snaplen)
+	return err
+}
+
+func (s *afPacketSource) setBpfExpression(bpfExpression string) error {
+	filter, err := compileAfPacketBpf(bpfExpression, s.snaplen)
+	if err != nil {
+		return err
+	}
+	for _, socket := range s.sockets {
+		if err := socket.SetBPF(filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *afPacketSource) close() {
+	s.closed.Store(true)
+}
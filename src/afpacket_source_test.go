@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/afpacket"
+	"golang.org/x/net/bpf"
+)
+
+func TestCompileAfPacketBpf(t *testing.T) {
+	snaplen := defaultConfig().Capture.Snaplen
+	filter, err := compileAfPacketBpf("tcp and (port 80 or port 443)", snaplen)
+	if err != nil {
+		t.Fatalf("compileAfPacketBpf() error = %v", err)
+	}
+	// The filter keeps the first snaplen bytes of the packets it accepts
+	if !slices.ContainsFunc(filter, func(instruction bpf.RawInstruction) bool {
+		return instruction.Op == 0x6 && instruction.K == uint32(snaplen)
+	}) {
+		t.Errorf("Filter %v doesn't return the snaplen", filter)
+	}
+
+	_, err = compileAfPacketBpf("tcp and (port 80", snaplen)
+	if err == nil || !strings.Contains(err.Error(), `"tcp and (port 80"`) || !strings.Contains(err.Error(), "Ethernet") {
+		t.Errorf("compileAfPacketBpf() error = %v, want it to name the expression and link type", err)
+	}
+}
+
+func TestAfPacketSocketOptions(t *testing.T) {
+	config := defaultConfig().Capture.AfPacket
+	config.BlockTimeout = 10 * time.Millisecond
+	backend := newAfPacketBackend(65535, config)
+
+	tests := []struct {
+		name              string
+		interfaceName     string
+		expectedInterface bool
+	}{
+		{name: "Interface", interfaceName: "eth0", expectedInterface: true},
+		{name: "Every interface", interfaceName: anyInterface, expectedInterface: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := backend.socketOptions(tt.interfaceName, 16)
+			for _, expected := range []interface{}{
+				afpacket.OptTPacketVersion(afpacket.TPacketVersion3),
+				afpacket.OptBlockSize(afPacketBlockSize),
+				afpacket.OptNumBlocks(16),
+				afpacket.OptBlockTimeout(10 * time.Millisecond),
+				afpacket.OptPollTimeout(afPacketPollTimeout),
+			} {
+				if !slices.Contains(options, expected) {
+					t.Errorf("Options %v are missing %v", options, expected)
+				}
+			}
+			if slices.Contains(options, interface{}(afpacket.OptInterface(tt.interfaceName))) != tt.expectedInterface {
+				t.Errorf("Options %v bind to interface %q = %v, want %v", options, tt.interfaceName, !tt.expectedInterface, tt.expectedInterface)
+			}
+		})
+	}
+}
+
+func TestAfPacketFanoutGroupIds(t *testing.T) {
+	backend := newAfPacketBackend(65535, defaultConfig().Capture.AfPacket)
+	fanoutGroupId := func(name string) uint16 {
+		id, err := backend.fanoutGroupId(name)
+		if err != nil {
+			t.Fatalf("Failed to allocate fanout group ID for %s: %v", name, err)
+		}
+		return id
+	}
+	eth0 := fanoutGroupId("eth0")
+	cali := fanoutGroupId("cali1a2b")
+	if eth0 != 4600 || cali != 4601 {
+		t.Errorf("Fanout group IDs = %d, %d, want 4600, 4601", eth0, cali)
+	}
+	// An interface reopened before its old source is closed joins the same group, which stays allocated until both
+	// are closed
+	if reopened := fanoutGroupId("eth0"); reopened != eth0 {
+		t.Errorf("Reopened interface's fanout group ID = %d, want %d", reopened, eth0)
+	}
+	backend.releaseFanoutGroupId("eth0")
+	if id := fanoutGroupId("cali3c4d"); id != 4602 {
+		t.Errorf("Fanout group ID while eth0 is still open = %d, want 4602", id)
+	}
+	// Closed interfaces' IDs are reused rather than allocating ever larger ones
+	backend.releaseFanoutGroupId("eth0")
+	backend.releaseFanoutGroupId("cali1a2b")
+	if id := fanoutGroupId("cali5e6f"); id != 4600 {
+		t.Errorf("Fanout group ID after eth0 was closed = %d, want 4600", id)
+	}
+	if id := fanoutGroupId("cali7a8b"); id != 4601 {
+		t.Errorf("Fanout group ID after cali1a2b was closed = %d, want 4601", id)
+	}
+}
+
+func TestAfPacketFanoutGroupIdsWrapAround(t *testing.T) {
+	config := defaultConfig().Capture.AfPacket
+	config.FanoutGroupId = math.MaxUint16
+	backend := newAfPacketBackend(65535, config)
+	for _, expected := range []uint16{math.MaxUint16, 0, 1} {
+		id, err := backend.fanoutGroupId(fmt.Sprintf("eth%d", expected))
+		if err != nil {
+			t.Fatalf("Failed to allocate fanout group ID: %v", err)
+		}
+		if id != expected {
+			t.Errorf("Fanout group ID = %d, want %d", id, expected)
+		}
+	}
+}
+
+func TestAfPacketRingReservation(t *testing.T) {
+	config := defaultConfig().Capture.AfPacket
+	config.RingSize = 4 * afPacketBlockSize
+	config.MaxTotalRingSize = 10 * afPacketBlockSize
+	config.FanoutWorkers = 2
+	backend := newAfPacketBackend(65535, config)
+
+	// Each interface's two sockets need 8 blocks, so the second interface's rings are shrunk to the 2 left
+	expectedBlocks := []int{4, 1}
+	for i, expected := range expectedBlocks {
+		blocks, err := backend.reserveRing("eth0")
+		if err != nil || blocks != expected {
+			t.Fatalf("reserveRing() #%d = %d, %v, want %d", i, blocks, err, expected)
+		}
+	}
+	if _, err := backend.reserveRing("eth1"); err == nil {
+		t.Errorf("reserveRing() with no ring memory left succeeded")
+	}
+
+	backend.releaseRing(4)
+	if blocks, err := backend.reserveRing("eth1"); err != nil || blocks != 4 {
+		t.Errorf("reserveRing() after releasing a ring = %d, %v, want 4", blocks, err)
+	}
+}
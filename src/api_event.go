@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// apiEvent is a captured request and response in the versioned schema exported to streaming sinks such as Kafka. It's
+// a contract with downstream consumers, so it mustn't change with internal refactors: the JSON form is described by
+// schema/api_event.v1.schema.json and the protobuf form by schema/firetail/sensor/v1/api_event.proto. Fields may be
+// added within a version, but renaming, removing or renumbering one needs a new apiEventSchemaVersion.
+const (
+	apiEventSchemaVersion  = 1
+	apiEventSensorName     = "firetail-kubernetes-sensor"
+	apiEventTransportTcp   = "tcp"
+	apiEventEncodingBase64 = "base64"
+)
+
+// sensorVersion is the sensor's release, set at build time with -ldflags "-X main.sensorVersion=..."
+var sensorVersion = "dev"
+
+type apiEvent struct {
+	SchemaVersion int32              `json:"schemaVersion"`
+	EventId       string             `json:"eventId"`
+	Sensor        apiEventSensor     `json:"sensor"`
+	Timing        apiEventTiming     `json:"timing"`
+	Network       apiEventNetwork    `json:"network"`
+	Kubernetes    apiEventKubernetes `json:"kubernetes"`
+	Request       apiEventRequest    `json:"request"`
+	Response      apiEventResponse   `json:"response"`
+	// Redacted is true if the sensor replaced any header or body values before the event was exported
+	Redacted bool `json:"redacted"`
+	// DataClasses are the classes of sensitive data, such as emails, found in the request and response
+	DataClasses []string `json:"dataClasses,omitempty"`
+	// Auth describes the credentials the request was made with, if the sensor looked for them
+	Auth *apiEventAuth `json:"auth,omitempty"`
+	// Lossy is true if packets of the connection were truncated when they were captured, so the event may be corrupt
+	Lossy bool `json:"lossy,omitempty"`
+	// Tls describes the TLS session the request was decrypted from, if it was sent over TLS
+	Tls *apiEventTls `json:"tls,omitempty"`
+}
+
+type apiEventTls struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipherSuite"`
+	ServerName  string `json:"serverName,omitempty"`
+	Alpn        string `json:"alpn,omitempty"`
+}
+
+type apiEventAuth struct {
+	Schemes []string     `json:"schemes"`
+	Jwt     *apiEventJwt `json:"jwt,omitempty"`
+}
+
+// apiEventJwt is the header and some registered claims of a JWT. The rest of the token, and its signature, are never
+// exported.
+type apiEventJwt struct {
+	Algorithm string     `json:"algorithm"`
+	Issuer    string     `json:"issuer,omitempty"`
+	Audience  []string   `json:"audience,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+type apiEventSensor struct {
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	NodeName string `json:"nodeName,omitempty"`
+	PodName  string `json:"podName,omitempty"`
+}
+
+type apiEventTiming struct {
+	RequestTime  time.Time `json:"requestTime"`
+	ResponseTime time.Time `json:"responseTime"`
+	LatencyMs    float64   `json:"latencyMs"`
+}
+
+type apiEventNetwork struct {
+	Transport   string           `json:"transport"`
+	Source      apiEventEndpoint `json:"source"`
+	Destination apiEventEndpoint `json:"destination"`
+}
+
+type apiEventEndpoint struct {
+	Ip   string `json:"ip"`
+	Port int32  `json:"port"`
+}
+
+type apiEventKubernetes struct {
+	Source      *apiEventWorkload `json:"source,omitempty"`
+	Destination *apiEventWorkload `json:"destination,omitempty"`
+}
+
+type apiEventWorkload struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+type apiEventHeader struct {
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
+}
+
+type apiEventBody struct {
+	// Content is the body as text if it's valid UTF-8, and base64 encoded otherwise
+	Content  string `json:"content"`
+	Encoding string `json:"encoding,omitempty"`
+	// Size is the number of bytes captured, which is less than the body's size on the wire if it was truncated
+	Size      int64 `json:"size"`
+	Truncated bool  `json:"truncated"`
+	raw       []byte
+}
+
+type apiEventRequest struct {
+	Method string `json:"method"`
+	// Scheme is "https" for requests decrypted from TLS connections, and "http" otherwise
+	Scheme      string           `json:"scheme"`
+	Host        string           `json:"host"`
+	Path        string           `json:"path"`
+	Query       string           `json:"query,omitempty"`
+	HTTPVersion string           `json:"httpVersion"`
+	Headers     []apiEventHeader `json:"headers"`
+	Body        apiEventBody     `json:"body"`
+}
+
+type apiEventResponse struct {
+	StatusCode  int32            `json:"statusCode"`
+	HTTPVersion string           `json:"httpVersion"`
+	Headers     []apiEventHeader `json:"headers"`
+	Body        apiEventBody     `json:"body"`
+}
+
+// newApiEvent converts a captured request and response into an event, reading their bodies
+func newApiEvent(reqAndResp *httpRequestAndResponse, kubernetesConfig kubernetesConfig) *apiEvent {
+	request := reqAndResp.request
+	response := reqAndResp.response
+
+	requestBody, requestTruncated := readCapturedBody(request.Body)
+	responseBody, responseTruncated := readCapturedBody(response.Body)
+
+	requestTime := reqAndResp.requestTime
+	if requestTime.IsZero() {
+		requestTime = time.Now()
+	}
+	responseTime := reqAndResp.responseTime
+	if responseTime.Before(requestTime) {
+		responseTime = requestTime
+	}
+
+	return &apiEvent{
+		SchemaVersion: apiEventSchemaVersion,
+		EventId:       uuid.NewString(),
+		Sensor: apiEventSensor{
+			Name:     apiEventSensorName,
+			Version:  sensorVersion,
+			NodeName: kubernetesConfig.NodeName,
+			PodName:  kubernetesConfig.PodName,
+		},
+		Timing: apiEventTiming{
+			RequestTime:  requestTime.UTC(),
+			ResponseTime: responseTime.UTC(),
+			LatencyMs:    float64(responseTime.Sub(requestTime)) / float64(time.Millisecond),
+		},
+		Network: apiEventNetwork{
+			Transport:   apiEventTransportTcp,
+			Source:      newApiEventEndpoint(reqAndResp.src, reqAndResp.srcPort),
+			Destination: newApiEventEndpoint(reqAndResp.dst, reqAndResp.dstPort),
+		},
+		Kubernetes: apiEventKubernetes{
+			Source:      newApiEventWorkload(reqAndResp.srcWorkload),
+			Destination: newApiEventWorkload(reqAndResp.dstWorkload),
+		},
+		Request: apiEventRequest{
+			Method:      request.Method,
+			Scheme:      requestScheme(request),
+			Host:        request.Host,
+			Path:        request.URL.Path,
+			Query:       request.URL.RawQuery,
+			HTTPVersion: request.Proto,
+			Headers:     newApiEventHeaders(request.Header),
+			Body:        newApiEventBody(requestBody, reqAndResp.requestTruncated || requestTruncated),
+		},
+		Response: apiEventResponse{
+			StatusCode:  int32(response.StatusCode),
+			HTTPVersion: response.Proto,
+			Headers:     newApiEventHeaders(response.Header),
+			Body:        newApiEventBody(responseBody, reqAndResp.responseTruncated || responseTruncated),
+		},
+		Redacted:    reqAndResp.redacted,
+		DataClasses: reqAndResp.dataClasses,
+		Auth:        newApiEventAuth(reqAndResp.auth),
+		Lossy:       reqAndResp.lossy,
+		Tls:         newApiEventTls(request.TLS),
+	}
+}
+
+func newApiEventTls(state *tls.ConnectionState) *apiEventTls {
+	if state == nil {
+		return nil
+	}
+	return &apiEventTls{
+		Version:     tlsVersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ServerName:  state.ServerName,
+		Alpn:        state.NegotiatedProtocol,
+	}
+}
+
+func newApiEventAuth(auth *requestAuth) *apiEventAuth {
+	if auth == nil {
+		return nil
+	}
+	eventAuth := &apiEventAuth{Schemes: auth.Schemes}
+	if auth.Jwt != nil {
+		eventAuth.Jwt = &apiEventJwt{Algorithm: auth.Jwt.Algorithm, Issuer: auth.Jwt.Issuer, Audience: auth.Jwt.Audience}
+		if !auth.Jwt.ExpiresAt.IsZero() {
+			expiresAt := auth.Jwt.ExpiresAt
+			eventAuth.Jwt.ExpiresAt = &expiresAt
+		}
+	}
+	return eventAuth
+}
+
+func newApiEventEndpoint(ip string, port string) apiEventEndpoint {
+	parsedPort, _ := strconv.ParseInt(port, 10, 32)
+	return apiEventEndpoint{Ip: ip, Port: int32(parsedPort)}
+}
+
+// newApiEventWorkload splits a "namespace/name" workload, returning nil if the IP didn't belong to a known workload
+func newApiEventWorkload(workload string) *apiEventWorkload {
+	if workload == "" {
+		return nil
+	}
+	namespace, name, ok := strings.Cut(workload, "/")
+	if !ok {
+		return &apiEventWorkload{Name: workload}
+	}
+	return &apiEventWorkload{Namespace: namespace, Name: name}
+}
+
+// String returns the workload in the "namespace/name" form the rest of the sensor uses
+func (w *apiEventWorkload) String() string {
+	if w == nil {
+		return ""
+	}
+	if w.Namespace == "" {
+		return w.Name
+	}
+	return w.Namespace + "/" + w.Name
+}
+
+func newApiEventHeaders(headers http.Header) []apiEventHeader {
+	eventHeaders := []apiEventHeader{}
+	for name, values := range headers {
+		eventHeaders = append(eventHeaders, apiEventHeader{Name: name, Values: values})
+	}
+	sort.Slice(eventHeaders, func(i, j int) bool { return eventHeaders[i].Name < eventHeaders[j].Name })
+	return eventHeaders
+}
+
+func newApiEventBody(body []byte, truncated bool) apiEventBody {
+	if utf8.Valid(body) {
+		return apiEventBody{Content: string(body), Size: int64(len(body)), Truncated: truncated, raw: body}
+	}
+	return apiEventBody{
+		Content:   base64.StdEncoding.EncodeToString(body),
+		Encoding:  apiEventEncodingBase64,
+		Size:      int64(len(body)),
+		Truncated: truncated,
+		raw:       body,
+	}
+}
+
+func (e *apiEvent) marshalJson() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// marshalProto encodes the event as a firetail.sensor.v1.ApiEvent. Bodies are sent as raw bytes, as protobuf doesn't
+// need them encoded, and times as nanoseconds since the Unix epoch.
+func (e *apiEvent) marshalProto() []byte {
+	var b []byte
+	b = appendProtoVarint(b, 1, uint64(e.SchemaVersion))
+	b = appendProtoString(b, 2, e.EventId)
+	b = appendProtoMessage(b, 3, e.Sensor.marshalProto())
+	b = appendProtoMessage(b, 4, e.Timing.marshalProto())
+	b = appendProtoMessage(b, 5, e.Network.marshalProto())
+	b = appendProtoMessage(b, 6, e.Kubernetes.marshalProto())
+	b = appendProtoMessage(b, 7, e.Request.marshalProto())
+	b = appendProtoMessage(b, 8, e.Response.marshalProto())
+	b = appendProtoBool(b, 9, e.Redacted)
+	for _, dataClass := range e.DataClasses {
+		b = appendProtoString(b, 10, dataClass)
+	}
+	if e.Auth != nil {
+		b = appendProtoMessage(b, 11, e.Auth.marshalProto())
+	}
+	b = appendProtoBool(b, 12, e.Lossy)
+	if e.Tls != nil {
+		b = appendProtoMessage(b, 13, e.Tls.marshalProto())
+	}
+	return b
+}
+
+func (t *apiEventTls) marshalProto() []byte {
+	b := appendProtoString(nil, 1, t.Version)
+	b = appendProtoString(b, 2, t.CipherSuite)
+	b = appendProtoString(b, 3, t.ServerName)
+	return appendProtoString(b, 4, t.Alpn)
+}
+
+func (a *apiEventAuth) marshalProto() []byte {
+	var b []byte
+	for _, scheme := range a.Schemes {
+		b = appendProtoString(b, 1, scheme)
+	}
+	if a.Jwt != nil {
+		b = appendProtoMessage(b, 2, a.Jwt.marshalProto())
+	}
+	return b
+}
+
+func (j *apiEventJwt) marshalProto() []byte {
+	b := appendProtoString(nil, 1, j.Algorithm)
+	b = appendProtoString(b, 2, j.Issuer)
+	for _, audience := range j.Audience {
+		b = appendProtoString(b, 3, audience)
+	}
+	if j.ExpiresAt != nil {
+		b = appendProtoVarint(b, 4, uint64(j.ExpiresAt.Unix()))
+	}
+	return b
+}
+
+func appendProtoBool(b []byte, num protowire.Number, value bool) []byte {
+	return appendProtoVarint(b, num, protowire.EncodeBool(value))
+}
+
+func (s apiEventSensor) marshalProto() []byte {
+	b := appendProtoString(nil, 1, s.Name)
+	b = appendProtoString(b, 2, s.Version)
+	b = appendProtoString(b, 3, s.NodeName)
+	return appendProtoString(b, 4, s.PodName)
+}
+
+func (t apiEventTiming) marshalProto() []byte {
+	b := appendProtoVarint(nil, 1, uint64(t.RequestTime.UnixNano()))
+	b = appendProtoVarint(b, 2, uint64(t.ResponseTime.UnixNano()))
+	return appendProtoDouble(b, 3, t.LatencyMs)
+}
+
+func (n apiEventNetwork) marshalProto() []byte {
+	b := appendProtoString(nil, 1, n.Transport)
+	b = appendProtoMessage(b, 2, n.Source.marshalProto())
+	return appendProtoMessage(b, 3, n.Destination.marshalProto())
+}
+
+func (e apiEventEndpoint) marshalProto() []byte {
+	b := appendProtoString(nil, 1, e.Ip)
+	return appendProtoVarint(b, 2, uint64(e.Port))
+}
+
+func (k apiEventKubernetes) marshalProto() []byte {
+	var b []byte
+	if k.Source != nil {
+		b = appendProtoMessage(b, 1, k.Source.marshalProto())
+	}
+	if k.Destination != nil {
+		b = appendProtoMessage(b, 2, k.Destination.marshalProto())
+	}
+	return b
+}
+
+func (w *apiEventWorkload) marshalProto() []byte {
+	b := appendProtoString(nil, 1, w.Namespace)
+	return appendProtoString(b, 2, w.Name)
+}
+
+func appendApiEventHeaders(b []byte, num protowire.Number, headers []apiEventHeader) []byte {
+	for _, header := range headers {
+		h := appendProtoString(nil, 1, header.Name)
+		for _, value := range header.Values {
+			h = appendProtoBytes(h, 2, []byte(value))
+		}
+		b = appendProtoMessage(b, num, h)
+	}
+	return b
+}
+
+func (b apiEventBody) marshalProto() []byte {
+	var m []byte
+	if len(b.raw) > 0 {
+		m = appendProtoBytes(m, 1, b.raw)
+	}
+	m = appendProtoVarint(m, 2, uint64(b.Size))
+	return appendProtoBool(m, 3, b.Truncated)
+}
+
+func (r apiEventRequest) marshalProto() []byte {
+	b := appendProtoString(nil, 1, r.Method)
+	b = appendProtoString(b, 2, r.Host)
+	b = appendProtoString(b, 3, r.Path)
+	b = appendProtoString(b, 4, r.Query)
+	b = appendProtoString(b, 5, r.HTTPVersion)
+	b = appendApiEventHeaders(b, 6, r.Headers)
+	b = appendProtoMessage(b, 7, r.Body.marshalProto())
+	return appendProtoString(b, 8, r.Scheme)
+}
+
+func (r apiEventResponse) marshalProto() []byte {
+	b := appendProtoVarint(nil, 1, uint64(r.StatusCode))
+	b = appendProtoString(b, 2, r.HTTPVersion)
+	b = appendApiEventHeaders(b, 3, r.Headers)
+	return appendProtoMessage(b, 4, r.Body.marshalProto())
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "Rewrite golden files in testdata with the current output")
+
+const apiEventJsonSchemaPath = "../schema/api_event.v1.schema.json"
+
+// newTestApiEvent returns an event with every field set, from a request and response which have been through the
+// redactor. Its ID and the sensor version are fixed so it can be compared against golden files.
+func newTestApiEvent(t *testing.T) *apiEvent {
+	reqAndResp := newTestRequestAndResponse(
+		t,
+		"POST /orders?dryRun=true HTTP/1.1\r\n"+
+			"Host: orders.shop.svc\r\n"+
+			"Authorization: Bearer secret\r\n"+
+			"Content-Type: application/json\r\n"+
+			"Content-Length: 33\r\n\r\n"+
+			`{"item": "book", "card": "4242"}`+"\n",
+		"HTTP/1.1 201 Created\r\n"+
+			"Content-Type: application/octet-stream\r\n"+
+			"Content-Length: 4\r\n\r\n"+
+			"\xff\xfe\x00\x01",
+	)
+	reqAndResp.src, reqAndResp.srcPort, reqAndResp.srcWorkload = "10.0.0.1", "51234", "shop/frontend"
+	reqAndResp.dst, reqAndResp.dstPort, reqAndResp.dstWorkload = "10.0.0.2", "8080", "shop/orders"
+	reqAndResp.requestTime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	reqAndResp.responseTime = reqAndResp.requestTime.Add(12500 * time.Microsecond)
+	reqAndResp.responseTruncated = true
+	reqAndResp.request.TLS = &tls.ConnectionState{
+		Version:            tls.VersionTLS13,
+		CipherSuite:        tls.TLS_AES_128_GCM_SHA256,
+		ServerName:         "orders.shop.svc",
+		NegotiatedProtocol: "http/1.1",
+	}
+	newRedactor(redactionConfig{
+		Headers:     []string{"Authorization"},
+		JsonFields:  []string{"card"},
+		Replacement: "[REDACTED]",
+	}).redact(reqAndResp)
+
+	previousVersion := sensorVersion
+	sensorVersion = "1.2.3"
+	defer func() { sensorVersion = previousVersion }()
+	event := newApiEvent(reqAndResp, kubernetesConfig{NodeName: "node-1", PodName: "firetail-sensor-abcde"})
+	event.EventId = "0b9c5a4e-6f0d-4f7a-9d3b-2f1e8c7a6b5d"
+	return event
+}
+
+func checkGolden(t *testing.T, name string, actual []byte) {
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.WriteFile(path, actual, 0o644); err != nil {
+			t.Fatalf("Failed to update golden file: %v", err)
+		}
+	}
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read golden file: %v", err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("%s doesn't match its golden file, which should only change with the schema version. "+
+			"Run go test -update if the change is intended.\nGot:\n%q\nWant:\n%q", name, actual, expected)
+	}
+}
+
+func TestApiEventGoldenJson(t *testing.T) {
+	eventJson, err := json.MarshalIndent(newTestApiEvent(t), "", "  ")
+	if err != nil {
+		t.Fatalf("Failed to encode event: %v", err)
+	}
+	checkGolden(t, "api_event.v1.golden.json", append(eventJson, '\n'))
+}
+
+func TestApiEventGoldenProto(t *testing.T) {
+	checkGolden(t, "api_event.v1.golden.pb", newTestApiEvent(t).marshalProto())
+}
+
+func TestApiEventFields(t *testing.T) {
+	event := newTestApiEvent(t)
+	if event.SchemaVersion != 1 || !event.Redacted {
+		t.Errorf("SchemaVersion = %d and Redacted = %v, want 1 and true", event.SchemaVersion, event.Redacted)
+	}
+	if event.Kubernetes.Destination.String() != "shop/orders" || event.Kubernetes.Source.String() != "shop/frontend" {
+		t.Errorf("Kubernetes = %+v, want the workloads to round trip", event.Kubernetes)
+	}
+	if !strings.Contains(event.Request.Body.Content, `"[REDACTED]"`) || event.Request.Body.Truncated {
+		t.Errorf("Request body = %+v, want it redacted and not truncated", event.Request.Body)
+	}
+	if event.Response.Body.Encoding != "base64" || event.Response.Body.Size != 4 || !event.Response.Body.Truncated {
+		t.Errorf("Response body = %+v, want 4 base64 encoded and truncated bytes", event.Response.Body)
+	}
+	if event.Request.Scheme != "https" || event.Tls == nil || event.Tls.Version != "TLS 1.3" || event.Tls.CipherSuite != "TLS_AES_128_GCM_SHA256" {
+		t.Errorf("Scheme = %q and Tls = %+v, want the TLS 1.3 session", event.Request.Scheme, event.Tls)
+	}
+
+	reqAndResp := newTestRequestAndResponse(t, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", newTestResponseBytes(200))
+	reqAndResp.dstWorkload = "unnamespaced"
+	event = newApiEvent(reqAndResp, kubernetesConfig{})
+	if event.Kubernetes.Source != nil || event.Kubernetes.Destination.Name != "unnamespaced" || event.Redacted {
+		t.Errorf("Event = %+v, want no source workload, an unnamespaced destination and no redaction", event)
+	}
+	if event.Request.Scheme != "http" || event.Tls != nil {
+		t.Errorf("Scheme = %q and Tls = %+v, want plain HTTP", event.Request.Scheme, event.Tls)
+	}
+	if event.Timing.LatencyMs != 0 || event.Timing.ResponseTime.Before(event.Timing.RequestTime) {
+		t.Errorf("Timing = %+v, want a zero latency when the response time is unknown", event.Timing)
+	}
+}
+
+// TestApiEventMatchesJsonSchema checks the JSON form of an event against the published schema's properties and
+// required fields, so the schema and the struct can't drift apart. It doesn't implement the rest of JSON Schema.
+func TestApiEventMatchesJsonSchema(t *testing.T) {
+	schemaBytes, err := os.ReadFile(apiEventJsonSchemaPath)
+	if err != nil {
+		t.Fatalf("Failed to read schema: %v", err)
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(schemaBytes, &schema); err != nil {
+		t.Fatalf("Failed to parse schema: %v", err)
+	}
+	apiEvent := newTestApiEvent(t)
+	expiresAt := time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)
+	apiEvent.DataClasses = []string{dataClassEmail}
+	apiEvent.Lossy = true
+	apiEvent.Auth = &apiEventAuth{
+		Schemes: []string{authSchemeJwt, authSchemeCookie},
+		Jwt:     &apiEventJwt{Algorithm: "RS256", Issuer: "https://auth.example.com", Audience: []string{"shop"}, ExpiresAt: &expiresAt},
+	}
+	eventJson, err := apiEvent.marshalJson()
+	if err != nil {
+		t.Fatalf("Failed to encode event: %v", err)
+	}
+	var event interface{}
+	if err := json.Unmarshal(eventJson, &event); err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	checkJsonSchema(t, schema, schema, event, "$")
+}
+
+func checkJsonSchema(t *testing.T, root map[string]interface{}, schema map[string]interface{}, value interface{}, path string) {
+	if ref, ok := schema["$ref"].(string); ok {
+		definition, ok := root["$defs"].(map[string]interface{})[strings.TrimPrefix(ref, "#/$defs/")]
+		if !ok {
+			t.Fatalf("%s: schema has no definition for %s", path, ref)
+		}
+		schema = definition.(map[string]interface{})
+	}
+	if constValue, ok := schema["const"]; ok && constValue != value {
+		t.Errorf("%s = %v, want %v", path, value, constValue)
+	}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		for key, fieldValue := range value {
+			fieldSchema, ok := properties[key].(map[string]interface{})
+			if !ok {
+				t.Errorf("%s.%s isn't in the schema", path, key)
+				continue
+			}
+			checkJsonSchema(t, root, fieldSchema, fieldValue, path+"."+key)
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, key := range required {
+			if _, ok := value[key.(string)]; !ok {
+				t.Errorf("%s is missing required field %s", path, key)
+			}
+		}
+	case []interface{}:
+		items, _ := schema["items"].(map[string]interface{})
+		for _, item := range value {
+			checkJsonSchema(t, root, items, item, path+"[]")
+		}
+	}
+}
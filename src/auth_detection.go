@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	authSchemeJwt    = "jwt"
+	authSchemeBearer = "bearer"
+	authSchemeBasic  = "basic"
+	authSchemeApiKey = "api_key"
+	authSchemeMtls   = "mtls"
+	authSchemeCookie = "cookie"
+	authSchemeOther  = "other"
+	authSchemeNone   = "none"
+)
+
+// mtlsHeaders are set by proxies and service meshes, such as Envoy's X-Forwarded-Client-Cert, when they've
+// authenticated the client with a certificate. The sensor can't see client certificates itself, so these are hints.
+var mtlsHeaders = []string{"X-Forwarded-Client-Cert", "X-Ssl-Client-Cert", "X-Client-Cert", "Ssl-Client-Cert", "X-Ssl-Client-Verify"}
+
+// requestAuth describes the credentials a request was made with. Schemes is in order of precedence and is just
+// [none] if there weren't any. Credentials themselves are never kept; for JWTs only the header and some claims are.
+type requestAuth struct {
+	Schemes []string
+	Jwt     *jwtInfo
+}
+
+// jwtInfo is the header and registered claims of a JWT. ExpiresAt is zero if it has no exp claim.
+type jwtInfo struct {
+	Algorithm string
+	Issuer    string
+	Audience  []string
+	ExpiresAt time.Time
+}
+
+func (a *requestAuth) authenticated() bool {
+	return len(a.Schemes) > 0 && a.Schemes[0] != authSchemeNone
+}
+
+// authDetector finds the credentials in captured requests. It has to run before redaction, which usually replaces
+// the headers it looks at.
+type authDetector struct {
+	apiKeyHeaders []string
+}
+
+func newAuthDetector(config authConfig) *authDetector {
+	detector := &authDetector{}
+	for _, header := range config.ApiKeyHeaders {
+		detector.apiKeyHeaders = append(detector.apiKeyHeaders, http.CanonicalHeaderKey(strings.TrimSpace(header)))
+	}
+	return detector
+}
+
+func (d *authDetector) detect(request *http.Request) *requestAuth {
+	auth := &requestAuth{}
+	add := func(scheme string) {
+		for _, existing := range auth.Schemes {
+			if existing == scheme {
+				return
+			}
+		}
+		auth.Schemes = append(auth.Schemes, scheme)
+	}
+
+	for _, authorization := range request.Header.Values("Authorization") {
+		scheme, credentials, _ := strings.Cut(strings.TrimSpace(authorization), " ")
+		credentials = strings.TrimSpace(credentials)
+		switch {
+		case strings.EqualFold(scheme, "Bearer"):
+			if jwt, ok := decodeJwt(credentials); ok {
+				auth.Jwt = jwt
+				add(authSchemeJwt)
+			} else {
+				add(authSchemeBearer)
+			}
+		case strings.EqualFold(scheme, "Basic"):
+			add(authSchemeBasic)
+		case strings.EqualFold(scheme, "ApiKey"), strings.EqualFold(scheme, "Api-Key"):
+			add(authSchemeApiKey)
+		case scheme != "":
+			add(authSchemeOther)
+		}
+	}
+	for _, header := range d.apiKeyHeaders {
+		if request.Header.Get(header) != "" {
+			add(authSchemeApiKey)
+		}
+	}
+	for _, header := range mtlsHeaders {
+		if request.Header.Get(header) != "" {
+			add(authSchemeMtls)
+		}
+	}
+	if len(request.Cookies()) > 0 {
+		add(authSchemeCookie)
+	}
+	if len(auth.Schemes) == 0 {
+		add(authSchemeNone)
+	}
+	return auth
+}
+
+// decodeJwt decodes a JWT's header and the registered claims the sensor reports. The signature isn't decoded, let
+// alone verified, and the token is only treated as a JWT if its header and payload are valid JSON.
+func decodeJwt(token string) (*jwtInfo, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if !decodeJwtPart(parts[0], &header) || header.Algorithm == "" {
+		return nil, false
+	}
+	var claims struct {
+		Issuer    string          `json:"iss"`
+		Audience  json.RawMessage `json:"aud"`
+		ExpiresAt *json.Number    `json:"exp"`
+	}
+	if !decodeJwtPart(parts[1], &claims) {
+		return nil, false
+	}
+
+	jwt := &jwtInfo{Algorithm: header.Algorithm, Issuer: claims.Issuer}
+	// aud is either a single string or an array of them
+	var audience string
+	if json.Unmarshal(claims.Audience, &audience) == nil {
+		jwt.Audience = []string{audience}
+	} else {
+		json.Unmarshal(claims.Audience, &jwt.Audience)
+	}
+	if claims.ExpiresAt != nil {
+		if exp, err := claims.ExpiresAt.Float64(); err == nil {
+			jwt.ExpiresAt = time.Unix(int64(exp), 0).UTC()
+		}
+	}
+	return jwt, true
+}
+
+func decodeJwtPart(part string, target interface{}) bool {
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(part, "="))
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(decoded, target) == nil
+}
+
+// authChecker reports findings for requests which were served successfully with missing or untrustworthy
+// credentials: without any credentials at all, with an expired JWT, or with an unsigned JWT. Requests to public paths,
+// such as health checks, aren't expected to have credentials.
+type authChecker struct {
+	publicPaths []string
+	findings    *findingsReporter
+}
+
+func (c *authChecker) export(reqAndResp *httpRequestAndResponse) {
+	if reqAndResp.auth == nil || reqAndResp.response.StatusCode < 200 || reqAndResp.response.StatusCode > 299 {
+		return
+	}
+	for _, f := range c.check(reqAndResp) {
+		f.Service = openApiServiceName(reqAndResp)
+		f.Method = reqAndResp.request.Method
+		f.Path, _ = inferPathTemplate(reqAndResp.request.URL.Path)
+		f.StatusCode = reqAndResp.response.StatusCode
+		c.findings.report(f)
+	}
+}
+
+func (c *authChecker) check(reqAndResp *httpRequestAndResponse) []finding {
+	auth := reqAndResp.auth
+	if !auth.authenticated() {
+		for _, pattern := range c.publicPaths {
+			if matched, _ := path.Match(pattern, reqAndResp.request.URL.Path); matched {
+				return nil
+			}
+		}
+		return []finding{{Type: findingTypeUnauthenticatedEndpoint}}
+	}
+	if auth.Jwt == nil {
+		return nil
+	}
+	var detail string
+	if auth.Jwt.Issuer != "" {
+		detail = "issued by " + auth.Jwt.Issuer
+	}
+	var findings []finding
+	if strings.EqualFold(auth.Jwt.Algorithm, "none") {
+		findings = append(findings, finding{Type: findingTypeUnsignedJwtAccepted, Detail: detail})
+	}
+	requestTime := reqAndResp.requestTime
+	if requestTime.IsZero() {
+		requestTime = time.Now()
+	}
+	if !auth.Jwt.ExpiresAt.IsZero() && auth.Jwt.ExpiresAt.Before(requestTime) {
+		findings = append(findings, finding{Type: findingTypeExpiredJwtAccepted, Detail: detail})
+	}
+	return findings
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestJwt(header string, claims string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(header)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".c2lnbmF0dXJl"
+}
+
+func TestDetectAuth(t *testing.T) {
+	detector := newAuthDetector(defaultConfig().Auth)
+	tests := []struct {
+		name            string
+		headers         map[string]string
+		expectedSchemes []string
+		expectedJwt     *jwtInfo
+	}{
+		{
+			name:            "No credentials",
+			headers:         map[string]string{"Accept": "application/json"},
+			expectedSchemes: []string{authSchemeNone},
+		},
+		{
+			name:            "JWT bearer token",
+			headers:         map[string]string{"Authorization": "Bearer " + newTestJwt(`{"alg":"RS256"}`, `{"iss":"https://auth","aud":"shop","exp":1714564800,"sub":"alice"}`)},
+			expectedSchemes: []string{authSchemeJwt},
+			expectedJwt:     &jwtInfo{Algorithm: "RS256", Issuer: "https://auth", Audience: []string{"shop"}, ExpiresAt: time.Unix(1714564800, 0).UTC()},
+		},
+		{
+			name:            "JWT with several audiences and no expiry",
+			headers:         map[string]string{"Authorization": "bearer " + newTestJwt(`{"alg":"none"}`, `{"aud":["shop","admin"]}`)},
+			expectedSchemes: []string{authSchemeJwt},
+			expectedJwt:     &jwtInfo{Algorithm: "none", Audience: []string{"shop", "admin"}},
+		},
+		{
+			name:            "Opaque bearer token",
+			headers:         map[string]string{"Authorization": "Bearer 8b3f0b8e6f0d4f7a"},
+			expectedSchemes: []string{authSchemeBearer},
+		},
+		{
+			name:            "Basic auth and a session cookie",
+			headers:         map[string]string{"Authorization": "Basic YWxpY2U6c2VjcmV0", "Cookie": "session=abc"},
+			expectedSchemes: []string{authSchemeBasic, authSchemeCookie},
+		},
+		{
+			name:            "API key header",
+			headers:         map[string]string{"x-api-key": "abc"},
+			expectedSchemes: []string{authSchemeApiKey},
+		},
+		{
+			name:            "Client certificate forwarded by a proxy",
+			headers:         map[string]string{"X-Forwarded-Client-Cert": "By=spiffe://cluster.local/ns/shop/sa/users"},
+			expectedSchemes: []string{authSchemeMtls},
+		},
+		{
+			name:            "Unknown scheme",
+			headers:         map[string]string{"Authorization": "Digest username=alice"},
+			expectedSchemes: []string{authSchemeOther},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, _ := http.NewRequest("GET", "http://users/users/1", nil)
+			for name, value := range test.headers {
+				request.Header.Set(name, value)
+			}
+			auth := detector.detect(request)
+			if !reflect.DeepEqual(auth.Schemes, test.expectedSchemes) || !reflect.DeepEqual(auth.Jwt, test.expectedJwt) {
+				t.Errorf("detect() = %v, %+v, want %v, %+v", auth.Schemes, auth.Jwt, test.expectedSchemes, test.expectedJwt)
+			}
+		})
+	}
+}
+
+func TestAuthCheckerFindings(t *testing.T) {
+	requestTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		path          string
+		statusCode    int
+		auth          *requestAuth
+		expectedTypes []string
+	}{
+		{
+			name:          "Served without credentials",
+			path:          "/users/1",
+			statusCode:    200,
+			auth:          &requestAuth{Schemes: []string{authSchemeNone}},
+			expectedTypes: []string{findingTypeUnauthenticatedEndpoint},
+		},
+		{
+			name:       "Rejected without credentials",
+			path:       "/users/1",
+			statusCode: 401,
+			auth:       &requestAuth{Schemes: []string{authSchemeNone}},
+		},
+		{
+			name:       "Public path",
+			path:       "/healthz",
+			statusCode: 200,
+			auth:       &requestAuth{Schemes: []string{authSchemeNone}},
+		},
+		{
+			name:       "Valid JWT",
+			path:       "/users/1",
+			statusCode: 200,
+			auth:       &requestAuth{Schemes: []string{authSchemeJwt}, Jwt: &jwtInfo{Algorithm: "RS256", ExpiresAt: requestTime.Add(time.Hour)}},
+		},
+		{
+			name:          "Expired unsigned JWT",
+			path:          "/users/1",
+			statusCode:    204,
+			auth:          &requestAuth{Schemes: []string{authSchemeJwt}, Jwt: &jwtInfo{Algorithm: "none", ExpiresAt: requestTime.Add(-time.Hour)}},
+			expectedTypes: []string{findingTypeUnsignedJwtAccepted, findingTypeExpiredJwtAccepted},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			findings := newFindingsReporter(findingsConfig{ReportInterval: time.Hour, MaxFindings: 10}, newDropCounters())
+			var reported []string
+			findings.emit = func(f finding) { reported = append(reported, f.Type) }
+
+			reqAndResp := newTestRequestAndResponse(t, "GET "+test.path+" HTTP/1.1\r\nHost: users\r\n\r\n", newTestResponseBytes(test.statusCode))
+			reqAndResp.requestTime = requestTime
+			reqAndResp.auth = test.auth
+			(&authChecker{publicPaths: defaultConfig().Auth.PublicPaths, findings: findings}).export(reqAndResp)
+			if !reflect.DeepEqual(reported, test.expectedTypes) {
+				t.Errorf("Findings = %v, want %v", reported, test.expectedTypes)
+			}
+		})
+	}
+}
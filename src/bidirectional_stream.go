@@ -4,11 +4,14 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
@@ -21,8 +24,27 @@ type bidirectionalStreamFactory struct {
 	conns                     *sync.Map
 	requestAndResponseChannel *chan httpRequestAndResponse
 	maxBodySize               int64
+	drops                     *dropCounters
+	// tlsHandshakes, if set, receives the handshake metadata of TLS connections, which can't be parsed as HTTP
+	tlsHandshakes *chan *tlsHandshake
+	// keyLog, if set, holds the secrets of TLS sessions which can be decrypted
+	keyLog *tlsKeyLog
+	// connectionSummaries, if set, receives summaries of connections which HTTP couldn't be read from
+	connectionSummaries *chan *connectionSummary
+	// protocolStats, if set, enables protocol detection: only streams which start like HTTP are read as HTTP, and the
+	// protocol of every connection is counted
+	protocolStats *protocolStats
+	// streams, if set, is used to wait for all the streams to finish, such as at the end of a pcap file
+	streams *sync.WaitGroup
+	// open holds every stream which hasn't finished yet, so packets can be attributed to them
+	open sync.Map
+	// truncated holds the keys of connections a truncated packet was seen on before their stream was created
+	truncated sync.Map
 }
 
+// errTlsNotDecrypted is why no HTTP could be read from TLS connections without logged secrets
+var errTlsNotDecrypted = errors.New("TLS connection wasn't decrypted")
+
 func (f *bidirectionalStreamFactory) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
 	key := netFlow.FastHash() ^ tcpFlow.FastHash()
 
@@ -48,28 +70,138 @@ func (f *bidirectionalStreamFactory) New(netFlow, tcpFlow gopacket.Flow) tcpasse
 	s := &bidirectionalStream{
 		net:                       netFlow,
 		transport:                 tcpFlow,
-		clientToServer:            tcpreader.NewReaderStream(),
-		serverToClient:            tcpreader.NewReaderStream(),
+		clientToServer:            timedReaderStream{ReaderStream: tcpreader.NewReaderStream()},
+		serverToClient:            timedReaderStream{ReaderStream: tcpreader.NewReaderStream()},
 		requestAndResponseChannel: f.requestAndResponseChannel,
 		closeCallback: func() {
 			f.conns.Delete(fmt.Sprint(key))
+			f.open.Delete(fmt.Sprint(key))
+			if f.streams != nil {
+				f.streams.Done()
+			}
 		},
-		maxBodySize: f.maxBodySize,
+		maxBodySize:         f.maxBodySize,
+		drops:               f.drops,
+		tlsHandshakes:       f.tlsHandshakes,
+		keyLog:              f.keyLog,
+		connectionSummaries: f.connectionSummaries,
+		protocolStats:       f.protocolStats,
+	}
+	if _, ok := f.truncated.LoadAndDelete(fmt.Sprint(key)); ok {
+		s.lossy.Store(true)
 	}
 	f.conns.Store(fmt.Sprint(key), s)
+	f.open.Store(fmt.Sprint(key), s)
+	if f.streams != nil {
+		f.streams.Add(1)
+	}
 	go s.run()
 
 	// The first time we see the connection, it will be from the client to the server
 	return &s.clientToServer
 }
 
+// closeUnmatched completes the server to client side of any connections which never saw a packet from the server, so
+// their streams can finish rather than waiting to time out. This is only safe once no more packets will be assembled.
+func (f *bidirectionalStreamFactory) closeUnmatched() {
+	f.conns.Range(func(key, conn any) bool {
+		if _, ok := f.conns.LoadAndDelete(key); ok {
+			conn.(*bidirectionalStream).serverToClient.ReassemblyComplete()
+		}
+		return true
+	})
+}
+
+// observeReset marks the stream of the connection a packet with the RST flag was seen on as having been reset, which
+// the assembler doesn't distinguish from it being closed with a FIN
+func (f *bidirectionalStreamFactory) observeReset(netFlow, tcpFlow gopacket.Flow) {
+	if conn, ok := f.open.Load(fmt.Sprint(netFlow.FastHash() ^ tcpFlow.FastHash())); ok {
+		conn.(*bidirectionalStream).reset.Store(true)
+	}
+}
+
+// observeTruncated marks the stream of the connection a packet was captured from as lossy, if the packet was longer
+// than the snaplen. The truncated bytes leave a gap in the stream which reassembly skips over, so anything read from it
+// may be corrupt. The packet may be the first of the connection, so it's remembered until the stream is created.
+func (f *bidirectionalStreamFactory) observeTruncated(netFlow, tcpFlow gopacket.Flow) {
+	key := fmt.Sprint(netFlow.FastHash() ^ tcpFlow.FastHash())
+	if conn, ok := f.open.Load(key); ok {
+		conn.(*bidirectionalStream).lossy.Store(true)
+		return
+	}
+	f.truncated.Store(key, struct{}{})
+}
+
+// timedReaderStream is a tcpreader.ReaderStream which records when it first and last received anything, how many
+// bytes it received, and the first of them, so connections can be summarised without reading them
+type timedReaderStream struct {
+	tcpreader.ReaderStream
+	firstSeen atomic.Int64
+	lastSeen  atomic.Int64
+	bytes     atomic.Int64
+	head      atomic.Pointer[[]byte]
+	// ended is set if the stream was closed by a FIN or RST, rather than being flushed
+	ended atomic.Bool
+}
+
+func (t *timedReaderStream) Reassembled(reassembly []tcpassembly.Reassembly) {
+	for _, r := range reassembly {
+		if len(r.Bytes) > 0 {
+			// The reassembled bytes are reused once they've been read, so the head is copied
+			if t.firstSeen.Load() == 0 {
+				t.firstSeen.Store(r.Seen.UnixNano())
+				head := bytes.Clone(r.Bytes[:min(len(r.Bytes), streamHeadLength)])
+				t.head.Store(&head)
+			}
+			t.bytes.Add(int64(len(r.Bytes)))
+		}
+		t.lastSeen.Store(r.Seen.UnixNano())
+		if r.End {
+			t.ended.Store(true)
+		}
+	}
+	t.ReaderStream.Reassembled(reassembly)
+}
+
+func (t *timedReaderStream) firstSeenTime() time.Time {
+	if firstSeen := t.firstSeen.Load(); firstSeen != 0 {
+		return time.Unix(0, firstSeen)
+	}
+	return time.Time{}
+}
+
+func (t *timedReaderStream) lastSeenTime() time.Time {
+	if lastSeen := t.lastSeen.Load(); lastSeen != 0 {
+		return time.Unix(0, lastSeen)
+	}
+	return time.Time{}
+}
+
+func (t *timedReaderStream) headBytes() []byte {
+	if head := t.head.Load(); head != nil {
+		return *head
+	}
+	return nil
+}
+
 type bidirectionalStream struct {
 	net, transport            gopacket.Flow
-	clientToServer            tcpreader.ReaderStream
-	serverToClient            tcpreader.ReaderStream
+	clientToServer            timedReaderStream
+	serverToClient            timedReaderStream
 	requestAndResponseChannel *chan httpRequestAndResponse
 	closeCallback             func()
 	maxBodySize               int64
+	drops                     *dropCounters
+	tlsHandshakes             *chan *tlsHandshake
+	keyLog                    *tlsKeyLog
+	connectionSummaries       *chan *connectionSummary
+	protocolStats             *protocolStats
+	reset                     atomic.Bool
+	// lossy is set if any of the connection's packets were truncated when they were captured
+	lossy atomic.Bool
+	// requestErr and responseErr are why the request or response couldn't be read, each set by only one goroutine
+	requestErr  error
+	responseErr error
 }
 
 func (s *bidirectionalStream) run() {
@@ -82,6 +214,11 @@ func (s *bidirectionalStream) run() {
 	requestChannel := make(chan *http.Request, 1)
 	responseChannel := make(chan *http.Response, 1)
 
+	// If a reader fills its buffer the stream had at least maxBodySize bytes, so its body is likely to be truncated
+	var requestTruncated, responseTruncated bool
+	// The raw bytes read from each side are kept so TLS connections can be recognised once both sides have finished
+	var clientBytes, serverBytes []byte
+
 	err := sem.Acquire(context.Background(), 1)
 	if err != nil {
 		slog.Error("Failed to acquire semaphore for clientToServer reader:", "Err", err.Error())
@@ -95,20 +232,25 @@ func (s *bidirectionalStream) run() {
 				slog.Error("Recovered from panic in clientToServer reader:", "Err", r)
 			}
 		}()
-		requestBytes := make([]byte, s.maxBodySize)
-		bytesRead, err := io.ReadFull(&s.clientToServer, requestBytes)
+		var err error
+		clientBytes, err = s.readSide(&s.clientToServer, func(head []byte) bool {
+			return isTlsHandshakeRecord(head) || isHttpRequestHead(head)
+		})
 		if err != nil && err != io.ErrUnexpectedEOF {
-			slog.Debug("Failed to read request bytes from stream:", "Err", err.Error(), "BytesRead", bytesRead)
+			if err != errProtocolNotParsed {
+				slog.Debug("Failed to read request bytes from stream:", "Err", err.Error(), "BytesRead", len(clientBytes))
+			}
+			s.requestErr = err
 			return
 		}
-		request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(requestBytes[:bytesRead])))
-		if err != nil {
-			slog.Debug("Failed to read request bytes:", "Err", err.Error())
+		requestTruncated = int64(len(clientBytes)) == s.maxBodySize
+		// TLS connections are read once both sides have finished, as the server's hello is needed to decrypt them
+		if isTlsHandshakeRecord(clientBytes) {
 			return
 		}
-		// RemoteAddr is not filled in by ReadRequest so we have to populate it ourselves
-		request.RemoteAddr = fmt.Sprintf("%s:%s", s.net.Src().String(), s.transport.Src().String())
-		requestChannel <- request
+		if request := s.readHttpRequest(clientBytes); request != nil {
+			requestChannel <- request
+		}
 	}()
 
 	err = sem.Acquire(context.Background(), 1)
@@ -124,18 +266,24 @@ func (s *bidirectionalStream) run() {
 				slog.Error("Recovered from panic in serverToClient reader:", "Err", r)
 			}
 		}()
-		responseBytes := make([]byte, s.maxBodySize)
-		bytesRead, err := io.ReadFull(&s.serverToClient, responseBytes)
+		var err error
+		serverBytes, err = s.readSide(&s.serverToClient, func(head []byte) bool {
+			return isTlsHandshakeRecord(head) || bytes.HasPrefix(head, httpResponsePrefix)
+		})
 		if err != nil && err != io.ErrUnexpectedEOF {
-			slog.Debug("Failed to read response bytes from stream:", "Err", err.Error(), "BytesRead", bytesRead)
+			if err != errProtocolNotParsed {
+				slog.Debug("Failed to read response bytes from stream:", "Err", err.Error(), "BytesRead", len(serverBytes))
+			}
+			s.responseErr = err
 			return
 		}
-		response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(responseBytes[:bytesRead])), nil)
-		if err != nil {
-			slog.Debug("Failed to read response bytes:", "Err", err.Error())
+		responseTruncated = int64(len(serverBytes)) == s.maxBodySize
+		if isTlsHandshakeRecord(serverBytes) {
 			return
 		}
-		responseChannel <- response
+		if response := s.readHttpResponse(serverBytes); response != nil {
+			responseChannel <- response
+		}
 	}()
 
 	// Wait for both goroutines to finish with timeout of 2 minutes
@@ -145,20 +293,27 @@ func (s *bidirectionalStream) run() {
 		if err != context.DeadlineExceeded {
 			slog.Error("Failed to acquire semaphore for both readers:", "Err", err.Error())
 		}
+		s.recordProtocol()
+		s.reportConnection("timed out reading stream")
 		return
 	}
+	s.recordProtocol()
 
 	var capturedRequest *http.Request
 	var capturedResponse *http.Response
 
-	select {
-	case capturedRequest = <-requestChannel:
-	default:
-	}
+	if isTlsHandshakeRecord(clientBytes) {
+		capturedRequest, capturedResponse = s.readTlsConnection(clientBytes, serverBytes)
+	} else {
+		select {
+		case capturedRequest = <-requestChannel:
+		default:
+		}
 
-	select {
-	case capturedResponse = <-responseChannel:
-	default:
+		select {
+		case capturedResponse = <-responseChannel:
+		default:
+		}
 	}
 
 	if capturedRequest == nil && capturedResponse == nil {
@@ -188,15 +343,206 @@ func (s *bidirectionalStream) run() {
 	}
 
 	if capturedRequest == nil || capturedResponse == nil {
+		var parseError string
+		if capturedRequest == nil && s.requestErr != nil {
+			parseError = "request: " + parseErrorSummary(s.requestErr)
+		} else if capturedResponse == nil && s.responseErr != nil {
+			parseError = "response: " + parseErrorSummary(s.responseErr)
+		}
+		s.reportConnection(parseError)
+		return
+	}
+
+	// Never block on a full queue, as that would hold up the stream and ultimately capture
+	select {
+	case *s.requestAndResponseChannel <- httpRequestAndResponse{
+		request:           capturedRequest,
+		response:          capturedResponse,
+		src:               s.net.Src().String(),
+		dst:               s.net.Dst().String(),
+		srcPort:           s.transport.Src().String(),
+		dstPort:           s.transport.Dst().String(),
+		requestTime:       s.clientToServer.firstSeenTime(),
+		responseTime:      s.serverToClient.firstSeenTime(),
+		requestTruncated:  requestTruncated,
+		responseTruncated: responseTruncated,
+		lossy:             s.lossy.Load(),
+	}:
+	default:
+		slog.Warn(
+			"Pipeline queue full, dropping captured request and response",
+			"Src", s.net.Src().String(),
+			"Dst", s.net.Dst().String(),
+			"SrcPort", s.transport.Src().String(),
+			"DstPort", s.transport.Dst().String(),
+		)
+		s.drops.increment(dropReasonQueueFull)
+	}
+}
+
+// readSide reads up to maxBodySize bytes from one side of the connection. If protocol detection is enabled, only the
+// first streamHeadLength bytes are read until detect says the side is worth reading; if it isn't, the rest of it is
+// discarded without being buffered and errProtocolNotParsed is returned. Like io.ReadFull, io.ErrUnexpectedEOF is
+// returned if the side ended before maxBodySize bytes were read.
+func (s *bidirectionalStream) readSide(side io.Reader, detect func(head []byte) bool) ([]byte, error) {
+	headLength := s.maxBodySize
+	if s.protocolStats != nil {
+		headLength = min(s.maxBodySize, streamHeadLength)
+	}
+	head := make([]byte, headLength)
+	bytesRead, err := io.ReadFull(side, head)
+	head = head[:bytesRead]
+	if s.protocolStats != nil && bytesRead > 0 && !detect(head) {
+		if err == nil {
+			tcpreader.DiscardBytesToEOF(side)
+		}
+		return head, errProtocolNotParsed
+	}
+	if err != nil || int64(bytesRead) == s.maxBodySize {
+		return head, err
+	}
+
+	sideBytes := make([]byte, s.maxBodySize)
+	copy(sideBytes, head)
+	bytesRead, err = io.ReadFull(side, sideBytes[len(head):])
+	if err == io.EOF {
+		// The side ended straight after its head
+		err = io.ErrUnexpectedEOF
+	}
+	return sideBytes[:len(head)+bytesRead], err
+}
+
+func (s *bidirectionalStream) readHttpRequest(requestBytes []byte) *http.Request {
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(requestBytes)))
+	if err != nil {
+		slog.Debug("Failed to read request bytes:", "Err", err.Error())
+		s.requestErr = err
+		return nil
+	}
+	// RemoteAddr is not filled in by ReadRequest so we have to populate it ourselves
+	request.RemoteAddr = fmt.Sprintf("%s:%s", s.net.Src().String(), s.transport.Src().String())
+	return request
+}
+
+func (s *bidirectionalStream) readHttpResponse(responseBytes []byte) *http.Response {
+	response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(responseBytes)), nil)
+	if err != nil {
+		slog.Debug("Failed to read response bytes:", "Err", err.Error())
+		s.responseErr = err
+		return nil
+	}
+	return response
+}
+
+// readTlsConnection parses the hellos at the start of a TLS connection and queues their metadata without blocking.
+// If the session's secrets have been logged, the connection is then decrypted and the HTTP request and response
+// inside it are read.
+func (s *bidirectionalStream) readTlsConnection(clientBytes []byte, serverBytes []byte) (*http.Request, *http.Response) {
+	if s.tlsHandshakes == nil && s.keyLog == nil {
+		s.requestErr = errTlsNotDecrypted
+		return nil, nil
+	}
+	clientHello, err := parseTlsClientHello(clientBytes)
+	if err != nil {
+		slog.Debug("Failed to parse TLS ClientHello:", "Err", err.Error(), "Src", s.net.Src().String(), "Dst", s.net.Dst().String())
+		s.requestErr = err
+		return nil, nil
+	}
+	handshake := &tlsHandshake{
+		src:         s.net.Src().String(),
+		dst:         s.net.Dst().String(),
+		srcPort:     s.transport.Src().String(),
+		dstPort:     s.transport.Dst().String(),
+		time:        s.clientToServer.firstSeenTime(),
+		clientHello: clientHello,
+	}
+	if isTlsHandshakeRecord(serverBytes) {
+		if handshake.serverHello, err = parseTlsServerHello(serverBytes); err != nil {
+			slog.Debug("Failed to parse TLS ServerHello:", "Err", err.Error(), "Src", s.net.Src().String(), "Dst", s.net.Dst().String())
+		}
+	}
+	if s.tlsHandshakes != nil {
+		select {
+		case *s.tlsHandshakes <- handshake:
+		default:
+			s.drops.increment(dropReasonTlsQueueFull)
+		}
+	}
+
+	if s.keyLog == nil {
+		s.requestErr = errTlsNotDecrypted
+		return nil, nil
+	}
+	secrets := s.keyLog.secrets(clientHello.random)
+	if secrets == nil {
+		slog.Debug("No TLS secrets logged for connection:", "Src", handshake.src, "Dst", handshake.dst, "ServerName", clientHello.serverName)
+		s.requestErr = errTlsNotDecrypted
+		return nil, nil
+	}
+	clientPlaintext, serverPlaintext, err := decryptTlsConnection(handshake, secrets, clientBytes, serverBytes)
+	if err != nil {
+		slog.Debug("Failed to decrypt TLS connection:", "Err", err.Error(), "Src", handshake.src, "Dst", handshake.dst)
+		s.requestErr = err
+		return nil, nil
+	}
+	request, response := s.readHttpRequest(clientPlaintext), s.readHttpResponse(serverPlaintext)
+	if request != nil {
+		request.TLS = &tls.ConnectionState{
+			Version:            handshake.serverHello.negotiatedVersion(),
+			HandshakeComplete:  true,
+			CipherSuite:        handshake.serverHello.cipherSuite,
+			NegotiatedProtocol: handshake.serverHello.alpn,
+			ServerName:         clientHello.serverName,
+		}
+	}
+	return request, response
+}
+
+// recordProtocol counts the protocol of the connection against its server port, if protocol detection is enabled
+func (s *bidirectionalStream) recordProtocol() {
+	if s.protocolStats == nil || (s.clientToServer.bytes.Load() == 0 && s.serverToClient.bytes.Load() == 0) {
 		return
 	}
+	s.protocolStats.increment(serverPort(s.transport), guessProtocol(s.clientToServer.headBytes(), s.serverToClient.headBytes()))
+}
 
-	*s.requestAndResponseChannel <- httpRequestAndResponse{
-		request:  capturedRequest,
-		response: capturedResponse,
-		src:      s.net.Src().String(),
-		dst:      s.net.Dst().String(),
-		srcPort:  s.transport.Src().String(),
-		dstPort:  s.transport.Dst().String(),
+// reportConnection queues a summary of a connection HTTP couldn't be read from without blocking, if connection
+// summaries are enabled. Connections on which nothing was sent, such as port scans, aren't summarised.
+func (s *bidirectionalStream) reportConnection(parseError string) {
+	if s.connectionSummaries == nil {
+		return
+	}
+	summary := &connectionSummary{
+		src:         s.net.Src().String(),
+		dst:         s.net.Dst().String(),
+		srcPort:     s.transport.Src().String(),
+		dstPort:     s.transport.Dst().String(),
+		clientBytes: s.clientToServer.bytes.Load(),
+		serverBytes: s.serverToClient.bytes.Load(),
+		start:       s.clientToServer.firstSeenTime(),
+		end:         s.clientToServer.lastSeenTime(),
+		closeReason: connectionCloseTimeout,
+		protocol:    guessProtocol(s.clientToServer.headBytes(), s.serverToClient.headBytes()),
+		parseError:  parseError,
+		lossy:       s.lossy.Load(),
+	}
+	if summary.clientBytes == 0 && summary.serverBytes == 0 {
+		return
+	}
+	if serverStart := s.serverToClient.firstSeenTime(); summary.start.IsZero() || (!serverStart.IsZero() && serverStart.Before(summary.start)) {
+		summary.start = serverStart
+	}
+	if serverEnd := s.serverToClient.lastSeenTime(); serverEnd.After(summary.end) {
+		summary.end = serverEnd
+	}
+	if s.reset.Load() {
+		summary.closeReason = connectionCloseRst
+	} else if s.clientToServer.ended.Load() || s.serverToClient.ended.Load() {
+		summary.closeReason = connectionCloseFin
+	}
+	select {
+	case *s.connectionSummaries <- summary:
+	default:
+		s.drops.increment(dropReasonConnectionsQueueFull)
 	}
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"net"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// anyInterface is libpcap's pseudo-interface which captures on every interface at once, with a cooked link layer
+const anyInterface = "any"
+
+// resolveCaptureInterfaces returns the names of the available interfaces which match any of the configured names or
+// globs, such as "cali*". The "any" pseudo-interface is never listed by the kernel, so it's kept if it's configured.
+func resolveCaptureInterfaces(patterns []string, available []string) []string {
+	var resolved []string
+	for _, pattern := range patterns {
+		if pattern == anyInterface {
+			resolved = append(resolved, anyInterface)
+			continue
+		}
+		for _, name := range available {
+			if matched, _ := filepath.Match(pattern, name); matched {
+				resolved = append(resolved, name)
+			}
+		}
+	}
+	slices.Sort(resolved)
+	return slices.Compact(resolved)
+}
+
+func listInterfaceNames() ([]string, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(interfaces))
+	for _, i := range interfaces {
+		names = append(names, i.Name)
+	}
+	return names, nil
+}
+
+// packetDeduplicator recognises packets captured more than once, such as on both a pod's veth and the bridge it's
+// attached to. Packets are identified by their IPs, IP ID, TCP header up to the window size and payload length, which
+// don't change as a packet is bridged or routed between interfaces. A packet is a duplicate if the same one was seen
+// in the last window, checked against two generations of hashes so memory is bounded by the packet rate.
+type packetDeduplicator struct {
+	window   time.Duration
+	rotated  time.Time
+	current  map[uint64]struct{}
+	previous map[uint64]struct{}
+}
+
+func newPacketDeduplicator(window time.Duration) *packetDeduplicator {
+	return &packetDeduplicator{window: window, current: map[uint64]struct{}{}, previous: map[uint64]struct{}{}}
+}
+
+func (d *packetDeduplicator) isDuplicate(ip *layers.IPv4, tcp *layers.TCP, timestamp time.Time) bool {
+	if timestamp.Sub(d.rotated) >= d.window {
+		d.previous, d.current, d.rotated = d.current, map[uint64]struct{}{}, timestamp
+	}
+
+	hash := fnv.New64a()
+	hash.Write(ip.SrcIP.To4())
+	hash.Write(ip.DstIP.To4())
+	hash.Write(binary.BigEndian.AppendUint16(nil, ip.Id))
+	// The first 14 bytes of the TCP header are the ports, sequence and acknowledgement numbers, data offset and flags
+	if len(tcp.Contents) >= 14 {
+		hash.Write(tcp.Contents[:14])
+	}
+	hash.Write(binary.BigEndian.AppendUint32(nil, uint32(len(tcp.Payload))))
+	key := hash.Sum64()
+
+	if _, ok := d.current[key]; ok {
+		return true
+	}
+	if _, ok := d.previous[key]; ok {
+		return true
+	}
+	d.current[key] = struct{}{}
+	return false
+}
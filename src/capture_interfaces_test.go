@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestResolveCaptureInterfaces(t *testing.T) {
+	available := []string{"lo", "eth0", "cali1a2b", "cali3c4d", "cni0", "vethc0ffee"}
+	tests := []struct {
+		name     string
+		patterns []string
+		want     []string
+	}{
+		{"Any", []string{"any"}, []string{"any"}},
+		{"Names", []string{"eth0", "lo"}, []string{"eth0", "lo"}},
+		{"Globs", []string{"cali*", "veth*"}, []string{"cali1a2b", "cali3c4d", "vethc0ffee"}},
+		{"Overlapping patterns", []string{"cali*", "cali1a2b"}, []string{"cali1a2b", "cali3c4d"}},
+		{"Missing interface", []string{"eth1", "flannel*"}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := resolveCaptureInterfaces(test.patterns, available); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("resolveCaptureInterfaces() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPacketDeduplicator(t *testing.T) {
+	newPacket := func(id uint16, payload string) (*layers.IPv4, *layers.TCP) {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 0, 0, 2), Id: id}
+		tcp := &layers.TCP{SrcPort: 51234, DstPort: 8080, Seq: 1000, Ack: 2000, PSH: true, ACK: true, Window: 64240}
+		tcp.SetNetworkLayerForChecksum(ip)
+		buffer := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ip, tcp, gopacket.Payload(payload)); err != nil {
+			t.Fatalf("Failed to serialize packet: %v", err)
+		}
+		packet := gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+		return packet.NetworkLayer().(*layers.IPv4), packet.TransportLayer().(*layers.TCP)
+	}
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	deduplicator := newPacketDeduplicator(100 * time.Millisecond)
+
+	tests := []struct {
+		name  string
+		id    uint16
+		after time.Duration
+		want  bool
+	}{
+		{"First capture", 1, 0, false},
+		{"Same packet on another interface", 1, time.Millisecond, true},
+		{"Retransmission with a new IP ID", 2, 2 * time.Millisecond, false},
+		{"Same packet in the next window", 1, 150 * time.Millisecond, true},
+		{"Same packet after two windows", 1, 400 * time.Millisecond, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ip, tcp := newPacket(test.id, "GET / HTTP/1.1\r\n\r\n")
+			if got := deduplicator.isDuplicate(ip, tcp, start.Add(test.after)); got != test.want {
+				t.Errorf("isDuplicate() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	captureRuleActionInclude = "include"
+	captureRuleActionExclude = "exclude"
+)
+
+type captureRuleConfig struct {
+	Name         string              `yaml:"name"`
+	Action       string              `yaml:"action"`
+	Methods      []string            `yaml:"methods,omitempty"`
+	Hosts        []string            `yaml:"hosts,omitempty"`
+	Paths        []string            `yaml:"paths,omitempty"`
+	PathRegex    string              `yaml:"pathRegex,omitempty"`
+	StatusCodes  []string            `yaml:"statusCodes,omitempty"`
+	Headers      []headerMatchConfig `yaml:"headers,omitempty"`
+	Sources      []string            `yaml:"sources,omitempty"`
+	Destinations []string            `yaml:"destinations,omitempty"`
+}
+
+type headerMatchConfig struct {
+	Name       string `yaml:"name"`
+	Value      string `yaml:"value,omitempty"`
+	ValueRegex string `yaml:"valueRegex,omitempty"`
+	Response   bool   `yaml:"response,omitempty"`
+}
+
+// captureRules is an ordered list of include/exclude rules. The first rule which matches a captured request and
+// response decides whether it is exported; if none match, the default action is used.
+type captureRules struct {
+	rules         []*captureRule
+	defaultAction string
+}
+
+type captureRule struct {
+	name         string
+	action       string
+	methods      map[string]struct{}
+	hosts        []string
+	paths        []string
+	pathRegex    *regexp.Regexp
+	statusCodes  []statusCodeRange
+	headers      []*headerMatcher
+	sources      []*endpointMatcher
+	destinations []*endpointMatcher
+}
+
+type statusCodeRange struct {
+	min, max int
+}
+
+type headerMatcher struct {
+	name       string
+	value      string
+	valueRegex *regexp.Regexp
+	response   bool
+}
+
+// endpointMatcher matches a source or destination by IP, CIDR or a "namespace/name" workload glob
+type endpointMatcher struct {
+	network  *net.IPNet
+	workload string
+}
+
+func newCaptureRules(ruleConfigs []captureRuleConfig, defaultAction string) (*captureRules, error) {
+	if defaultAction == "" {
+		defaultAction = captureRuleActionInclude
+	}
+	if defaultAction != captureRuleActionInclude && defaultAction != captureRuleActionExclude {
+		return nil, fmt.Errorf("filtering.defaultAction must be %q or %q, got %q", captureRuleActionInclude, captureRuleActionExclude, defaultAction)
+	}
+	rules := &captureRules{defaultAction: defaultAction}
+	var errs []error
+	for i, ruleConfig := range ruleConfigs {
+		rule, err := newCaptureRule(ruleConfig)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("filtering.rules[%d]: %v", i, err))
+			continue
+		}
+		rules.rules = append(rules.rules, rule)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return rules, nil
+}
+
+func newCaptureRule(config captureRuleConfig) (*captureRule, error) {
+	rule := &captureRule{
+		name:    config.Name,
+		action:  config.Action,
+		methods: map[string]struct{}{},
+	}
+	if rule.action != captureRuleActionInclude && rule.action != captureRuleActionExclude {
+		return nil, fmt.Errorf("action must be %q or %q, got %q", captureRuleActionInclude, captureRuleActionExclude, config.Action)
+	}
+	for _, method := range config.Methods {
+		rule.methods[strings.ToUpper(method)] = struct{}{}
+	}
+	for _, pattern := range append(append([]string{}, config.Hosts...), config.Paths...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %v", pattern, err)
+		}
+	}
+	rule.hosts = config.Hosts
+	rule.paths = config.Paths
+	if config.PathRegex != "" {
+		pathRegex, err := regexp.Compile(config.PathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pathRegex %q: %v", config.PathRegex, err)
+		}
+		rule.pathRegex = pathRegex
+	}
+	for _, statusCodes := range config.StatusCodes {
+		statusCodeRange, err := parseStatusCodeRange(statusCodes)
+		if err != nil {
+			return nil, err
+		}
+		rule.statusCodes = append(rule.statusCodes, statusCodeRange)
+	}
+	for _, headerConfig := range config.Headers {
+		if headerConfig.Name == "" {
+			return nil, errors.New("header matches must have a name")
+		}
+		if headerConfig.Value != "" {
+			if _, err := path.Match(headerConfig.Value, ""); err != nil {
+				return nil, fmt.Errorf("invalid glob %q for header %s: %v", headerConfig.Value, headerConfig.Name, err)
+			}
+		}
+		matcher := &headerMatcher{
+			name:     http.CanonicalHeaderKey(headerConfig.Name),
+			value:    headerConfig.Value,
+			response: headerConfig.Response,
+		}
+		if headerConfig.ValueRegex != "" {
+			valueRegex, err := regexp.Compile(headerConfig.ValueRegex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid valueRegex %q for header %s: %v", headerConfig.ValueRegex, headerConfig.Name, err)
+			}
+			matcher.valueRegex = valueRegex
+		}
+		rule.headers = append(rule.headers, matcher)
+	}
+	for _, endpoints := range []struct {
+		configs  []string
+		matchers *[]*endpointMatcher
+	}{
+		{config.Sources, &rule.sources},
+		{config.Destinations, &rule.destinations},
+	} {
+		for _, endpoint := range endpoints.configs {
+			matcher, err := newEndpointMatcher(endpoint)
+			if err != nil {
+				return nil, err
+			}
+			*endpoints.matchers = append(*endpoints.matchers, matcher)
+		}
+	}
+	return rule, nil
+}
+
+// parseStatusCodeRange parses a single status code ("404"), a class ("5xx") or an inclusive range ("500-599")
+func parseStatusCodeRange(statusCodes string) (statusCodeRange, error) {
+	statusCodes = strings.ToLower(strings.TrimSpace(statusCodes))
+	if len(statusCodes) == 3 && strings.HasSuffix(statusCodes, "xx") {
+		class, err := strconv.Atoi(statusCodes[:1])
+		if err == nil && class >= 1 && class <= 5 {
+			return statusCodeRange{class * 100, class*100 + 99}, nil
+		}
+	}
+	if lower, upper, isRange := strings.Cut(statusCodes, "-"); isRange {
+		lowerCode, lowerErr := strconv.Atoi(lower)
+		upperCode, upperErr := strconv.Atoi(upper)
+		if lowerErr == nil && upperErr == nil && lowerCode <= upperCode {
+			return statusCodeRange{lowerCode, upperCode}, nil
+		}
+	}
+	if statusCode, err := strconv.Atoi(statusCodes); err == nil {
+		return statusCodeRange{statusCode, statusCode}, nil
+	}
+	return statusCodeRange{}, fmt.Errorf("invalid status code match %q, expected e.g. 404, 5xx or 500-599", statusCodes)
+}
+
+func newEndpointMatcher(endpoint string) (*endpointMatcher, error) {
+	if _, network, err := net.ParseCIDR(endpoint); err == nil {
+		return &endpointMatcher{network: network}, nil
+	}
+	if ip := net.ParseIP(endpoint); ip != nil {
+		bits := 8 * len(ip.To4())
+		if bits == 0 {
+			bits = 8 * net.IPv6len
+		}
+		return &endpointMatcher{network: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}}, nil
+	}
+	if _, err := path.Match(endpoint, ""); err != nil || !strings.Contains(endpoint, "/") {
+		return nil, fmt.Errorf("invalid source or destination %q, expected an IP, CIDR or namespace/name workload glob", endpoint)
+	}
+	return &endpointMatcher{workload: endpoint}, nil
+}
+
+func (m *endpointMatcher) matches(ip string, workload string) bool {
+	if m.network != nil {
+		parsedIp := net.ParseIP(ip)
+		return parsedIp != nil && m.network.Contains(parsedIp)
+	}
+	if workload == "" {
+		return false
+	}
+	matched, _ := path.Match(m.workload, workload)
+	return matched
+}
+
+// shouldExport returns true if the captured request and response should be exported, along with the name of the rule
+// that decided it, which is empty if the default action was used
+func (r *captureRules) shouldExport(reqAndResp *httpRequestAndResponse) (bool, string) {
+	for _, rule := range r.rules {
+		if rule.matches(reqAndResp) {
+			return rule.action == captureRuleActionInclude, rule.name
+		}
+	}
+	return r.defaultAction == captureRuleActionInclude, ""
+}
+
+func (r *captureRule) matches(reqAndResp *httpRequestAndResponse) bool {
+	if len(r.methods) > 0 {
+		if _, ok := r.methods[strings.ToUpper(reqAndResp.request.Method)]; !ok {
+			return false
+		}
+	}
+	if len(r.hosts) > 0 {
+		host := reqAndResp.request.Host
+		if hostWithoutPort, _, err := net.SplitHostPort(host); err == nil {
+			host = hostWithoutPort
+		}
+		if !matchesAnyGlob(r.hosts, host) && !matchesAnyGlob(r.hosts, reqAndResp.request.Host) {
+			return false
+		}
+	}
+	requestPath := ""
+	if reqAndResp.request.URL != nil {
+		requestPath = reqAndResp.request.URL.Path
+	}
+	if len(r.paths) > 0 && !matchesAnyGlob(r.paths, requestPath) {
+		return false
+	}
+	if r.pathRegex != nil && !r.pathRegex.MatchString(requestPath) {
+		return false
+	}
+	if len(r.statusCodes) > 0 {
+		matched := false
+		for _, statusCodeRange := range r.statusCodes {
+			if reqAndResp.response.StatusCode >= statusCodeRange.min && reqAndResp.response.StatusCode <= statusCodeRange.max {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for _, header := range r.headers {
+		if !header.matches(reqAndResp) {
+			return false
+		}
+	}
+	if len(r.sources) > 0 && !matchesAnyEndpoint(r.sources, reqAndResp.src, reqAndResp.srcWorkload) {
+		return false
+	}
+	if len(r.destinations) > 0 && !matchesAnyEndpoint(r.destinations, reqAndResp.dst, reqAndResp.dstWorkload) {
+		return false
+	}
+	return true
+}
+
+// matches returns true if the header is present and, if a value glob or regex is configured, any of its values match
+func (m *headerMatcher) matches(reqAndResp *httpRequestAndResponse) bool {
+	headers := reqAndResp.request.Header
+	if m.response {
+		headers = reqAndResp.response.Header
+	}
+	values := headers.Values(m.name)
+	if m.name == "Host" && !m.response && reqAndResp.request.Host != "" {
+		values = append(values, reqAndResp.request.Host)
+	}
+	if len(values) == 0 {
+		return false
+	}
+	if m.value == "" && m.valueRegex == nil {
+		return true
+	}
+	for _, value := range values {
+		if m.value != "" {
+			if matched, _ := path.Match(m.value, value); !matched {
+				continue
+			}
+		}
+		if m.valueRegex != nil && !m.valueRegex.MatchString(value) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func matchesAnyGlob(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAnyEndpoint(matchers []*endpointMatcher, ip string, workload string) bool {
+	for _, matcher := range matchers {
+		if matcher.matches(ip, workload) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCaptureRulesShouldExport(t *testing.T) {
+	probeRules := []captureRuleConfig{
+		{
+			Name:    "drop-health-checks",
+			Action:  "exclude",
+			Methods: []string{"get"},
+			Paths:   []string{"/healthz", "/metrics", "/ready*"},
+		},
+		{
+			Name:    "drop-kube-probes",
+			Action:  "exclude",
+			Headers: []headerMatchConfig{{Name: "user-agent", Value: "kube-probe/*"}},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		rules          []captureRuleConfig
+		defaultAction  string
+		method         string
+		url            string
+		host           string
+		headers        map[string]string
+		statusCode     int
+		src            string
+		dstWorkload    string
+		expectedExport bool
+		expectedRule   string
+	}{
+		{
+			name:           "No rules exports everything",
+			method:         "GET",
+			url:            "/healthz",
+			statusCode:     200,
+			expectedExport: true,
+		},
+		{
+			name:           "Health check is excluded",
+			rules:          probeRules,
+			method:         "GET",
+			url:            "/healthz",
+			statusCode:     200,
+			expectedExport: false,
+			expectedRule:   "drop-health-checks",
+		},
+		{
+			name:           "Path glob matches",
+			rules:          probeRules,
+			method:         "GET",
+			url:            "/readyz?verbose",
+			statusCode:     200,
+			expectedExport: false,
+			expectedRule:   "drop-health-checks",
+		},
+		{
+			name:           "Method must also match",
+			rules:          probeRules,
+			method:         "POST",
+			url:            "/metrics",
+			statusCode:     200,
+			expectedExport: true,
+		},
+		{
+			name:           "Kube probe user agent is excluded",
+			rules:          probeRules,
+			method:         "GET",
+			url:            "/api/status",
+			headers:        map[string]string{"User-Agent": "kube-probe/1.29"},
+			statusCode:     200,
+			expectedExport: false,
+			expectedRule:   "drop-kube-probes",
+		},
+		{
+			name: "First matching rule wins",
+			rules: []captureRuleConfig{
+				{Name: "keep-errors", Action: "include", StatusCodes: []string{"5xx"}},
+				{Name: "drop-health", Action: "exclude", Paths: []string{"/healthz"}},
+			},
+			method:         "GET",
+			url:            "/healthz",
+			statusCode:     503,
+			expectedExport: true,
+			expectedRule:   "keep-errors",
+		},
+		{
+			name: "Default exclude with include rule on host and path regex",
+			rules: []captureRuleConfig{
+				{Name: "orders", Action: "include", Hosts: []string{"orders.*"}, PathRegex: `^/v[0-9]+/orders`},
+			},
+			defaultAction:  "exclude",
+			method:         "GET",
+			url:            "/v2/orders/123",
+			host:           "orders.shop.svc:8080",
+			statusCode:     200,
+			expectedExport: true,
+			expectedRule:   "orders",
+		},
+		{
+			name: "Default exclude with no matching rule",
+			rules: []captureRuleConfig{
+				{Name: "orders", Action: "include", Hosts: []string{"orders.*"}},
+			},
+			defaultAction:  "exclude",
+			method:         "GET",
+			url:            "/v2/orders/123",
+			host:           "payments.shop.svc",
+			statusCode:     200,
+			expectedExport: false,
+		},
+		{
+			name: "Status code range",
+			rules: []captureRuleConfig{
+				{Name: "drop-redirects", Action: "exclude", StatusCodes: []string{"300-308"}},
+			},
+			method:         "GET",
+			url:            "/",
+			statusCode:     302,
+			expectedExport: false,
+			expectedRule:   "drop-redirects",
+		},
+		{
+			name: "Source CIDR",
+			rules: []captureRuleConfig{
+				{Name: "drop-monitoring", Action: "exclude", Sources: []string{"10.1.0.0/16"}},
+			},
+			method:         "GET",
+			url:            "/",
+			statusCode:     200,
+			src:            "10.1.2.3",
+			expectedExport: false,
+			expectedRule:   "drop-monitoring",
+		},
+		{
+			name: "Destination workload glob",
+			rules: []captureRuleConfig{
+				{Name: "drop-kube-system", Action: "exclude", Destinations: []string{"kube-system/*"}},
+			},
+			method:         "GET",
+			url:            "/",
+			statusCode:     200,
+			dstWorkload:    "kube-system/metrics-server",
+			expectedExport: false,
+			expectedRule:   "drop-kube-system",
+		},
+		{
+			name: "Header presence",
+			rules: []captureRuleConfig{
+				{Name: "drop-internal", Action: "exclude", Headers: []headerMatchConfig{{Name: "X-Internal"}}},
+			},
+			method:         "GET",
+			url:            "/",
+			headers:        map[string]string{"X-Internal": "1"},
+			statusCode:     200,
+			expectedExport: false,
+			expectedRule:   "drop-internal",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := newCaptureRules(tt.rules, tt.defaultAction)
+			if err != nil {
+				t.Fatalf("newCaptureRules() error = %v", err)
+			}
+			req, err := http.NewRequest(tt.method, "http://example.com"+tt.url, nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			reqAndResp := httpRequestAndResponse{
+				request:     req,
+				response:    &http.Response{StatusCode: tt.statusCode, Header: http.Header{}},
+				src:         tt.src,
+				dstWorkload: tt.dstWorkload,
+			}
+
+			export, ruleName := rules.shouldExport(&reqAndResp)
+			if export != tt.expectedExport {
+				t.Errorf("shouldExport() = %v, want %v", export, tt.expectedExport)
+			}
+			if ruleName != tt.expectedRule {
+				t.Errorf("shouldExport() rule = %q, want %q", ruleName, tt.expectedRule)
+			}
+		})
+	}
+}
+
+func TestNewCaptureRulesErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		rules         []captureRuleConfig
+		defaultAction string
+		expectedError string
+	}{
+		{
+			name:          "Invalid default action",
+			defaultAction: "drop",
+			expectedError: "filtering.defaultAction must be",
+		},
+		{
+			name:          "Invalid action",
+			rules:         []captureRuleConfig{{Action: "drop"}},
+			expectedError: "filtering.rules[0]: action must be",
+		},
+		{
+			name:          "Invalid path regex",
+			rules:         []captureRuleConfig{{Action: "exclude", PathRegex: "("}},
+			expectedError: "invalid pathRegex",
+		},
+		{
+			name:          "Invalid status code",
+			rules:         []captureRuleConfig{{Action: "exclude", StatusCodes: []string{"6xx"}}},
+			expectedError: "invalid status code match",
+		},
+		{
+			name:          "Invalid destination",
+			rules:         []captureRuleConfig{{Action: "exclude", Destinations: []string{"metrics-server"}}},
+			expectedError: "invalid source or destination",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newCaptureRules(tt.rules, tt.defaultAction)
+			if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+				t.Fatalf("newCaptureRules() error = %v, want error containing %q", err, tt.expectedError)
+			}
+		})
+	}
+}
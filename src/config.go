@@ -0,0 +1,915 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	configFileEnvVar = "FIRETAIL_KUBERNETES_SENSOR_CONFIG_FILE"
+
+	defaultBpfExpression = "tcp and (port 80 or port 443)"
+	// maxSnaplen is the largest snaplen libpcap accepts, which fits GRO and TSO coalesced segments and jumbo frames
+	maxSnaplen = 262144
+	// protocolDetectionBpfExpression captures every TCP connection, leaving the sensor to work out which carry HTTP
+	protocolDetectionBpfExpression = "tcp"
+
+	defaultFiretailMaxLogAge = time.Minute
+	// devModeFiretailMaxLogAge is the FireTail log shipper's default max log age in dev mode, so logs show up quickly
+	devModeFiretailMaxLogAge = time.Second
+)
+
+type sensorConfig struct {
+	Sensor         sensorSettings       `yaml:"sensor"`
+	Capture        captureConfig        `yaml:"capture"`
+	Pipeline       pipelineConfig       `yaml:"pipeline"`
+	Filtering      filteringConfig      `yaml:"filtering"`
+	Sampling       samplingConfig       `yaml:"sampling"`
+	Redaction      redactionConfig      `yaml:"redaction"`
+	Classification classificationConfig `yaml:"classification"`
+	Sinks          sinksConfig          `yaml:"sinks"`
+	OpenApi        openApiConfig        `yaml:"openapi"`
+	Findings       findingsConfig       `yaml:"findings"`
+	Inventory      inventoryConfig      `yaml:"inventory"`
+	Auth           authConfig           `yaml:"auth"`
+	Tls            tlsConfig            `yaml:"tls"`
+	Connections    connectionsConfig    `yaml:"connections"`
+	Kubernetes     kubernetesConfig     `yaml:"kubernetes"`
+}
+
+type sensorSettings struct {
+	LifetimeMinutes      int           `yaml:"lifetimeMinutes"`
+	DevMode              bool          `yaml:"devMode"`
+	DevServerEnabled     bool          `yaml:"devServerEnabled"`
+	ConfigReloadInterval time.Duration `yaml:"configReloadInterval"`
+	// HealthAddress is the address the liveness and readiness endpoints are served on, which is disabled if empty
+	HealthAddress string `yaml:"healthAddress"`
+}
+
+type captureConfig struct {
+	BpfExpression            string              `yaml:"bpfExpression"`
+	MaxContentLength         int64               `yaml:"maxContentLength"`
+	ProtocolDetection        bool                `yaml:"protocolDetection"`
+	Interfaces               []string            `yaml:"interfaces"`
+	InterfaceRefreshInterval time.Duration       `yaml:"interfaceRefreshInterval"`
+	DeduplicationWindow      time.Duration       `yaml:"deduplicationWindow"`
+	Backend                  string              `yaml:"backend"`
+	Snaplen                  int                 `yaml:"snaplen"`
+	Pcap                     pcapConfig          `yaml:"pcap"`
+	AfPacket                 afPacketConfig      `yaml:"afPacket"`
+	Decapsulation            decapsulationConfig `yaml:"decapsulation"`
+}
+
+type decapsulationConfig struct {
+	Enabled     bool  `yaml:"enabled"`
+	VxlanPorts  []int `yaml:"vxlanPorts"`
+	GenevePorts []int `yaml:"genevePorts"`
+}
+
+// widenBpfExpression extends a BPF expression to also capture the encapsulated packets the sensor decapsulates, as the
+// filter only sees their outer headers
+func (c decapsulationConfig) widenBpfExpression(bpfExpression string) string {
+	var ports []string
+	for _, port := range slices.Concat(c.VxlanPorts, c.GenevePorts) {
+		ports = append(ports, "port "+strconv.Itoa(port))
+	}
+	widened := "(" + bpfExpression + ") or ip proto 4"
+	if len(ports) > 0 {
+		widened += " or (udp and (" + strings.Join(ports, " or ") + "))"
+	}
+	return widened
+}
+
+type pcapConfig struct {
+	Promiscuous   bool `yaml:"promiscuous"`
+	BufferSize    int  `yaml:"bufferSize"`
+	ImmediateMode bool `yaml:"immediateMode"`
+}
+
+type afPacketConfig struct {
+	RingSize         int           `yaml:"ringSize"`
+	MaxTotalRingSize int           `yaml:"maxTotalRingSize"`
+	BlockTimeout     time.Duration `yaml:"blockTimeout"`
+	FanoutWorkers    int           `yaml:"fanoutWorkers"`
+	FanoutGroupId    int           `yaml:"fanoutGroupId"`
+}
+
+type pipelineConfig struct {
+	QueueSize int `yaml:"queueSize"`
+	Workers   int `yaml:"workers"`
+}
+
+type filteringConfig struct {
+	OnlyLogJson   bool                `yaml:"onlyLogJson"`
+	DefaultAction string              `yaml:"defaultAction"`
+	Rules         []captureRuleConfig `yaml:"rules"`
+}
+
+type samplingConfig struct {
+	Probability           float64 `yaml:"probability"`
+	AlwaysKeepErrors      bool    `yaml:"alwaysKeepErrors"`
+	EndpointRatePerSecond float64 `yaml:"endpointRatePerSecond"`
+	EndpointBurst         int     `yaml:"endpointBurst"`
+	MaxEndpoints          int     `yaml:"maxEndpoints"`
+}
+
+type redactionConfig struct {
+	Headers     []string `yaml:"headers"`
+	JsonFields  []string `yaml:"jsonFields"`
+	Replacement string   `yaml:"replacement"`
+}
+
+type classificationConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Classes []string `yaml:"classes"`
+}
+
+type sinksConfig struct {
+	Firetail firetailSinkConfig `yaml:"firetail"`
+	Otlp     otlpSinkConfig     `yaml:"otlp"`
+	Har      harSinkConfig      `yaml:"har"`
+	Kafka    kafkaSinkConfig    `yaml:"kafka"`
+}
+
+type firetailSinkConfig struct {
+	ApiUrl       string        `yaml:"apiUrl"`
+	ApiToken     string        `yaml:"apiToken"`
+	MaxLogAge    time.Duration `yaml:"maxLogAge"`
+	MaxBatchSize int           `yaml:"maxBatchSize"`
+	QueueSize    int           `yaml:"queueSize"`
+	Spool        spoolConfig   `yaml:"spool"`
+}
+
+type spoolConfig struct {
+	Directory      string        `yaml:"directory"`
+	MaxBytes       int64         `yaml:"maxBytes"`
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`
+}
+
+type otlpSinkConfig struct {
+	Endpoint     string            `yaml:"endpoint"`
+	Protocol     string            `yaml:"protocol"`
+	Headers      map[string]string `yaml:"headers"`
+	Timeout      time.Duration     `yaml:"timeout"`
+	ServiceName  string            `yaml:"serviceName"`
+	ExportLogs   bool              `yaml:"exportLogs"`
+	MaxBatchSize int               `yaml:"maxBatchSize"`
+	MaxBatchAge  time.Duration     `yaml:"maxBatchAge"`
+	QueueSize    int               `yaml:"queueSize"`
+}
+
+type harSinkConfig struct {
+	Directory    string        `yaml:"directory"`
+	MaxFileBytes int64         `yaml:"maxFileBytes"`
+	MaxFileAge   time.Duration `yaml:"maxFileAge"`
+	MaxFiles     int           `yaml:"maxFiles"`
+	QueueSize    int           `yaml:"queueSize"`
+}
+
+type kafkaSinkConfig struct {
+	Brokers          []string        `yaml:"brokers"`
+	Topic            string          `yaml:"topic"`
+	FindingsTopic    string          `yaml:"findingsTopic"`
+	ConnectionsTopic string          `yaml:"connectionsTopic"`
+	ClientId         string          `yaml:"clientId"`
+	Format           string          `yaml:"format"`
+	PartitionKey     string          `yaml:"partitionKey"`
+	Compression      string          `yaml:"compression"`
+	Acks             int             `yaml:"acks"`
+	Timeout          time.Duration   `yaml:"timeout"`
+	MaxBatchBytes    int             `yaml:"maxBatchBytes"`
+	MaxBatchAge      time.Duration   `yaml:"maxBatchAge"`
+	QueueSize        int             `yaml:"queueSize"`
+	Tls              kafkaTlsConfig  `yaml:"tls"`
+	Sasl             kafkaSaslConfig `yaml:"sasl"`
+}
+
+type kafkaTlsConfig struct {
+	Enabled            bool   `yaml:"enabled"`
+	CaFile             string `yaml:"caFile"`
+	CertFile           string `yaml:"certFile"`
+	KeyFile            string `yaml:"keyFile"`
+	ServerName         string `yaml:"serverName"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+type kafkaSaslConfig struct {
+	Mechanism string `yaml:"mechanism"`
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+}
+
+type openApiConfig struct {
+	Inference   openApiInferenceConfig   `yaml:"inference"`
+	Conformance openApiConformanceConfig `yaml:"conformance"`
+}
+
+type openApiInferenceConfig struct {
+	Directory              string        `yaml:"directory"`
+	Interval               time.Duration `yaml:"interval"`
+	MaxEndpointsPerService int           `yaml:"maxEndpointsPerService"`
+	QueueSize              int           `yaml:"queueSize"`
+}
+
+type openApiConformanceConfig struct {
+	SpecDirectory  string            `yaml:"specDirectory"`
+	Specs          map[string]string `yaml:"specs"`
+	ReloadInterval time.Duration     `yaml:"reloadInterval"`
+}
+
+type findingsConfig struct {
+	ReportInterval time.Duration `yaml:"reportInterval"`
+	MaxFindings    int           `yaml:"maxFindings"`
+}
+
+type authConfig struct {
+	ApiKeyHeaders []string `yaml:"apiKeyHeaders"`
+	Findings      bool     `yaml:"findings"`
+	PublicPaths   []string `yaml:"publicPaths"`
+}
+
+type tlsConfig struct {
+	Metadata             bool          `yaml:"metadata"`
+	Findings             bool          `yaml:"findings"`
+	QueueSize            int           `yaml:"queueSize"`
+	KeyLogFiles          []string      `yaml:"keyLogFiles"`
+	KeyLogReloadInterval time.Duration `yaml:"keyLogReloadInterval"`
+	MaxKeyLogSessions    int           `yaml:"maxKeyLogSessions"`
+}
+
+type connectionsConfig struct {
+	Summaries bool `yaml:"summaries"`
+	QueueSize int  `yaml:"queueSize"`
+}
+
+type inventoryConfig struct {
+	File          string        `yaml:"file"`
+	WriteInterval time.Duration `yaml:"writeInterval"`
+	MaxEndpoints  int           `yaml:"maxEndpoints"`
+}
+
+type kubernetesConfig struct {
+	ServiceIpFiltering       bool          `yaml:"serviceIpFiltering"`
+	ServiceIpRefreshInterval time.Duration `yaml:"serviceIpRefreshInterval"`
+	PodIpLookup              bool          `yaml:"podIpLookup"`
+	NodeName                 string        `yaml:"nodeName"`
+	PodName                  string        `yaml:"podName"`
+}
+
+func defaultConfig() *sensorConfig {
+	return &sensorConfig{
+		Sensor: sensorSettings{
+			LifetimeMinutes:      15,
+			ConfigReloadInterval: 10 * time.Second,
+		},
+		Capture: captureConfig{
+			BpfExpression:            defaultBpfExpression,
+			MaxContentLength:         1048576, // 1MiB
+			Interfaces:               []string{anyInterface},
+			InterfaceRefreshInterval: 10 * time.Second,
+			DeduplicationWindow:      100 * time.Millisecond,
+			Backend:                  captureBackendPcap,
+			Snaplen:                  maxSnaplen,
+			Pcap: pcapConfig{
+				Promiscuous: true,
+			},
+			AfPacket: afPacketConfig{
+				RingSize:         64 * 1024 * 1024,  // 64MiB
+				MaxTotalRingSize: 512 * 1024 * 1024, // 512MiB
+				BlockTimeout:     64 * time.Millisecond,
+				FanoutWorkers:    1,
+				FanoutGroupId:    4600,
+			},
+			Decapsulation: decapsulationConfig{
+				Enabled: true,
+				// 8472 is the Linux kernel's default VXLAN port, which Flannel uses, rather than the IANA port
+				VxlanPorts:  []int{4789, 8472},
+				GenevePorts: []int{6081},
+			},
+		},
+		Pipeline: pipelineConfig{
+			QueueSize: 1000,
+			Workers:   4,
+		},
+		Filtering: filteringConfig{
+			DefaultAction: captureRuleActionInclude,
+		},
+		Sampling: samplingConfig{
+			Probability:      1,
+			AlwaysKeepErrors: true,
+			MaxEndpoints:     10000,
+		},
+		Redaction: redactionConfig{
+			Replacement: "REDACTED",
+		},
+		Sinks: sinksConfig{
+			Firetail: firetailSinkConfig{
+				ApiUrl:       "https://api.logging.eu-west-1.prod.firetail.app/logs/bulk",
+				MaxLogAge:    defaultFiretailMaxLogAge,
+				MaxBatchSize: 512 * 1024,
+				QueueSize:    1000,
+				Spool: spoolConfig{
+					MaxBytes:       256 * 1024 * 1024, // 256MiB
+					InitialBackoff: time.Second,
+					MaxBackoff:     5 * time.Minute,
+				},
+			},
+			Otlp: otlpSinkConfig{
+				Protocol:     otlpProtocolHttpProtobuf,
+				Timeout:      10 * time.Second,
+				ServiceName:  otlpDefaultServiceName,
+				MaxBatchSize: 512,
+				MaxBatchAge:  5 * time.Second,
+				QueueSize:    2048,
+			},
+			Har: harSinkConfig{
+				MaxFileBytes: 64 * 1024 * 1024, // 64MiB
+				MaxFileAge:   time.Hour,
+				MaxFiles:     24,
+				QueueSize:    1000,
+			},
+			Kafka: kafkaSinkConfig{
+				Topic:         "firetail-api-events",
+				ClientId:      "firetail-kubernetes-sensor",
+				Format:        kafkaFormatJson,
+				PartitionKey:  "dstWorkload",
+				Compression:   "gzip",
+				Acks:          -1,
+				Timeout:       10 * time.Second,
+				MaxBatchBytes: 1024 * 1024, // 1MiB
+				MaxBatchAge:   time.Second,
+				QueueSize:     2048,
+			},
+		},
+		OpenApi: openApiConfig{
+			Inference: openApiInferenceConfig{
+				Interval:               5 * time.Minute,
+				MaxEndpointsPerService: 500,
+				QueueSize:              1000,
+			},
+			Conformance: openApiConformanceConfig{
+				ReloadInterval: time.Minute,
+			},
+		},
+		Findings: findingsConfig{
+			ReportInterval: time.Minute,
+			MaxFindings:    10000,
+		},
+		Inventory: inventoryConfig{
+			WriteInterval: time.Minute,
+			MaxEndpoints:  10000,
+		},
+		Auth: authConfig{
+			ApiKeyHeaders: []string{"X-Api-Key", "Api-Key", "X-Api-Token", "X-Auth-Token"},
+			Findings:      true,
+			PublicPaths:   []string{"/health", "/healthz", "/livez", "/readyz", "/ready", "/ping", "/metrics", "/favicon.ico"},
+		},
+		Tls: tlsConfig{
+			Metadata:             true,
+			Findings:             true,
+			QueueSize:            1000,
+			KeyLogReloadInterval: 5 * time.Second,
+			MaxKeyLogSessions:    100000,
+		},
+		Connections: connectionsConfig{
+			QueueSize: 1000,
+		},
+		Kubernetes: kubernetesConfig{
+			ServiceIpFiltering:       true,
+			ServiceIpRefreshInterval: time.Second,
+		},
+	}
+}
+
+// loadConfig builds the sensor's config from its defaults, the config file named by
+// FIRETAIL_KUBERNETES_SENSOR_CONFIG_FILE (if set), and then any environment variable overrides, in that order.
+func loadConfig() (*sensorConfig, error) {
+	config := defaultConfig()
+	if configFilePath, ok := os.LookupEnv(configFileEnvVar); ok && configFilePath != "" {
+		if err := config.loadFile(configFilePath); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	// Protocol detection needs to see connections on every port, so it widens the default BPF expression, but not one
+	// that's been set explicitly
+	if config.Capture.BpfExpression == defaultBpfExpression {
+		if config.Capture.ProtocolDetection {
+			config.Capture.BpfExpression = protocolDetectionBpfExpression
+		}
+		// Likewise, the default has to let the tunnelled packets of overlay networks through to be decapsulated
+		if config.Capture.Decapsulation.Enabled {
+			config.Capture.BpfExpression = config.Capture.Decapsulation.widenBpfExpression(config.Capture.BpfExpression)
+		}
+	}
+	// Dev mode shortens the default max log age, but not one that's been set explicitly
+	if config.Sensor.DevMode && config.Sinks.Firetail.MaxLogAge == defaultFiretailMaxLogAge {
+		config.Sinks.Firetail.MaxLogAge = devModeFiretailMaxLogAge
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *sensorConfig) loadFile(path string) error {
+	configBytes, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read config file %s: %v", path, err)
+	}
+	// JSON is a subset of YAML, so the YAML decoder handles both formats
+	decoder := yaml.NewDecoder(bytes.NewReader(configBytes))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("Failed to parse config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// reloadableEnvVar is an environment variable which overrides a setting the config reloader applies live. While it's
+// set, changes to the setting in the config file have no effect.
+type reloadableEnvVar struct {
+	name    string
+	setting string
+	value   func(c *sensorConfig) any
+}
+
+var reloadableEnvVars = []reloadableEnvVar{
+	{"BPF_EXPRESSION", "capture.bpfExpression", func(c *sensorConfig) any { return c.Capture.BpfExpression }},
+	{"ENABLE_ONLY_LOG_JSON", "filtering.onlyLogJson", func(c *sensorConfig) any { return c.Filtering.OnlyLogJson }},
+	{"ENABLE_DATA_CLASSIFICATION", "classification.enabled", func(c *sensorConfig) any { return c.Classification.Enabled }},
+}
+
+func (c *sensorConfig) applyEnv(lookupEnv func(string) (string, bool)) error {
+	var errs []error
+	setString := func(name string, target *string) {
+		if value, ok := lookupEnv(name); ok {
+			*target = value
+		}
+	}
+	setBool := func(name string, target *bool, invert bool) {
+		if value, ok := lookupEnv(name); ok {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s must be a boolean, got %q", name, value))
+				return
+			}
+			*target = parsed != invert
+		}
+	}
+	setInt := func(name string, target *int) {
+		if value, ok := lookupEnv(name); ok {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s must be an integer, got %q", name, value))
+				return
+			}
+			*target = parsed
+		}
+	}
+	setInt64 := func(name string, target *int64) {
+		if value, ok := lookupEnv(name); ok {
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s must be an integer, got %q", name, value))
+				return
+			}
+			*target = parsed
+		}
+	}
+
+	setInt("FIRETAIL_KUBERNETES_SENSOR_LIFETIME_MINUTES", &c.Sensor.LifetimeMinutes)
+	setBool("FIRETAIL_KUBERNETES_SENSOR_DEV_MODE", &c.Sensor.DevMode, false)
+	setBool("FIRETAIL_KUBERNETES_SENSOR_DEV_SERVER_ENABLED", &c.Sensor.DevServerEnabled, false)
+	setString("FIRETAIL_KUBERNETES_SENSOR_HEALTH_ADDRESS", &c.Sensor.HealthAddress)
+	setString("BPF_EXPRESSION", &c.Capture.BpfExpression)
+	setInt64("MAX_CONTENT_LENGTH", &c.Capture.MaxContentLength)
+	setBool("ENABLE_PROTOCOL_DETECTION", &c.Capture.ProtocolDetection, false)
+	setString("CAPTURE_BACKEND", &c.Capture.Backend)
+	setInt("CAPTURE_SNAPLEN", &c.Capture.Snaplen)
+	if value, ok := lookupEnv("CAPTURE_INTERFACES"); ok {
+		c.Capture.Interfaces = nil
+		for _, pattern := range strings.Split(value, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				c.Capture.Interfaces = append(c.Capture.Interfaces, pattern)
+			}
+		}
+	}
+	setInt("PIPELINE_QUEUE_SIZE", &c.Pipeline.QueueSize)
+	setInt("PIPELINE_WORKERS", &c.Pipeline.Workers)
+	setBool("ENABLE_ONLY_LOG_JSON", &c.Filtering.OnlyLogJson, false)
+	setBool("ENABLE_DATA_CLASSIFICATION", &c.Classification.Enabled, false)
+	setString("FIRETAIL_API_URL", &c.Sinks.Firetail.ApiUrl)
+	setString("FIRETAIL_API_TOKEN", &c.Sinks.Firetail.ApiToken)
+	setBool("DISABLE_SERVICE_IP_FILTERING", &c.Kubernetes.ServiceIpFiltering, true)
+	setString("FIRETAIL_SPOOL_DIRECTORY", &c.Sinks.Firetail.Spool.Directory)
+	setString("OTEL_EXPORTER_OTLP_ENDPOINT", &c.Sinks.Otlp.Endpoint)
+	setString("OTEL_EXPORTER_OTLP_PROTOCOL", &c.Sinks.Otlp.Protocol)
+	setString("OTEL_SERVICE_NAME", &c.Sinks.Otlp.ServiceName)
+	if value, ok := lookupEnv("OTEL_EXPORTER_OTLP_HEADERS"); ok {
+		headers, err := parseOtlpHeaders(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS %v", err))
+		} else {
+			c.Sinks.Otlp.Headers = headers
+		}
+	}
+	setString("HAR_DIRECTORY", &c.Sinks.Har.Directory)
+	if value, ok := lookupEnv("KAFKA_BROKERS"); ok {
+		c.Sinks.Kafka.Brokers = nil
+		for _, broker := range strings.Split(value, ",") {
+			if broker = strings.TrimSpace(broker); broker != "" {
+				c.Sinks.Kafka.Brokers = append(c.Sinks.Kafka.Brokers, broker)
+			}
+		}
+	}
+	setString("KAFKA_TOPIC", &c.Sinks.Kafka.Topic)
+	setString("KAFKA_FINDINGS_TOPIC", &c.Sinks.Kafka.FindingsTopic)
+	setString("KAFKA_CONNECTIONS_TOPIC", &c.Sinks.Kafka.ConnectionsTopic)
+	setBool("KAFKA_TLS_ENABLED", &c.Sinks.Kafka.Tls.Enabled, false)
+	setString("KAFKA_SASL_MECHANISM", &c.Sinks.Kafka.Sasl.Mechanism)
+	setString("KAFKA_SASL_USERNAME", &c.Sinks.Kafka.Sasl.Username)
+	setString("KAFKA_SASL_PASSWORD", &c.Sinks.Kafka.Sasl.Password)
+	setString("OPENAPI_INFERENCE_DIRECTORY", &c.OpenApi.Inference.Directory)
+	setString("OPENAPI_SPEC_DIRECTORY", &c.OpenApi.Conformance.SpecDirectory)
+	setString("INVENTORY_FILE", &c.Inventory.File)
+	setBool("DISABLE_TLS_METADATA", &c.Tls.Metadata, true)
+	if value, ok := lookupEnv("TLS_KEY_LOG_FILES"); ok {
+		c.Tls.KeyLogFiles = nil
+		for _, pattern := range strings.Split(value, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				c.Tls.KeyLogFiles = append(c.Tls.KeyLogFiles, pattern)
+			}
+		}
+	}
+	setBool("ENABLE_CONNECTION_SUMMARIES", &c.Connections.Summaries, false)
+	setString("NODE_NAME", &c.Kubernetes.NodeName)
+	setString("POD_NAME", &c.Kubernetes.PodName)
+
+	return errors.Join(errs...)
+}
+
+// checkBpfExpression compiles a BPF expression for the link types interfaces usually have. Some expressions are only
+// valid for some link types, so it's only rejected if it compiles for none of them; each capture still compiles it for
+// its own link type when it's opened.
+func checkBpfExpression(bpfExpression string) error {
+	_, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, maxSnaplen, bpfExpression)
+	if err == nil {
+		return nil
+	}
+	if _, sllErr := pcap.CompileBPFFilter(layers.LinkTypeLinuxSLL, maxSnaplen, bpfExpression); sllErr == nil {
+		return nil
+	}
+	return err
+}
+
+func (c *sensorConfig) validate() error {
+	var errs []error
+	if c.Sensor.ConfigReloadInterval < 0 {
+		errs = append(errs, fmt.Errorf("sensor.configReloadInterval must not be negative, got %s", c.Sensor.ConfigReloadInterval))
+	}
+	if c.Sensor.HealthAddress != "" {
+		if _, _, err := net.SplitHostPort(c.Sensor.HealthAddress); err != nil {
+			errs = append(errs, fmt.Errorf("sensor.healthAddress must be a host:port address, got %q", c.Sensor.HealthAddress))
+		}
+	}
+	if c.Sinks.Firetail.ApiToken == "" {
+		errs = append(errs, errors.New("sinks.firetail.apiToken must be set, either in the config file or via FIRETAIL_API_TOKEN"))
+	}
+	if parsedUrl, err := url.Parse(c.Sinks.Firetail.ApiUrl); err != nil || (parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https") || parsedUrl.Host == "" {
+		errs = append(errs, fmt.Errorf("sinks.firetail.apiUrl must be an absolute http(s) URL, got %q", c.Sinks.Firetail.ApiUrl))
+	}
+	if c.Sinks.Firetail.MaxLogAge <= 0 {
+		errs = append(errs, fmt.Errorf("sinks.firetail.maxLogAge must be greater than 0, got %s", c.Sinks.Firetail.MaxLogAge))
+	}
+	if c.Sinks.Firetail.MaxBatchSize <= 0 {
+		errs = append(errs, fmt.Errorf("sinks.firetail.maxBatchSize must be greater than 0, got %d", c.Sinks.Firetail.MaxBatchSize))
+	}
+	if c.Sinks.Firetail.QueueSize <= 0 {
+		errs = append(errs, fmt.Errorf("sinks.firetail.queueSize must be greater than 0, got %d", c.Sinks.Firetail.QueueSize))
+	}
+	if strings.TrimSpace(c.Capture.BpfExpression) == "" {
+		errs = append(errs, errors.New("capture.bpfExpression must not be empty"))
+	} else if err := checkBpfExpression(c.Capture.BpfExpression); err != nil {
+		// Checking the syntax up front means a typo is reported with the setting's name rather than as every
+		// interface failing to open
+		errs = append(errs, fmt.Errorf("capture.bpfExpression %q is invalid: %v", c.Capture.BpfExpression, err))
+	}
+	if c.Capture.MaxContentLength <= 0 {
+		errs = append(errs, fmt.Errorf("capture.maxContentLength must be greater than 0, got %d", c.Capture.MaxContentLength))
+	}
+	if len(c.Capture.Interfaces) == 0 {
+		errs = append(errs, errors.New("capture.interfaces must not be empty"))
+	}
+	for i, pattern := range c.Capture.Interfaces {
+		if _, err := filepath.Match(pattern, ""); err != nil || pattern == "" {
+			errs = append(errs, fmt.Errorf("capture.interfaces[%d] must be an interface name or glob, got %q", i, pattern))
+		}
+	}
+	if c.Capture.InterfaceRefreshInterval <= 0 {
+		errs = append(errs, fmt.Errorf("capture.interfaceRefreshInterval must be greater than 0, got %s", c.Capture.InterfaceRefreshInterval))
+	}
+	if c.Capture.DeduplicationWindow < 0 {
+		errs = append(errs, fmt.Errorf("capture.deduplicationWindow must not be negative, got %s", c.Capture.DeduplicationWindow))
+	}
+	if c.Capture.Snaplen <= 0 || c.Capture.Snaplen > maxSnaplen {
+		errs = append(errs, fmt.Errorf("capture.snaplen must be between 1 and %d, got %d", maxSnaplen, c.Capture.Snaplen))
+	}
+	for i, port := range c.Capture.Decapsulation.VxlanPorts {
+		if port <= 0 || port > math.MaxUint16 {
+			errs = append(errs, fmt.Errorf("capture.decapsulation.vxlanPorts[%d] must be a port between 1 and %d, got %d", i, math.MaxUint16, port))
+		}
+	}
+	for i, port := range c.Capture.Decapsulation.GenevePorts {
+		if port <= 0 || port > math.MaxUint16 {
+			errs = append(errs, fmt.Errorf("capture.decapsulation.genevePorts[%d] must be a port between 1 and %d, got %d", i, math.MaxUint16, port))
+		}
+	}
+	switch c.Capture.Backend {
+	case captureBackendPcap:
+		if c.Capture.Pcap.BufferSize < 0 {
+			errs = append(errs, fmt.Errorf("capture.pcap.bufferSize must not be negative, got %d", c.Capture.Pcap.BufferSize))
+		}
+	case captureBackendAfPacket:
+		if c.Capture.AfPacket.RingSize <= 0 || c.Capture.AfPacket.RingSize%afPacketBlockSize != 0 {
+			errs = append(errs, fmt.Errorf("capture.afPacket.ringSize must be a positive multiple of %d, got %d", afPacketBlockSize, c.Capture.AfPacket.RingSize))
+		}
+		if c.Capture.AfPacket.MaxTotalRingSize < c.Capture.AfPacket.FanoutWorkers*afPacketBlockSize || c.Capture.AfPacket.MaxTotalRingSize%afPacketBlockSize != 0 {
+			errs = append(errs, fmt.Errorf("capture.afPacket.maxTotalRingSize must be a multiple of %d with room for a block per fanout worker, got %d", afPacketBlockSize, c.Capture.AfPacket.MaxTotalRingSize))
+		}
+		if c.Capture.AfPacket.BlockTimeout < time.Millisecond {
+			errs = append(errs, fmt.Errorf("capture.afPacket.blockTimeout must be at least 1ms, got %s", c.Capture.AfPacket.BlockTimeout))
+		}
+		if c.Capture.AfPacket.FanoutWorkers <= 0 {
+			errs = append(errs, fmt.Errorf("capture.afPacket.fanoutWorkers must be greater than 0, got %d", c.Capture.AfPacket.FanoutWorkers))
+		}
+		if c.Capture.AfPacket.FanoutGroupId < 0 || c.Capture.AfPacket.FanoutGroupId > math.MaxUint16 {
+			errs = append(errs, fmt.Errorf("capture.afPacket.fanoutGroupId must be between 0 and %d, got %d", math.MaxUint16, c.Capture.AfPacket.FanoutGroupId))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("capture.backend must be %q or %q, got %q", captureBackendPcap, captureBackendAfPacket, c.Capture.Backend))
+	}
+	if c.Sinks.Firetail.Spool.Directory != "" {
+		if c.Sinks.Firetail.Spool.MaxBytes < int64(c.Sinks.Firetail.MaxBatchSize) {
+			errs = append(errs, fmt.Errorf("sinks.firetail.spool.maxBytes must be at least sinks.firetail.maxBatchSize (%d), got %d", c.Sinks.Firetail.MaxBatchSize, c.Sinks.Firetail.Spool.MaxBytes))
+		}
+		if c.Sinks.Firetail.Spool.InitialBackoff <= 0 {
+			errs = append(errs, fmt.Errorf("sinks.firetail.spool.initialBackoff must be greater than 0, got %s", c.Sinks.Firetail.Spool.InitialBackoff))
+		}
+		if c.Sinks.Firetail.Spool.MaxBackoff < c.Sinks.Firetail.Spool.InitialBackoff {
+			errs = append(errs, fmt.Errorf("sinks.firetail.spool.maxBackoff must be at least sinks.firetail.spool.initialBackoff, got %s", c.Sinks.Firetail.Spool.MaxBackoff))
+		}
+	}
+	if c.Sinks.Otlp.Endpoint != "" {
+		if endpointUrl, err := url.Parse(c.Sinks.Otlp.Endpoint); err != nil || (endpointUrl.Scheme != "http" && endpointUrl.Scheme != "https") || endpointUrl.Host == "" {
+			errs = append(errs, fmt.Errorf("sinks.otlp.endpoint must be an absolute http(s) URL, got %q", c.Sinks.Otlp.Endpoint))
+		}
+		switch c.Sinks.Otlp.Protocol {
+		case otlpProtocolGrpc, otlpProtocolHttpProtobuf, otlpProtocolHttpJson:
+		default:
+			errs = append(errs, fmt.Errorf("sinks.otlp.protocol must be one of %q, %q or %q, got %q", otlpProtocolGrpc, otlpProtocolHttpProtobuf, otlpProtocolHttpJson, c.Sinks.Otlp.Protocol))
+		}
+		if c.Sinks.Otlp.Timeout <= 0 {
+			errs = append(errs, fmt.Errorf("sinks.otlp.timeout must be greater than 0, got %s", c.Sinks.Otlp.Timeout))
+		}
+		if c.Sinks.Otlp.MaxBatchSize <= 0 {
+			errs = append(errs, fmt.Errorf("sinks.otlp.maxBatchSize must be greater than 0, got %d", c.Sinks.Otlp.MaxBatchSize))
+		}
+		if c.Sinks.Otlp.MaxBatchAge <= 0 {
+			errs = append(errs, fmt.Errorf("sinks.otlp.maxBatchAge must be greater than 0, got %s", c.Sinks.Otlp.MaxBatchAge))
+		}
+		if c.Sinks.Otlp.QueueSize <= 0 {
+			errs = append(errs, fmt.Errorf("sinks.otlp.queueSize must be greater than 0, got %d", c.Sinks.Otlp.QueueSize))
+		}
+	}
+	if c.Sinks.Har.Directory != "" {
+		if c.Sinks.Har.MaxFileBytes <= 0 {
+			errs = append(errs, fmt.Errorf("sinks.har.maxFileBytes must be greater than 0, got %d", c.Sinks.Har.MaxFileBytes))
+		}
+		if c.Sinks.Har.MaxFileAge <= 0 {
+			errs = append(errs, fmt.Errorf("sinks.har.maxFileAge must be greater than 0, got %s", c.Sinks.Har.MaxFileAge))
+		}
+		if c.Sinks.Har.MaxFiles < 0 {
+			errs = append(errs, fmt.Errorf("sinks.har.maxFiles must not be negative, got %d", c.Sinks.Har.MaxFiles))
+		}
+		if c.Sinks.Har.QueueSize <= 0 {
+			errs = append(errs, fmt.Errorf("sinks.har.queueSize must be greater than 0, got %d", c.Sinks.Har.QueueSize))
+		}
+	}
+	if len(c.Sinks.Kafka.Brokers) > 0 {
+		for i, broker := range c.Sinks.Kafka.Brokers {
+			if _, _, err := net.SplitHostPort(broker); err != nil {
+				errs = append(errs, fmt.Errorf("sinks.kafka.brokers[%d] must be a host:port, got %q", i, broker))
+			}
+		}
+		if c.Sinks.Kafka.Topic == "" {
+			errs = append(errs, errors.New("sinks.kafka.topic must not be empty"))
+		}
+		if c.Sinks.Kafka.Format != kafkaFormatJson && c.Sinks.Kafka.Format != kafkaFormatProtobuf {
+			errs = append(errs, fmt.Errorf("sinks.kafka.format must be %q or %q, got %q", kafkaFormatJson, kafkaFormatProtobuf, c.Sinks.Kafka.Format))
+		}
+		if !slices.Contains(kafkaPartitionKeys, c.Sinks.Kafka.PartitionKey) {
+			errs = append(errs, fmt.Errorf("sinks.kafka.partitionKey must be one of %v, got %q", kafkaPartitionKeys, c.Sinks.Kafka.PartitionKey))
+		}
+		if _, ok := kafkaCompressionCodecs[c.Sinks.Kafka.Compression]; !ok {
+			errs = append(errs, fmt.Errorf("sinks.kafka.compression must be \"none\" or \"gzip\", got %q", c.Sinks.Kafka.Compression))
+		}
+		if c.Sinks.Kafka.Acks != 0 && c.Sinks.Kafka.Acks != 1 && c.Sinks.Kafka.Acks != -1 {
+			errs = append(errs, fmt.Errorf("sinks.kafka.acks must be 0, 1 or -1, got %d", c.Sinks.Kafka.Acks))
+		}
+		if c.Sinks.Kafka.Timeout <= 0 {
+			errs = append(errs, fmt.Errorf("sinks.kafka.timeout must be greater than 0, got %s", c.Sinks.Kafka.Timeout))
+		}
+		if c.Sinks.Kafka.MaxBatchBytes <= 0 {
+			errs = append(errs, fmt.Errorf("sinks.kafka.maxBatchBytes must be greater than 0, got %d", c.Sinks.Kafka.MaxBatchBytes))
+		}
+		if c.Sinks.Kafka.MaxBatchAge <= 0 || c.Sinks.Kafka.MaxBatchAge > kafkaMaxBatchAge {
+			errs = append(errs, fmt.Errorf("sinks.kafka.maxBatchAge must be greater than 0 and at most %s, got %s", kafkaMaxBatchAge, c.Sinks.Kafka.MaxBatchAge))
+		}
+		if c.Sinks.Kafka.QueueSize <= 0 {
+			errs = append(errs, fmt.Errorf("sinks.kafka.queueSize must be greater than 0, got %d", c.Sinks.Kafka.QueueSize))
+		}
+		if (c.Sinks.Kafka.Tls.CertFile == "") != (c.Sinks.Kafka.Tls.KeyFile == "") {
+			errs = append(errs, errors.New("sinks.kafka.tls.certFile and sinks.kafka.tls.keyFile must be set together"))
+		}
+		if c.Sinks.Kafka.Sasl.Mechanism != "" {
+			if !slices.Contains(kafkaSaslMechanisms, c.Sinks.Kafka.Sasl.Mechanism) {
+				errs = append(errs, fmt.Errorf("sinks.kafka.sasl.mechanism must be one of %v, got %q", kafkaSaslMechanisms, c.Sinks.Kafka.Sasl.Mechanism))
+			}
+			if c.Sinks.Kafka.Sasl.Username == "" {
+				errs = append(errs, errors.New("sinks.kafka.sasl.username must not be empty when sinks.kafka.sasl.mechanism is set"))
+			}
+		}
+	}
+	if c.OpenApi.Inference.Directory != "" {
+		if c.OpenApi.Inference.Interval <= 0 {
+			errs = append(errs, fmt.Errorf("openapi.inference.interval must be greater than 0, got %s", c.OpenApi.Inference.Interval))
+		}
+		if c.OpenApi.Inference.MaxEndpointsPerService <= 0 {
+			errs = append(errs, fmt.Errorf("openapi.inference.maxEndpointsPerService must be greater than 0, got %d", c.OpenApi.Inference.MaxEndpointsPerService))
+		}
+		if c.OpenApi.Inference.QueueSize <= 0 {
+			errs = append(errs, fmt.Errorf("openapi.inference.queueSize must be greater than 0, got %d", c.OpenApi.Inference.QueueSize))
+		}
+	}
+	if c.OpenApi.Conformance.enabled() && c.OpenApi.Conformance.ReloadInterval <= 0 {
+		errs = append(errs, fmt.Errorf("openapi.conformance.reloadInterval must be greater than 0, got %s", c.OpenApi.Conformance.ReloadInterval))
+	}
+	for service, path := range c.OpenApi.Conformance.Specs {
+		if strings.TrimSpace(service) == "" || strings.TrimSpace(path) == "" {
+			errs = append(errs, fmt.Errorf("openapi.conformance.specs must map services to spec files, got %q: %q", service, path))
+		}
+	}
+	if c.Findings.ReportInterval <= 0 {
+		errs = append(errs, fmt.Errorf("findings.reportInterval must be greater than 0, got %s", c.Findings.ReportInterval))
+	}
+	if c.Findings.MaxFindings <= 0 {
+		errs = append(errs, fmt.Errorf("findings.maxFindings must be greater than 0, got %d", c.Findings.MaxFindings))
+	}
+	if c.Inventory.File != "" && c.Inventory.WriteInterval <= 0 {
+		errs = append(errs, fmt.Errorf("inventory.writeInterval must be greater than 0, got %s", c.Inventory.WriteInterval))
+	}
+	for i, header := range c.Auth.ApiKeyHeaders {
+		if strings.TrimSpace(header) == "" {
+			errs = append(errs, fmt.Errorf("auth.apiKeyHeaders[%d] must not be empty", i))
+		}
+	}
+	for i, pattern := range c.Auth.PublicPaths {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			errs = append(errs, fmt.Errorf("auth.publicPaths[%d] must be a valid glob, got %q", i, pattern))
+		}
+	}
+	if c.Tls.Metadata && c.Tls.QueueSize <= 0 {
+		errs = append(errs, fmt.Errorf("tls.queueSize must be greater than 0, got %d", c.Tls.QueueSize))
+	}
+	for i, pattern := range c.Tls.KeyLogFiles {
+		if _, err := filepath.Match(pattern, ""); err != nil || pattern == "" {
+			errs = append(errs, fmt.Errorf("tls.keyLogFiles[%d] must be a valid glob, got %q", i, pattern))
+		}
+	}
+	if len(c.Tls.KeyLogFiles) > 0 {
+		if c.Tls.KeyLogReloadInterval <= 0 {
+			errs = append(errs, fmt.Errorf("tls.keyLogReloadInterval must be greater than 0, got %s", c.Tls.KeyLogReloadInterval))
+		}
+		if c.Tls.MaxKeyLogSessions <= 0 {
+			errs = append(errs, fmt.Errorf("tls.maxKeyLogSessions must be greater than 0, got %d", c.Tls.MaxKeyLogSessions))
+		}
+	}
+	if c.Connections.Summaries && c.Connections.QueueSize <= 0 {
+		errs = append(errs, fmt.Errorf("connections.queueSize must be greater than 0, got %d", c.Connections.QueueSize))
+	}
+	if c.Inventory.MaxEndpoints <= 0 {
+		errs = append(errs, fmt.Errorf("inventory.maxEndpoints must be greater than 0, got %d", c.Inventory.MaxEndpoints))
+	}
+	if c.Pipeline.QueueSize <= 0 {
+		errs = append(errs, fmt.Errorf("pipeline.queueSize must be greater than 0, got %d", c.Pipeline.QueueSize))
+	}
+	if c.Pipeline.Workers <= 0 {
+		errs = append(errs, fmt.Errorf("pipeline.workers must be greater than 0, got %d", c.Pipeline.Workers))
+	}
+	if _, err := newCaptureRules(c.Filtering.Rules, c.Filtering.DefaultAction); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Sampling.Probability < 0 || c.Sampling.Probability > 1 {
+		errs = append(errs, fmt.Errorf("sampling.probability must be between 0 and 1, got %v", c.Sampling.Probability))
+	}
+	if c.Sampling.EndpointRatePerSecond < 0 {
+		errs = append(errs, fmt.Errorf("sampling.endpointRatePerSecond must not be negative, got %v", c.Sampling.EndpointRatePerSecond))
+	}
+	if c.Sampling.EndpointBurst < 0 {
+		errs = append(errs, fmt.Errorf("sampling.endpointBurst must not be negative, got %d", c.Sampling.EndpointBurst))
+	}
+	if c.Sampling.MaxEndpoints <= 0 {
+		errs = append(errs, fmt.Errorf("sampling.maxEndpoints must be greater than 0, got %d", c.Sampling.MaxEndpoints))
+	}
+	for i, class := range c.Classification.Classes {
+		if !slices.Contains(dataClasses, class) {
+			errs = append(errs, fmt.Errorf("classification.classes[%d] must be one of %v, got %q", i, dataClasses, class))
+		}
+	}
+	for i, header := range c.Redaction.Headers {
+		if strings.TrimSpace(header) == "" {
+			errs = append(errs, fmt.Errorf("redaction.headers[%d] must not be empty", i))
+		}
+	}
+	for i, field := range c.Redaction.JsonFields {
+		if strings.TrimSpace(field) == "" {
+			errs = append(errs, fmt.Errorf("redaction.jsonFields[%d] must not be empty", i))
+		}
+	}
+	if c.Kubernetes.ServiceIpRefreshInterval <= 0 {
+		errs = append(errs, fmt.Errorf("kubernetes.serviceIpRefreshInterval must be greater than 0, got %s", c.Kubernetes.ServiceIpRefreshInterval))
+	}
+	return errors.Join(errs...)
+}
+
+func (c openApiConformanceConfig) enabled() bool {
+	return c.SpecDirectory != "" || len(c.Specs) > 0
+}
+
+// String renders the config as YAML with secrets masked, so it can be logged at startup
+func (c *sensorConfig) String() string {
+	masked := *c
+	if masked.Sinks.Firetail.ApiToken != "" {
+		masked.Sinks.Firetail.ApiToken = "********"
+	}
+	// OTLP headers usually carry credentials, so only their names are logged
+	if len(masked.Sinks.Otlp.Headers) > 0 {
+		masked.Sinks.Otlp.Headers = map[string]string{}
+		for key := range c.Sinks.Otlp.Headers {
+			masked.Sinks.Otlp.Headers[key] = "********"
+		}
+	}
+	if masked.Sinks.Kafka.Sasl.Password != "" {
+		masked.Sinks.Kafka.Sasl.Password = "********"
+	}
+	configBytes, err := yaml.Marshal(&masked)
+	if err != nil {
+		return fmt.Sprintf("failed to render config: %v", err)
+	}
+	return string(configBytes)
+}
+
+// parseOtlpHeaders parses headers in the format of OTEL_EXPORTER_OTLP_HEADERS, a comma separated list of
+// URL encoded key=value pairs
+func parseOtlpHeaders(value string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, headerValue, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("must be a comma separated list of key=value pairs, got %q", pair)
+		}
+		decodedKey, err := url.QueryUnescape(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("has an invalid key %q: %v", key, err)
+		}
+		decodedValue, err := url.QueryUnescape(strings.TrimSpace(headerValue))
+		if err != nil {
+			return nil, fmt.Errorf("has an invalid value for %q: %v", decodedKey, err)
+		}
+		headers[decodedKey] = decodedValue
+	}
+	return headers, nil
+}
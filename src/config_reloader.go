@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/sha256"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"time"
+)
+
+// configReloader polls the config file and applies any changes to the BPF expression, filters, classification and
+// redaction rules while the sensor is running. Changes to any other settings are only picked up on restart.
+type configReloader struct {
+	path             string
+	interval         time.Duration
+	current          *sensorConfig
+	currentHash      [sha256.Size]byte
+	loadConfig       func() (*sensorConfig, error)
+	lookupEnv        func(string) (string, bool)
+	setBpfExpression func(string) error
+	rules            *pipelineRulesHolder
+	// currentFile is the config file as it was last loaded, without environment variables applied
+	currentFile *sensorConfig
+}
+
+func newConfigReloader(
+	path string,
+	interval time.Duration,
+	current *sensorConfig,
+	setBpfExpression func(string) error,
+	rules *pipelineRulesHolder,
+) *configReloader {
+	reloader := &configReloader{
+		path:             path,
+		interval:         interval,
+		current:          current,
+		loadConfig:       loadConfig,
+		lookupEnv:        os.LookupEnv,
+		setBpfExpression: setBpfExpression,
+		rules:            rules,
+	}
+	if configBytes, err := os.ReadFile(path); err == nil {
+		reloader.currentHash = sha256.Sum256(configBytes)
+	}
+	reloader.shadowedSettings()
+	return reloader
+}
+
+func (r *configReloader) run() {
+	t := time.NewTicker(r.interval)
+	for {
+		select {
+		case <-t.C:
+			r.checkForChanges()
+		}
+	}
+}
+
+func (r *configReloader) checkForChanges() {
+	// ConfigMap volumes are updated by atomically swapping a symlink, so the contents are compared rather than the
+	// modification time
+	configBytes, err := os.ReadFile(r.path)
+	if err != nil {
+		slog.Error("Failed to read config file for reload:", "Path", r.path, "Err", err.Error())
+		return
+	}
+	hash := sha256.Sum256(configBytes)
+	if hash == r.currentHash {
+		return
+	}
+	r.currentHash = hash
+	slog.Info("Config file changed, reloading...", "Path", r.path)
+	for _, setting := range r.shadowedSettings() {
+		slog.Warn(
+			"Config file changed a setting which is overridden by an environment variable, so the change has no effect:",
+			"Setting", setting.setting,
+			"EnvVar", setting.name,
+		)
+	}
+	if err := r.reload(); err != nil {
+		slog.Error("Failed to reload config, keeping the previous config:", "Err", err.Error())
+	}
+}
+
+func (r *configReloader) reload() error {
+	newConfig, err := r.loadConfig()
+	if err != nil {
+		return err
+	}
+
+	newRules, err := newPipelineRules(newConfig)
+	if err != nil {
+		return err
+	}
+	// The sampler's per-endpoint rate limiters are kept if sampling hasn't changed, so reloading other settings doesn't
+	// refill every endpoint's burst
+	if newConfig.Sampling == r.current.Sampling {
+		newRules.sampler = r.rules.load().sampler
+	}
+
+	if newConfig.Capture.BpfExpression != r.current.Capture.BpfExpression {
+		if err := r.setBpfExpression(newConfig.Capture.BpfExpression); err != nil {
+			return err
+		}
+		slog.Info("Applied new BPF expression", "BpfExpression", newConfig.Capture.BpfExpression)
+	}
+
+	r.rules.store(newRules)
+
+	for section, changed := range map[string]bool{
+		"sensor":                           !reflect.DeepEqual(newConfig.Sensor, r.current.Sensor),
+		"capture.maxContentLength":         newConfig.Capture.MaxContentLength != r.current.Capture.MaxContentLength,
+		"capture.protocolDetection":        newConfig.Capture.ProtocolDetection != r.current.Capture.ProtocolDetection,
+		"capture.interfaces":               !slices.Equal(newConfig.Capture.Interfaces, r.current.Capture.Interfaces),
+		"capture.interfaceRefreshInterval": newConfig.Capture.InterfaceRefreshInterval != r.current.Capture.InterfaceRefreshInterval,
+		"capture.deduplicationWindow":      newConfig.Capture.DeduplicationWindow != r.current.Capture.DeduplicationWindow,
+		"capture.backend":                  newConfig.Capture.Backend != r.current.Capture.Backend,
+		"capture.snaplen":                  newConfig.Capture.Snaplen != r.current.Capture.Snaplen,
+		"capture.pcap":                     newConfig.Capture.Pcap != r.current.Capture.Pcap,
+		"capture.afPacket":                 newConfig.Capture.AfPacket != r.current.Capture.AfPacket,
+		"capture.decapsulation":            !reflect.DeepEqual(newConfig.Capture.Decapsulation, r.current.Capture.Decapsulation),
+		"pipeline":                         newConfig.Pipeline != r.current.Pipeline,
+		"sinks":                            !reflect.DeepEqual(newConfig.Sinks, r.current.Sinks),
+		"openapi":                          !reflect.DeepEqual(newConfig.OpenApi, r.current.OpenApi),
+		"findings":                         newConfig.Findings != r.current.Findings,
+		"inventory":                        newConfig.Inventory != r.current.Inventory,
+		"auth":                             !reflect.DeepEqual(newConfig.Auth, r.current.Auth),
+		"tls":                              !reflect.DeepEqual(newConfig.Tls, r.current.Tls),
+		"connections":                      newConfig.Connections != r.current.Connections,
+		"kubernetes":                       !reflect.DeepEqual(newConfig.Kubernetes, r.current.Kubernetes),
+	} {
+		if changed {
+			slog.Warn("Config file changed settings which require a restart to take effect:", "Section", section)
+		}
+	}
+
+	// Settings which require a restart are kept as they were so they're still reported as changed on later reloads
+	newConfig.Sensor = r.current.Sensor
+	newConfig.Capture.MaxContentLength = r.current.Capture.MaxContentLength
+	newConfig.Capture.ProtocolDetection = r.current.Capture.ProtocolDetection
+	newConfig.Capture.Interfaces = r.current.Capture.Interfaces
+	newConfig.Capture.InterfaceRefreshInterval = r.current.Capture.InterfaceRefreshInterval
+	newConfig.Capture.DeduplicationWindow = r.current.Capture.DeduplicationWindow
+	newConfig.Capture.Backend = r.current.Capture.Backend
+	newConfig.Capture.Snaplen = r.current.Capture.Snaplen
+	newConfig.Capture.Pcap = r.current.Capture.Pcap
+	newConfig.Capture.AfPacket = r.current.Capture.AfPacket
+	newConfig.Capture.Decapsulation = r.current.Capture.Decapsulation
+	newConfig.Pipeline = r.current.Pipeline
+	newConfig.Sinks = r.current.Sinks
+	newConfig.OpenApi = r.current.OpenApi
+	newConfig.Findings = r.current.Findings
+	newConfig.Inventory = r.current.Inventory
+	newConfig.Auth = r.current.Auth
+	newConfig.Tls = r.current.Tls
+	newConfig.Connections = r.current.Connections
+	newConfig.Kubernetes = r.current.Kubernetes
+	r.current = newConfig
+
+	slog.Info("Config reloaded. Effective configuration:\n" + r.current.String())
+	return nil
+}
+
+// shadowedSettings loads the config file without environment variables applied, and returns the reloadable settings
+// that have changed in it since it was last loaded but are overridden by an environment variable
+func (r *configReloader) shadowedSettings() []reloadableEnvVar {
+	fileConfig := defaultConfig()
+	if err := fileConfig.loadFile(r.path); err != nil {
+		return nil
+	}
+	previousFile := r.currentFile
+	r.currentFile = fileConfig
+	if previousFile == nil {
+		return nil
+	}
+	var shadowed []reloadableEnvVar
+	for _, envVar := range reloadableEnvVars {
+		if _, ok := r.lookupEnv(envVar.name); ok && envVar.value(fileConfig) != envVar.value(previousFile) {
+			shadowed = append(shadowed, envVar)
+		}
+	}
+	return shadowed
+}
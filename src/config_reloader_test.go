@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigReloaderReload(t *testing.T) {
+	tests := []struct {
+		name                  string
+		newConfig             func() *sensorConfig
+		loadErr               error
+		bpfErr                error
+		expectedError         bool
+		expectedBpfExpression string
+		expectedOnlyLogJson   bool
+		expectedNewSampler    bool
+	}{
+		{
+			name: "BPF expression and filters are applied",
+			newConfig: func() *sensorConfig {
+				config := defaultConfig()
+				config.Capture.BpfExpression = "tcp and port 8080"
+				config.Filtering.OnlyLogJson = true
+				return config
+			},
+			expectedBpfExpression: "tcp and port 8080",
+			expectedOnlyLogJson:   true,
+		},
+		{
+			name: "Filters are applied without touching an unchanged BPF expression",
+			newConfig: func() *sensorConfig {
+				config := defaultConfig()
+				config.Filtering.OnlyLogJson = true
+				return config
+			},
+			expectedBpfExpression: "",
+			expectedOnlyLogJson:   true,
+		},
+		{
+			name: "Rejected BPF expression leaves the previous rules in place",
+			newConfig: func() *sensorConfig {
+				config := defaultConfig()
+				config.Capture.BpfExpression = "tcp and port banana"
+				config.Filtering.OnlyLogJson = true
+				return config
+			},
+			bpfErr:                errors.New("syntax error"),
+			expectedError:         true,
+			expectedBpfExpression: "tcp and port banana",
+			expectedOnlyLogJson:   false,
+		},
+		{
+			name: "Changed sampling replaces the sampler",
+			newConfig: func() *sensorConfig {
+				config := defaultConfig()
+				config.Sampling.EndpointRatePerSecond = 10
+				return config
+			},
+			expectedNewSampler: true,
+		},
+		{
+			name:                "Invalid config leaves the previous rules in place",
+			newConfig:           func() *sensorConfig { return nil },
+			loadErr:             errors.New("capture.maxContentLength must be greater than 0"),
+			expectedError:       true,
+			expectedOnlyLogJson: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			initialConfig := defaultConfig()
+			initialRules, err := newPipelineRules(initialConfig)
+			if err != nil {
+				t.Fatalf("newPipelineRules() error = %v", err)
+			}
+			rules := newPipelineRulesHolder(initialRules)
+			appliedBpfExpression := ""
+			reloader := &configReloader{
+				current: initialConfig,
+				loadConfig: func() (*sensorConfig, error) {
+					return tt.newConfig(), tt.loadErr
+				},
+				setBpfExpression: func(bpfExpression string) error {
+					appliedBpfExpression = bpfExpression
+					return tt.bpfErr
+				},
+				rules: rules,
+			}
+
+			err = reloader.reload()
+			if (err != nil) != tt.expectedError {
+				t.Fatalf("reload() error = %v, expectedError %v", err, tt.expectedError)
+			}
+			if appliedBpfExpression != tt.expectedBpfExpression {
+				t.Errorf("Applied BPF expression = %q, want %q", appliedBpfExpression, tt.expectedBpfExpression)
+			}
+			if rules.load().onlyLogJson != tt.expectedOnlyLogJson {
+				t.Errorf("onlyLogJson = %v, want %v", rules.load().onlyLogJson, tt.expectedOnlyLogJson)
+			}
+			// Unchanged sampling keeps the sampler, along with its per-endpoint rate limiters
+			if (rules.load().sampler != initialRules.sampler) != tt.expectedNewSampler {
+				t.Errorf("Sampler replaced = %v, want %v", rules.load().sampler != initialRules.sampler, tt.expectedNewSampler)
+			}
+		})
+	}
+}
+
+func TestConfigReloaderOnlyReloadsOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("filtering:\n  onlyLogJson: false\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	initialRules, err := newPipelineRules(defaultConfig())
+	if err != nil {
+		t.Fatalf("newPipelineRules() error = %v", err)
+	}
+	loads := 0
+	reloader := newConfigReloader(path, 0, defaultConfig(), func(string) error { return nil }, newPipelineRulesHolder(initialRules))
+	reloader.loadConfig = func() (*sensorConfig, error) {
+		loads++
+		return defaultConfig(), nil
+	}
+
+	reloader.checkForChanges()
+	if loads != 0 {
+		t.Fatalf("Config reloaded %d time(s) without the file changing", loads)
+	}
+
+	if err := os.WriteFile(path, []byte("filtering:\n  onlyLogJson: true\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	reloader.checkForChanges()
+	reloader.checkForChanges()
+	if loads != 1 {
+		t.Fatalf("Config reloaded %d time(s) after one change, want 1", loads)
+	}
+}
+
+func TestConfigReloaderShadowedSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("capture:\n  bpfExpression: tcp port 80\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	initialRules, err := newPipelineRules(defaultConfig())
+	if err != nil {
+		t.Fatalf("newPipelineRules() error = %v", err)
+	}
+	reloader := newConfigReloader(path, 0, defaultConfig(), func(string) error { return nil }, newPipelineRulesHolder(initialRules))
+	reloader.lookupEnv = func(name string) (string, bool) {
+		return "tcp", name == "BPF_EXPRESSION"
+	}
+
+	// The only setting that changed is overridden by BPF_EXPRESSION
+	if err := os.WriteFile(path, []byte("capture:\n  bpfExpression: tcp port 8080\nfiltering:\n  onlyLogJson: true\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	shadowed := reloader.shadowedSettings()
+	if len(shadowed) != 1 || shadowed[0].setting != "capture.bpfExpression" {
+		t.Errorf("shadowedSettings() = %+v, want only capture.bpfExpression", shadowed)
+	}
+	if shadowed := reloader.shadowedSettings(); len(shadowed) != 0 {
+		t.Errorf("shadowedSettings() = %+v without the file changing, want none", shadowed)
+	}
+}
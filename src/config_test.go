@@ -0,0 +1,431 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name          string
+		fileName      string
+		contents      string
+		expectedError string
+		check         func(t *testing.T, config *sensorConfig)
+	}{
+		{
+			name:     "YAML file overrides defaults",
+			fileName: "config.yaml",
+			contents: `
+capture:
+  bpfExpression: tcp and port 8080
+filtering:
+  onlyLogJson: true
+kubernetes:
+  serviceIpRefreshInterval: 5s
+`,
+			check: func(t *testing.T, config *sensorConfig) {
+				if config.Capture.BpfExpression != "tcp and port 8080" {
+					t.Errorf("BpfExpression = %q, want %q", config.Capture.BpfExpression, "tcp and port 8080")
+				}
+				if config.Capture.MaxContentLength != 1048576 {
+					t.Errorf("MaxContentLength = %d, want default of 1048576", config.Capture.MaxContentLength)
+				}
+				if !config.Filtering.OnlyLogJson {
+					t.Errorf("OnlyLogJson = false, want true")
+				}
+				if config.Kubernetes.ServiceIpRefreshInterval != 5*time.Second {
+					t.Errorf("ServiceIpRefreshInterval = %s, want 5s", config.Kubernetes.ServiceIpRefreshInterval)
+				}
+			},
+		},
+		{
+			name:     "JSON file overrides defaults",
+			fileName: "config.json",
+			contents: `{"redaction": {"headers": ["Authorization"]}, "capture": {"maxContentLength": 1024}}`,
+			check: func(t *testing.T, config *sensorConfig) {
+				if len(config.Redaction.Headers) != 1 || config.Redaction.Headers[0] != "Authorization" {
+					t.Errorf("Redaction.Headers = %v, want [Authorization]", config.Redaction.Headers)
+				}
+				if config.Capture.MaxContentLength != 1024 {
+					t.Errorf("MaxContentLength = %d, want 1024", config.Capture.MaxContentLength)
+				}
+			},
+		},
+		{
+			name:          "Unknown fields are rejected",
+			fileName:      "config.yaml",
+			contents:      "capture:\n  bpfExpresion: tcp\n",
+			expectedError: "field bpfExpresion not found",
+		},
+		{
+			name:          "Wrongly typed fields are rejected",
+			fileName:      "config.yaml",
+			contents:      "capture:\n  maxContentLength: lots\n",
+			expectedError: "cannot unmarshal",
+		},
+		{
+			name:     "Empty file leaves defaults",
+			fileName: "config.yaml",
+			contents: "",
+			check: func(t *testing.T, config *sensorConfig) {
+				if config.Capture.BpfExpression != defaultConfig().Capture.BpfExpression {
+					t.Errorf("BpfExpression = %q, want default", config.Capture.BpfExpression)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.fileName)
+			if err := os.WriteFile(path, []byte(tt.contents), 0o600); err != nil {
+				t.Fatalf("Failed to write config file: %v", err)
+			}
+			config := defaultConfig()
+			err := config.loadFile(path)
+			if tt.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+					t.Fatalf("loadFile() error = %v, want error containing %q", err, tt.expectedError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadFile() error = %v", err)
+			}
+			tt.check(t, config)
+		})
+	}
+}
+
+func TestConfigApplyEnv(t *testing.T) {
+	tests := []struct {
+		name          string
+		env           map[string]string
+		expectedError string
+		check         func(t *testing.T, config *sensorConfig)
+	}{
+		{
+			name: "Environment variables override config",
+			env: map[string]string{
+				"BPF_EXPRESSION":               "tcp",
+				"MAX_CONTENT_LENGTH":           "2048",
+				"DISABLE_SERVICE_IP_FILTERING": "true",
+				"FIRETAIL_API_TOKEN":           "PS-02-XXXXXXXX",
+			},
+			check: func(t *testing.T, config *sensorConfig) {
+				if config.Capture.BpfExpression != "tcp" {
+					t.Errorf("BpfExpression = %q, want %q", config.Capture.BpfExpression, "tcp")
+				}
+				if config.Capture.MaxContentLength != 2048 {
+					t.Errorf("MaxContentLength = %d, want 2048", config.Capture.MaxContentLength)
+				}
+				if config.Kubernetes.ServiceIpFiltering {
+					t.Errorf("ServiceIpFiltering = true, want false")
+				}
+				if config.Sinks.Firetail.ApiToken != "PS-02-XXXXXXXX" {
+					t.Errorf("ApiToken = %q, want %q", config.Sinks.Firetail.ApiToken, "PS-02-XXXXXXXX")
+				}
+			},
+		},
+		{
+			name: "OTLP environment variables",
+			env: map[string]string{
+				"OTEL_EXPORTER_OTLP_ENDPOINT": "http://otel-collector:4317",
+				"OTEL_EXPORTER_OTLP_PROTOCOL": "grpc",
+				"OTEL_EXPORTER_OTLP_HEADERS":  "api-key=abc%3D123, x-tenant=shop",
+			},
+			check: func(t *testing.T, config *sensorConfig) {
+				if config.Sinks.Otlp.Endpoint != "http://otel-collector:4317" || config.Sinks.Otlp.Protocol != "grpc" {
+					t.Errorf("Otlp = %+v", config.Sinks.Otlp)
+				}
+				if config.Sinks.Otlp.Headers["api-key"] != "abc=123" || config.Sinks.Otlp.Headers["x-tenant"] != "shop" {
+					t.Errorf("Otlp.Headers = %v", config.Sinks.Otlp.Headers)
+				}
+			},
+		},
+		{
+			name: "Capture interfaces",
+			env:  map[string]string{"CAPTURE_INTERFACES": "eth0, cali*,"},
+			check: func(t *testing.T, config *sensorConfig) {
+				if !reflect.DeepEqual(config.Capture.Interfaces, []string{"eth0", "cali*"}) {
+					t.Errorf("Interfaces = %q, want %q", config.Capture.Interfaces, []string{"eth0", "cali*"})
+				}
+			},
+		},
+		{
+			name:          "Malformed OTLP headers are an error",
+			env:           map[string]string{"OTEL_EXPORTER_OTLP_HEADERS": "api-key"},
+			expectedError: "OTEL_EXPORTER_OTLP_HEADERS must be a comma separated list",
+		},
+		{
+			name:          "Unparsable MAX_CONTENT_LENGTH is an error",
+			env:           map[string]string{"MAX_CONTENT_LENGTH": "1MiB"},
+			expectedError: "MAX_CONTENT_LENGTH must be an integer",
+		},
+		{
+			name:          "Unparsable booleans are an error",
+			env:           map[string]string{"ENABLE_ONLY_LOG_JSON": "yes please"},
+			expectedError: "ENABLE_ONLY_LOG_JSON must be a boolean",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := defaultConfig()
+			err := config.applyEnv(func(name string) (string, bool) {
+				value, ok := tt.env[name]
+				return value, ok
+			})
+			if tt.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+					t.Fatalf("applyEnv() error = %v, want error containing %q", err, tt.expectedError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyEnv() error = %v", err)
+			}
+			tt.check(t, config)
+		})
+	}
+}
+
+func TestLoadConfigDefaultBpfExpression(t *testing.T) {
+	tests := []struct {
+		name                  string
+		configFile            string
+		env                   map[string]string
+		expectedBpfExpression string
+	}{
+		{
+			name:                  "Default is widened for decapsulation",
+			expectedBpfExpression: "(tcp and (port 80 or port 443)) or ip proto 4 or (udp and (port 4789 or port 8472 or port 6081))",
+		},
+		{
+			name:                  "Default is widened for protocol detection",
+			env:                   map[string]string{"ENABLE_PROTOCOL_DETECTION": "true"},
+			expectedBpfExpression: "(tcp) or ip proto 4 or (udp and (port 4789 or port 8472 or port 6081))",
+		},
+		{
+			name:                  "Default is left alone with decapsulation disabled",
+			configFile:            "capture:\n  decapsulation:\n    enabled: false\n",
+			expectedBpfExpression: defaultBpfExpression,
+		},
+		{
+			name:                  "Only IP-in-IP is added without overlay ports",
+			configFile:            "capture:\n  decapsulation:\n    vxlanPorts: []\n    genevePorts: []\n",
+			env:                   map[string]string{"ENABLE_PROTOCOL_DETECTION": "true"},
+			expectedBpfExpression: "(tcp) or ip proto 4",
+		},
+		{
+			name:                  "Explicit expression is kept",
+			env:                   map[string]string{"ENABLE_PROTOCOL_DETECTION": "true", "BPF_EXPRESSION": "tcp and not port 22"},
+			expectedBpfExpression: "tcp and not port 22",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(configFileEnvVar, "")
+			if tt.configFile != "" {
+				path := filepath.Join(t.TempDir(), "config.yaml")
+				if err := os.WriteFile(path, []byte(tt.configFile), 0o600); err != nil {
+					t.Fatalf("Failed to write config file: %v", err)
+				}
+				t.Setenv(configFileEnvVar, path)
+			}
+			t.Setenv("FIRETAIL_API_TOKEN", "PS-02-XXXXXXXX")
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			config, err := loadConfig()
+			if err != nil {
+				t.Fatalf("loadConfig() error = %v", err)
+			}
+			if config.Capture.BpfExpression != tt.expectedBpfExpression {
+				t.Errorf("BpfExpression = %q, want %q", config.Capture.BpfExpression, tt.expectedBpfExpression)
+			}
+		})
+	}
+}
+
+func TestLoadConfigDevModeMaxLogAge(t *testing.T) {
+	tests := []struct {
+		name              string
+		configFile        string
+		expectedMaxLogAge time.Duration
+	}{
+		{
+			name:              "Default is shortened in dev mode",
+			configFile:        "sensor:\n  devMode: true\n",
+			expectedMaxLogAge: devModeFiretailMaxLogAge,
+		},
+		{
+			name:              "Explicit max log age is kept in dev mode",
+			configFile:        "sensor:\n  devMode: true\nsinks:\n  firetail:\n    maxLogAge: 10s\n",
+			expectedMaxLogAge: 10 * time.Second,
+		},
+		{
+			name:              "Default is kept outside dev mode",
+			configFile:        "sensor:\n  devMode: false\n",
+			expectedMaxLogAge: defaultFiretailMaxLogAge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.configFile), 0o600); err != nil {
+				t.Fatalf("Failed to write config file: %v", err)
+			}
+			t.Setenv(configFileEnvVar, path)
+			t.Setenv("FIRETAIL_API_TOKEN", "PS-02-XXXXXXXX")
+			config, err := loadConfig()
+			if err != nil {
+				t.Fatalf("loadConfig() error = %v", err)
+			}
+			if config.Sinks.Firetail.MaxLogAge != tt.expectedMaxLogAge {
+				t.Errorf("MaxLogAge = %s, want %s", config.Sinks.Firetail.MaxLogAge, tt.expectedMaxLogAge)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name          string
+		modify        func(config *sensorConfig)
+		expectedError string
+	}{
+		{
+			name:   "Valid config",
+			modify: func(config *sensorConfig) {},
+		},
+		{
+			name:          "Missing API token",
+			modify:        func(config *sensorConfig) { config.Sinks.Firetail.ApiToken = "" },
+			expectedError: "sinks.firetail.apiToken must be set",
+		},
+		{
+			name:          "Relative API URL",
+			modify:        func(config *sensorConfig) { config.Sinks.Firetail.ApiUrl = "/logs/bulk" },
+			expectedError: "sinks.firetail.apiUrl must be an absolute http(s) URL",
+		},
+		{
+			name:          "Zero max content length",
+			modify:        func(config *sensorConfig) { config.Capture.MaxContentLength = 0 },
+			expectedError: "capture.maxContentLength must be greater than 0",
+		},
+		{
+			name:          "Empty BPF expression",
+			modify:        func(config *sensorConfig) { config.Capture.BpfExpression = " " },
+			expectedError: "capture.bpfExpression must not be empty",
+		},
+		{
+			name:          "Unparsable BPF expression",
+			modify:        func(config *sensorConfig) { config.Capture.BpfExpression = "tcp and (port 80" },
+			expectedError: `capture.bpfExpression "tcp and (port 80" is invalid`,
+		},
+		{
+			name:          "Health address without a port",
+			modify:        func(config *sensorConfig) { config.Sensor.HealthAddress = "localhost" },
+			expectedError: `sensor.healthAddress must be a host:port address, got "localhost"`,
+		},
+		{
+			name: "Unknown Kafka SASL mechanism",
+			modify: func(config *sensorConfig) {
+				config.Sinks.Kafka.Brokers = []string{"kafka:9092"}
+				config.Sinks.Kafka.Sasl = kafkaSaslConfig{Mechanism: "GSSAPI", Username: "sensor"}
+			},
+			expectedError: `sinks.kafka.sasl.mechanism must be one of [PLAIN SCRAM-SHA-256 SCRAM-SHA-512], got "GSSAPI"`,
+		},
+		{
+			name: "Kafka batch age over a minute",
+			modify: func(config *sensorConfig) {
+				config.Sinks.Kafka.Brokers = []string{"kafka:9092"}
+				config.Sinks.Kafka.MaxBatchAge = time.Hour
+			},
+			expectedError: "sinks.kafka.maxBatchAge must be greater than 0 and at most 1m0s, got 1h0m0s",
+		},
+		{
+			name:          "Malformed interface glob",
+			modify:        func(config *sensorConfig) { config.Capture.Interfaces = []string{"eth0", "cali["} },
+			expectedError: "capture.interfaces[1] must be an interface name or glob",
+		},
+		{
+			name:          "Negative deduplication window",
+			modify:        func(config *sensorConfig) { config.Capture.DeduplicationWindow = -time.Millisecond },
+			expectedError: "capture.deduplicationWindow must not be negative",
+		},
+		{
+			name:          "Snaplen over libpcap's maximum",
+			modify:        func(config *sensorConfig) { config.Capture.Snaplen = 1 << 20 },
+			expectedError: "capture.snaplen must be between 1 and 262144",
+		},
+		{
+			name:          "Invalid VXLAN port",
+			modify:        func(config *sensorConfig) { config.Capture.Decapsulation.VxlanPorts = []int{4789, 0} },
+			expectedError: "capture.decapsulation.vxlanPorts[1] must be a port between 1 and 65535",
+		},
+		{
+			name:          "Unknown capture backend",
+			modify:        func(config *sensorConfig) { config.Capture.Backend = "pfring" },
+			expectedError: `capture.backend must be "pcap" or "afpacket"`,
+		},
+		{
+			name: "AF_PACKET ring size not a multiple of the block size",
+			modify: func(config *sensorConfig) {
+				config.Capture.Backend = captureBackendAfPacket
+				config.Capture.AfPacket.RingSize = 1000000
+			},
+			expectedError: "capture.afPacket.ringSize must be a positive multiple of 524288",
+		},
+		{
+			name: "AF_PACKET ring memory limit too small for the fanout workers",
+			modify: func(config *sensorConfig) {
+				config.Capture.Backend = captureBackendAfPacket
+				config.Capture.AfPacket.FanoutWorkers = 4
+				config.Capture.AfPacket.MaxTotalRingSize = 2 * afPacketBlockSize
+			},
+			expectedError: "capture.afPacket.maxTotalRingSize must be a multiple of 524288 with room for a block per fanout worker",
+		},
+		{
+			name:          "Empty redacted header",
+			modify:        func(config *sensorConfig) { config.Redaction.Headers = []string{"Authorization", ""} },
+			expectedError: "redaction.headers[1] must not be empty",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := defaultConfig()
+			config.Sinks.Firetail.ApiToken = "PS-02-XXXXXXXX"
+			tt.modify(config)
+			err := config.validate()
+			if tt.expectedError == "" {
+				if err != nil {
+					t.Fatalf("validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+				t.Fatalf("validate() error = %v, want error containing %q", err, tt.expectedError)
+			}
+		})
+	}
+}
+
+func TestConfigStringMasksToken(t *testing.T) {
+	config := defaultConfig()
+	config.Sinks.Firetail.ApiToken = "PS-02-XXXXXXXX"
+	rendered := config.String()
+	if strings.Contains(rendered, "PS-02-XXXXXXXX") {
+		t.Errorf("String() leaked the API token: %s", rendered)
+	}
+	if config.Sinks.Firetail.ApiToken != "PS-02-XXXXXXXX" {
+		t.Errorf("String() modified the original config")
+	}
+}
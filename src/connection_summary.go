@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	dropReasonConnectionsQueueFull = "connections.queueSize"
+
+	connectionCloseFin     = "fin"
+	connectionCloseRst     = "rst"
+	connectionCloseTimeout = "timeout"
+
+	connectionEventSchemaVersion = 1
+)
+
+// connectionSummary describes a TCP connection the sensor couldn't read an HTTP request and response from, such as
+// one carrying another protocol or malformed HTTP, so traffic to services that isn't logged is still visible
+type connectionSummary struct {
+	src         string
+	dst         string
+	srcPort     string
+	dstPort     string
+	srcWorkload string
+	dstWorkload string
+	clientBytes int64
+	serverBytes int64
+	start       time.Time
+	end         time.Time
+	// closeReason is how the connection ended: with a FIN, an RST, or neither before the sensor stopped waiting for it
+	closeReason string
+	protocol    string
+	parseError  string
+	// lossy is true if packets of the connection were truncated when they were captured
+	lossy bool
+}
+
+// parseErrorSummary is an error's message without anything it quotes from the stream, such as the malformed line in
+// http.ReadRequest's errors, so summaries never include captured bytes
+func parseErrorSummary(err error) string {
+	message := err.Error()
+	if i := strings.IndexByte(message, '"'); i >= 0 {
+		message = message[:i]
+	}
+	if i := strings.Index(message, ": "); i >= 0 {
+		message = message[:i]
+	}
+	return strings.TrimSpace(message)
+}
+
+// connectionMonitor logs and exports the summaries of connections streams couldn't read HTTP from. Like captured
+// requests, connections to IPs that aren't services are ignored if service IP filtering is enabled.
+type connectionMonitor struct {
+	summaries       chan *connectionSummary
+	ipManager       *serviceIpManager
+	workloadManager *serviceIpManager
+	exporters       []func(*connectionSummary)
+}
+
+func (m *connectionMonitor) run() {
+	for summary := range m.summaries {
+		m.observe(summary)
+	}
+}
+
+func (m *connectionMonitor) observe(summary *connectionSummary) {
+	if m.ipManager != nil && !m.ipManager.isServiceIP(summary.dst) {
+		slog.Debug("Ignoring connection to non-service IP:", "Src", summary.src, "Dst", summary.dst, "DstPort", summary.dstPort)
+		return
+	}
+	if m.workloadManager != nil {
+		summary.srcWorkload = m.workloadManager.workloadName(summary.src)
+		summary.dstWorkload = m.workloadManager.workloadName(summary.dst)
+	}
+	slog.Info(
+		"Connection without HTTP:",
+		"Src", summary.src,
+		"Dst", summary.dst,
+		"SrcPort", summary.srcPort,
+		"DstPort", summary.dstPort,
+		"SrcWorkload", summary.srcWorkload,
+		"DstWorkload", summary.dstWorkload,
+		"ClientBytes", summary.clientBytes,
+		"ServerBytes", summary.serverBytes,
+		"Duration", summary.end.Sub(summary.start),
+		"CloseReason", summary.closeReason,
+		"Protocol", summary.protocol,
+		"ParseError", summary.parseError,
+		"Lossy", summary.lossy,
+	)
+	for _, export := range m.exporters {
+		export(summary)
+	}
+}
+
+// connectionEvent is a connection summary in the versioned schema exported to streaming sinks, described by
+// schema/connection_event.v1.schema.json. Like apiEvent, it's a contract with downstream consumers.
+type connectionEvent struct {
+	SchemaVersion int32                     `json:"schemaVersion"`
+	EventId       string                    `json:"eventId"`
+	Sensor        apiEventSensor            `json:"sensor"`
+	Network       apiEventNetwork           `json:"network"`
+	Kubernetes    apiEventKubernetes        `json:"kubernetes"`
+	Connection    connectionEventConnection `json:"connection"`
+}
+
+type connectionEventConnection struct {
+	StartTime   time.Time `json:"startTime"`
+	EndTime     time.Time `json:"endTime"`
+	DurationMs  float64   `json:"durationMs"`
+	ClientBytes int64     `json:"clientBytes"`
+	ServerBytes int64     `json:"serverBytes"`
+	CloseReason string    `json:"closeReason"`
+	Protocol    string    `json:"protocol"`
+	ParseError  string    `json:"parseError,omitempty"`
+	Lossy       bool      `json:"lossy,omitempty"`
+}
+
+func newConnectionEvent(summary *connectionSummary, kubernetesConfig kubernetesConfig) *connectionEvent {
+	return &connectionEvent{
+		SchemaVersion: connectionEventSchemaVersion,
+		EventId:       uuid.NewString(),
+		Sensor: apiEventSensor{
+			Name:     apiEventSensorName,
+			Version:  sensorVersion,
+			NodeName: kubernetesConfig.NodeName,
+			PodName:  kubernetesConfig.PodName,
+		},
+		Network: apiEventNetwork{
+			Transport:   apiEventTransportTcp,
+			Source:      newApiEventEndpoint(summary.src, summary.srcPort),
+			Destination: newApiEventEndpoint(summary.dst, summary.dstPort),
+		},
+		Kubernetes: apiEventKubernetes{
+			Source:      newApiEventWorkload(summary.srcWorkload),
+			Destination: newApiEventWorkload(summary.dstWorkload),
+		},
+		Connection: connectionEventConnection{
+			StartTime:   summary.start.UTC(),
+			EndTime:     summary.end.UTC(),
+			DurationMs:  float64(summary.end.Sub(summary.start)) / float64(time.Millisecond),
+			ClientBytes: summary.clientBytes,
+			ServerBytes: summary.serverBytes,
+			CloseReason: summary.closeReason,
+			Protocol:    summary.protocol,
+			ParseError:  summary.parseError,
+			Lossy:       summary.lossy,
+		},
+	}
+}
+
+func (e *connectionEvent) marshalJson() ([]byte, error) {
+	return json.Marshal(e)
+}
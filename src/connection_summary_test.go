@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+const connectionEventJsonSchemaPath = "../schema/connection_event.v1.schema.json"
+
+// assembleTestPackets reassembles packets the same way as live capture, and waits for the factory's streams to finish
+func assembleTestPackets(factory *bidirectionalStreamFactory, packets []gopacket.Packet) {
+	assembler := tcpassembly.NewAssembler(tcpassembly.NewStreamPool(factory))
+	for _, packet := range packets {
+		tcp := packet.TransportLayer().(*layers.TCP)
+		if packet.Metadata().CaptureLength < packet.Metadata().Length {
+			factory.observeTruncated(packet.NetworkLayer().NetworkFlow(), tcp.TransportFlow())
+		}
+		if tcp.RST {
+			factory.observeReset(packet.NetworkLayer().NetworkFlow(), tcp.TransportFlow())
+		}
+		assembler.AssembleWithTimestamp(packet.NetworkLayer().NetworkFlow(), tcp, packet.Metadata().Timestamp)
+	}
+	assembler.FlushAll()
+	factory.closeUnmatched()
+	factory.streams.Wait()
+}
+
+func TestConnectionSummaries(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	fin := func(tcp *layers.TCP) { tcp.FIN = true }
+	rst := func(tcp *layers.TCP) { tcp.RST = true }
+	tests := []struct {
+		name          string
+		clientPayload string
+		serverPayload string
+		closeFlags    func(*layers.TCP)
+		want          *connectionSummary
+	}{
+		{
+			name:          "SSH closed with a FIN",
+			clientPayload: "SSH-2.0-OpenSSH_9.6\r\n",
+			serverPayload: "SSH-2.0-OpenSSH_9.6 Ubuntu\r\n",
+			closeFlags:    fin,
+			want: &connectionSummary{
+				clientBytes: 21, serverBytes: 28, start: start.Add(2 * time.Millisecond), end: start.Add(20 * time.Millisecond),
+				closeReason: connectionCloseFin, protocol: protocolSsh, parseError: "request: malformed HTTP request",
+			},
+		},
+		{
+			name:          "PostgreSQL reset",
+			clientPayload: "\x00\x00\x00\x08\x04\xd2\x16\x2f",
+			serverPayload: "N",
+			closeFlags:    rst,
+			want: &connectionSummary{
+				clientBytes: 8, serverBytes: 1, start: start.Add(2 * time.Millisecond), end: start.Add(20 * time.Millisecond),
+				closeReason: connectionCloseRst, protocol: protocolPostgresql, parseError: "request: malformed HTTP request",
+			},
+		},
+		{
+			name:          "Malformed HTTP response left open",
+			clientPayload: "GET / HTTP/1.1\r\nHost: users\r\n\r\n",
+			serverPayload: "HTTP/1.1 abc\r\n\r\n",
+			want: &connectionSummary{
+				clientBytes: 31, serverBytes: 16, start: start.Add(2 * time.Millisecond), end: start.Add(12 * time.Millisecond),
+				closeReason: connectionCloseTimeout, protocol: protocolHttp, parseError: "response: malformed HTTP status code",
+			},
+		},
+		{
+			name:          "HTTP",
+			clientPayload: "GET / HTTP/1.1\r\nHost: users\r\n\r\n",
+			serverPayload: "HTTP/1.1 204 No Content\r\n\r\n",
+			closeFlags:    fin,
+		},
+		{
+			name:       "No data",
+			closeFlags: rst,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requestAndResponseChannel := make(chan httpRequestAndResponse, 1)
+			summaries := make(chan *connectionSummary, 1)
+			var streams sync.WaitGroup
+			factory := &bidirectionalStreamFactory{
+				conns:                     &sync.Map{},
+				requestAndResponseChannel: &requestAndResponseChannel,
+				maxBodySize:               1024,
+				drops:                     newDropCounters(),
+				connectionSummaries:       &summaries,
+				streams:                   &streams,
+			}
+			assembleTestPackets(factory, newTestConnectionPackets(t, 8080, []byte(test.clientPayload), []byte(test.serverPayload), test.closeFlags))
+			close(summaries)
+
+			got := <-summaries
+			if test.want == nil {
+				if got != nil {
+					t.Errorf("Summary = %+v, want none", got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatalf("Summary = nil, want %+v", test.want)
+			}
+			test.want.src, test.want.dst, test.want.srcPort, test.want.dstPort = "10.0.0.1", "10.0.0.2", "51234", "8080"
+			got.start, got.end = got.start.UTC(), got.end.UTC()
+			if *got != *test.want {
+				t.Errorf("Summary = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTruncatedPacketsMarkStreamsLossy(t *testing.T) {
+	// The packets are the client's SYN, the server's SYN-ACK, the request, and then the response
+	tests := []struct {
+		name      string
+		truncated int
+		wantLossy bool
+	}{
+		{"Nothing truncated", -1, false},
+		{"SYN, before the stream exists", 0, true},
+		{"Request", 2, true},
+		{"Response", 3, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requestAndResponseChannel := make(chan httpRequestAndResponse, 1)
+			factory := &bidirectionalStreamFactory{
+				conns:                     &sync.Map{},
+				requestAndResponseChannel: &requestAndResponseChannel,
+				maxBodySize:               1024,
+				drops:                     newDropCounters(),
+				streams:                   &sync.WaitGroup{},
+			}
+			packets := newTestConnectionPackets(t, 8080, []byte("GET / HTTP/1.1\r\nHost: users\r\n\r\n"), []byte("HTTP/1.1 204 No Content\r\n\r\n"), nil)
+			if test.truncated >= 0 {
+				// Only the start of the packet is captured, but the whole packet is still decoded for the test
+				packets[test.truncated].Metadata().Length += 1500
+			}
+			assembleTestPackets(factory, packets)
+			close(requestAndResponseChannel)
+
+			requestAndResponse, ok := <-requestAndResponseChannel
+			if !ok {
+				t.Fatalf("No request and response captured")
+			}
+			if requestAndResponse.lossy != test.wantLossy {
+				t.Errorf("lossy = %v, want %v", requestAndResponse.lossy, test.wantLossy)
+			}
+		})
+	}
+}
+
+func TestConnectionMonitorExports(t *testing.T) {
+	var exported []*connectionSummary
+	monitor := &connectionMonitor{exporters: []func(*connectionSummary){func(summary *connectionSummary) {
+		exported = append(exported, summary)
+	}}}
+	monitor.observe(&connectionSummary{src: "10.0.0.1", dst: "10.0.0.2", dstPort: "5432", protocol: protocolPostgresql})
+	if len(exported) != 1 || exported[0].protocol != protocolPostgresql {
+		t.Errorf("Exported %+v, want the PostgreSQL connection", exported)
+	}
+}
+
+func TestConnectionEventMatchesJsonSchema(t *testing.T) {
+	schemaBytes, err := os.ReadFile(connectionEventJsonSchemaPath)
+	if err != nil {
+		t.Fatalf("Failed to read schema: %v", err)
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(schemaBytes, &schema); err != nil {
+		t.Fatalf("Failed to parse schema: %v", err)
+	}
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	eventJson, err := newConnectionEvent(&connectionSummary{
+		src:         "10.0.0.1",
+		dst:         "10.0.0.2",
+		srcPort:     "51234",
+		dstPort:     "8080",
+		dstWorkload: "shop/users",
+		clientBytes: 21,
+		serverBytes: 28,
+		start:       start,
+		end:         start.Add(1500 * time.Millisecond),
+		closeReason: connectionCloseFin,
+		protocol:    protocolSsh,
+		parseError:  "request: malformed HTTP request",
+		lossy:       true,
+	}, kubernetesConfig{NodeName: "node-1"}).marshalJson()
+	if err != nil {
+		t.Fatalf("Failed to encode event: %v", err)
+	}
+	var event map[string]interface{}
+	if err := json.Unmarshal(eventJson, &event); err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	checkJsonSchema(t, schema, schema, event, "$")
+	if connection := event["connection"].(map[string]interface{}); connection["durationMs"] != 1500.0 {
+		t.Errorf("durationMs = %v, want 1500", connection["durationMs"])
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	dataClassEmail      = "email"
+	dataClassPhone      = "phone"
+	dataClassNationalId = "national_id"
+	dataClassCardNumber = "card_number"
+	dataClassJwt        = "jwt"
+	dataClassIban       = "iban"
+
+	// maxClassifiedValues bounds how many values are checked in each body, so a huge JSON array can't stall a worker
+	maxClassifiedValues = 10000
+)
+
+var dataClasses = []string{dataClassEmail, dataClassPhone, dataClassNationalId, dataClassCardNumber, dataClassJwt, dataClassIban}
+
+var (
+	emailPattern      = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)
+	phonePattern      = regexp.MustCompile(`^\+?[0-9][0-9 ().-]{6,20}[0-9]$`)
+	ssnPattern        = regexp.MustCompile(`^([0-9]{3})-([0-9]{2})-([0-9]{4})$`)
+	ninoPattern       = regexp.MustCompile(`^[A-CEGHJ-PR-TW-Z][A-CEGHJ-NPR-TW-Z] ?[0-9]{2} ?[0-9]{2} ?[0-9]{2} ?[A-D]$`)
+	cardNumberPattern = regexp.MustCompile(`^[0-9]{4}([ -]?[0-9]{2,4}){2,4}([ -]?[0-9]{1,4})?$`)
+	jwtPattern        = regexp.MustCompile(`^eyJ[A-Za-z0-9_-]*\.eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*$`)
+	ibanPattern       = regexp.MustCompile(`^[A-Z]{2}[0-9]{2}[A-Z0-9]{11,30}$`)
+)
+
+// phoneKeyHints are substrings of the names of fields, query parameters and headers which hold phone numbers. Bare
+// digit strings are only classified as phone numbers under one of these names, as they'd otherwise match most IDs.
+var phoneKeyHints = []string{"phone", "mobile", "tel", "fax", "msisdn"}
+
+// dataClassifier tags captured requests and responses with the classes of sensitive data found in their JSON bodies,
+// query strings and headers, such as emails and card numbers. Only values are checked; a field merely named "email"
+// isn't enough. Values are checked before redaction, but the values themselves are never kept.
+type dataClassifier struct {
+	classes map[string]struct{}
+}
+
+// newDataClassifier returns a classifier for the configured classes, or nil if classification is disabled
+func newDataClassifier(config classificationConfig) *dataClassifier {
+	if !config.Enabled {
+		return nil
+	}
+	c := &dataClassifier{classes: map[string]struct{}{}}
+	classes := config.Classes
+	if len(classes) == 0 {
+		classes = dataClasses
+	}
+	for _, class := range classes {
+		c.classes[class] = struct{}{}
+	}
+	return c
+}
+
+func (c *dataClassifier) classify(reqAndResp *httpRequestAndResponse) {
+	found := map[string]struct{}{}
+	for key, values := range reqAndResp.request.URL.Query() {
+		for _, value := range values {
+			c.classifyValue(key, value, found)
+		}
+	}
+	c.classifyHeaders(reqAndResp.request.Header, found)
+	c.classifyHeaders(reqAndResp.response.Header, found)
+
+	var truncated bool
+	reqAndResp.request.Body, truncated = c.classifyBody(reqAndResp.request.Body, found)
+	reqAndResp.requestTruncated = reqAndResp.requestTruncated || truncated
+	reqAndResp.response.Body, truncated = c.classifyBody(reqAndResp.response.Body, found)
+	reqAndResp.responseTruncated = reqAndResp.responseTruncated || truncated
+
+	reqAndResp.dataClasses = make([]string, 0, len(found))
+	for class := range found {
+		reqAndResp.dataClasses = append(reqAndResp.dataClasses, class)
+	}
+	sort.Strings(reqAndResp.dataClasses)
+}
+
+func (c *dataClassifier) classifyHeaders(headers http.Header, found map[string]struct{}) {
+	for key, values := range headers {
+		for _, value := range values {
+			if scheme, credentials, ok := strings.Cut(value, " "); ok && strings.EqualFold(scheme, "Bearer") {
+				value = credentials
+			}
+			c.classifyValue(key, value, found)
+		}
+	}
+}
+
+// classifyBody reads a body and checks the values in it if it's JSON, returning a replacement for the body that
+// hasn't been read and whether it was truncated
+func (c *dataClassifier) classifyBody(body io.ReadCloser, found map[string]struct{}) (io.ReadCloser, bool) {
+	bodyBytes, truncated := readCapturedBody(body)
+	if body == nil || body == http.NoBody {
+		return body, false
+	}
+	if value, ok := decodeJsonBody(bodyBytes); ok {
+		remaining := maxClassifiedValues
+		c.classifyJsonValue("", value, found, &remaining)
+	}
+	return io.NopCloser(bytes.NewReader(bodyBytes)), truncated
+}
+
+func (c *dataClassifier) classifyJsonValue(key string, value interface{}, found map[string]struct{}, remaining *int) {
+	if *remaining <= 0 {
+		return
+	}
+	*remaining--
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for fieldKey, fieldValue := range typed {
+			c.classifyJsonValue(fieldKey, fieldValue, found, remaining)
+		}
+	case []interface{}:
+		for _, item := range typed {
+			c.classifyJsonValue(key, item, found, remaining)
+		}
+	case string:
+		c.classifyValue(key, typed, found)
+	case json.Number:
+		c.classifyValue(key, typed.String(), found)
+	}
+}
+
+// classifyValue adds the classes of sensitive data a single value holds to found. The key is the name of the field,
+// query parameter or header the value was in.
+func (c *dataClassifier) classifyValue(key string, value string, found map[string]struct{}) {
+	value = strings.TrimSpace(value)
+	if len(value) < 6 || len(value) > 4096 {
+		return
+	}
+	check := func(class string, matches func(string) bool) {
+		if _, ok := found[class]; ok {
+			return
+		}
+		if _, ok := c.classes[class]; ok && matches(value) {
+			found[class] = struct{}{}
+		}
+	}
+	check(dataClassEmail, emailPattern.MatchString)
+	check(dataClassJwt, jwtPattern.MatchString)
+	check(dataClassCardNumber, isCardNumber)
+	check(dataClassNationalId, isNationalId)
+	check(dataClassIban, isIban)
+	check(dataClassPhone, func(value string) bool { return isPhoneNumber(key, value) })
+}
+
+// isCardNumber checks for 13 to 19 digits, optionally grouped by spaces or dashes, that pass the Luhn check
+func isCardNumber(value string) bool {
+	if !cardNumberPattern.MatchString(value) {
+		return false
+	}
+	digits := stripNonDigits(value)
+	if len(digits) < 13 || len(digits) > 19 || strings.Count(digits, digits[:1]) == len(digits) {
+		return false
+	}
+	sum := 0
+	for i := 0; i < len(digits); i++ {
+		digit := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+	return sum%10 == 0
+}
+
+// isNationalId checks for US social security numbers and UK national insurance numbers
+func isNationalId(value string) bool {
+	if matches := ssnPattern.FindStringSubmatch(value); matches != nil {
+		area, group, serial := matches[1], matches[2], matches[3]
+		return area != "000" && area != "666" && area[0] != '9' && group != "00" && serial != "0000"
+	}
+	return ninoPattern.MatchString(strings.ToUpper(value))
+}
+
+// isIban checks for an IBAN, optionally grouped by spaces, with a valid mod 97 check digit
+func isIban(value string) bool {
+	iban := strings.ToUpper(strings.ReplaceAll(value, " ", ""))
+	if !ibanPattern.MatchString(iban) {
+		return false
+	}
+	var numeric strings.Builder
+	for _, r := range iban[4:] + iban[:4] {
+		if r >= 'A' && r <= 'Z' {
+			numeric.WriteString(big.NewInt(int64(r - 'A' + 10)).String())
+		} else {
+			numeric.WriteRune(r)
+		}
+	}
+	n, ok := new(big.Int).SetString(numeric.String(), 10)
+	return ok && new(big.Int).Mod(n, big.NewInt(97)).Int64() == 1
+}
+
+// isPhoneNumber checks for 8 to 15 digits in international format, or in any format under a key that suggests the
+// value is a phone number
+func isPhoneNumber(key string, value string) bool {
+	if !phonePattern.MatchString(value) {
+		return false
+	}
+	digits := stripNonDigits(value)
+	if len(digits) < 8 || len(digits) > 15 {
+		return false
+	}
+	if strings.HasPrefix(value, "+") {
+		return true
+	}
+	key = strings.ToLower(key)
+	for _, hint := range phoneKeyHints {
+		if strings.Contains(key, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+func stripNonDigits(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, value)
+}
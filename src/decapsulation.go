@@ -0,0 +1,72 @@
+package main
+
+import (
+	"slices"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// maxEncapsulationDepth is how many overlay headers are decoded by hand before a packet is given up on, so crafted
+// packets nesting VXLAN in VXLAN can't make the packet loop spin
+const maxEncapsulationDepth = 4
+
+// overlayDecoder finds the TCP connections inside packets which CNIs have encapsulated to carry them between nodes,
+// such as Flannel's and Calico's VXLAN, Cilium's Geneve and Calico's IP-in-IP, so they're reassembled with the IPs of
+// the pods at either end rather than those of their nodes. VLAN tags and IP-in-IP are decoded by gopacket itself.
+type overlayDecoder struct {
+	enabled     bool
+	vxlanPorts  []int
+	genevePorts []int
+}
+
+func newOverlayDecoder(config decapsulationConfig) *overlayDecoder {
+	return &overlayDecoder{enabled: config.Enabled, vxlanPorts: config.VxlanPorts, genevePorts: config.GenevePorts}
+}
+
+// decapsulate returns the innermost network and TCP layers of a packet, or nils if it doesn't carry TCP. UDP is only
+// looked into on the configured VXLAN and Geneve ports, and nothing is decapsulated if decapsulation is disabled.
+func (d *overlayDecoder) decapsulate(packet gopacket.Packet) (gopacket.NetworkLayer, *layers.TCP) {
+	return d.innermostTcp(packet.Layers(), nil, 0)
+}
+
+func (d *overlayDecoder) innermostTcp(packetLayers []gopacket.Layer, network gopacket.NetworkLayer, depth int) (gopacket.NetworkLayer, *layers.TCP) {
+	for i, layer := range packetLayers {
+		switch layer := layer.(type) {
+		case *layers.IPv4, *layers.IPv6:
+			// gopacket decodes IP-in-IP itself, so it's ignored here if decapsulation is disabled
+			if network != nil && !d.enabled {
+				return nil, nil
+			}
+			network = layer.(gopacket.NetworkLayer)
+		case *layers.TCP:
+			return network, layer
+		case *layers.UDP:
+			overlay := d.overlayLayerType(layer.DstPort)
+			if overlay == gopacket.LayerTypeZero {
+				return nil, nil
+			}
+			// gopacket decodes VXLAN and Geneve on their IANA ports itself, but not on others such as Flannel's 8472
+			if i+1 < len(packetLayers) && packetLayers[i+1].LayerType() == overlay {
+				continue
+			}
+			if depth == maxEncapsulationDepth {
+				return nil, nil
+			}
+			return d.innermostTcp(gopacket.NewPacket(layer.Payload, overlay, gopacket.NoCopy).Layers(), network, depth+1)
+		}
+	}
+	return nil, nil
+}
+
+func (d *overlayDecoder) overlayLayerType(port layers.UDPPort) gopacket.LayerType {
+	switch {
+	case !d.enabled:
+		return gopacket.LayerTypeZero
+	case slices.Contains(d.vxlanPorts, int(port)):
+		return layers.LayerTypeVXLAN
+	case slices.Contains(d.genevePorts, int(port)):
+		return layers.LayerTypeGeneve
+	}
+	return gopacket.LayerTypeZero
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestOverlayDecoderDecapsulate(t *testing.T) {
+	serialize := func(t *testing.T, serializable ...gopacket.SerializableLayer) []byte {
+		for i, layer := range serializable {
+			if tcp, ok := layer.(*layers.TCP); ok {
+				tcp.SetNetworkLayerForChecksum(serializable[i-1].(*layers.IPv4))
+			}
+		}
+		buffer := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, serializable...); err != nil {
+			t.Fatalf("Failed to serialize packet: %v", err)
+		}
+		return buffer.Bytes()
+	}
+	ethernet := func(ethernetType layers.EthernetType) *layers.Ethernet {
+		return &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 2}, EthernetType: ethernetType}
+	}
+	ipv4 := func(src, dst net.IP, protocol layers.IPProtocol) *layers.IPv4 {
+		return &layers.IPv4{Version: 4, TTL: 64, Protocol: protocol, SrcIP: src, DstIP: dst}
+	}
+	nodeA, nodeB := net.IP{192, 168, 0, 1}, net.IP{192, 168, 0, 2}
+	podA, podB := net.IP{10, 244, 1, 5}, net.IP{10, 244, 2, 7}
+	// innerFrame is the pod to pod packet as the overlay carries it, an Ethernet frame for VXLAN and Geneve
+	innerFrame := func(t *testing.T) []byte {
+		return serialize(t, ethernet(layers.EthernetTypeIPv4), ipv4(podA, podB, layers.IPProtocolTCP), &layers.TCP{SrcPort: 51234, DstPort: 8080, ACK: true}, gopacket.Payload("GET / HTTP/1.1\r\n\r\n"))
+	}
+	udp := func(port layers.UDPPort, payload []byte) []gopacket.SerializableLayer {
+		outer := ipv4(nodeA, nodeB, layers.IPProtocolUDP)
+		udp := &layers.UDP{SrcPort: 40000, DstPort: port}
+		udp.SetNetworkLayerForChecksum(outer)
+		return []gopacket.SerializableLayer{ethernet(layers.EthernetTypeIPv4), outer, udp, gopacket.Payload(payload)}
+	}
+	vxlanHeader := []byte{0x08, 0, 0, 0, 0, 0, 1, 0}
+	// A Geneve header without options carrying an Ethernet frame, with a VNI of 1
+	geneveHeader := []byte{0, 0, 0x65, 0x58, 0, 0, 1, 0}
+
+	tests := []struct {
+		name    string
+		packet  func(t *testing.T) []byte
+		wantSrc net.IP
+		wantDst net.IP
+		// encapsulated packets' TCP isn't found with decapsulation disabled
+		encapsulated bool
+	}{
+		{
+			name: "Plain TCP",
+			packet: func(t *testing.T) []byte {
+				return innerFrame(t)
+			},
+			wantSrc: podA, wantDst: podB,
+		},
+		{
+			name: "VLAN tagged",
+			packet: func(t *testing.T) []byte {
+				return serialize(t, ethernet(layers.EthernetTypeDot1Q), &layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeIPv4}, ipv4(podA, podB, layers.IPProtocolTCP), &layers.TCP{SrcPort: 51234, DstPort: 8080, ACK: true}, gopacket.Payload("GET / HTTP/1.1\r\n\r\n"))
+			},
+			wantSrc: podA, wantDst: podB,
+		},
+		{
+			name: "IP-in-IP",
+			packet: func(t *testing.T) []byte {
+				return serialize(t, ethernet(layers.EthernetTypeIPv4), ipv4(nodeA, nodeB, layers.IPProtocolIPv4), ipv4(podA, podB, layers.IPProtocolTCP), &layers.TCP{SrcPort: 51234, DstPort: 8080, ACK: true}, gopacket.Payload("GET / HTTP/1.1\r\n\r\n"))
+			},
+			wantSrc: podA, wantDst: podB, encapsulated: true,
+		},
+		{
+			name: "VXLAN on the IANA port",
+			packet: func(t *testing.T) []byte {
+				return serialize(t, udp(4789, append(vxlanHeader, innerFrame(t)...))...)
+			},
+			wantSrc: podA, wantDst: podB, encapsulated: true,
+		},
+		{
+			name: "VXLAN on Flannel's port",
+			packet: func(t *testing.T) []byte {
+				return serialize(t, udp(8472, append(vxlanHeader, innerFrame(t)...))...)
+			},
+			wantSrc: podA, wantDst: podB, encapsulated: true,
+		},
+		{
+			name: "Geneve",
+			packet: func(t *testing.T) []byte {
+				return serialize(t, udp(6081, append(geneveHeader, innerFrame(t)...))...)
+			},
+			wantSrc: podA, wantDst: podB, encapsulated: true,
+		},
+		{
+			name: "VXLAN on a port that isn't configured",
+			packet: func(t *testing.T) []byte {
+				return serialize(t, udp(9999, append(vxlanHeader, innerFrame(t)...))...)
+			},
+		},
+		{
+			name: "DNS",
+			packet: func(t *testing.T) []byte {
+				return serialize(t, udp(53, []byte{0x12, 0x34, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0})...)
+			},
+		},
+	}
+	decoder := newOverlayDecoder(defaultConfig().Capture.Decapsulation)
+	disabledConfig := defaultConfig().Capture.Decapsulation
+	disabledConfig.Enabled = false
+	disabledDecoder := newOverlayDecoder(disabledConfig)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet := gopacket.NewPacket(test.packet(t), layers.LinkTypeEthernet, gopacket.Default)
+			if _, tcp := disabledDecoder.decapsulate(packet); (tcp != nil) != (test.wantSrc != nil && !test.encapsulated) {
+				t.Errorf("decapsulate() with decapsulation disabled found TCP = %v", tcp != nil)
+			}
+			network, tcp := decoder.decapsulate(packet)
+			if test.wantSrc == nil {
+				if network != nil || tcp != nil {
+					t.Errorf("decapsulate() = %v, %v, want no TCP", network, tcp)
+				}
+				return
+			}
+			ip, ok := network.(*layers.IPv4)
+			if !ok || tcp == nil {
+				t.Fatalf("decapsulate() = %v, %v, want the inner IPv4 and TCP layers", network, tcp)
+			}
+			if !ip.SrcIP.Equal(test.wantSrc) || !ip.DstIP.Equal(test.wantDst) || tcp.DstPort != 8080 {
+				t.Errorf("Inner flow = %s:%s -> %s:%s, want %s -> %s:8080", ip.SrcIP, tcp.SrcPort, ip.DstIP, tcp.DstPort, test.wantSrc, test.wantDst)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dropReasonQueueFull           = "pipeline.queueSize"
+	dropReasonNonServiceIp        = "kubernetes.serviceIpFiltering"
+	dropReasonCaptureRules        = "filtering.rules"
+	dropReasonOnlyLogJson         = "filtering.onlyLogJson"
+	dropReasonSamplingProbability = "sampling.probability"
+	dropReasonEndpointRateLimit   = "sampling.endpointRateLimit"
+	// dropReasonSnaplen counts packets truncated by the snaplen, rather than requests and responses
+	dropReasonSnaplen = "capture.snaplen"
+)
+
+// dropCounters counts how many captured requests and responses were dropped by each policy. It lives for the lifetime
+// of the sensor, so the counts carry over config reloads.
+type dropCounters struct {
+	counts *sync.Map
+}
+
+func newDropCounters() *dropCounters {
+	return &dropCounters{counts: &sync.Map{}}
+}
+
+func (c *dropCounters) increment(reason string) {
+	count, _ := c.counts.LoadOrStore(reason, &atomic.Uint64{})
+	count.(*atomic.Uint64).Add(1)
+}
+
+func (c *dropCounters) snapshot() map[string]uint64 {
+	counts := map[string]uint64{}
+	c.counts.Range(func(key, value interface{}) bool {
+		counts[key.(string)] = value.(*atomic.Uint64).Load()
+		return true
+	})
+	return counts
+}
+
+// run periodically logs the total number of drops by each policy since the sensor started, if any have changed
+func (c *dropCounters) run(interval time.Duration) {
+	t := time.NewTicker(interval)
+	var previous map[string]uint64
+	for {
+		select {
+		case <-t.C:
+			current := c.snapshot()
+			changed := false
+			reasons := make([]string, 0, len(current))
+			for reason, count := range current {
+				reasons = append(reasons, reason)
+				changed = changed || previous[reason] != count
+			}
+			previous = current
+			if !changed {
+				continue
+			}
+			sort.Strings(reasons)
+			args := make([]any, 0, 2*len(reasons))
+			for _, reason := range reasons {
+				args = append(args, reason, current[reason])
+			}
+			slog.Info("Dropped requests and responses by policy since startup:", args...)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	dropReasonInventoryMaxEndpoints = "inventory.maxEndpoints"
+
+	// maxTlsClientFingerprints bounds how many distinct client fingerprints are kept for each TLS endpoint
+	maxTlsClientFingerprints = 100
+)
+
+type inventoryKey struct {
+	service string
+	method  string
+	path    string
+}
+
+// inventoryEndpoint is an endpoint of a service that's been seen in captured traffic. Its path is the template from
+// the service's OpenAPI spec if the spec documents it, or otherwise one inferred from the paths seen.
+type inventoryEndpoint struct {
+	Service string `json:"service"`
+	Method  string `json:"method"`
+	Path    string `json:"path"`
+	// HasSpec is true if the service had an OpenAPI spec when the endpoint was last seen, in which case Documented is
+	// whether the spec has the endpoint and Deprecated whether it's marked deprecated there
+	HasSpec    bool `json:"hasSpec"`
+	Documented bool `json:"documented"`
+	Deprecated bool `json:"deprecated"`
+	// DataClasses are the classes of sensitive data that have been found in any of the endpoint's calls
+	DataClasses []string `json:"dataClasses,omitempty"`
+	// AuthSchemes are the schemes of the credentials the endpoint has been called with, including "none"
+	AuthSchemes []string  `json:"authSchemes,omitempty"`
+	Count       uint64    `json:"count"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+type tlsInventoryKey struct {
+	service    string
+	serverName string
+	port       string
+}
+
+// inventoryTlsEndpoint is a TLS server that's been seen in captured traffic, identified by the service it belongs to,
+// the server name (SNI) clients asked for and its port. Versions and CipherSuites are what it's negotiated, and Weak is
+// whether it's ever negotiated a version or cipher suite that's reported as a finding.
+type inventoryTlsEndpoint struct {
+	Service      string   `json:"service"`
+	ServerName   string   `json:"serverName,omitempty"`
+	Port         string   `json:"port"`
+	Versions     []string `json:"versions,omitempty"`
+	CipherSuites []string `json:"cipherSuites,omitempty"`
+	Alpn         []string `json:"alpn,omitempty"`
+	Weak         bool     `json:"weak"`
+	// Ja3 and Ja4 are the fingerprints of the clients that have connected, up to maxTlsClientFingerprints of each
+	Ja3       []string  `json:"ja3,omitempty"`
+	Ja4       []string  `json:"ja4,omitempty"`
+	Count     uint64    `json:"count"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+type inventoryFile struct {
+	GeneratedAt  time.Time               `json:"generatedAt"`
+	Endpoints    []*inventoryEndpoint    `json:"endpoints"`
+	TlsEndpoints []*inventoryTlsEndpoint `json:"tlsEndpoints,omitempty"`
+}
+
+// endpointInventory keeps track of every endpoint seen in captured traffic. When a service has an OpenAPI spec, calls
+// to endpoints it doesn't document are reported as shadow endpoints, and calls to endpoints it marks as deprecated
+// are reported as zombie endpoints. Only maxEndpoints endpoints are tracked; calls to any more are still checked
+// against their spec, but are otherwise dropped. TLS endpoints are kept separately, with the same limit.
+type endpointInventory struct {
+	file          string
+	writeInterval time.Duration
+	maxEndpoints  int
+	// specs is nil if no OpenAPI specs are configured, in which case endpoints are only inventoried
+	specs     *openApiSpecStore
+	findings  *findingsReporter
+	drops     *dropCounters
+	now       func() time.Time
+	mutex     sync.Mutex
+	endpoints map[inventoryKey]*inventoryEndpoint
+	tls       map[tlsInventoryKey]*inventoryTlsEndpoint
+	changed   bool
+}
+
+func newEndpointInventory(config inventoryConfig, specs *openApiSpecStore, findings *findingsReporter, drops *dropCounters) *endpointInventory {
+	return &endpointInventory{
+		file:          config.File,
+		writeInterval: config.WriteInterval,
+		maxEndpoints:  config.MaxEndpoints,
+		specs:         specs,
+		findings:      findings,
+		drops:         drops,
+		now:           time.Now,
+		endpoints:     map[inventoryKey]*inventoryEndpoint{},
+		tls:           map[tlsInventoryKey]*inventoryTlsEndpoint{},
+	}
+}
+
+func (i *endpointInventory) export(reqAndResp *httpRequestAndResponse) {
+	service := openApiServiceName(reqAndResp)
+	method := reqAndResp.request.Method
+	path, _ := inferPathTemplate(reqAndResp.request.URL.Path)
+
+	var spec *openApiSpec
+	if i.specs != nil {
+		spec = i.specs.forService(service)
+	}
+	documented, deprecated := false, false
+	if spec != nil {
+		if route, _, ok := spec.route(method, reqAndResp.request.URL.Path); ok {
+			path = route.Path
+			documented, deprecated = true, route.Operation.Deprecated
+		}
+	}
+
+	var authSchemes []string
+	if reqAndResp.auth != nil {
+		authSchemes = reqAndResp.auth.Schemes
+	}
+	i.record(inventoryKey{service, method, path}, spec != nil, documented, deprecated, reqAndResp.dataClasses, authSchemes)
+
+	switch {
+	case spec != nil && !documented:
+		i.findings.report(finding{Type: findingTypeShadowEndpoint, Service: service, Method: method, Path: path})
+	case deprecated:
+		i.findings.report(finding{Type: findingTypeZombieEndpoint, Service: service, Method: method, Path: path})
+	}
+}
+
+func (i *endpointInventory) record(key inventoryKey, hasSpec bool, documented bool, deprecated bool, dataClasses []string, authSchemes []string) {
+	now := i.now()
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	endpoint, ok := i.endpoints[key]
+	if !ok {
+		if len(i.endpoints) >= i.maxEndpoints {
+			i.drops.increment(dropReasonInventoryMaxEndpoints)
+			return
+		}
+		endpoint = &inventoryEndpoint{Service: key.service, Method: key.method, Path: key.path, FirstSeen: now}
+		i.endpoints[key] = endpoint
+	}
+	endpoint.HasSpec, endpoint.Documented, endpoint.Deprecated = hasSpec, documented, deprecated
+	endpoint.DataClasses = mergeSortedStrings(endpoint.DataClasses, dataClasses)
+	endpoint.AuthSchemes = mergeSortedStrings(endpoint.AuthSchemes, authSchemes)
+	endpoint.Count++
+	endpoint.LastSeen = now
+	i.changed = true
+}
+
+// recordTls adds a TLS handshake to the inventory. The version and cipher suite are empty if the server's reply wasn't
+// captured.
+func (i *endpointInventory) recordTls(key tlsInventoryKey, version string, cipherSuite string, alpn string, ja3 string, ja4 string, weak bool) {
+	now := i.now()
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	endpoint, ok := i.tls[key]
+	if !ok {
+		if len(i.tls) >= i.maxEndpoints {
+			i.drops.increment(dropReasonInventoryMaxEndpoints)
+			return
+		}
+		endpoint = &inventoryTlsEndpoint{Service: key.service, ServerName: key.serverName, Port: key.port, FirstSeen: now}
+		i.tls[key] = endpoint
+	}
+	for _, value := range []struct {
+		set   *[]string
+		value string
+		limit int
+	}{
+		{&endpoint.Versions, version, 0},
+		{&endpoint.CipherSuites, cipherSuite, 0},
+		{&endpoint.Alpn, alpn, 0},
+		{&endpoint.Ja3, ja3, maxTlsClientFingerprints},
+		{&endpoint.Ja4, ja4, maxTlsClientFingerprints},
+	} {
+		if value.value != "" && (value.limit == 0 || len(*value.set) < value.limit) {
+			*value.set = mergeSortedStrings(*value.set, []string{value.value})
+		}
+	}
+	endpoint.Weak = endpoint.Weak || weak
+	endpoint.Count++
+	endpoint.LastSeen = now
+	i.changed = true
+}
+
+// mergeSortedStrings adds any values that aren't already in a sorted set to it
+func mergeSortedStrings(set []string, values []string) []string {
+	for _, value := range values {
+		if index, found := slices.BinarySearch(set, value); !found {
+			set = slices.Insert(set, index, value)
+		}
+	}
+	return set
+}
+
+// snapshot copies the inventory, sorted by service, path and method
+func (i *endpointInventory) snapshot() []*inventoryEndpoint {
+	i.mutex.Lock()
+	endpoints := make([]*inventoryEndpoint, 0, len(i.endpoints))
+	for _, endpoint := range i.endpoints {
+		copied := *endpoint
+		copied.DataClasses = slices.Clone(endpoint.DataClasses)
+		copied.AuthSchemes = slices.Clone(endpoint.AuthSchemes)
+		endpoints = append(endpoints, &copied)
+	}
+	i.changed = false
+	i.mutex.Unlock()
+
+	sort.Slice(endpoints, func(a, b int) bool {
+		if endpoints[a].Service != endpoints[b].Service {
+			return endpoints[a].Service < endpoints[b].Service
+		}
+		if endpoints[a].Path != endpoints[b].Path {
+			return endpoints[a].Path < endpoints[b].Path
+		}
+		return endpoints[a].Method < endpoints[b].Method
+	})
+	return endpoints
+}
+
+// snapshotTls copies the TLS endpoints in the inventory, sorted by service, server name and port
+func (i *endpointInventory) snapshotTls() []*inventoryTlsEndpoint {
+	i.mutex.Lock()
+	endpoints := make([]*inventoryTlsEndpoint, 0, len(i.tls))
+	for _, endpoint := range i.tls {
+		copied := *endpoint
+		copied.Versions = slices.Clone(endpoint.Versions)
+		copied.CipherSuites = slices.Clone(endpoint.CipherSuites)
+		copied.Alpn = slices.Clone(endpoint.Alpn)
+		copied.Ja3 = slices.Clone(endpoint.Ja3)
+		copied.Ja4 = slices.Clone(endpoint.Ja4)
+		endpoints = append(endpoints, &copied)
+	}
+	i.mutex.Unlock()
+
+	sort.Slice(endpoints, func(a, b int) bool {
+		if endpoints[a].Service != endpoints[b].Service {
+			return endpoints[a].Service < endpoints[b].Service
+		}
+		if endpoints[a].ServerName != endpoints[b].ServerName {
+			return endpoints[a].ServerName < endpoints[b].ServerName
+		}
+		return endpoints[a].Port < endpoints[b].Port
+	})
+	return endpoints
+}
+
+// run writes the inventory to its file every writeInterval, if it's changed since it was last written
+func (i *endpointInventory) run() {
+	ticker := time.NewTicker(i.writeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		i.mutex.Lock()
+		changed := i.changed
+		i.mutex.Unlock()
+		if !changed {
+			continue
+		}
+		if err := i.write(); err != nil {
+			slog.Error("Failed to write endpoint inventory:", "Err", err.Error())
+		}
+	}
+}
+
+func (i *endpointInventory) write() error {
+	inventoryBytes, err := json.MarshalIndent(
+		inventoryFile{GeneratedAt: i.now().UTC(), Endpoints: i.snapshot(), TlsEndpoints: i.snapshotTls()}, "", "  ",
+	)
+	if err != nil {
+		return fmt.Errorf("Failed to encode endpoint inventory: %v", err)
+	}
+	tmpPath := i.file + ".tmp"
+	if err := os.WriteFile(tmpPath, append(inventoryBytes, '\n'), 0o644); err != nil {
+		return fmt.Errorf("Failed to write endpoint inventory %s: %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, i.file); err != nil {
+		return fmt.Errorf("Failed to rename endpoint inventory %s: %v", tmpPath, err)
+	}
+	return nil
+}
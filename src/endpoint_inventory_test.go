@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEndpointInventoryShadowAndZombieEndpoints(t *testing.T) {
+	findings := newFindingsReporter(findingsConfig{ReportInterval: time.Hour, MaxFindings: 10}, newDropCounters())
+	var reported []finding
+	findings.emit = func(f finding) { reported = append(reported, f) }
+	inventory := newEndpointInventory(
+		inventoryConfig{MaxEndpoints: 10},
+		newTestOpenApiSpecStore(t, nil, nil),
+		findings,
+		newDropCounters(),
+	)
+
+	for _, exchange := range []struct {
+		dstWorkload string
+		request     string
+	}{
+		{"shop/users", "GET /api/users/1 HTTP/1.1\r\nHost: users\r\n\r\n"},
+		{"shop/users", "GET /users/2 HTTP/1.1\r\nHost: users\r\n\r\n"},
+		{"shop/users", "DELETE /users/2 HTTP/1.1\r\nHost: users\r\n\r\n"},
+		{"shop/users", "GET /users/me HTTP/1.1\r\nHost: users\r\n\r\n"},
+		{"shop/orders", "GET /orders/7 HTTP/1.1\r\nHost: orders\r\n\r\n"},
+	} {
+		reqAndResp := newTestRequestAndResponse(t, exchange.request, newTestResponseBytes(200))
+		reqAndResp.dstWorkload = exchange.dstWorkload
+		inventory.export(reqAndResp)
+	}
+
+	expectedFindings := []finding{
+		{Type: findingTypeShadowEndpoint, Service: "shop/users", Method: "DELETE", Path: "/users/{id}"},
+		{Type: findingTypeZombieEndpoint, Service: "shop/users", Method: "GET", Path: "/users/me"},
+	}
+	for i := range reported {
+		reported[i].Count, reported[i].FirstSeen, reported[i].LastSeen = 0, time.Time{}, time.Time{}
+	}
+	if !reflect.DeepEqual(reported, expectedFindings) {
+		t.Errorf("Findings = %+v, want %+v", reported, expectedFindings)
+	}
+
+	type summary struct {
+		service, method, path string
+		hasSpec, documented   bool
+		deprecated            bool
+		count                 uint64
+	}
+	var summaries []summary
+	for _, endpoint := range inventory.snapshot() {
+		summaries = append(summaries, summary{
+			endpoint.Service, endpoint.Method, endpoint.Path,
+			endpoint.HasSpec, endpoint.Documented, endpoint.Deprecated, endpoint.Count,
+		})
+	}
+	expectedSummaries := []summary{
+		{"shop/orders", "GET", "/orders/{id}", false, false, false, 1},
+		{"shop/users", "GET", "/users/me", true, true, true, 1},
+		{"shop/users", "DELETE", "/users/{id}", true, false, false, 1},
+		{"shop/users", "GET", "/users/{id}", true, true, false, 2},
+	}
+	if !reflect.DeepEqual(summaries, expectedSummaries) {
+		t.Errorf("Inventory = %+v, want %+v", summaries, expectedSummaries)
+	}
+}
+
+func TestEndpointInventoryMaxEndpoints(t *testing.T) {
+	findings := newFindingsReporter(findingsConfig{ReportInterval: time.Hour, MaxFindings: 10}, newDropCounters())
+	inventory := newEndpointInventory(
+		inventoryConfig{File: filepath.Join(t.TempDir(), "inventory.json"), MaxEndpoints: 1},
+		nil,
+		findings,
+		newDropCounters(),
+	)
+	for _, request := range []string{"GET /a HTTP/1.1\r\nHost: a\r\n\r\n", "GET /b HTTP/1.1\r\nHost: a\r\n\r\n"} {
+		inventory.export(newTestRequestAndResponse(t, request, newTestResponseBytes(200)))
+	}
+	if dropped := inventory.drops.snapshot()[dropReasonInventoryMaxEndpoints]; dropped != 1 {
+		t.Errorf("Dropped %d endpoints, want 1", dropped)
+	}
+
+	if err := inventory.write(); err != nil {
+		t.Fatalf("Failed to write inventory: %v", err)
+	}
+	inventoryBytes, err := os.ReadFile(inventory.file)
+	if err != nil {
+		t.Fatalf("Failed to read inventory: %v", err)
+	}
+	var written inventoryFile
+	if err := json.Unmarshal(inventoryBytes, &written); err != nil {
+		t.Fatalf("Failed to decode inventory: %v", err)
+	}
+	if len(written.Endpoints) != 1 || written.Endpoints[0].Path != "/a" || written.Endpoints[0].Service != "a" {
+		t.Errorf("Written endpoints = %+v, want just GET /a", written.Endpoints)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	dropReasonMaxFindings = "findings.maxFindings"
+
+	findingTypeShadowEndpoint       = "shadow_endpoint"
+	findingTypeZombieEndpoint       = "zombie_endpoint"
+	findingTypeSchemaMismatch       = "schema_mismatch"
+	findingTypeUnexpectedStatusCode = "unexpected_status_code"
+
+	findingTypeUnauthenticatedEndpoint = "unauthenticated_endpoint"
+	findingTypeExpiredJwtAccepted      = "expired_jwt_accepted"
+	findingTypeUnsignedJwtAccepted     = "unsigned_jwt_accepted"
+
+	findingTypeWeakTlsVersion = "weak_tls_version"
+	findingTypeWeakTlsCipher  = "weak_tls_cipher"
+
+	findingEventSchemaVersion = 1
+)
+
+// finding is something the sensor noticed about an API from its traffic, such as a request that doesn't conform to
+// the service's OpenAPI spec. Findings are aggregated, so Count is the number of times it's been seen between
+// FirstSeen and LastSeen.
+type finding struct {
+	Type       string    `json:"type"`
+	Service    string    `json:"service"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+	Count      uint64    `json:"count"`
+	FirstSeen  time.Time `json:"firstSeen"`
+	LastSeen   time.Time `json:"lastSeen"`
+}
+
+type findingKey struct {
+	findingType string
+	service     string
+	method      string
+	path        string
+	statusCode  int
+	detail      string
+}
+
+type trackedFinding struct {
+	finding       finding
+	reportedCount uint64
+}
+
+// findingsReporter aggregates findings so the same one seen on every request doesn't flood the logs. A finding is
+// reported the first time it's seen, and then at most once every reportInterval with its updated count if it's been
+// seen again since. Only maxFindings distinct findings are tracked; any more are dropped.
+type findingsReporter struct {
+	reportInterval time.Duration
+	maxFindings    int
+	drops          *dropCounters
+	now            func() time.Time
+	emit           func(finding)
+	mutex          sync.Mutex
+	findings       map[findingKey]*trackedFinding
+}
+
+// newFindingsReporter creates a reporter which logs findings, and passes them to any exporters given
+func newFindingsReporter(config findingsConfig, drops *dropCounters, exporters ...func(finding)) *findingsReporter {
+	return &findingsReporter{
+		reportInterval: config.ReportInterval,
+		maxFindings:    config.MaxFindings,
+		drops:          drops,
+		now:            time.Now,
+		emit: func(f finding) {
+			logFinding(f)
+			for _, export := range exporters {
+				export(f)
+			}
+		},
+		findings: map[findingKey]*trackedFinding{},
+	}
+}
+
+func (r *findingsReporter) report(f finding) {
+	key := findingKey{f.Type, f.Service, f.Method, f.Path, f.StatusCode, f.Detail}
+	now := r.now()
+
+	r.mutex.Lock()
+	tracked, ok := r.findings[key]
+	if ok {
+		tracked.finding.Count++
+		tracked.finding.LastSeen = now
+		r.mutex.Unlock()
+		return
+	}
+	if len(r.findings) >= r.maxFindings {
+		r.mutex.Unlock()
+		r.drops.increment(dropReasonMaxFindings)
+		return
+	}
+	f.Count, f.FirstSeen, f.LastSeen = 1, now, now
+	r.findings[key] = &trackedFinding{finding: f, reportedCount: 1}
+	r.mutex.Unlock()
+
+	r.emit(f)
+}
+
+// run reports findings that have been seen again since they were last reported, every reportInterval
+func (r *findingsReporter) run() {
+	ticker := time.NewTicker(r.reportInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.flush()
+	}
+}
+
+func (r *findingsReporter) flush() {
+	var updated []finding
+	r.mutex.Lock()
+	for _, tracked := range r.findings {
+		if tracked.finding.Count > tracked.reportedCount {
+			updated = append(updated, tracked.finding)
+			tracked.reportedCount = tracked.finding.Count
+		}
+	}
+	r.mutex.Unlock()
+	for _, f := range updated {
+		r.emit(f)
+	}
+}
+
+func logFinding(f finding) {
+	slog.Warn(
+		"API finding:",
+		"Type", f.Type,
+		"Service", f.Service,
+		"Method", f.Method,
+		"Path", f.Path,
+		"StatusCode", f.StatusCode,
+		"Detail", f.Detail,
+		"Count", f.Count,
+		"FirstSeen", f.FirstSeen,
+		"LastSeen", f.LastSeen,
+	)
+}
+
+// findingEvent is a finding in the versioned schema exported to streaming sinks, described by
+// schema/finding_event.v1.schema.json. Like apiEvent, it's a contract with downstream consumers.
+type findingEvent struct {
+	SchemaVersion int32          `json:"schemaVersion"`
+	EventId       string         `json:"eventId"`
+	Sensor        apiEventSensor `json:"sensor"`
+	Finding       finding        `json:"finding"`
+}
+
+func newFindingEvent(f finding, kubernetesConfig kubernetesConfig) *findingEvent {
+	f.FirstSeen, f.LastSeen = f.FirstSeen.UTC(), f.LastSeen.UTC()
+	return &findingEvent{
+		SchemaVersion: findingEventSchemaVersion,
+		EventId:       uuid.NewString(),
+		Sensor: apiEventSensor{
+			Name:     apiEventSensorName,
+			Version:  sensorVersion,
+			NodeName: kubernetesConfig.NodeName,
+			PodName:  kubernetesConfig.PodName,
+		},
+		Finding: f,
+	}
+}
+
+func (e *findingEvent) marshalJson() ([]byte, error) {
+	return json.Marshal(e)
+}
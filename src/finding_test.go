@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+const findingEventJsonSchemaPath = "../schema/finding_event.v1.schema.json"
+
+func TestFindingsReporterAggregates(t *testing.T) {
+	reporter := newFindingsReporter(findingsConfig{ReportInterval: time.Hour, MaxFindings: 2}, newDropCounters())
+	var emitted []finding
+	reporter.emit = func(f finding) { emitted = append(emitted, f) }
+
+	undocumented := finding{Type: findingTypeShadowEndpoint, Service: "shop/users", Method: "GET", Path: "/a"}
+	reporter.report(undocumented)
+	reporter.report(undocumented)
+	reporter.report(finding{Type: findingTypeShadowEndpoint, Service: "shop/users", Method: "GET", Path: "/b"})
+	reporter.report(finding{Type: findingTypeShadowEndpoint, Service: "shop/users", Method: "GET", Path: "/c"})
+	if len(emitted) != 2 || emitted[0].Count != 1 {
+		t.Fatalf("Emitted %+v, want the first sighting of /a and /b", emitted)
+	}
+	if dropped := reporter.drops.snapshot()[dropReasonMaxFindings]; dropped != 1 {
+		t.Errorf("Dropped %d findings, want 1", dropped)
+	}
+
+	emitted = nil
+	reporter.flush()
+	if len(emitted) != 1 || emitted[0].Path != "/a" || emitted[0].Count != 2 {
+		t.Errorf("Flush emitted %+v, want /a with a count of 2", emitted)
+	}
+	emitted = nil
+	reporter.flush()
+	if len(emitted) != 0 {
+		t.Errorf("Flush emitted %+v, want nothing as there were no new sightings", emitted)
+	}
+}
+
+func TestFindingEventMatchesJsonSchema(t *testing.T) {
+	schemaBytes, err := os.ReadFile(findingEventJsonSchemaPath)
+	if err != nil {
+		t.Fatalf("Failed to read schema: %v", err)
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(schemaBytes, &schema); err != nil {
+		t.Fatalf("Failed to parse schema: %v", err)
+	}
+	seen := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	eventJson, err := newFindingEvent(finding{
+		Type:       findingTypeSchemaMismatch,
+		Service:    "shop/users",
+		Method:     "GET",
+		Path:       "/users/{id}",
+		StatusCode: 200,
+		Detail:     `response at /name: property "name" is missing`,
+		Count:      3,
+		FirstSeen:  seen,
+		LastSeen:   seen.Add(time.Minute),
+	}, kubernetesConfig{NodeName: "node-1"}).marshalJson()
+	if err != nil {
+		t.Fatalf("Failed to encode event: %v", err)
+	}
+	var event interface{}
+	if err := json.Unmarshal(eventJson, &event); err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	checkJsonSchema(t, schema, schema, event, "$")
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/FireTail-io/firetail-go-lib/logging"
+)
+
+const (
+	dropReasonFiretailQueueFull     = "sinks.firetail.queueSize"
+	dropReasonFiretailEntryTooLarge = "sinks.firetail.maxBatchSize"
+)
+
+// firetailPostAttempts is how many times a batch is posted to the FireTail logging API before it's given up on
+const firetailPostAttempts = 3
+
+// firetailLogEntry is a FireTail log entry with extra metadata about how and where the sensor captured it. FireTail's
+// logging schema has no fields for it, so it's sent in a separate sensor object alongside the schema's fields.
+type firetailLogEntry struct {
+	logging.LogEntry
+	Sensor firetailSensorMetadata `json:"sensor"`
+}
+
+type firetailSensorMetadata struct {
+	NodeName          string  `json:"nodeName,omitempty"`
+	PodName           string  `json:"podName,omitempty"`
+	SrcIp             string  `json:"srcIp"`
+	SrcPort           string  `json:"srcPort"`
+	SrcWorkload       string  `json:"srcWorkload,omitempty"`
+	DstIp             string  `json:"dstIp"`
+	DstPort           string  `json:"dstPort"`
+	DstWorkload       string  `json:"dstWorkload,omitempty"`
+	LatencyMs         float64 `json:"latencyMs"`
+	RequestTruncated  bool    `json:"requestTruncated"`
+	ResponseTruncated bool    `json:"responseTruncated"`
+}
+
+// firetailLogShipper encodes captured requests and responses as FireTail log entries and sends them to the FireTail
+// logging API in batches. A batch is sent when adding another entry would take it over maxBatchSize bytes, or when
+// its oldest entry is older than maxLogAge.
+type firetailLogShipper struct {
+	apiUrl       string
+	apiToken     string
+	maxBatchSize int
+	maxLogAge    time.Duration
+	retryBackoff time.Duration
+	nodeName     string
+	podName      string
+	client       *http.Client
+	entries      chan []byte
+	sanitise     func(logging.LogEntry) logging.LogEntry
+	drops        *dropCounters
+	sendBatch    func([][]byte) error
+}
+
+func newFiretailLogShipper(config firetailSinkConfig, kubernetesConfig kubernetesConfig, drops *dropCounters) *firetailLogShipper {
+	shipper := &firetailLogShipper{
+		apiUrl:       config.ApiUrl,
+		apiToken:     config.ApiToken,
+		maxBatchSize: config.MaxBatchSize,
+		maxLogAge:    config.MaxLogAge,
+		retryBackoff: time.Second,
+		nodeName:     kubernetesConfig.NodeName,
+		podName:      kubernetesConfig.PodName,
+		client:       &http.Client{Timeout: 30 * time.Second},
+		entries:      make(chan []byte, config.QueueSize),
+		sanitise:     logging.DefaultSanitiser(),
+		drops:        drops,
+	}
+	shipper.sendBatch = shipper.postBatch
+	return shipper
+}
+
+// export encodes the request and response and queues it to be sent. If the queue is full it's dropped rather than
+// holding up the pipeline's worker.
+func (s *firetailLogShipper) export(reqAndResp *httpRequestAndResponse) {
+	entryBytes, err := s.encode(reqAndResp)
+	if err != nil {
+		slog.Error("Failed to encode FireTail log entry:", "Err", err.Error())
+		return
+	}
+	if len(entryBytes) > s.maxBatchSize {
+		slog.Warn(
+			"FireTail log entry is larger than the max batch size, dropping it",
+			"EntrySize", len(entryBytes),
+			"MaxBatchSize", s.maxBatchSize,
+		)
+		s.drops.increment(dropReasonFiretailEntryTooLarge)
+		return
+	}
+	select {
+	case s.entries <- entryBytes:
+	default:
+		slog.Warn("FireTail log shipper queue full, dropping log entry")
+		s.drops.increment(dropReasonFiretailQueueFull)
+	}
+}
+
+func (s *firetailLogShipper) encode(reqAndResp *httpRequestAndResponse) ([]byte, error) {
+	request := reqAndResp.request
+	response := reqAndResp.response
+
+	requestBody, requestTruncated := readCapturedBody(request.Body)
+	responseBody, responseTruncated := readCapturedBody(response.Body)
+
+	requestHeaders := request.Header.Clone()
+	if requestHeaders == nil {
+		requestHeaders = http.Header{}
+	}
+	requestHeaders.Set("Host", request.Host)
+	requestHeaders.Set("Content-Length", strconv.Itoa(len(requestBody)))
+	responseHeaders := response.Header.Clone()
+	if responseHeaders == nil {
+		responseHeaders = http.Header{}
+	}
+
+	dateCreated := reqAndResp.requestTime
+	if dateCreated.IsZero() {
+		dateCreated = time.Now()
+	}
+	latencyMs := 0.0
+	if !reqAndResp.requestTime.IsZero() && reqAndResp.responseTime.After(reqAndResp.requestTime) {
+		latencyMs = float64(reqAndResp.responseTime.Sub(reqAndResp.requestTime)) / float64(time.Millisecond)
+	}
+
+	ip := reqAndResp.src
+	if ip == "" {
+		if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+			ip = host
+		}
+	}
+
+	logEntry := s.sanitise(logging.LogEntry{
+		Version:       logging.The100Alpha,
+		DateCreated:   dateCreated.UnixMilli(),
+		ExecutionTime: latencyMs,
+		Request: logging.Request{
+			Body:         string(requestBody),
+			Headers:      requestHeaders,
+			HTTPProtocol: logging.HTTPProtocol(request.Proto),
+			IP:           ip,
+			Method:       logging.Method(request.Method),
+			URI:          requestScheme(request) + "://" + request.Host + request.URL.RequestURI(),
+			Resource:     request.URL.Path,
+		},
+		Response: logging.Response{
+			Body:       string(responseBody),
+			Headers:    responseHeaders,
+			StatusCode: int64(response.StatusCode),
+		},
+	})
+
+	return json.Marshal(firetailLogEntry{
+		LogEntry: logEntry,
+		Sensor: firetailSensorMetadata{
+			NodeName:          s.nodeName,
+			PodName:           s.podName,
+			SrcIp:             reqAndResp.src,
+			SrcPort:           reqAndResp.srcPort,
+			SrcWorkload:       reqAndResp.srcWorkload,
+			DstIp:             reqAndResp.dst,
+			DstPort:           reqAndResp.dstPort,
+			DstWorkload:       reqAndResp.dstWorkload,
+			LatencyMs:         latencyMs,
+			RequestTruncated:  reqAndResp.requestTruncated || requestTruncated,
+			ResponseTruncated: reqAndResp.responseTruncated || responseTruncated,
+		},
+	})
+}
+
+// readCapturedBody reads as much of a captured body as was captured. If the body was cut short, because the stream was
+// longer than the max content length, the partial body is returned along with true.
+func readCapturedBody(body io.ReadCloser) ([]byte, bool) {
+	if body == nil || body == http.NoBody {
+		return nil, false
+	}
+	bodyBytes, err := io.ReadAll(body)
+	if err != nil {
+		return bodyBytes, errors.Is(err, io.ErrUnexpectedEOF)
+	}
+	return bodyBytes, false
+}
+
+// run batches up queued log entries and sends them to FireTail until the entries channel is closed, at which point
+// any remaining entries are sent
+func (s *firetailLogShipper) run() {
+	batch := [][]byte{}
+	batchSize := 0
+	flushTimer := time.NewTimer(s.maxLogAge)
+	flushTimer.Stop()
+
+	flush := func() {
+		flushTimer.Stop()
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.sendBatch(batch); err != nil {
+			slog.Error("Failed to send logs to FireTail:", "Err", err.Error(), "Entries", len(batch))
+		} else {
+			slog.Debug("Sent logs to FireTail", "Entries", len(batch), "Bytes", batchSize)
+		}
+		batch = [][]byte{}
+		batchSize = 0
+	}
+
+	for {
+		select {
+		case entry, ok := <-s.entries:
+			if !ok {
+				flush()
+				return
+			}
+			if batchSize+len(entry) > s.maxBatchSize {
+				flush()
+			}
+			if len(batch) == 0 {
+				flushTimer.Reset(s.maxLogAge)
+			}
+			batch = append(batch, entry)
+			batchSize += len(entry)
+		case <-flushTimer.C:
+			flush()
+		}
+	}
+}
+
+// postBatch sends a batch of log entries to the FireTail logging API as newline delimited JSON, making up to
+// firetailPostAttempts attempts if the error is retryable. The wait between attempts starts at retryBackoff and
+// doubles.
+func (s *firetailLogShipper) postBatch(batch [][]byte) error {
+	body := encodeFiretailBatch(batch)
+	backoff := s.retryBackoff
+	var err error
+	for attempt := 1; attempt <= firetailPostAttempts; attempt++ {
+		if attempt > 1 {
+			slog.Warn(
+				"Failed to send logs to FireTail, retrying after backoff",
+				"Attempt", attempt-1,
+				"Backoff", backoff,
+				"Err", err.Error(),
+			)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = s.postBody(body); err == nil || !isRetryableFiretailError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func encodeFiretailBatch(batch [][]byte) []byte {
+	body := bytes.Join(batch, []byte{'\n'})
+	return append(body, '\n')
+}
+
+// firetailApiError is returned when the FireTail logging API responds with anything other than success
+type firetailApiError struct {
+	statusCode int
+	response   map[string]interface{}
+}
+
+func (e *firetailApiError) Error() string {
+	return fmt.Sprintf("got err response from FireTail API: %d %v", e.statusCode, e.response)
+}
+
+// isRetryableFiretailError returns false for errors that will happen again however many times a batch is retried, such
+// as the API rejecting the token or the batch itself
+func isRetryableFiretailError(err error) bool {
+	var apiErr *firetailApiError
+	if !errors.As(err, &apiErr) {
+		return true
+	}
+	switch {
+	case apiErr.statusCode == http.StatusRequestTimeout, apiErr.statusCode == http.StatusTooManyRequests:
+		return true
+	case apiErr.statusCode >= 400 && apiErr.statusCode < 500:
+		return false
+	}
+	return true
+}
+
+func (s *firetailLogShipper) postBody(body []byte) error {
+	req, err := http.NewRequest("POST", s.apiUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("x-ft-api-key", s.apiToken)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var res map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&res)
+	if resp.StatusCode != http.StatusOK || res["message"] != "success" {
+		return &firetailApiError{statusCode: resp.StatusCode, response: res}
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestFiretailLogShipper(apiUrl string) *firetailLogShipper {
+	return newFiretailLogShipper(
+		firetailSinkConfig{
+			ApiUrl:       apiUrl,
+			ApiToken:     "PS-02-XXXXXXXX",
+			MaxLogAge:    time.Hour,
+			MaxBatchSize: 1024 * 1024,
+			QueueSize:    10,
+		},
+		kubernetesConfig{NodeName: "node-1", PodName: "firetail-sensor-abcde"},
+		newDropCounters(),
+	)
+}
+
+func TestFiretailLogShipperEncode(t *testing.T) {
+	requestBytes := "POST /users/123?verbose=true HTTP/1.1\r\n" +
+		"Host: users.default.svc\r\n" +
+		"Authorization: Bearer secret\r\n" +
+		"Content-Length: 17\r\n\r\n" +
+		`{"name": "Alice"}`
+	request, err := http.ReadRequest(bufio.NewReader(strings.NewReader(requestBytes)))
+	if err != nil {
+		t.Fatalf("Failed to read request: %v", err)
+	}
+	// The response claims a longer body than was captured, as if it had been cut short at the max content length
+	responseBytes := "HTTP/1.1 201 Created\r\n" +
+		"Content-Type: application/json\r\n" +
+		"Content-Length: 100\r\n\r\n" +
+		`{"id": 123`
+	response, err := http.ReadResponse(bufio.NewReader(strings.NewReader(responseBytes)), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	requestTime := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	entryBytes, err := newTestFiretailLogShipper("http://localhost").encode(&httpRequestAndResponse{
+		request:      request,
+		response:     response,
+		src:          "10.0.0.1",
+		srcPort:      "51234",
+		dst:          "10.96.0.10",
+		dstPort:      "80",
+		dstWorkload:  "default/users",
+		requestTime:  requestTime,
+		responseTime: requestTime.Add(25 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatalf("encode() error = %v", err)
+	}
+
+	var entry firetailLogEntry
+	if err := json.Unmarshal(entryBytes, &entry); err != nil {
+		t.Fatalf("Failed to unmarshal log entry: %v", err)
+	}
+	if entry.DateCreated != requestTime.UnixMilli() {
+		t.Errorf("DateCreated = %d, want %d", entry.DateCreated, requestTime.UnixMilli())
+	}
+	if entry.ExecutionTime != 25 {
+		t.Errorf("ExecutionTime = %v, want 25", entry.ExecutionTime)
+	}
+	if entry.Request.URI != "http://users.default.svc/users/123?verbose=true" {
+		t.Errorf("Request.URI = %q", entry.Request.URI)
+	}
+	if entry.Request.IP != "10.0.0.1" {
+		t.Errorf("Request.IP = %q, want 10.0.0.1", entry.Request.IP)
+	}
+	if entry.Request.Body != `{"name": "Alice"}` {
+		t.Errorf("Request.Body = %q", entry.Request.Body)
+	}
+	if values := entry.Request.Headers["Authorization"]; len(values) != 1 || strings.Contains(values[0], "secret") {
+		t.Errorf("Authorization header was not sanitised: %v", values)
+	}
+	if entry.Response.StatusCode != 201 || entry.Response.Body != `{"id": 123` {
+		t.Errorf("Response = %d %q", entry.Response.StatusCode, entry.Response.Body)
+	}
+	expectedMetadata := firetailSensorMetadata{
+		NodeName:          "node-1",
+		PodName:           "firetail-sensor-abcde",
+		SrcIp:             "10.0.0.1",
+		SrcPort:           "51234",
+		DstIp:             "10.96.0.10",
+		DstPort:           "80",
+		DstWorkload:       "default/users",
+		LatencyMs:         25,
+		RequestTruncated:  false,
+		ResponseTruncated: true,
+	}
+	if entry.Sensor != expectedMetadata {
+		t.Errorf("Sensor = %+v, want %+v", entry.Sensor, expectedMetadata)
+	}
+}
+
+func TestFiretailLogShipperBatches(t *testing.T) {
+	var receivedMutex sync.Mutex
+	received := [][]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-ft-api-key") != "PS-02-XXXXXXXX" {
+			t.Errorf("x-ft-api-key = %q", r.Header.Get("x-ft-api-key"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		receivedMutex.Lock()
+		received = append(received, strings.Split(strings.TrimSuffix(string(body), "\n"), "\n"))
+		receivedMutex.Unlock()
+		w.Write([]byte(`{"message": "success"}`))
+	}))
+	defer server.Close()
+
+	shipper := newTestFiretailLogShipper(server.URL)
+	shipper.maxBatchSize = 10
+	done := make(chan struct{})
+	go func() {
+		shipper.run()
+		close(done)
+	}()
+
+	// Each entry is 4 bytes, so only two fit in a 10 byte batch
+	for _, entry := range []string{`"aa"`, `"bb"`, `"cc"`} {
+		shipper.entries <- []byte(entry)
+	}
+	close(shipper.entries)
+	<-done
+
+	receivedMutex.Lock()
+	defer receivedMutex.Unlock()
+	if len(received) != 2 || len(received[0]) != 2 || len(received[1]) != 1 {
+		t.Fatalf("Received batches %v, want 2 batches of 2 and 1 entries", received)
+	}
+}
+
+func TestFiretailLogShipperDropsOversizedEntries(t *testing.T) {
+	shipper := newTestFiretailLogShipper("http://localhost")
+	shipper.maxBatchSize = 10
+	shipper.export(newTestRequestAndResponse(t, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", newTestResponseBytes(200)))
+	if len(shipper.entries) != 0 {
+		t.Errorf("Queued %d entries, want the oversized entry to be dropped", len(shipper.entries))
+	}
+	if drops := shipper.drops.snapshot()[dropReasonFiretailEntryTooLarge]; drops != 1 {
+		t.Errorf("Dropped %d oversized entries, want 1", drops)
+	}
+}
+
+func TestFiretailLogShipperFlushesOldBatches(t *testing.T) {
+	sent := make(chan [][]byte, 1)
+	shipper := newTestFiretailLogShipper("http://localhost")
+	shipper.maxLogAge = 10 * time.Millisecond
+	shipper.sendBatch = func(batch [][]byte) error {
+		sent <- batch
+		return nil
+	}
+	go shipper.run()
+	shipper.entries <- []byte(`"aa"`)
+
+	select {
+	case batch := <-sent:
+		if len(batch) != 1 || !bytes.Equal(batch[0], []byte(`"aa"`)) {
+			t.Errorf("Sent batch %q, want [\"aa\"]", batch)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Batch was not flushed after maxLogAge")
+	}
+}
+
+func TestFiretailLogShipperReportsApiErrors(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"message": "rate limited"}`))
+	}))
+	defer server.Close()
+
+	shipper := newTestFiretailLogShipper(server.URL)
+	shipper.retryBackoff = 10 * time.Millisecond
+	start := time.Now()
+	err := shipper.postBatch([][]byte{[]byte(`{}`)})
+	if err == nil {
+		t.Fatalf("postBatch() error = nil, want error")
+	}
+	if attempts != 3 {
+		t.Errorf("Made %d attempts, want 3", attempts)
+	}
+	// The backoff doubles, so the retries wait 10ms then 20ms
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("Retries took %s, want at least 30ms of backoff", elapsed)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The types below follow the HTTP Archive 1.2 spec: http://www.softwareishard.com/blog/har-12-spec/. Fields the
+// sensor can't know, such as DNS and connect timings or header sizes, are -1 as the spec requires.
+
+const (
+	harVersion        = "1.2"
+	harCreatorName    = "firetail-kubernetes-sensor"
+	harCreatorVersion = "1.0"
+)
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Connection      string      `json:"connection,omitempty"`
+	SrcWorkload     string      `json:"_srcWorkload,omitempty"`
+	DstWorkload     string      `json:"_dstWorkload,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+	Truncated   bool           `json:"_truncated,omitempty"`
+}
+
+// harPostData mirrors harContent's encoding field so binary request bodies can be base64 encoded too
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+	Truncated   bool           `json:"_truncated,omitempty"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// newHarEntry converts a captured request and response into a HAR entry, reading their bodies. The wait time is the
+// time between the first packets of the request and the response, which is all the sensor can measure.
+func newHarEntry(reqAndResp *httpRequestAndResponse) harEntry {
+	request := reqAndResp.request
+	response := reqAndResp.response
+
+	requestBody, requestTruncated := readCapturedBody(request.Body)
+	responseBody, responseTruncated := readCapturedBody(response.Body)
+
+	startedDateTime := reqAndResp.requestTime
+	if startedDateTime.IsZero() {
+		startedDateTime = time.Now()
+	}
+	waitMs := 0.0
+	if !reqAndResp.requestTime.IsZero() && reqAndResp.responseTime.After(reqAndResp.requestTime) {
+		waitMs = float64(reqAndResp.responseTime.Sub(reqAndResp.requestTime)) / float64(time.Millisecond)
+	}
+
+	entry := harEntry{
+		StartedDateTime: startedDateTime.UTC().Format(time.RFC3339Nano),
+		Time:            waitMs,
+		Request: harRequest{
+			Method:      request.Method,
+			URL:         requestScheme(request) + "://" + request.Host + request.URL.RequestURI(),
+			HTTPVersion: request.Proto,
+			Cookies:     harCookies(request.Cookies()),
+			Headers:     harHeaders(request.Header, request.Host),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(requestBody),
+			Truncated:   reqAndResp.requestTruncated || requestTruncated,
+		},
+		Response: harResponse{
+			Status:      response.StatusCode,
+			StatusText:  strings.TrimSpace(strings.TrimPrefix(response.Status, fmt.Sprint(response.StatusCode))),
+			HTTPVersion: response.Proto,
+			Cookies:     harCookies(response.Cookies()),
+			Headers:     harHeaders(response.Header, ""),
+			RedirectURL: response.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    len(responseBody),
+			Truncated:   reqAndResp.responseTruncated || responseTruncated,
+		},
+		Timings:         harTimings{Blocked: -1, DNS: -1, Connect: -1, Send: 0, Wait: waitMs, Receive: 0, SSL: -1},
+		ServerIPAddress: reqAndResp.dst,
+		SrcWorkload:     reqAndResp.srcWorkload,
+		DstWorkload:     reqAndResp.dstWorkload,
+	}
+	if reqAndResp.src != "" {
+		entry.Connection = reqAndResp.src + ":" + reqAndResp.srcPort
+	}
+	if entry.Response.StatusText == "" {
+		entry.Response.StatusText = http.StatusText(response.StatusCode)
+	}
+
+	for key, values := range request.URL.Query() {
+		for _, value := range values {
+			entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: key, Value: value})
+		}
+	}
+	sort.SliceStable(entry.Request.QueryString, func(i, j int) bool {
+		return entry.Request.QueryString[i].Name < entry.Request.QueryString[j].Name
+	})
+
+	if len(requestBody) > 0 {
+		mimeType := request.Header.Get("Content-Type")
+		text, encoding := harEncodeBody(requestBody, mimeType)
+		entry.Request.PostData = &harPostData{MimeType: mimeType, Text: text, Encoding: encoding}
+	}
+	mimeType := response.Header.Get("Content-Type")
+	text, encoding := harEncodeBody(responseBody, mimeType)
+	entry.Response.Content = harContent{Size: len(responseBody), MimeType: mimeType, Text: text, Encoding: encoding}
+
+	return entry
+}
+
+func harHeaders(headers http.Header, host string) []harNameValue {
+	harHeaders := []harNameValue{}
+	// The Go HTTP parser moves the Host header out of the headers map, but it was on the wire so belongs in the HAR
+	if host != "" {
+		harHeaders = append(harHeaders, harNameValue{Name: "Host", Value: host})
+	}
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range headers[key] {
+			harHeaders = append(harHeaders, harNameValue{Name: key, Value: value})
+		}
+	}
+	return harHeaders
+}
+
+func harCookies(cookies []*http.Cookie) []harNameValue {
+	harCookies := []harNameValue{}
+	for _, cookie := range cookies {
+		harCookies = append(harCookies, harNameValue{Name: cookie.Name, Value: cookie.Value})
+	}
+	return harCookies
+}
+
+// harEncodeBody returns a body as text if it's a textual content type and valid UTF-8, and as base64 otherwise
+func harEncodeBody(body []byte, contentType string) (string, string) {
+	if len(body) == 0 {
+		return "", ""
+	}
+	if isTextContentType(contentType) && utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func isTextContentType(contentType string) bool {
+	if contentType == "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	for _, suffix := range []string{"json", "xml", "javascript", "x-www-form-urlencoded", "graphql", "yaml"} {
+		if strings.HasSuffix(mediaType, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeHarFile writes a complete HAR file containing the given entries
+func writeHarFile(path string, entries []harEntry) error {
+	harBytes, err := json.MarshalIndent(harFile{Log: harLog{
+		Version: harVersion,
+		Creator: harCreator{Name: harCreatorName, Version: harCreatorVersion},
+		Entries: entries,
+	}}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to encode HAR file: %v", err)
+	}
+	if err := os.WriteFile(path, append(harBytes, '\n'), 0o644); err != nil {
+		return fmt.Errorf("Failed to write HAR file %s: %v", path, err)
+	}
+	return nil
+}
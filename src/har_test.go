@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewHarEntry(t *testing.T) {
+	reqAndResp := newTestRequestAndResponse(
+		t,
+		"POST /upload?tag=b&tag=a&id=7 HTTP/1.1\r\n"+
+			"Host: files.default.svc\r\n"+
+			"Cookie: session=abc\r\n"+
+			"Content-Type: application/octet-stream\r\n"+
+			"Content-Length: 4\r\n\r\n"+
+			"\x00\x01\x02\x03",
+		"HTTP/1.1 201 Created\r\n"+
+			"Content-Type: application/json; charset=utf-8\r\n"+
+			"Set-Cookie: seen=1\r\n"+
+			"Content-Length: 11\r\n\r\n"+
+			`{"id": 123}`,
+	)
+	reqAndResp.src, reqAndResp.srcPort, reqAndResp.dst = "10.0.0.1", "51234", "10.0.0.2"
+	reqAndResp.requestTime = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	reqAndResp.responseTime = reqAndResp.requestTime.Add(15 * time.Millisecond)
+
+	entry := newHarEntry(reqAndResp)
+
+	if entry.StartedDateTime != "2025-01-01T00:00:00Z" || entry.Time != 15 || entry.Timings.Wait != 15 {
+		t.Errorf("Timing = %s %v %+v", entry.StartedDateTime, entry.Time, entry.Timings)
+	}
+	if entry.Request.URL != "http://files.default.svc/upload?tag=b&tag=a&id=7" {
+		t.Errorf("Request.URL = %q", entry.Request.URL)
+	}
+	expectedQuery := []harNameValue{{"id", "7"}, {"tag", "b"}, {"tag", "a"}}
+	if len(entry.Request.QueryString) != len(expectedQuery) {
+		t.Fatalf("Request.QueryString = %v, want %v", entry.Request.QueryString, expectedQuery)
+	}
+	for i, expected := range expectedQuery {
+		if entry.Request.QueryString[i] != expected {
+			t.Errorf("Request.QueryString[%d] = %v, want %v", i, entry.Request.QueryString[i], expected)
+		}
+	}
+	if entry.Request.Headers[0] != (harNameValue{"Host", "files.default.svc"}) {
+		t.Errorf("First request header = %v, want Host", entry.Request.Headers[0])
+	}
+	if len(entry.Request.Cookies) != 1 || entry.Request.Cookies[0] != (harNameValue{"session", "abc"}) {
+		t.Errorf("Request.Cookies = %v", entry.Request.Cookies)
+	}
+	if entry.Request.PostData == nil || entry.Request.PostData.Encoding != "base64" || entry.Request.PostData.Text != "AAECAw==" {
+		t.Errorf("Request.PostData = %+v, want base64 encoded binary body", entry.Request.PostData)
+	}
+	if entry.Response.Status != 201 || entry.Response.StatusText != "Created" {
+		t.Errorf("Response status = %d %q", entry.Response.Status, entry.Response.StatusText)
+	}
+	if entry.Response.Content.Text != `{"id": 123}` || entry.Response.Content.Encoding != "" || entry.Response.Content.Size != 11 {
+		t.Errorf("Response.Content = %+v, want text JSON body", entry.Response.Content)
+	}
+	if len(entry.Response.Cookies) != 1 || entry.Response.Cookies[0] != (harNameValue{"seen", "1"}) {
+		t.Errorf("Response.Cookies = %v", entry.Response.Cookies)
+	}
+	if entry.Connection != "10.0.0.1:51234" || entry.ServerIPAddress != "10.0.0.2" {
+		t.Errorf("Connection = %q, ServerIPAddress = %q", entry.Connection, entry.ServerIPAddress)
+	}
+}
+
+func readHarFile(t *testing.T, path string) harFile {
+	harBytes, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read HAR file: %v", err)
+	}
+	var har harFile
+	if err := json.Unmarshal(harBytes, &har); err != nil {
+		t.Fatalf("HAR file %s is not valid JSON: %v", path, err)
+	}
+	if har.Log.Version != harVersion {
+		t.Errorf("HAR version = %q, want %q", har.Log.Version, harVersion)
+	}
+	return har
+}
+
+func TestHarWriterRotatesAndPrunes(t *testing.T) {
+	directory := t.TempDir()
+	writer, err := newHarWriter(harSinkConfig{
+		Directory:    directory,
+		MaxFileBytes: 1024,
+		MaxFileAge:   time.Hour,
+		MaxFiles:     2,
+		QueueSize:    10,
+	}, newDropCounters())
+	if err != nil {
+		t.Fatalf("newHarWriter() error = %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		writer.run()
+		close(done)
+	}()
+
+	// Each entry is around 600 bytes, so only one fits in each 1KiB file
+	for i := 0; i < 4; i++ {
+		writer.export(newTestRequestAndResponse(
+			t,
+			"GET /items HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			"HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 2\r\n\r\nok",
+		))
+	}
+	close(writer.entries)
+	<-done
+
+	files, _ := filepath.Glob(filepath.Join(directory, "*"))
+	if len(files) != 2 {
+		t.Fatalf("HAR directory has %v, want the 2 newest files", files)
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file, harFileSuffix) {
+			t.Errorf("File %s wasn't closed off", file)
+		}
+		if har := readHarFile(t, file); len(har.Log.Entries) != 1 || har.Log.Entries[0].Response.Content.Text != "ok" {
+			t.Errorf("HAR file %s has entries %+v", file, har.Log.Entries)
+		}
+	}
+}
+
+func TestHarWriterRotatesByAge(t *testing.T) {
+	directory := t.TempDir()
+	writer, err := newHarWriter(harSinkConfig{
+		Directory:    directory,
+		MaxFileBytes: 1024 * 1024,
+		MaxFileAge:   10 * time.Millisecond,
+		QueueSize:    10,
+	}, newDropCounters())
+	if err != nil {
+		t.Fatalf("newHarWriter() error = %v", err)
+	}
+	go writer.run()
+	writer.export(newTestRequestAndResponse(t, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "HTTP/1.1 204 No Content\r\n\r\n"))
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if files, _ := filepath.Glob(filepath.Join(directory, "*"+harFileSuffix)); len(files) == 1 {
+			readHarFile(t, files[0])
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("HAR file was not rotated after maxFileAge")
+}
+
+func TestHarWriterRecoversPartialFilesAndClosesOnShutdown(t *testing.T) {
+	directory := t.TempDir()
+	header := fmt.Sprintf(`{"log":{"version":%q,"creator":{"name":%q,"version":%q},"entries":[`, harVersion, harCreatorName, harCreatorVersion)
+	files := map[string]string{
+		"capture-20250101T000000.000000000Z.har": header + "\n" + `{"time":1}` + "\n]}}\n",
+		// The sensor was killed part way through writing the third entry
+		"capture-20250102T000000.000000000Z.har.partial": header + "\n" + `{"time":1},` + "\n" + `{"time":2},` + "\n" + `{"ti`,
+		"capture-20250103T000000.000000000Z.har.partial": header,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(directory, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	writer, err := newHarWriter(harSinkConfig{
+		Directory:    directory,
+		MaxFileBytes: 1024 * 1024,
+		MaxFileAge:   time.Hour,
+		MaxFiles:     2,
+		QueueSize:    10,
+	}, newDropCounters())
+	if err != nil {
+		t.Fatalf("newHarWriter() error = %v", err)
+	}
+	recovered := filepath.Join(directory, "capture-20250102T000000.000000000Z.har")
+	if har := readHarFile(t, recovered); len(har.Log.Entries) != 2 {
+		t.Errorf("Recovered HAR file has %d entries, want the 2 complete ones", len(har.Log.Entries))
+	}
+	if _, err := os.Stat(filepath.Join(directory, "capture-20250103T000000.000000000Z.har.partial")); !os.IsNotExist(err) {
+		t.Errorf("Partial file without any entries wasn't removed")
+	}
+
+	go writer.run()
+	writer.export(newTestRequestAndResponse(t, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "HTTP/1.1 204 No Content\r\n\r\n"))
+	writer.close()
+
+	// Opening the new file counts towards maxFiles, so the oldest file is removed
+	remaining, _ := filepath.Glob(filepath.Join(directory, "*"))
+	if len(remaining) != 2 || remaining[0] != recovered {
+		t.Fatalf("HAR directory has %v, want the recovered file and the one closed on shutdown", remaining)
+	}
+	if har := readHarFile(t, remaining[1]); len(har.Log.Entries) != 1 {
+		t.Errorf("HAR file closed on shutdown has %d entries, want 1", len(har.Log.Entries))
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	dropReasonHarQueueFull = "sinks.har.queueSize"
+	harFileSuffix          = ".har"
+	harPartialSuffix       = ".har.partial"
+)
+
+// harWriter writes captured requests and responses to HAR files in a directory. Entries are appended to the current
+// file as they arrive, which is named with a .partial suffix until it's rotated, at which point the HAR log is closed
+// off so the file is valid. Files are rotated when they reach maxFileBytes or maxFileAge, and only the newest maxFiles,
+// including the one being written, are kept. Partial files left behind by a previous run are closed off on startup.
+type harWriter struct {
+	directory    string
+	maxFileBytes int64
+	maxFileAge   time.Duration
+	maxFiles     int
+	entries      chan []byte
+	drops        *dropCounters
+	now          func() time.Time
+	file         *os.File
+	path         string
+	size         int64
+	entryCount   int
+	// stop makes run close off the current file and return, after which it closes stopped
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func newHarWriter(config harSinkConfig, drops *dropCounters) (*harWriter, error) {
+	if err := os.MkdirAll(config.Directory, 0o755); err != nil {
+		return nil, fmt.Errorf("Failed to create HAR directory %s: %v", config.Directory, err)
+	}
+	w := &harWriter{
+		directory:    config.Directory,
+		maxFileBytes: config.MaxFileBytes,
+		maxFileAge:   config.MaxFileAge,
+		maxFiles:     config.MaxFiles,
+		entries:      make(chan []byte, config.QueueSize),
+		drops:        drops,
+		now:          time.Now,
+		stop:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	w.recoverPartialFiles()
+	w.prune()
+	return w, nil
+}
+
+// export converts the request and response to a HAR entry and queues it to be written. If the queue is full it's
+// dropped rather than holding up the pipeline's worker.
+func (w *harWriter) export(reqAndResp *httpRequestAndResponse) {
+	entryBytes, err := json.Marshal(newHarEntry(reqAndResp))
+	if err != nil {
+		slog.Error("Failed to encode HAR entry:", "Err", err.Error())
+		return
+	}
+	select {
+	case w.entries <- entryBytes:
+	default:
+		slog.Warn("HAR writer queue full, dropping entry")
+		w.drops.increment(dropReasonHarQueueFull)
+	}
+}
+
+// run writes queued entries until the entries channel is closed or close is called, at which point the current file is
+// closed off
+func (w *harWriter) run() {
+	defer close(w.stopped)
+	rotateTimer := time.NewTimer(w.maxFileAge)
+	rotateTimer.Stop()
+	for {
+		select {
+		case <-w.stop:
+			w.writeQueued()
+			w.rotate()
+			return
+		case entry, ok := <-w.entries:
+			if !ok {
+				w.rotate()
+				return
+			}
+			opened := w.file == nil
+			if err := w.write(entry); err != nil {
+				slog.Error("Failed to write HAR entry:", "Err", err.Error())
+				continue
+			}
+			if opened {
+				rotateTimer.Reset(w.maxFileAge)
+			}
+			if w.file == nil {
+				rotateTimer.Stop()
+			}
+		case <-rotateTimer.C:
+			w.rotate()
+		}
+	}
+}
+
+// close writes the queued entries, closes off the current file and waits for run to return, so the file is valid if
+// the sensor is shutting down. Entries exported afterwards are queued but never written.
+func (w *harWriter) close() {
+	close(w.stop)
+	<-w.stopped
+}
+
+// writeQueued writes the entries already queued without waiting for more
+func (w *harWriter) writeQueued() {
+	for {
+		select {
+		case entry, ok := <-w.entries:
+			if !ok {
+				return
+			}
+			if err := w.write(entry); err != nil {
+				slog.Error("Failed to write HAR entry:", "Err", err.Error())
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (w *harWriter) write(entry []byte) error {
+	if w.file != nil && w.size+int64(len(entry))+1 > w.maxFileBytes {
+		w.rotate()
+	}
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	separator := ""
+	if w.entryCount > 0 {
+		separator = ","
+	}
+	written, err := w.file.WriteString(separator + "\n" + string(entry))
+	w.size += int64(written)
+	if err != nil {
+		return err
+	}
+	w.entryCount++
+	if w.size >= w.maxFileBytes {
+		w.rotate()
+	}
+	return nil
+}
+
+func (w *harWriter) open() error {
+	header, err := json.Marshal(harCreator{Name: harCreatorName, Version: harCreatorVersion})
+	if err != nil {
+		return err
+	}
+	name := "capture-" + w.now().UTC().Format("20060102T150405.000000000Z")
+	w.path = filepath.Join(w.directory, name+harPartialSuffix)
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("Failed to create HAR file: %v", err)
+	}
+	written, err := fmt.Fprintf(file, `{"log":{"version":%q,"creator":%s,"entries":[`, harVersion, header)
+	if err != nil {
+		file.Close()
+		os.Remove(w.path)
+		return fmt.Errorf("Failed to write HAR file header: %v", err)
+	}
+	w.file, w.size, w.entryCount = file, int64(written), 0
+	w.prune()
+	return nil
+}
+
+// rotate closes off the current file, if there is one, and removes the oldest files beyond maxFiles
+func (w *harWriter) rotate() {
+	if w.file == nil {
+		return
+	}
+	_, err := w.file.WriteString("\n]}}\n")
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.file = nil
+	if err != nil {
+		slog.Error("Failed to close HAR file:", "Path", w.path, "Err", err.Error())
+		return
+	}
+	finalPath := strings.TrimSuffix(w.path, harPartialSuffix) + harFileSuffix
+	if err := os.Rename(w.path, finalPath); err != nil {
+		slog.Error("Failed to rename HAR file:", "Path", w.path, "Err", err.Error())
+		return
+	}
+	slog.Debug("Rotated HAR file", "Path", finalPath, "Entries", w.entryCount, "Bytes", w.size)
+	w.prune()
+}
+
+// prune removes the oldest files beyond maxFiles, counting the file being written, which is never removed
+func (w *harWriter) prune() {
+	if w.maxFiles <= 0 {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(w.directory, "capture-*"+harFileSuffix))
+	if err != nil {
+		return
+	}
+	partialFiles, err := filepath.Glob(filepath.Join(w.directory, "capture-*"+harPartialSuffix))
+	if err != nil {
+		return
+	}
+	files = append(files, partialFiles...)
+	if len(files) <= w.maxFiles {
+		return
+	}
+	// The file names are timestamps, so sort oldest first
+	sort.Strings(files)
+	for _, file := range files[:len(files)-w.maxFiles] {
+		if w.file != nil && file == w.path {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			slog.Error("Failed to remove old HAR file:", "Path", file, "Err", err.Error())
+		}
+	}
+}
+
+// recoverPartialFiles closes off the partial files left behind by a sensor that didn't shut down cleanly, keeping
+// every entry up to the first incomplete one. Files without any complete entries are removed.
+func (w *harWriter) recoverPartialFiles() {
+	paths, err := filepath.Glob(filepath.Join(w.directory, "capture-*"+harPartialSuffix))
+	if err != nil {
+		return
+	}
+	for _, path := range paths {
+		entries, err := recoverHarFile(path)
+		if err != nil {
+			slog.Warn("Removing HAR file which couldn't be recovered:", "Path", path, "Err", err.Error())
+			if err := os.Remove(path); err != nil {
+				slog.Error("Failed to remove HAR file:", "Path", path, "Err", err.Error())
+			}
+			continue
+		}
+		slog.Info("Recovered HAR file left behind by a previous run", "Path", path, "Entries", entries)
+	}
+}
+
+// recoverHarFile rewrites a partial file as a complete one and renames it, returning how many entries it kept. Each
+// entry was written on its own line, so the file is read line by line until one isn't valid JSON.
+func recoverHarFile(path string) (int, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	lines := bytes.Split(content, []byte("\n"))
+	if !bytes.HasPrefix(lines[0], []byte(`{"log":`)) {
+		return 0, fmt.Errorf("file doesn't start with a HAR header")
+	}
+	entries := [][]byte{}
+	for _, line := range lines[1:] {
+		entry := bytes.TrimSuffix(line, []byte(","))
+		if !json.Valid(entry) {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return 0, fmt.Errorf("file has no complete entries")
+	}
+	recovered := bytes.Join([][]byte{lines[0], bytes.Join(entries, []byte(",\n"))}, []byte("\n"))
+	recovered = append(recovered, "\n]}}\n"...)
+	if err := os.WriteFile(path, recovered, 0o644); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(path, strings.TrimSuffix(path, harPartialSuffix)+harFileSuffix); err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+)
+
+// healthServer serves liveness and readiness endpoints for Kubernetes probes. The sensor is live as long as it can
+// serve requests, and ready once it's capturing on at least one interface, so a sensor whose captures keep failing is
+// reported rather than restarted in a tight loop. It also serves the drop counters, and the protocols detected on
+// each port if protocol detection is enabled, as Prometheus metrics.
+type healthServer struct {
+	address       string
+	captureHealth func() []interfaceHealth
+	drops         *dropCounters
+	// protocolStats is nil if protocol detection is disabled
+	protocolStats *protocolStats
+}
+
+type readinessResponse struct {
+	Ready      bool              `json:"ready"`
+	Interfaces []interfaceHealth `json:"interfaces"`
+}
+
+func newHealthServer(address string, captureHealth func() []interfaceHealth, drops *dropCounters, protocolStats *protocolStats) *healthServer {
+	return &healthServer{address: address, captureHealth: captureHealth, drops: drops, protocolStats: protocolStats}
+}
+
+func (h *healthServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /livez", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		interfaces := h.captureHealth()
+		response := readinessResponse{
+			Ready:      slices.ContainsFunc(interfaces, func(i interfaceHealth) bool { return i.Capturing }),
+			Interfaces: interfaces,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !response.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			slog.Debug("Failed to write readiness response:", "Err", err.Error())
+		}
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		h.writeMetrics(w)
+	})
+	return mux
+}
+
+// writeMetrics writes the metrics in the Prometheus text format, sorted so the output is stable
+func (h *healthServer) writeMetrics(w http.ResponseWriter) {
+	drops := h.drops.snapshot()
+	reasons := make([]string, 0, len(drops))
+	for reason := range drops {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	fmt.Fprintln(w, "# HELP firetail_sensor_dropped_total Requests and responses dropped by each policy since the sensor started.")
+	fmt.Fprintln(w, "# TYPE firetail_sensor_dropped_total counter")
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "firetail_sensor_dropped_total{reason=%q} %d\n", reason, drops[reason])
+	}
+	if h.protocolStats == nil {
+		return
+	}
+	protocols := h.protocolStats.snapshot()
+	ports := make([]string, 0, len(protocols))
+	for port := range protocols {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	fmt.Fprintln(w, "# HELP firetail_sensor_connections_total Connections seen with each detected protocol by server port since the sensor started.")
+	fmt.Fprintln(w, "# TYPE firetail_sensor_connections_total counter")
+	for _, port := range ports {
+		names := make([]string, 0, len(protocols[port]))
+		for protocol := range protocols[port] {
+			names = append(names, protocol)
+		}
+		sort.Strings(names)
+		for _, protocol := range names {
+			fmt.Fprintf(w, "firetail_sensor_connections_total{port=%q,protocol=%q} %d\n", port, protocol, protocols[port][protocol])
+		}
+	}
+}
+
+func (h *healthServer) run() {
+	if err := http.ListenAndServe(h.address, h.handler()); err != nil {
+		slog.Error("Health server stopped:", "Address", h.address, "Err", err.Error())
+	}
+}
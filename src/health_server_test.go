@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthServerReadiness(t *testing.T) {
+	retryAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name           string
+		interfaces     []interfaceHealth
+		expectedStatus int
+	}{
+		{
+			name:           "No interfaces opened yet",
+			interfaces:     []interfaceHealth{},
+			expectedStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name: "Every capture failing",
+			interfaces: []interfaceHealth{
+				{Interface: "eth0", Failures: 3, LastError: "permission denied", RetryAt: &retryAt},
+			},
+			expectedStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name: "One capture running",
+			interfaces: []interfaceHealth{
+				{Interface: "cali1a2b", Capturing: true},
+				{Interface: "eth0", Failures: 3, LastError: "permission denied", RetryAt: &retryAt},
+			},
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newHealthServer(":0", func() []interfaceHealth { return tt.interfaces }, newDropCounters(), nil)
+			recorder := httptest.NewRecorder()
+			server.handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if recorder.Code != tt.expectedStatus {
+				t.Errorf("Status = %d, want %d", recorder.Code, tt.expectedStatus)
+			}
+			var response readinessResponse
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatalf("Failed to parse readiness response: %v", err)
+			}
+			if response.Ready != (tt.expectedStatus == http.StatusOK) || len(response.Interfaces) != len(tt.interfaces) {
+				t.Errorf("Response = %+v, want ready %v with %d interface(s)", response, tt.expectedStatus == http.StatusOK, len(tt.interfaces))
+			}
+
+			// The sensor is live whether or not it's capturing
+			recorder = httptest.NewRecorder()
+			server.handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/livez", nil))
+			if recorder.Code != http.StatusOK {
+				t.Errorf("Liveness status = %d, want %d", recorder.Code, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestHealthServerMetrics(t *testing.T) {
+	drops := newDropCounters()
+	drops.increment(dropReasonSamplingProbability)
+	drops.increment(dropReasonCaptureRules)
+	drops.increment(dropReasonCaptureRules)
+	stats := newProtocolStats()
+	stats.increment("8080", protocolHttp)
+	stats.increment("5432", protocolPostgresql)
+	server := newHealthServer(":0", func() []interfaceHealth { return nil }, drops, stats)
+
+	recorder := httptest.NewRecorder()
+	server.handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	for _, expected := range []string{
+		"firetail_sensor_dropped_total{reason=\"filtering.rules\"} 2\nfiretail_sensor_dropped_total{reason=\"sampling.probability\"} 1\n",
+		"firetail_sensor_connections_total{port=\"5432\",protocol=\"postgresql\"} 1\nfiretail_sensor_connections_total{port=\"8080\",protocol=\"http\"} 1\n",
+	} {
+		if !strings.Contains(recorder.Body.String(), expected) {
+			t.Errorf("Metrics = %q, want them to contain %q", recorder.Body.String(), expected)
+		}
+	}
+}
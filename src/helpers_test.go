@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// newTestRequestAndResponse parses a request and response as the sensor would read them off the wire
+func newTestRequestAndResponse(t *testing.T, requestBytes string, responseBytes string) *httpRequestAndResponse {
+	request, err := http.ReadRequest(bufio.NewReader(strings.NewReader(requestBytes)))
+	if err != nil {
+		t.Fatalf("Failed to read request: %v", err)
+	}
+	response, err := http.ReadResponse(bufio.NewReader(strings.NewReader(responseBytes)), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	return &httpRequestAndResponse{request: request, response: response}
+}
+
+// newTestResponseBytes returns an empty response with the given status code
+func newTestResponseBytes(statusCode int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Length: 0\r\n\r\n", statusCode, http.StatusText(statusCode))
+}
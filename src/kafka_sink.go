@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+const (
+	dropReasonKafkaQueueFull    = "sinks.kafka.queueSize"
+	dropReasonKafkaRejected     = "sinks.kafka.rejected"
+	dropReasonKafkaEncodeFailed = "sinks.kafka.encodeFailed"
+	kafkaFormatJson             = "json"
+	kafkaFormatProtobuf         = "protobuf"
+	kafkaPartitionKeyNone       = "none"
+	kafkaMaxAttempts            = 3
+	// kafkaMaxBatchAge is the longest linger franz-go allows
+	kafkaMaxBatchAge = time.Minute
+)
+
+var kafkaPartitionKeys = []string{"dstWorkload", "srcWorkload", "dstIp", "srcIp", "host", kafkaPartitionKeyNone}
+
+var kafkaCompressionCodecs = map[string]kgo.CompressionCodec{"none": kgo.NoCompression(), "gzip": kgo.GzipCompression()}
+
+var kafkaSaslMechanisms = []string{"PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512"}
+
+// kafkaSink publishes captured requests and responses as events to a Kafka topic with a franz-go client. The client
+// batches events until a batch reaches maxBatchBytes or its oldest event is maxBatchAge old, then sends it to the
+// partition's leader. Partitions are picked by hashing the configured partition key the same way as the Java client,
+// so consumers see all the events for a key in order.
+type kafkaSink struct {
+	topic        string
+	format       string
+	partitionKey string
+	timeout      time.Duration
+	kubernetes   kubernetesConfig
+	client       *kgo.Client
+	drops        *dropCounters
+}
+
+// newKafkaSink creates a sink and its client. Any opts are applied after the ones built from the config.
+func newKafkaSink(config kafkaSinkConfig, kubernetesConfig kubernetesConfig, drops *dropCounters, opts ...kgo.Opt) (*kafkaSink, error) {
+	clientOpts, err := kafkaClientOpts(config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := kgo.NewClient(append(clientOpts, opts...)...)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create Kafka client: %v", err)
+	}
+	return &kafkaSink{
+		topic:        config.Topic,
+		format:       config.Format,
+		partitionKey: config.PartitionKey,
+		timeout:      config.Timeout,
+		kubernetes:   kubernetesConfig,
+		client:       client,
+		drops:        drops,
+	}, nil
+}
+
+// kafkaClientOpts configures a franz-go client to produce to the configured topic. Idempotent writes are disabled, as
+// they need acks from all in-sync replicas, and records are failed after kafkaMaxAttempts tries so the sink never holds
+// onto events indefinitely while Kafka is unavailable.
+func kafkaClientOpts(config kafkaSinkConfig) ([]kgo.Opt, error) {
+	acks := kgo.AllISRAcks()
+	switch config.Acks {
+	case 0:
+		acks = kgo.NoAck()
+	case 1:
+		acks = kgo.LeaderAck()
+	}
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(config.Brokers...),
+		kgo.ClientID(config.ClientId),
+		kgo.DefaultProduceTopic(config.Topic),
+		kgo.RequiredAcks(acks),
+		kgo.DisableIdempotentWrite(),
+		kgo.RecordPartitioner(kgo.StickyKeyPartitioner(nil)),
+		kgo.ProducerBatchCompression(kafkaCompressionCodecs[config.Compression]),
+		kgo.ProducerBatchMaxBytes(int32(config.MaxBatchBytes)),
+		kgo.ProducerLinger(config.MaxBatchAge),
+		kgo.MaxBufferedRecords(config.QueueSize),
+		kgo.ProduceRequestTimeout(config.Timeout),
+		kgo.DialTimeout(config.Timeout),
+		kgo.RecordRetries(kafkaMaxAttempts),
+		kgo.UnknownTopicRetries(kafkaMaxAttempts),
+		kgo.RequestRetries(kafkaMaxAttempts),
+	}
+	if config.Tls.Enabled {
+		tlsConfig, err := newKafkaTlsConfig(config.Tls)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, kgo.DialTLSConfig(tlsConfig))
+	}
+	switch config.Sasl.Mechanism {
+	case "PLAIN":
+		opts = append(opts, kgo.SASL(plain.Auth{User: config.Sasl.Username, Pass: config.Sasl.Password}.AsMechanism()))
+	case "SCRAM-SHA-256":
+		opts = append(opts, kgo.SASL(scram.Auth{User: config.Sasl.Username, Pass: config.Sasl.Password}.AsSha256Mechanism()))
+	case "SCRAM-SHA-512":
+		opts = append(opts, kgo.SASL(scram.Auth{User: config.Sasl.Username, Pass: config.Sasl.Password}.AsSha512Mechanism()))
+	}
+	return opts, nil
+}
+
+func newKafkaTlsConfig(config kafkaTlsConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if config.CaFile != "" {
+		ca, err := os.ReadFile(config.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read Kafka TLS CA file: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("Kafka TLS CA file %s doesn't contain any PEM certificates", config.CaFile)
+		}
+	}
+	if config.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load Kafka TLS client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+// export serialises the request and response and queues it to be published. If the queue is full it's dropped
+// rather than holding up the pipeline's worker.
+func (s *kafkaSink) export(reqAndResp *httpRequestAndResponse) {
+	event := newApiEvent(reqAndResp, s.kubernetes)
+	var value []byte
+	if s.format == kafkaFormatProtobuf {
+		value = event.marshalProto()
+	} else {
+		var err error
+		if value, err = event.marshalJson(); err != nil {
+			slog.Error("Failed to encode Kafka event:", "Err", err.Error())
+			s.drops.increment(dropReasonKafkaEncodeFailed)
+			return
+		}
+	}
+	s.produce(&kgo.Record{Key: s.recordKey(reqAndResp), Value: value, Timestamp: event.Timing.RequestTime})
+}
+
+// exportFinding queues a finding to be published as a JSON event, keyed by its service. Findings are published by
+// their own sink so they can go to a different topic from API events.
+func (s *kafkaSink) exportFinding(f finding) {
+	value, err := newFindingEvent(f, s.kubernetes).marshalJson()
+	if err != nil {
+		slog.Error("Failed to encode Kafka finding event:", "Err", err.Error())
+		s.drops.increment(dropReasonKafkaEncodeFailed)
+		return
+	}
+	record := &kgo.Record{Value: value, Timestamp: f.LastSeen}
+	if f.Service != "" {
+		record.Key = []byte(f.Service)
+	}
+	s.produce(record)
+}
+
+// exportConnection queues a connection summary to be published as a JSON event, keyed by its destination workload or
+// IP. Like findings, connection summaries are published by their own sink.
+func (s *kafkaSink) exportConnection(summary *connectionSummary) {
+	value, err := newConnectionEvent(summary, s.kubernetes).marshalJson()
+	if err != nil {
+		slog.Error("Failed to encode Kafka connection event:", "Err", err.Error())
+		s.drops.increment(dropReasonKafkaEncodeFailed)
+		return
+	}
+	record := &kgo.Record{Value: value, Timestamp: summary.end}
+	if summary.dstWorkload != "" {
+		record.Key = []byte(summary.dstWorkload)
+	} else {
+		record.Key = []byte(summary.dst)
+	}
+	s.produce(record)
+}
+
+func (s *kafkaSink) recordKey(reqAndResp *httpRequestAndResponse) []byte {
+	var key string
+	switch s.partitionKey {
+	case "dstWorkload":
+		key = reqAndResp.dstWorkload
+		if key == "" {
+			key = reqAndResp.dst
+		}
+	case "srcWorkload":
+		key = reqAndResp.srcWorkload
+		if key == "" {
+			key = reqAndResp.src
+		}
+	case "dstIp":
+		key = reqAndResp.dst
+	case "srcIp":
+		key = reqAndResp.src
+	case "host":
+		key = reqAndResp.request.Host
+	}
+	if key == "" {
+		return nil
+	}
+	return []byte(key)
+}
+
+// produce hands a record to the client without blocking. If the client already has queueSize records buffered, or the
+// record fails to be published, it's dropped and counted.
+func (s *kafkaSink) produce(record *kgo.Record) {
+	s.client.TryProduce(context.Background(), record, func(record *kgo.Record, err error) {
+		switch {
+		case err == nil:
+		case errors.Is(err, kgo.ErrMaxBuffered):
+			slog.Warn("Kafka sink queue full, dropping event")
+			s.drops.increment(dropReasonKafkaQueueFull)
+		default:
+			slog.Error("Failed to publish event to Kafka:", "Topic", record.Topic, "Err", err.Error())
+			s.drops.increment(dropReasonKafkaRejected)
+		}
+	})
+}
+
+// close publishes any buffered events and closes the client, waiting at most the sink's timeout for them to be sent
+func (s *kafkaSink) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	if err := s.client.Flush(ctx); err != nil {
+		slog.Error("Failed to publish buffered events to Kafka:", "Topic", s.topic, "Err", err.Error())
+	}
+	s.client.Close()
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"github.com/xdg-go/scram"
+)
+
+// testKafkaBroker is an in-process stand-in for a single Kafka broker, which the sink's franz-go client talks to.
+// Requests and responses are decoded and encoded by franz-go's kmsg package. It checks each record batch's CRC and
+// decompresses it, and can require TLS and SASL authentication with an independent SCRAM server.
+type testKafkaBroker struct {
+	t          *testing.T
+	listener   net.Listener
+	topic      string
+	partitions int32
+	// tlsConfig makes the broker listen with TLS if it's set
+	tlsConfig *tls.Config
+	// sasl makes the broker require authentication with its mechanism, username and password if it's set
+	sasl     kafkaSaslConfig
+	mutex    sync.Mutex
+	records  map[int32][]testKafkaRecord
+	produces int
+	// produceErrors are returned for every partition in the first produce requests, one per request
+	produceErrors []int16
+}
+
+type testKafkaRecord struct {
+	key       []byte
+	value     []byte
+	timestamp time.Time
+}
+
+func newTestKafkaBroker(t *testing.T, topic string, partitions int32) *testKafkaBroker {
+	return startTestKafkaBroker(&testKafkaBroker{t: t, topic: topic, partitions: partitions})
+}
+
+// startTestKafkaBroker starts a broker once its settings are filled in, so they're never changed while it's serving
+func startTestKafkaBroker(broker *testKafkaBroker) *testKafkaBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		broker.t.Fatalf("Failed to listen: %v", err)
+	}
+	if broker.tlsConfig != nil {
+		listener = tls.NewListener(listener, broker.tlsConfig)
+	}
+	broker.listener = listener
+	broker.records = map[int32][]testKafkaRecord{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(conn)
+		}
+	}()
+	broker.t.Cleanup(func() { listener.Close() })
+	return broker
+}
+
+// testKafkaSession is a connection's SASL state
+type testKafkaSession struct {
+	mechanism     string
+	conversation  *scram.ServerConversation
+	authenticated bool
+}
+
+func (b *testKafkaBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	session := &testKafkaSession{}
+	for {
+		var sizeBytes [4]byte
+		if _, err := io.ReadFull(conn, sizeBytes[:]); err != nil {
+			return
+		}
+		request := make([]byte, binary.BigEndian.Uint32(sizeBytes[:]))
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		// Requests have a v1 header, which is the API key and version, correlation ID and client ID, followed by tagged
+		// fields if the request is flexible
+		if len(request) < 10 {
+			b.t.Errorf("Request is too short for its header: %d bytes", len(request))
+			return
+		}
+		apiKey := int16(binary.BigEndian.Uint16(request))
+		apiVersion := int16(binary.BigEndian.Uint16(request[2:]))
+		correlationId := binary.BigEndian.Uint32(request[4:])
+		clientIdLength := int(int16(binary.BigEndian.Uint16(request[8:])))
+		body := request[10+max(clientIdLength, 0):]
+
+		decoded := kmsg.RequestForKey(apiKey)
+		if decoded == nil {
+			b.t.Errorf("Unexpected request for API key %d", apiKey)
+			return
+		}
+		decoded.SetVersion(apiVersion)
+		if decoded.IsFlexible() {
+			if body = skipTestKafkaTags(body); body == nil {
+				b.t.Errorf("Request for API key %d has invalid tagged fields in its header", apiKey)
+				return
+			}
+		}
+		if err := decoded.ReadFrom(body); err != nil {
+			b.t.Errorf("Failed to decode request for API key %d version %d: %v", apiKey, apiVersion, err)
+			return
+		}
+
+		var response kmsg.Response
+		switch decoded := decoded.(type) {
+		case *kmsg.ApiVersionsRequest:
+			response = b.apiVersions(decoded)
+		case *kmsg.SASLHandshakeRequest:
+			response = b.saslHandshake(decoded, session)
+		case *kmsg.SASLAuthenticateRequest:
+			response = b.saslAuthenticate(decoded, session)
+		case *kmsg.MetadataRequest:
+			if b.sasl.Mechanism != "" && !session.authenticated {
+				b.t.Errorf("Metadata request before SASL authentication")
+				return
+			}
+			response = b.metadata(decoded)
+		case *kmsg.ProduceRequest:
+			if b.sasl.Mechanism != "" && !session.authenticated {
+				b.t.Errorf("Produce request before SASL authentication")
+				return
+			}
+			response = b.produce(decoded)
+		default:
+			b.t.Errorf("Unexpected request for API key %d version %d", apiKey, apiVersion)
+			return
+		}
+		if response == nil {
+			continue
+		}
+		// Flexible responses have tagged fields after the correlation ID, except for ApiVersions, so clients can read
+		// it whichever version they asked for
+		header := binary.BigEndian.AppendUint32(nil, correlationId)
+		if response.IsFlexible() && response.Key() != kmsg.ApiVersions.Int16() {
+			header = append(header, 0)
+		}
+		encoded := response.AppendTo(nil)
+		framed := binary.BigEndian.AppendUint32(nil, uint32(len(header)+len(encoded)))
+		framed = append(framed, header...)
+		if _, err := conn.Write(append(framed, encoded...)); err != nil {
+			return
+		}
+	}
+}
+
+// skipTestKafkaTags skips over the tagged fields at the start of b, returning nil if they're invalid
+func skipTestKafkaTags(b []byte) []byte {
+	tags, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil
+	}
+	b = b[n:]
+	for i := uint64(0); i < tags; i++ {
+		if _, n = binary.Uvarint(b); n <= 0 {
+			return nil
+		}
+		b = b[n:]
+		size, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < size {
+			return nil
+		}
+		b = b[n+int(size):]
+	}
+	return b
+}
+
+// apiVersions advertises the requests the broker handles, at every version kmsg supports
+func (b *testKafkaBroker) apiVersions(request *kmsg.ApiVersionsRequest) kmsg.Response {
+	response := request.ResponseKind().(*kmsg.ApiVersionsResponse)
+	for _, supported := range []kmsg.Request{
+		kmsg.NewPtrApiVersionsRequest(),
+		kmsg.NewPtrSASLHandshakeRequest(),
+		kmsg.NewPtrSASLAuthenticateRequest(),
+		kmsg.NewPtrMetadataRequest(),
+		kmsg.NewPtrProduceRequest(),
+	} {
+		response.ApiKeys = append(response.ApiKeys, kmsg.ApiVersionsResponseApiKey{
+			ApiKey:     supported.Key(),
+			MaxVersion: supported.MaxVersion(),
+		})
+	}
+	return response
+}
+
+func (b *testKafkaBroker) saslHandshake(request *kmsg.SASLHandshakeRequest, session *testKafkaSession) kmsg.Response {
+	response := request.ResponseKind().(*kmsg.SASLHandshakeResponse)
+	response.SupportedMechanisms = []string{b.sasl.Mechanism}
+	if request.Mechanism != b.sasl.Mechanism {
+		response.ErrorCode = 33 // UNSUPPORTED_SASL_MECHANISM
+		return response
+	}
+	session.mechanism = request.Mechanism
+	if strings.HasPrefix(request.Mechanism, "SCRAM-") {
+		hash := scram.SHA256
+		if request.Mechanism == "SCRAM-SHA-512" {
+			hash = scram.SHA512
+		}
+		server, err := hash.NewServer(func(username string) (scram.StoredCredentials, error) {
+			client, err := hash.NewClient(b.sasl.Username, b.sasl.Password, "")
+			if err != nil {
+				return scram.StoredCredentials{}, err
+			}
+			return client.GetStoredCredentials(scram.KeyFactors{Salt: "test-salt", Iters: 4096}), nil
+		})
+		if err != nil {
+			b.t.Fatalf("Failed to create SCRAM server: %v", err)
+		}
+		session.conversation = server.NewConversation()
+	}
+	return response
+}
+
+func (b *testKafkaBroker) saslAuthenticate(request *kmsg.SASLAuthenticateRequest, session *testKafkaSession) kmsg.Response {
+	response := request.ResponseKind().(*kmsg.SASLAuthenticateResponse)
+	fail := func(message string) kmsg.Response {
+		response.ErrorCode = 58 // SASL_AUTHENTICATION_FAILED
+		response.ErrorMessage = &message
+		return response
+	}
+	switch {
+	case session.mechanism == "PLAIN":
+		if string(request.SASLAuthBytes) != "\x00"+b.sasl.Username+"\x00"+b.sasl.Password {
+			return fail("Invalid username or password")
+		}
+		session.authenticated = true
+	case session.conversation != nil:
+		challenge, err := session.conversation.Step(string(request.SASLAuthBytes))
+		if err != nil {
+			return fail(err.Error())
+		}
+		response.SASLAuthBytes = []byte(challenge)
+		session.authenticated = session.conversation.Done() && session.conversation.Valid()
+	default:
+		b.t.Errorf("SASL authenticate request before handshake")
+	}
+	return response
+}
+
+func (b *testKafkaBroker) metadata(request *kmsg.MetadataRequest) kmsg.Response {
+	if request.AllowAutoTopicCreation {
+		b.t.Errorf("Metadata request allows topics to be created")
+	}
+	host, port, _ := net.SplitHostPort(b.listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+	response := request.ResponseKind().(*kmsg.MetadataResponse)
+	response.Brokers = []kmsg.MetadataResponseBroker{{NodeID: 0, Host: host, Port: int32(portNumber)}}
+	for _, requestTopic := range request.Topics {
+		topic := kmsg.NewMetadataResponseTopic()
+		topic.Topic = requestTopic.Topic
+		if requestTopic.Topic == nil || *requestTopic.Topic != b.topic {
+			topic.ErrorCode = 3 // UNKNOWN_TOPIC_OR_PARTITION
+			response.Topics = append(response.Topics, topic)
+			continue
+		}
+		for partition := int32(0); partition < b.partitions; partition++ {
+			topic.Partitions = append(topic.Partitions, kmsg.MetadataResponseTopicPartition{
+				Partition: partition,
+				Leader:    0,
+				Replicas:  []int32{0},
+				ISR:       []int32{0},
+			})
+		}
+		response.Topics = append(response.Topics, topic)
+	}
+	return response
+}
+
+func (b *testKafkaBroker) produce(request *kmsg.ProduceRequest) kmsg.Response {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var produceError int16
+	if b.produces < len(b.produceErrors) {
+		produceError = b.produceErrors[b.produces]
+	}
+	b.produces++
+
+	response := request.ResponseKind().(*kmsg.ProduceResponse)
+	for _, requestTopic := range request.Topics {
+		topic := kmsg.ProduceResponseTopic{Topic: requestTopic.Topic}
+		for _, requestPartition := range requestTopic.Partitions {
+			records := b.decodeRecordBatch(requestPartition.Records)
+			if produceError == 0 {
+				b.records[requestPartition.Partition] = append(b.records[requestPartition.Partition], records...)
+			}
+			partition := kmsg.NewProduceResponseTopicPartition()
+			partition.Partition = requestPartition.Partition
+			partition.ErrorCode = produceError
+			topic.Partitions = append(topic.Partitions, partition)
+		}
+		response.Topics = append(response.Topics, topic)
+	}
+	if request.Acks == 0 {
+		return nil
+	}
+	return response
+}
+
+func (b *testKafkaBroker) decodeRecordBatch(encoded []byte) []testKafkaRecord {
+	var batch kmsg.RecordBatch
+	if err := batch.ReadFrom(encoded); err != nil {
+		b.t.Errorf("Failed to decode record batch: %v", err)
+		return nil
+	}
+	if int(batch.Length) != len(encoded)-12 {
+		b.t.Errorf("Record batch length = %d, want %d", batch.Length, len(encoded)-12)
+	}
+	if batch.Magic != 2 {
+		b.t.Errorf("Record batch magic = %d, want 2", batch.Magic)
+	}
+	// The CRC covers everything from the attributes to the end of the batch
+	if actual := crc32.Checksum(encoded[21:], crc32.MakeTable(crc32.Castagnoli)); actual != uint32(batch.CRC) {
+		b.t.Errorf("Record batch CRC = %x, want %x", uint32(batch.CRC), actual)
+	}
+
+	recordBytes := batch.Records
+	if batch.Attributes&7 == 1 {
+		reader, err := gzip.NewReader(bytes.NewReader(recordBytes))
+		if err != nil {
+			b.t.Errorf("Failed to decompress record batch: %v", err)
+			return nil
+		}
+		if recordBytes, err = io.ReadAll(reader); err != nil {
+			b.t.Errorf("Failed to decompress record batch: %v", err)
+			return nil
+		}
+	}
+
+	records := []testKafkaRecord{}
+	for i := int32(0); i < batch.NumRecords; i++ {
+		length, n := binary.Varint(recordBytes)
+		if n <= 0 || int(length) > len(recordBytes)-n {
+			b.t.Errorf("Record %d has an invalid length", i)
+			return records
+		}
+		var record kmsg.Record
+		if err := record.ReadFrom(recordBytes[:n+int(length)]); err != nil {
+			b.t.Errorf("Failed to decode record %d: %v", i, err)
+			return records
+		}
+		if record.OffsetDelta != i {
+			b.t.Errorf("Record %d has offset delta %d", i, record.OffsetDelta)
+		}
+		recordBytes = recordBytes[n+int(length):]
+		records = append(records, testKafkaRecord{
+			key:       record.Key,
+			value:     record.Value,
+			timestamp: time.UnixMilli(batch.FirstTimestamp + record.TimestampDelta64),
+		})
+	}
+	if len(recordBytes) > 0 {
+		b.t.Errorf("Record batch has %d bytes after its %d records", len(recordBytes), batch.NumRecords)
+	}
+	return records
+}
+
+func (b *testKafkaBroker) receivedRecords() map[int32][]testKafkaRecord {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	records := map[int32][]testKafkaRecord{}
+	for partition, partitionRecords := range b.records {
+		records[partition] = slices.Clone(partitionRecords)
+	}
+	return records
+}
+
+func newTestKafkaSinkConfig(broker *testKafkaBroker, format string, acks int) kafkaSinkConfig {
+	return kafkaSinkConfig{
+		Brokers:       []string{broker.listener.Addr().String()},
+		Topic:         broker.topic,
+		ClientId:      "test",
+		Format:        format,
+		PartitionKey:  "dstWorkload",
+		Compression:   "gzip",
+		Acks:          acks,
+		Timeout:       5 * time.Second,
+		MaxBatchBytes: 1024 * 1024,
+		MaxBatchAge:   time.Minute,
+		QueueSize:     10,
+	}
+}
+
+func newTestKafkaSink(broker *testKafkaBroker, format string, acks int) *kafkaSink {
+	return newTestKafkaSinkWithConfig(broker.t, newTestKafkaSinkConfig(broker, format, acks))
+}
+
+func newTestKafkaSinkWithConfig(t *testing.T, config kafkaSinkConfig) *kafkaSink {
+	// Retries and metadata refreshes are sped up so retried records don't hold up the tests
+	sink, err := newKafkaSink(
+		config,
+		kubernetesConfig{NodeName: "node-1"},
+		newDropCounters(),
+		kgo.RetryBackoffFn(func(int) time.Duration { return time.Millisecond }),
+		kgo.MetadataMinAge(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create Kafka sink: %v", err)
+	}
+	return sink
+}
+
+// exportTestKafkaEvents exports a request and response to each destination workload, then closes the sink so they're
+// all published or dropped
+func exportTestKafkaEvents(t *testing.T, sink *kafkaSink, dstWorkloads ...string) {
+	for _, dstWorkload := range dstWorkloads {
+		reqAndResp := newTestRequestAndResponse(t, "GET /users/1 HTTP/1.1\r\nHost: example.com\r\n\r\n", newTestResponseBytes(200))
+		reqAndResp.dst, reqAndResp.dstWorkload = "10.0.0.2", dstWorkload
+		sink.export(reqAndResp)
+	}
+	sink.close()
+}
+
+func TestKafkaSinkPublishesByPartitionKey(t *testing.T) {
+	broker := newTestKafkaBroker(t, "api-events", 4)
+	exportTestKafkaEvents(t, newTestKafkaSink(broker, kafkaFormatJson, -1), "shop/orders", "shop/users", "shop/orders")
+
+	// Keys are partitioned like the Java client's default partitioner
+	partitioner := kgo.StickyKeyPartitioner(nil).ForTopic("api-events")
+	received := broker.receivedRecords()
+	total := 0
+	for partition, records := range received {
+		for _, record := range records {
+			total++
+			if expected := partitioner.Partition(&kgo.Record{Key: record.key}, 4); int32(expected) != partition {
+				t.Errorf("Record with key %q was on partition %d, want %d", record.key, partition, expected)
+			}
+			var event apiEvent
+			if err := json.Unmarshal(record.value, &event); err != nil {
+				t.Fatalf("Record value isn't a JSON event: %v", err)
+			}
+			if event.Kubernetes.Destination.String() != string(record.key) || event.Request.Path != "/users/1" ||
+				event.Sensor.NodeName != "node-1" {
+				t.Errorf("Event = %+v, want it to match its key %q", event, record.key)
+			}
+		}
+	}
+	if total != 3 {
+		t.Errorf("Broker received %d records, want 3", total)
+	}
+}
+
+func TestKafkaSinkProtobufWithoutAcks(t *testing.T) {
+	broker := newTestKafkaBroker(t, "api-events", 1)
+	exportTestKafkaEvents(t, newTestKafkaSink(broker, kafkaFormatProtobuf, 0), "shop/orders")
+
+	// Without acks the sink doesn't wait for the broker, so give it a moment to process the request
+	deadline := time.Now().Add(time.Second)
+	for len(broker.receivedRecords()[0]) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	records := broker.receivedRecords()[0]
+	if len(records) != 1 {
+		t.Fatalf("Broker received %d records, want 1", len(records))
+	}
+	if strs := protoStrings(records[0].value); !slices.Contains(strs, "/users/1") || !slices.Contains(strs, "orders") {
+		t.Errorf("Protobuf event is missing its path or workload: %q", strs)
+	}
+}
+
+func TestKafkaSinkPublishesFindings(t *testing.T) {
+	broker := newTestKafkaBroker(t, "api-findings", 1)
+	sink := newTestKafkaSink(broker, kafkaFormatProtobuf, -1)
+	sink.exportFinding(finding{Type: findingTypeShadowEndpoint, Service: "shop/users", Method: "DELETE", Path: "/users/{id}", Count: 1})
+	sink.close()
+
+	records := broker.receivedRecords()[0]
+	if len(records) != 1 || string(records[0].key) != "shop/users" {
+		t.Fatalf("Broker received %+v, want one finding keyed by its service", records)
+	}
+	var event findingEvent
+	if err := json.Unmarshal(records[0].value, &event); err != nil {
+		t.Fatalf("Record value isn't a JSON finding event, even though the sink's format is protobuf: %v", err)
+	}
+	if event.Finding.Type != findingTypeShadowEndpoint || event.Finding.Path != "/users/{id}" || event.Sensor.NodeName != "node-1" {
+		t.Errorf("Event = %+v, want the shadow endpoint finding", event)
+	}
+}
+
+func TestKafkaSinkPublishesConnections(t *testing.T) {
+	broker := newTestKafkaBroker(t, "api-connections", 1)
+	sink := newTestKafkaSink(broker, kafkaFormatJson, -1)
+	sink.exportConnection(&connectionSummary{src: "10.0.0.1", dst: "10.0.0.2", srcPort: "51234", dstPort: "6379", clientBytes: 14, protocol: protocolRedis, closeReason: connectionCloseFin})
+	sink.close()
+
+	records := broker.receivedRecords()[0]
+	if len(records) != 1 || string(records[0].key) != "10.0.0.2" {
+		t.Fatalf("Broker received %+v, want one connection keyed by its destination IP", records)
+	}
+	var event connectionEvent
+	if err := json.Unmarshal(records[0].value, &event); err != nil {
+		t.Fatalf("Record value isn't a JSON connection event: %v", err)
+	}
+	if event.Connection.Protocol != protocolRedis || event.Network.Destination.Port != 6379 || event.Connection.ClientBytes != 14 {
+		t.Errorf("Event = %+v, want the Redis connection", event)
+	}
+}
+
+func TestKafkaSinkRetriesRetriableErrors(t *testing.T) {
+	broker := startTestKafkaBroker(&testKafkaBroker{t: t, topic: "api-events", partitions: 2, produceErrors: []int16{6}})
+	sink := newTestKafkaSink(broker, kafkaFormatJson, 1)
+	exportTestKafkaEvents(t, sink, "shop/orders")
+
+	total := 0
+	for _, records := range broker.receivedRecords() {
+		total += len(records)
+	}
+	if total != 1 {
+		t.Errorf("Broker received %d records after a retry, want 1", total)
+	}
+	if drops := sink.drops.snapshot()[dropReasonKafkaRejected]; drops != 0 {
+		t.Errorf("Dropped %d events, want 0", drops)
+	}
+}
+
+func TestKafkaSinkDropsRejectedEvents(t *testing.T) {
+	broker := startTestKafkaBroker(&testKafkaBroker{t: t, topic: "api-events", partitions: 1, produceErrors: []int16{10}})
+	sink := newTestKafkaSink(broker, kafkaFormatJson, -1)
+	exportTestKafkaEvents(t, sink, "shop/orders", "shop/users")
+
+	broker.mutex.Lock()
+	produces := broker.produces
+	broker.mutex.Unlock()
+	if produces != 1 {
+		t.Errorf("Broker received %d produce requests, want 1 as the error isn't retriable", produces)
+	}
+	if drops := sink.drops.snapshot()[dropReasonKafkaRejected]; drops != 2 {
+		t.Errorf("Dropped %d events, want 2", drops)
+	}
+}
+
+func TestKafkaSinkDropsEventsWhenQueueIsFull(t *testing.T) {
+	broker := newTestKafkaBroker(t, "api-events", 1)
+	config := newTestKafkaSinkConfig(broker, kafkaFormatJson, -1)
+	config.QueueSize = 1
+	sink := newTestKafkaSinkWithConfig(t, config)
+	exportTestKafkaEvents(t, sink, "shop/orders", "shop/users")
+
+	if received := broker.receivedRecords()[0]; len(received) != 1 {
+		t.Errorf("Broker received %d records, want 1", len(received))
+	}
+	if drops := sink.drops.snapshot()[dropReasonKafkaQueueFull]; drops != 1 {
+		t.Errorf("Dropped %d events, want 1", drops)
+	}
+}
+
+func TestKafkaSinkUnknownTopic(t *testing.T) {
+	broker := newTestKafkaBroker(t, "other-topic", 1)
+	config := newTestKafkaSinkConfig(broker, kafkaFormatJson, -1)
+	config.Topic = "api-events"
+	sink := newTestKafkaSinkWithConfig(t, config)
+	exportTestKafkaEvents(t, sink, "shop/orders")
+
+	if drops := sink.drops.snapshot()[dropReasonKafkaRejected]; drops != 1 {
+		t.Errorf("Dropped %d events, want 1", drops)
+	}
+}
+
+func TestKafkaSinkTlsAndSasl(t *testing.T) {
+	certificate := newTestCertificate(t, "kafka.test")
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]}), 0o600); err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		mechanism      string
+		password       string
+		expectedEvents int
+	}{
+		{name: "TLS without SASL", expectedEvents: 1},
+		{name: "SASL PLAIN", mechanism: "PLAIN", password: "secret", expectedEvents: 1},
+		{name: "SASL SCRAM-SHA-256", mechanism: "SCRAM-SHA-256", password: "secret", expectedEvents: 1},
+		{name: "SASL SCRAM-SHA-512", mechanism: "SCRAM-SHA-512", password: "secret", expectedEvents: 1},
+		{name: "Wrong PLAIN password", mechanism: "PLAIN", password: "wrong", expectedEvents: 0},
+		{name: "Wrong SCRAM password", mechanism: "SCRAM-SHA-256", password: "wrong", expectedEvents: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := startTestKafkaBroker(&testKafkaBroker{
+				t:          t,
+				topic:      "api-events",
+				partitions: 1,
+				tlsConfig:  &tls.Config{Certificates: []tls.Certificate{certificate}},
+				sasl:       kafkaSaslConfig{Mechanism: tt.mechanism, Username: "sensor", Password: "secret"},
+			})
+			config := newTestKafkaSinkConfig(broker, kafkaFormatJson, -1)
+			config.Tls = kafkaTlsConfig{Enabled: true, CaFile: caFile, ServerName: "kafka.test"}
+			config.Sasl = kafkaSaslConfig{Mechanism: tt.mechanism, Username: "sensor", Password: tt.password}
+			sink := newTestKafkaSinkWithConfig(t, config)
+			exportTestKafkaEvents(t, sink, "shop/orders")
+
+			if received := len(broker.receivedRecords()[0]); received != tt.expectedEvents {
+				t.Errorf("Broker received %d records, want %d", received, tt.expectedEvents)
+			}
+			if drops := sink.drops.snapshot()[dropReasonKafkaRejected]; drops != uint64(1-tt.expectedEvents) {
+				t.Errorf("Dropped %d events, want %d", drops, 1-tt.expectedEvents)
+			}
+		})
+	}
+}
@@ -2,54 +2,46 @@ package main
 
 import (
 	"fmt"
-	"io"
 	"log"
 	"log/slog"
 	"net/http"
-	"net/http/httptest"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
-
-	firetail "github.com/FireTail-io/firetail-go-lib/middlewares/http"
 )
 
 func main() {
-	maxLifetimeMinutes, err := strconv.Atoi(os.Getenv("FIRETAIL_KUBERNETES_SENSOR_LIFETIME_MINUTES"))
+	if len(os.Args) > 1 && os.Args[1] == pcapToHarCommandName {
+		os.Exit(pcapToHarCommand(os.Args[2:]))
+	}
+
+	config, err := loadConfig()
 	if err != nil {
-		slog.Warn(
-			"FIRETAIL_KUBERNETES_SENSOR_LIFETIME_MINUTES environment variable not set. " +
-				"This sensor will shutdown in 15 minutes.",
-		)
-		maxLifetimeMinutes = 15
-	} else {
-		if maxLifetimeMinutes > 0 {
-			slog.Warn("This sensor will shutdown in " + strconv.Itoa(maxLifetimeMinutes) + " minute(s).")
-		} else {
-			slog.Warn("Shutdown timeout disabled. This sensor will run indefinitely.")
-		}
+		log.Fatal("Invalid configuration: ", err.Error())
+	}
+
+	if config.Sensor.DevMode {
+		slog.Warn("🧰 Development mode enabled, setting log level to debug...")
+		slog.SetLogLoggerLevel(slog.LevelDebug)
 	}
+
+	slog.Info("Effective configuration:\n" + config.String())
+
+	maxLifetimeMinutes := config.Sensor.LifetimeMinutes
 	if maxLifetimeMinutes > 0 {
+		slog.Warn("This sensor will shutdown in " + strconv.Itoa(maxLifetimeMinutes) + " minute(s).")
 		go func() {
 			time.Sleep(time.Minute * time.Duration(maxLifetimeMinutes))
 			slog.Warn("Timeout reached. Shutting down the sensor...")
 			os.Exit(0)
 		}()
+	} else {
+		slog.Warn("Shutdown timeout disabled. This sensor will run indefinitely.")
 	}
 
-	logsApiToken, logsApiTokenSet := os.LookupEnv("FIRETAIL_API_TOKEN")
-	if !logsApiTokenSet {
-		log.Fatal("FIRETAIL_API_TOKEN environment variable not set")
-	}
-
-	devEnabled, _ := strconv.ParseBool(os.Getenv("FIRETAIL_KUBERNETES_SENSOR_DEV_MODE"))
-	if devEnabled {
-		slog.Warn("🧰 Development mode enabled, setting log level to debug...")
-		slog.SetLogLoggerLevel(slog.LevelDebug)
-	}
-
-	devServerEnabled, err := strconv.ParseBool(os.Getenv("FIRETAIL_KUBERNETES_SENSOR_DEV_SERVER_ENABLED"))
-	if err == nil && devServerEnabled {
+	if config.Sensor.DevServerEnabled {
 		slog.Warn("🧰 Development server enabled, starting example HTTP server...")
 		go func() {
 			http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -59,127 +51,270 @@ func main() {
 		}()
 	}
 
-	bpfExpression, bpfExpressionSet := os.LookupEnv("BPF_EXPRESSION")
-	if !bpfExpressionSet {
-		slog.Info(
-			"BPF_EXPRESSION environment variable not set, using default: tcp and (port 80 or port 443). See docs for " +
-				"further info.",
+	var workloadManager, ipManager *serviceIpManager
+	if config.Kubernetes.ServiceIpFiltering || config.Kubernetes.PodIpLookup {
+		// Pod IPs are also needed to filter decapsulated overlay traffic, whose destination is a pod rather than a service
+		workloadManager = newServiceIpManager(
+			config.Kubernetes.ServiceIpRefreshInterval,
+			config.Kubernetes.PodIpLookup,
+			config.Kubernetes.ServiceIpFiltering && config.Capture.Decapsulation.Enabled,
 		)
-		bpfExpression = "tcp and (port 80 or port 443)"
 	}
-
-	var ipManager *serviceIpManager
-	if disableServiceIpFilter, err := strconv.ParseBool(os.Getenv("DISABLE_SERVICE_IP_FILTERING")); !(err == nil && disableServiceIpFilter) {
+	if config.Kubernetes.ServiceIpFiltering {
 		slog.Info(
 			"Service IP filter enabled, monitoring service IPs...",
 		)
-		ipManager = newServiceIpManager()
+		ipManager = workloadManager
 	}
 
-	var maxContentLength int64
-	maxContentLengthStr, maxContentLengthSet := os.LookupEnv("MAX_CONTENT_LENGTH")
-	if !maxContentLengthSet {
-		slog.Info("MAX_CONTENT_LENGTH environment variable not set, using default: 1MiB")
-		maxContentLength = 1048576 // 1MiB
-	} else if maxContentLength, err = strconv.ParseInt(maxContentLengthStr, 10, 64); err != nil {
-		slog.Error("Failed to parse MAX_CONTENT_LENGTH, Defaulting to 1MiB.", "Err", err.Error())
-		maxContentLength = 1048576 // 1MiB
+	maxContentLength := config.Capture.MaxContentLength
+	initialRules, err := newPipelineRules(config)
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err.Error())
 	}
+	rules := newPipelineRulesHolder(initialRules)
+	drops := newDropCounters()
+	go drops.run(time.Minute)
 
-	onlyLogJson, _ := strconv.ParseBool(os.Getenv("ENABLE_ONLY_LOG_JSON"))
-
-	requestAndResponseChannel := make(chan httpRequestAndResponse, 1)
+	requestAndResponseChannel := make(chan httpRequestAndResponse, config.Pipeline.QueueSize)
+	var tlsHandshakes *chan *tlsHandshake
+	if config.Tls.Metadata {
+		tlsHandshakeChannel := make(chan *tlsHandshake, config.Tls.QueueSize)
+		tlsHandshakes = &tlsHandshakeChannel
+	}
+	var connectionSummaries *chan *connectionSummary
+	if config.Connections.Summaries {
+		connectionSummaryChannel := make(chan *connectionSummary, config.Connections.QueueSize)
+		connectionSummaries = &connectionSummaryChannel
+	}
+	var stats *protocolStats
+	if config.Capture.ProtocolDetection {
+		slog.Info("Detecting the protocol of each connection, and only reading HTTP from those which start like HTTP...")
+		stats = newProtocolStats()
+		go stats.run(time.Minute)
+	}
+	var keyLog *tlsKeyLog
+	if len(config.Tls.KeyLogFiles) > 0 {
+		slog.Info(
+			"Decrypting TLS connections with secrets from key log files...",
+			"KeyLogFiles", config.Tls.KeyLogFiles,
+			"ReloadInterval", config.Tls.KeyLogReloadInterval,
+		)
+		keyLog = newTlsKeyLog(config.Tls)
+		go keyLog.run()
+	}
+	openPacketSource := newPcapBackend(config.Capture.Snaplen, config.Capture.Pcap).open
+	if config.Capture.Backend == captureBackendAfPacket {
+		openPacketSource = newAfPacketBackend(config.Capture.Snaplen, config.Capture.AfPacket).open
+	}
 	httpRequestStreamer := &httpRequestAndResponseStreamer{
-		bpfExpression:             bpfExpression,
+		bpfExpression:             config.Capture.BpfExpression,
+		interfaces:                config.Capture.Interfaces,
+		interfaceRefreshInterval:  config.Capture.InterfaceRefreshInterval,
+		deduplicationWindow:       config.Capture.DeduplicationWindow,
+		openPacketSource:          openPacketSource,
+		overlayDecoder:            newOverlayDecoder(config.Capture.Decapsulation),
 		requestAndResponseChannel: &requestAndResponseChannel,
 		ipManager:                 ipManager,
 		maxBodySize:               maxContentLength,
+		drops:                     drops,
+		tlsHandshakes:             tlsHandshakes,
+		keyLog:                    keyLog,
+		connectionSummaries:       connectionSummaries,
+		protocolStats:             stats,
 	}
 	go httpRequestStreamer.start()
 
-	var maxLogAge time.Duration = 0
-	if devEnabled {
-		slog.Warn("🧰 Development mode enabled, setting max age of logs held by Firetail middleware to 1 second...")
-		maxLogAge = time.Second
-	}
-	firetailMiddleware, err := firetail.GetMiddleware(
-		&firetail.Options{
-			LogsApiToken: logsApiToken,
-			LogsApiUrl:   os.Getenv("FIRETAIL_API_URL"),
-			MaxLogAge:    maxLogAge,
-		},
-	)
-	if err != nil {
-		log.Fatal("Failed to initialise Firetail middleware:", err.Error())
-	}
-
-	for {
-		select {
-		case requestAndResponse := <-requestAndResponseChannel:
-			if !(ipManager == nil || ipManager.isServiceIP(requestAndResponse.dst)) {
-				slog.Debug(
-					"Ignoring request to non-service IP:",
-					"Src", requestAndResponse.src,
-					"Dst", requestAndResponse.dst,
-					"SrcPort", requestAndResponse.srcPort,
-					"DstPort", requestAndResponse.dstPort,
-				)
-				continue
-			}
-			if onlyLogJson && !isJson(&requestAndResponse, maxContentLength) {
-				slog.Debug(
-					"Ignoring non-JSON request:",
-					"Src", requestAndResponse.src,
-					"Dst", requestAndResponse.dst,
-					"SrcPort", requestAndResponse.srcPort,
-					"DstPort", requestAndResponse.dstPort,
-				)
-				continue
+	if config.Sensor.HealthAddress != "" {
+		slog.Info("Serving liveness, readiness and metrics endpoints...", "Address", config.Sensor.HealthAddress)
+		go newHealthServer(config.Sensor.HealthAddress, httpRequestStreamer.captureHealth, drops, stats).run()
+	}
+
+	if configFilePath := os.Getenv(configFileEnvVar); configFilePath != "" && config.Sensor.ConfigReloadInterval > 0 {
+		slog.Info(
+			"Watching config file for changes to filters and redaction rules...",
+			"Path", configFilePath,
+			"Interval", config.Sensor.ConfigReloadInterval,
+		)
+		go newConfigReloader(
+			configFilePath,
+			config.Sensor.ConfigReloadInterval,
+			config,
+			httpRequestStreamer.setBpfExpression,
+			rules,
+		).run()
+	}
+
+	firetailConfig := config.Sinks.Firetail
+	firetailShipper := newFiretailLogShipper(firetailConfig, config.Kubernetes, drops)
+	if firetailConfig.Spool.Directory != "" {
+		slog.Info("Spooling FireTail logs to disk before sending them...", "Directory", firetailConfig.Spool.Directory)
+		spool, err := newDiskSpool(firetailConfig.Spool, firetailShipper.postBody, isRetryableFiretailError, drops)
+		if err != nil {
+			log.Fatal("Failed to initialise spool: ", err.Error())
+		}
+		firetailShipper.sendBatch = func(batch [][]byte) error {
+			return spool.write(encodeFiretailBatch(batch))
+		}
+		go spool.run()
+	}
+	go firetailShipper.run()
+	sinks := []func(*httpRequestAndResponse){firetailShipper.export}
+	findingExporters := []func(finding){}
+	connectionExporters := []func(*connectionSummary){}
+
+	if config.Sinks.Otlp.Endpoint != "" {
+		slog.Info(
+			"Exporting spans to OTLP collector...",
+			"Endpoint", config.Sinks.Otlp.Endpoint,
+			"Protocol", config.Sinks.Otlp.Protocol,
+			"ExportLogs", config.Sinks.Otlp.ExportLogs,
+		)
+		otlpExporter := newOtlpExporter(config.Sinks.Otlp, config.Kubernetes, drops)
+		go otlpExporter.run()
+		sinks = append(sinks, otlpExporter.export)
+	}
+
+	// shutdownHooks are run when the sensor is asked to stop, so files being written are left valid
+	var shutdownHooks []func()
+	if config.Sinks.Har.Directory != "" {
+		slog.Info("Writing HAR files...", "Directory", config.Sinks.Har.Directory)
+		harWriter, err := newHarWriter(config.Sinks.Har, drops)
+		if err != nil {
+			log.Fatal("Failed to initialise HAR writer: ", err.Error())
+		}
+		go harWriter.run()
+		sinks = append(sinks, harWriter.export)
+		shutdownHooks = append(shutdownHooks, harWriter.close)
+	}
+
+	if len(config.Sinks.Kafka.Brokers) > 0 {
+		slog.Info(
+			"Publishing events to Kafka...",
+			"Brokers", config.Sinks.Kafka.Brokers,
+			"Topic", config.Sinks.Kafka.Topic,
+			"Format", config.Sinks.Kafka.Format,
+		)
+		kafkaSink, err := newKafkaSink(config.Sinks.Kafka, config.Kubernetes, drops)
+		if err != nil {
+			log.Fatal("Failed to initialise Kafka sink: ", err.Error())
+		}
+		shutdownHooks = append(shutdownHooks, kafkaSink.close)
+		sinks = append(sinks, kafkaSink.export)
+
+		if config.Sinks.Kafka.FindingsTopic != "" {
+			slog.Info("Publishing findings to Kafka...", "Topic", config.Sinks.Kafka.FindingsTopic)
+			findingsConfig := config.Sinks.Kafka
+			findingsConfig.Topic = config.Sinks.Kafka.FindingsTopic
+			kafkaFindingsSink, err := newKafkaSink(findingsConfig, config.Kubernetes, drops)
+			if err != nil {
+				log.Fatal("Failed to initialise Kafka sink: ", err.Error())
 			}
-			slog.Debug(
-				"Captured request and response:",
-				"Method", requestAndResponse.request.Method,
-				"URL", requestAndResponse.request.URL,
-				"StatusCode", requestAndResponse.response.StatusCode,
-				"Src", requestAndResponse.src,
-				"Dst", requestAndResponse.dst,
-				"SrcPort", requestAndResponse.srcPort,
-				"DstPort", requestAndResponse.dstPort,
-			)
-			requestAndResponse.request.Header.Set(
-				"Content-Length", strconv.Itoa(int(requestAndResponse.request.ContentLength)),
-			)
-			requestAndResponse.request.Header.Set("Host", requestAndResponse.request.Host)
-			responseRecorder := httptest.NewRecorder()
-			firetailMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				w.WriteHeader(requestAndResponse.response.StatusCode)
-				for key, values := range requestAndResponse.response.Header {
-					for _, value := range values {
-						w.Header().Add(key, value)
-					}
-				}
-				requestAndResponse.response.Header.Set(
-					"Content-Length", strconv.Itoa(int(requestAndResponse.response.ContentLength)),
-				)
-				capturedResponseBody, err := io.ReadAll(requestAndResponse.response.Body)
-				if err != nil {
-					slog.Error("Error reading request body:", "err", err.Error())
-					return
-				}
-				w.Write(capturedResponseBody)
-			})).ServeHTTP(
-				responseRecorder,
-				requestAndResponse.request,
-			)
-			if responseRecorder != nil {
-				slog.Debug(
-					"Response from Firetail middleware:",
-					"StatusCode", responseRecorder.Code,
-					"Header", responseRecorder.Header(),
-					"Body", responseRecorder.Body.String(),
-				)
+			shutdownHooks = append(shutdownHooks, kafkaFindingsSink.close)
+			findingExporters = append(findingExporters, kafkaFindingsSink.exportFinding)
+		}
+
+		if config.Sinks.Kafka.ConnectionsTopic != "" && connectionSummaries != nil {
+			slog.Info("Publishing connection summaries to Kafka...", "Topic", config.Sinks.Kafka.ConnectionsTopic)
+			connectionsConfig := config.Sinks.Kafka
+			connectionsConfig.Topic = config.Sinks.Kafka.ConnectionsTopic
+			kafkaConnectionsSink, err := newKafkaSink(connectionsConfig, config.Kubernetes, drops)
+			if err != nil {
+				log.Fatal("Failed to initialise Kafka sink: ", err.Error())
 			}
-		default:
+			shutdownHooks = append(shutdownHooks, kafkaConnectionsSink.close)
+			connectionExporters = append(connectionExporters, kafkaConnectionsSink.exportConnection)
 		}
 	}
+
+	findings := newFindingsReporter(config.Findings, drops, findingExporters...)
+	go findings.run()
+
+	if config.OpenApi.Inference.Directory != "" {
+		slog.Info(
+			"Inferring OpenAPI specs from traffic...",
+			"Directory", config.OpenApi.Inference.Directory,
+			"Interval", config.OpenApi.Inference.Interval,
+		)
+		openApiInferrer, err := newOpenApiInferrer(config.OpenApi.Inference, drops)
+		if err != nil {
+			log.Fatal("Failed to initialise OpenAPI inference: ", err.Error())
+		}
+		go openApiInferrer.run()
+		sinks = append(sinks, openApiInferrer.export)
+	}
+
+	var specs *openApiSpecStore
+	var conformance *openApiConformanceChecker
+	if config.OpenApi.Conformance.enabled() {
+		slog.Info(
+			"Checking traffic against OpenAPI specs...",
+			"SpecDirectory", config.OpenApi.Conformance.SpecDirectory,
+			"Specs", len(config.OpenApi.Conformance.Specs),
+		)
+		var annotations func() map[string]string
+		if workloadManager != nil {
+			annotations = workloadManager.openApiSpecAnnotations
+		}
+		specs = newOpenApiSpecStore(config.OpenApi.Conformance, annotations)
+		go specs.run()
+		conformance = &openApiConformanceChecker{specs: specs, findings: findings}
+	}
+
+	if config.Auth.Findings {
+		sinks = append(sinks, (&authChecker{publicPaths: config.Auth.PublicPaths, findings: findings}).export)
+	}
+
+	var inventory *endpointInventory
+	if specs != nil || config.Inventory.File != "" {
+		inventory = newEndpointInventory(config.Inventory, specs, findings, drops)
+		if config.Inventory.File != "" {
+			slog.Info("Writing endpoint inventory...", "File", config.Inventory.File, "Interval", config.Inventory.WriteInterval)
+			go inventory.run()
+		}
+		sinks = append(sinks, inventory.export)
+	}
+
+	if tlsHandshakes != nil {
+		slog.Info("Recording TLS handshake metadata...", "Findings", config.Tls.Findings)
+		monitor := &tlsMonitor{handshakes: *tlsHandshakes, workloadManager: workloadManager, inventory: inventory}
+		if config.Tls.Findings {
+			monitor.findings = findings
+		}
+		go monitor.run()
+	}
+
+	if connectionSummaries != nil {
+		slog.Info("Summarising connections which HTTP can't be read from...")
+		go (&connectionMonitor{
+			summaries:       *connectionSummaries,
+			ipManager:       ipManager,
+			workloadManager: workloadManager,
+			exporters:       connectionExporters,
+		}).run()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		received := <-signals
+		slog.Warn("Received signal, shutting down the sensor...", "Signal", received.String())
+		for _, hook := range shutdownHooks {
+			hook()
+		}
+		os.Exit(0)
+	}()
+
+	(&pipeline{
+		queue:            requestAndResponseChannel,
+		workers:          config.Pipeline.Workers,
+		rules:            rules,
+		ipManager:        ipManager,
+		workloadManager:  workloadManager,
+		auth:             newAuthDetector(config.Auth),
+		conformance:      conformance,
+		maxContentLength: maxContentLength,
+		drops:            drops,
+		export:           exportToAll(sinks),
+	}).run()
 }
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+)
+
+const (
+	// openApiSpecAnnotation can be set on a Kubernetes Service to the name of a file in the spec directory, to check
+	// the service's traffic against that spec
+	openApiSpecAnnotation = "firetail.io/openapi-spec"
+	// maxFindingDetails bounds the number of schema mismatches reported for a single request and response
+	maxFindingDetails = 10
+)
+
+var (
+	openApiSpecExtensions   = []string{".yaml", ".yml", ".json"}
+	openApiPathTemplateVars = regexp.MustCompile(`\{[^{}/]+\}`)
+)
+
+// openApiSpecStore maps services to the OpenAPI specs their traffic should conform to. A service's spec is, in order
+// of precedence: the file given for it in the config, the file named by its firetail.io/openapi-spec annotation, or a
+// file in the spec directory named after it, such as namespace.name.yaml. The mapping is rebuilt every reloadInterval,
+// and specs are only parsed again if their file has changed.
+type openApiSpecStore struct {
+	directory      string
+	configured     map[string]string
+	annotations    func() map[string]string
+	reloadInterval time.Duration
+	specs          atomic.Pointer[map[string]*openApiSpec]
+}
+
+// openApiSpec is a parsed spec and its routes, in the order they should be matched
+type openApiSpec struct {
+	path      string
+	modTime   time.Time
+	doc       *openapi3.T
+	basePaths []string
+	routes    []openApiRoute
+}
+
+type openApiRoute struct {
+	template   string
+	pattern    *regexp.Regexp
+	paramNames []string
+	literals   int
+	pathItem   *openapi3.PathItem
+}
+
+func newOpenApiSpecStore(config openApiConformanceConfig, annotations func() map[string]string) *openApiSpecStore {
+	store := &openApiSpecStore{
+		directory:      config.SpecDirectory,
+		configured:     config.Specs,
+		annotations:    annotations,
+		reloadInterval: config.ReloadInterval,
+	}
+	store.reload()
+	return store
+}
+
+func (s *openApiSpecStore) run() {
+	ticker := time.NewTicker(s.reloadInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.reload()
+	}
+}
+
+func (s *openApiSpecStore) get(service string) *openApiSpec {
+	specs := s.specs.Load()
+	if specs == nil {
+		return nil
+	}
+	return (*specs)[service]
+}
+
+// forService finds a service's spec, either mapped to its name or found in the spec directory under its file key
+func (s *openApiSpecStore) forService(service string) *openApiSpec {
+	if spec := s.get(service); spec != nil {
+		return spec
+	}
+	return s.get(openApiSpecFileKey(service))
+}
+
+// reload rebuilds the mapping from services to specs, reusing the previous parse of any spec file that hasn't changed
+func (s *openApiSpecStore) reload() {
+	previous := map[string]*openApiSpec{}
+	if specs := s.specs.Load(); specs != nil {
+		for _, spec := range *specs {
+			previous[spec.path] = spec
+		}
+	}
+	loaded := map[string]*openApiSpec{}
+	load := func(path string) *openApiSpec {
+		if spec, ok := loaded[path]; ok {
+			return spec
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			slog.Error("Failed to read OpenAPI spec:", "Path", path, "Err", err.Error())
+			loaded[path] = nil
+			return nil
+		}
+		if spec, ok := previous[path]; ok && spec.modTime.Equal(info.ModTime()) {
+			loaded[path] = spec
+			return spec
+		}
+		spec, err := loadOpenApiSpec(path, info.ModTime())
+		if err != nil {
+			slog.Error("Failed to load OpenAPI spec:", "Path", path, "Err", err.Error())
+		} else {
+			slog.Info("Loaded OpenAPI spec", "Path", path, "Paths", len(spec.routes))
+		}
+		loaded[path] = spec
+		return spec
+	}
+
+	specs := map[string]*openApiSpec{}
+	if s.directory != "" {
+		entries, err := os.ReadDir(s.directory)
+		if err != nil {
+			slog.Error("Failed to list OpenAPI spec directory:", "Directory", s.directory, "Err", err.Error())
+		}
+		for _, entry := range entries {
+			service, ok := openApiSpecServiceName(entry.Name())
+			if !ok || entry.IsDir() {
+				continue
+			}
+			if spec := load(filepath.Join(s.directory, entry.Name())); spec != nil {
+				specs[service] = spec
+			}
+		}
+	}
+	// Annotations can only name files in the spec directory, so they can't be used to read other files on the node
+	if s.annotations != nil && s.directory != "" {
+		for service, fileName := range s.annotations() {
+			if spec := load(filepath.Join(s.directory, filepath.Base(fileName))); spec != nil {
+				specs[service] = spec
+			}
+		}
+	}
+	for service, path := range s.configured {
+		if !filepath.IsAbs(path) && s.directory != "" {
+			path = filepath.Join(s.directory, path)
+		}
+		if spec := load(path); spec != nil {
+			specs[service] = spec
+		}
+	}
+	s.specs.Store(&specs)
+}
+
+// openApiSpecServiceName returns the key a spec file in the spec directory is stored under, which is its name without
+// its extension (and without the .openapi suffix the inferrer adds), so namespace.name.yaml is the spec for the
+// service namespace/name. Services are looked up in the same form, see openApiSpecFileKey.
+func openApiSpecServiceName(fileName string) (string, bool) {
+	for _, extension := range openApiSpecExtensions {
+		if strings.HasSuffix(fileName, extension) {
+			return strings.TrimSuffix(strings.TrimSuffix(fileName, extension), ".openapi"), true
+		}
+	}
+	return "", false
+}
+
+// openApiSpecFileKey converts a service name to the form spec files in the spec directory are stored under
+func openApiSpecFileKey(service string) string {
+	return strings.TrimSuffix(openApiSpecFileName(service), openApiSpecSuffix)
+}
+
+func loadOpenApiSpec(path string, modTime time.Time) (*openApiSpec, error) {
+	loader := openapi3.NewLoader()
+	loader.IsExternalRefsAllowed = true
+	doc, err := loader.LoadFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := doc.Validate(loader.Context); err != nil {
+		return nil, fmt.Errorf("Invalid OpenAPI spec: %v", err)
+	}
+	spec := &openApiSpec{path: path, modTime: modTime, doc: doc}
+	for _, server := range doc.Servers {
+		if serverUrl, err := url.Parse(server.URL); err == nil && !strings.Contains(server.URL, "{") {
+			if basePath := strings.TrimSuffix(serverUrl.Path, "/"); basePath != "" {
+				spec.basePaths = append(spec.basePaths, basePath)
+			}
+		}
+	}
+	for template, pathItem := range doc.Paths {
+		spec.routes = append(spec.routes, newOpenApiRoute(template, pathItem))
+	}
+	// Literal segments take precedence over parameters, so /users/me is matched before /users/{id}
+	sort.Slice(spec.routes, func(i, j int) bool {
+		if spec.routes[i].literals != spec.routes[j].literals {
+			return spec.routes[i].literals > spec.routes[j].literals
+		}
+		return spec.routes[i].template < spec.routes[j].template
+	})
+	return spec, nil
+}
+
+func newOpenApiRoute(template string, pathItem *openapi3.PathItem) openApiRoute {
+	route := openApiRoute{template: template, pathItem: pathItem}
+	pattern := "^"
+	last := 0
+	for _, match := range openApiPathTemplateVars.FindAllStringIndex(template, -1) {
+		pattern += regexp.QuoteMeta(template[last:match[0]]) + "([^/]+)"
+		route.paramNames = append(route.paramNames, template[match[0]+1:match[1]-1])
+		last = match[1]
+	}
+	pattern += regexp.QuoteMeta(template[last:]) + "$"
+	route.pattern = regexp.MustCompile(pattern)
+	route.literals = len(strings.Split(template, "/")) - len(route.paramNames)
+	return route
+}
+
+// route finds the spec's operation for a request, trying the path as it is and with each of the servers' base paths
+// removed. The bool is false if the spec doesn't document the request's path and method.
+func (s *openApiSpec) route(method string, path string) (*routers.Route, map[string]string, bool) {
+	candidates := []string{path}
+	for _, basePath := range s.basePaths {
+		if strings.HasPrefix(path, basePath+"/") {
+			candidates = append(candidates, strings.TrimPrefix(path, basePath))
+		}
+	}
+	for _, candidate := range candidates {
+		for _, route := range s.routes {
+			matches := route.pattern.FindStringSubmatch(candidate)
+			if matches == nil {
+				continue
+			}
+			operation := route.pathItem.GetOperation(method)
+			if operation == nil {
+				continue
+			}
+			pathParams := map[string]string{}
+			for i, name := range route.paramNames {
+				value, err := url.PathUnescape(matches[i+1])
+				if err != nil {
+					value = matches[i+1]
+				}
+				pathParams[name] = value
+			}
+			return &routers.Route{
+				Spec:      s.doc,
+				Path:      route.template,
+				PathItem:  route.pathItem,
+				Method:    method,
+				Operation: operation,
+			}, pathParams, true
+		}
+	}
+	return nil, nil, false
+}
+
+// openApiConformanceChecker checks captured requests and responses against their service's OpenAPI spec, and reports
+// any that don't conform as findings. It runs in the pipeline before redaction, as a redacted value no longer matches
+// its schema unless it's a string.
+type openApiConformanceChecker struct {
+	specs    *openApiSpecStore
+	findings *findingsReporter
+}
+
+func (c *openApiConformanceChecker) check(reqAndResp *httpRequestAndResponse) {
+	service := openApiServiceName(reqAndResp)
+	spec := c.specs.forService(service)
+	if spec == nil {
+		return
+	}
+	// Validation reads the bodies, so they're buffered and put back afterwards for redaction and the sinks
+	var requestBody, responseBody []byte
+	var truncated bool
+	requestBody, truncated = readCapturedBody(reqAndResp.request.Body)
+	reqAndResp.requestTruncated = reqAndResp.requestTruncated || truncated
+	responseBody, truncated = readCapturedBody(reqAndResp.response.Body)
+	reqAndResp.responseTruncated = reqAndResp.responseTruncated || truncated
+	restoreBodies := func() {
+		if reqAndResp.request.Body != nil && reqAndResp.request.Body != http.NoBody {
+			reqAndResp.request.Body = io.NopCloser(bytes.NewReader(requestBody))
+		}
+		if reqAndResp.response.Body != nil && reqAndResp.response.Body != http.NoBody {
+			reqAndResp.response.Body = io.NopCloser(bytes.NewReader(responseBody))
+		}
+	}
+	restoreBodies()
+	defer restoreBodies()
+
+	for _, f := range checkOpenApiConformance(spec, reqAndResp) {
+		f.Service = service
+		c.findings.report(f)
+	}
+}
+
+// checkOpenApiConformance validates a request and response against a spec, returning a finding for each way they
+// don't conform to it. Details describe where and how a value didn't match its schema, but never include the value.
+// Requests to endpoints the spec doesn't document are left to the endpoint inventory to report as shadow endpoints.
+func checkOpenApiConformance(spec *openApiSpec, reqAndResp *httpRequestAndResponse) []finding {
+	request := reqAndResp.request
+	response := reqAndResp.response
+	route, pathParams, ok := spec.route(request.Method, request.URL.Path)
+	if !ok {
+		return nil
+	}
+	newFinding := func(findingType string, detail string) finding {
+		return finding{Type: findingType, Method: request.Method, Path: route.Path, StatusCode: response.StatusCode, Detail: detail}
+	}
+
+	var findings []finding
+	if request.Body == nil {
+		request.Body = http.NoBody
+	}
+	requestInput := &openapi3filter.RequestValidationInput{
+		Request:    request,
+		PathParams: pathParams,
+		Route:      route,
+		Options: &openapi3filter.Options{
+			MultiError:         true,
+			AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+			ExcludeRequestBody: reqAndResp.requestTruncated || !hasOpenApiBodyDecoder(request.Header),
+		},
+	}
+	if err := openapi3filter.ValidateRequest(context.Background(), requestInput); err != nil {
+		for _, detail := range openApiValidationDetails(err) {
+			findings = append(findings, newFinding(findingTypeSchemaMismatch, detail))
+		}
+	}
+
+	responseRef := openApiResponseForStatus(route.Operation.Responses, response.StatusCode)
+	if responseRef == nil {
+		return append(findings, newFinding(findingTypeUnexpectedStatusCode, ""))
+	}
+	// kin-openapi only looks responses up by their exact status code, so give it one that matches the range or default
+	responseRoute := *route
+	responseOperation := *route.Operation
+	responseOperation.Responses = openapi3.Responses{strconv.Itoa(response.StatusCode): responseRef}
+	responseRoute.Operation = &responseOperation
+	responseInput := *requestInput
+	responseInput.Route = &responseRoute
+
+	body := response.Body
+	if body == nil {
+		body = http.NoBody
+	}
+	err := openapi3filter.ValidateResponse(context.Background(), &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: &responseInput,
+		Status:                 response.StatusCode,
+		Header:                 response.Header,
+		Body:                   body,
+		Options: &openapi3filter.Options{
+			MultiError:          true,
+			ExcludeResponseBody: reqAndResp.responseTruncated || !hasOpenApiBodyDecoder(response.Header),
+		},
+	})
+	if err != nil {
+		for _, detail := range openApiValidationDetails(err) {
+			findings = append(findings, newFinding(findingTypeSchemaMismatch, detail))
+		}
+	}
+	if len(findings) > maxFindingDetails {
+		findings = findings[:maxFindingDetails]
+	}
+	return findings
+}
+
+// openApiResponseForStatus finds the response documented for a status code, by its exact code, its range such as
+// 2XX, or the default response, in that order
+func openApiResponseForStatus(responses openapi3.Responses, statusCode int) *openapi3.ResponseRef {
+	if response := responses.Get(statusCode); response != nil {
+		return response
+	}
+	statusRange := strconv.Itoa(statusCode/100) + "XX"
+	for code, response := range responses {
+		if strings.EqualFold(code, statusRange) {
+			return response
+		}
+	}
+	return responses.Default()
+}
+
+// hasOpenApiBodyDecoder returns false for content types kin-openapi can't decode, whose bodies can't be validated
+func hasOpenApiBodyDecoder(headers http.Header) bool {
+	contentType := headers.Get("Content-Type")
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return openapi3filter.RegisteredBodyDecoder(mediaType) != nil || isJsonMediaType(mediaType)
+}
+
+// openApiValidationDetails describes each of the problems in a kin-openapi validation error. Schema errors are
+// described by where the value was and why it didn't match, as their messages include the value itself, which may be
+// sensitive.
+func openApiValidationDetails(err error) []string {
+	// A MultiError matches errors.As for any type one of its errors matches, so the outer MultiError has to be
+	// unpacked by type rather than with errors.As, or the request and response errors inside it would be skipped
+	if multiError, ok := err.(openapi3.MultiError); ok {
+		var details []string
+		for _, err := range multiError {
+			details = append(details, openApiValidationDetails(err)...)
+		}
+		return details
+	}
+	var requestError *openapi3filter.RequestError
+	if errors.As(err, &requestError) {
+		location := "request"
+		switch {
+		case requestError.Parameter != nil:
+			location = fmt.Sprintf("%s parameter %q", requestError.Parameter.In, requestError.Parameter.Name)
+		case requestError.RequestBody != nil:
+			location = "request body"
+		}
+		return openApiSchemaDetails(location, requestError.Reason, requestError.Err)
+	}
+	var responseError *openapi3filter.ResponseError
+	if errors.As(err, &responseError) {
+		return openApiSchemaDetails("response", responseError.Reason, responseError.Err)
+	}
+	var securityError *openapi3filter.SecurityRequirementsError
+	if errors.As(err, &securityError) {
+		return nil
+	}
+	return []string{"request: failed to validate"}
+}
+
+func openApiSchemaDetails(location string, reason string, err error) []string {
+	if multiError, ok := err.(openapi3.MultiError); ok {
+		var details []string
+		for _, err := range multiError {
+			details = append(details, openApiSchemaDetails(location, reason, err)...)
+		}
+		return details
+	}
+	var schemaError *openapi3.SchemaError
+	if errors.As(err, &schemaError) {
+		return []string{fmt.Sprintf("%s at /%s: %s", location, strings.Join(schemaError.JSONPointer(), "/"), schemaError.Reason)}
+	}
+	if reason == "" {
+		reason = "doesn't match the spec"
+	}
+	return []string{location + ": " + reason}
+}
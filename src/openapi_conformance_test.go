@@ -0,0 +1,244 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testOpenApiSpec = `
+openapi: 3.0.3
+info:
+  title: users
+  version: "1"
+servers:
+  - url: http://users.shop.svc/api
+paths:
+  /users/{id}:
+    parameters:
+      - name: id
+        in: path
+        required: true
+        schema:
+          type: integer
+    get:
+      parameters:
+        - name: verbose
+          in: query
+          schema:
+            type: boolean
+      responses:
+        "200":
+          description: A user
+          content:
+            application/json:
+              schema:
+                type: object
+                required: [id, name]
+                properties:
+                  id:
+                    type: integer
+                  name:
+                    type: string
+        4XX:
+          description: An error
+  /users/me:
+    get:
+      deprecated: true
+      responses:
+        "200":
+          description: The current user
+  /users:
+    post:
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [name]
+              properties:
+                name:
+                  type: string
+      responses:
+        "201":
+          description: Created
+`
+
+func newTestOpenApiSpecStore(t *testing.T, annotations map[string]string, configured map[string]string) *openApiSpecStore {
+	directory := t.TempDir()
+	for _, name := range []string{"shop.users.yaml", "annotated.yaml"} {
+		if err := os.WriteFile(filepath.Join(directory, name), []byte(testOpenApiSpec), 0o644); err != nil {
+			t.Fatalf("Failed to write spec: %v", err)
+		}
+	}
+	return newOpenApiSpecStore(openApiConformanceConfig{
+		SpecDirectory:  directory,
+		Specs:          configured,
+		ReloadInterval: time.Hour,
+	}, func() map[string]string { return annotations })
+}
+
+func TestCheckOpenApiConformance(t *testing.T) {
+	spec := newTestOpenApiSpecStore(t, nil, nil).get("shop.users")
+	if spec == nil {
+		t.Fatalf("Spec wasn't loaded")
+	}
+
+	tests := []struct {
+		name             string
+		request          string
+		response         string
+		requestTruncated bool
+		expectedFindings []finding
+	}{
+		{
+			name:     "Conforming request and response",
+			request:  "GET /users/1?verbose=true HTTP/1.1\r\nHost: users\r\n\r\n",
+			response: "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 22\r\n\r\n" + `{"id": 1, "name": "a"}`,
+		},
+		{
+			name:     "Server base path is removed",
+			request:  "GET /api/users/1 HTTP/1.1\r\nHost: users\r\n\r\n",
+			response: "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n",
+		},
+		{
+			name:     "Literal path segments take precedence",
+			request:  "GET /users/me HTTP/1.1\r\nHost: users\r\n\r\n",
+			response: "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n",
+		},
+		{
+			name:     "Undocumented endpoints are left to the inventory",
+			request:  "DELETE /users/1 HTTP/1.1\r\nHost: users\r\n\r\n",
+			response: "HTTP/1.1 204 No Content\r\n\r\n",
+		},
+		{
+			name:     "Query parameter of the wrong type",
+			request:  "GET /users/1?verbose=yes HTTP/1.1\r\nHost: users\r\n\r\n",
+			response: "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n",
+			expectedFindings: []finding{{
+				Type:       findingTypeSchemaMismatch,
+				Method:     "GET",
+				Path:       "/users/{id}",
+				StatusCode: 404,
+				Detail:     `query parameter "verbose": doesn't match the spec`,
+			}},
+		},
+		{
+			name:     "Response body missing a required property",
+			request:  "GET /users/1 HTTP/1.1\r\nHost: users\r\n\r\n",
+			response: "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 11\r\n\r\n" + `{"id": "1"}`,
+			expectedFindings: []finding{
+				{
+					Type:       findingTypeSchemaMismatch,
+					Method:     "GET",
+					Path:       "/users/{id}",
+					StatusCode: 200,
+					Detail:     `response at /id: field must be set to integer or not be present`,
+				},
+				{
+					Type:       findingTypeSchemaMismatch,
+					Method:     "GET",
+					Path:       "/users/{id}",
+					StatusCode: 200,
+					Detail:     `response at /name: property "name" is missing`,
+				},
+			},
+		},
+		{
+			name:             "Truncated bodies aren't validated",
+			request:          "POST /users HTTP/1.1\r\nHost: users\r\nContent-Type: application/json\r\nContent-Length: 9\r\n\r\n" + `{"name": `,
+			response:         "HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n",
+			requestTruncated: true,
+		},
+		{
+			name:             "Unexpected status code",
+			request:          "POST /users HTTP/1.1\r\nHost: users\r\nContent-Type: application/json\r\nContent-Length: 13\r\n\r\n" + `{"name": "a"}`,
+			response:         "HTTP/1.1 500 Internal Server Error\r\nContent-Length: 0\r\n\r\n",
+			expectedFindings: []finding{{Type: findingTypeUnexpectedStatusCode, Method: "POST", Path: "/users", StatusCode: 500}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reqAndResp := newTestRequestAndResponse(t, test.request, test.response)
+			reqAndResp.requestTruncated = test.requestTruncated
+			findings := checkOpenApiConformance(spec, reqAndResp)
+			if !reflect.DeepEqual(findings, test.expectedFindings) {
+				t.Errorf("Findings = %+v, want %+v", findings, test.expectedFindings)
+			}
+		})
+	}
+}
+
+func TestOpenApiSpecStorePrecedence(t *testing.T) {
+	store := newTestOpenApiSpecStore(
+		t,
+		map[string]string{"shop/orders": "../../annotated.yaml", "shop/missing": "missing.yaml"},
+		map[string]string{"shop/carts": "shop.users.yaml"},
+	)
+	tests := []struct {
+		service      string
+		expectedFile string
+	}{
+		{"shop.users", "shop.users.yaml"},
+		{"shop/orders", "annotated.yaml"},
+		{"shop/carts", "shop.users.yaml"},
+		{"shop/missing", ""},
+	}
+	for _, test := range tests {
+		spec := store.get(test.service)
+		file := ""
+		if spec != nil {
+			file = filepath.Base(spec.path)
+		}
+		if file != test.expectedFile {
+			t.Errorf("Spec for %s = %q, want %q", test.service, file, test.expectedFile)
+		}
+	}
+}
+
+func TestOpenApiConformanceCheckedBeforeRedaction(t *testing.T) {
+	config := defaultConfig()
+	config.Redaction.JsonFields = []string{"id"}
+	rules, err := newPipelineRules(config)
+	if err != nil {
+		t.Fatalf("newPipelineRules() error = %v", err)
+	}
+	findings := newFindingsReporter(findingsConfig{ReportInterval: time.Hour, MaxFindings: 10}, newDropCounters())
+	var reported []finding
+	findings.emit = func(f finding) { reported = append(reported, f) }
+
+	var exportedBody string
+	p := &pipeline{
+		queue:            make(chan httpRequestAndResponse, 1),
+		workers:          1,
+		rules:            newPipelineRulesHolder(rules),
+		conformance:      &openApiConformanceChecker{specs: newTestOpenApiSpecStore(t, nil, nil), findings: findings},
+		maxContentLength: config.Capture.MaxContentLength,
+		drops:            newDropCounters(),
+		export: func(reqAndResp *httpRequestAndResponse) {
+			body, _ := readCapturedBody(reqAndResp.response.Body)
+			exportedBody = string(body)
+		},
+	}
+	// The integer id is redacted to a string, which the spec wouldn't allow
+	reqAndResp := newTestRequestAndResponse(
+		t,
+		"GET /users/1 HTTP/1.1\r\nHost: users\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 22\r\n\r\n"+`{"id": 1, "name": "a"}`,
+	)
+	reqAndResp.dstWorkload = "shop/users"
+	p.queue <- *reqAndResp
+	close(p.queue)
+	p.run()
+
+	if len(reported) != 0 {
+		t.Errorf("Findings = %+v, want none", reported)
+	}
+	if !strings.Contains(exportedBody, `"REDACTED"`) || strings.Contains(exportedBody, `"id":1`) {
+		t.Errorf("Exported body = %s, want the id redacted", exportedBody)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+const (
+	dropReasonOpenApiQueueFull    = "openapi.inference.queueSize"
+	dropReasonOpenApiMaxEndpoints = "openapi.inference.maxEndpointsPerService"
+	openApiVersion                = "3.0.3"
+	openApiInferredSpecVersion    = "inferred"
+	openApiSpecSuffix             = ".openapi.json"
+	openApiDefaultMediaType       = "application/octet-stream"
+	// maxOpenApiServers bounds the number of hosts listed as servers, as a service may be reached by many names
+	maxOpenApiServers = 16
+)
+
+var unsafeFileNameCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// openApiMethods are the methods an OpenAPI path item can describe. Requests with any other method are ignored.
+var openApiMethods = map[string]struct{}{
+	http.MethodDelete: {}, http.MethodGet: {}, http.MethodHead: {}, http.MethodOptions: {},
+	http.MethodPatch: {}, http.MethodPost: {}, http.MethodPut: {}, http.MethodTrace: {},
+}
+
+// openApiInferrer builds an OpenAPI 3 spec for each service from the requests and responses it observes, and
+// periodically writes them to a directory as <service>.openapi.json. Requests are grouped into operations by their
+// method and path template, where path segments that look like identifiers are replaced by parameters, and the schemas
+// of their query parameters and JSON bodies are inferred from the values seen.
+type openApiInferrer struct {
+	directory              string
+	interval               time.Duration
+	maxEndpointsPerService int
+	observations           chan openApiObservation
+	drops                  *dropCounters
+	services               map[string]*inferredService
+}
+
+// openApiObservation is what the inferrer needs from a captured request and response. It's extracted on the
+// pipeline's worker, so the inferrer's goroutine doesn't have to read or decode the bodies.
+type openApiObservation struct {
+	service    string
+	host       string
+	method     string
+	path       string
+	query      url.Values
+	statusCode int
+	request    openApiObservedBody
+	response   openApiObservedBody
+}
+
+type openApiObservedBody struct {
+	present   bool
+	mediaType string
+	// value is the decoded body if it's JSON, and valid is false if it isn't
+	value interface{}
+	valid bool
+}
+
+type inferredService struct {
+	hosts      map[string]struct{}
+	operations map[inferredOperationKey]*inferredOperation
+	changed    bool
+}
+
+type inferredOperationKey struct {
+	method       string
+	pathTemplate string
+}
+
+type inferredOperation struct {
+	count            int
+	pathParameters   []*inferredSchema
+	queryParameters  map[string]*inferredSchema
+	queryCounts      map[string]int
+	requestBodyCount int
+	requestBodies    map[string]*inferredSchema
+	responses        map[int]map[string]*inferredSchema
+}
+
+func newOpenApiInferrer(config openApiInferenceConfig, drops *dropCounters) (*openApiInferrer, error) {
+	if err := os.MkdirAll(config.Directory, 0o755); err != nil {
+		return nil, fmt.Errorf("Failed to create OpenAPI directory %s: %v", config.Directory, err)
+	}
+	return &openApiInferrer{
+		directory:              config.Directory,
+		interval:               config.Interval,
+		maxEndpointsPerService: config.MaxEndpointsPerService,
+		observations:           make(chan openApiObservation, config.QueueSize),
+		drops:                  drops,
+		services:               map[string]*inferredService{},
+	}, nil
+}
+
+// export extracts what the inferrer needs from the request and response and queues it. If the queue is full it's
+// dropped rather than holding up the pipeline's worker.
+func (i *openApiInferrer) export(reqAndResp *httpRequestAndResponse) {
+	request := reqAndResp.request
+	if _, ok := openApiMethods[request.Method]; !ok {
+		return
+	}
+	observation := openApiObservation{
+		service:    openApiServiceName(reqAndResp),
+		host:       request.Host,
+		method:     request.Method,
+		path:       request.URL.Path,
+		query:      request.URL.Query(),
+		statusCode: reqAndResp.response.StatusCode,
+		request:    observeOpenApiBody(request.Header, request.Body),
+		response:   observeOpenApiBody(reqAndResp.response.Header, reqAndResp.response.Body),
+	}
+	select {
+	case i.observations <- observation:
+	default:
+		slog.Warn("OpenAPI inference queue full, dropping request")
+		i.drops.increment(dropReasonOpenApiQueueFull)
+	}
+}
+
+// openApiServiceName names the service a request was made to: its destination workload if it's known, or otherwise
+// the host it was made to
+func openApiServiceName(reqAndResp *httpRequestAndResponse) string {
+	if reqAndResp.dstWorkload != "" {
+		return reqAndResp.dstWorkload
+	}
+	if host, _, err := net.SplitHostPort(reqAndResp.request.Host); err == nil && host != "" {
+		return host
+	}
+	if reqAndResp.request.Host != "" {
+		return reqAndResp.request.Host
+	}
+	return reqAndResp.dst
+}
+
+func observeOpenApiBody(headers http.Header, body io.ReadCloser) openApiObservedBody {
+	bodyBytes, _ := readCapturedBody(body)
+	if len(bodyBytes) == 0 {
+		return openApiObservedBody{}
+	}
+	observed := openApiObservedBody{present: true, mediaType: openApiDefaultMediaType}
+	if mediaType, _, err := mime.ParseMediaType(headers.Get("Content-Type")); err == nil {
+		observed.mediaType = mediaType
+	}
+	if isJsonMediaType(observed.mediaType) {
+		observed.value, observed.valid = decodeJsonBody(bodyBytes)
+	}
+	return observed
+}
+
+func isJsonMediaType(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// inferPathTemplate replaces path segments that look like identifiers with parameters named id, id2, id3 and so on,
+// returning the template and the segments that were replaced
+func inferPathTemplate(path string) (string, []string) {
+	segments := strings.Split(path, "/")
+	var values []string
+	for i, segment := range segments {
+		if !isIdentifierPathSegment(segment) {
+			continue
+		}
+		values = append(values, segment)
+		segments[i] = "{" + openApiPathParameterName(len(values)-1) + "}"
+	}
+	template := strings.Join(segments, "/")
+	if !strings.HasPrefix(template, "/") {
+		template = "/" + template
+	}
+	return template, values
+}
+
+func openApiPathParameterName(index int) string {
+	if index == 0 {
+		return "id"
+	}
+	return "id" + strconv.Itoa(index+1)
+}
+
+// run merges queued observations into the services' specs, and writes the specs that have changed every interval
+// until the observations channel is closed, at which point they're written one last time
+func (i *openApiInferrer) run() {
+	ticker := time.NewTicker(i.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case observation, ok := <-i.observations:
+			if !ok {
+				i.writeSpecs()
+				return
+			}
+			i.observe(observation)
+		case <-ticker.C:
+			i.writeSpecs()
+		}
+	}
+}
+
+func (i *openApiInferrer) observe(observation openApiObservation) {
+	service, ok := i.services[observation.service]
+	if !ok {
+		service = &inferredService{hosts: map[string]struct{}{}, operations: map[inferredOperationKey]*inferredOperation{}}
+		i.services[observation.service] = service
+	}
+
+	pathTemplate, pathValues := inferPathTemplate(observation.path)
+	key := inferredOperationKey{method: observation.method, pathTemplate: pathTemplate}
+	operation, ok := service.operations[key]
+	if !ok {
+		if len(service.operations) >= i.maxEndpointsPerService {
+			i.drops.increment(dropReasonOpenApiMaxEndpoints)
+			return
+		}
+		operation = &inferredOperation{
+			queryParameters: map[string]*inferredSchema{},
+			queryCounts:     map[string]int{},
+			requestBodies:   map[string]*inferredSchema{},
+			responses:       map[int]map[string]*inferredSchema{},
+		}
+		for range pathValues {
+			operation.pathParameters = append(operation.pathParameters, newInferredSchema())
+		}
+		service.operations[key] = operation
+	}
+	if _, ok := service.hosts[observation.host]; !ok && observation.host != "" && len(service.hosts) < maxOpenApiServers {
+		service.hosts[observation.host] = struct{}{}
+	}
+	service.changed = true
+	operation.count++
+
+	for j, value := range pathValues {
+		operation.pathParameters[j].observeQueryValue(value)
+	}
+	for name, values := range observation.query {
+		schema, ok := operation.queryParameters[name]
+		if !ok {
+			if len(operation.queryParameters) >= maxInferredProperties {
+				continue
+			}
+			schema = newInferredSchema()
+			operation.queryParameters[name] = schema
+		}
+		operation.queryCounts[name]++
+		for _, value := range values {
+			schema.observeQueryValue(value)
+		}
+	}
+	if observation.request.present {
+		operation.requestBodyCount++
+		observeOpenApiContent(operation.requestBodies, observation.request)
+	}
+	content, ok := operation.responses[observation.statusCode]
+	if !ok {
+		content = map[string]*inferredSchema{}
+		operation.responses[observation.statusCode] = content
+	}
+	if observation.response.present {
+		observeOpenApiContent(content, observation.response)
+	}
+}
+
+// observeOpenApiContent merges a body into the schemas of a request body or response, by media type. Bodies that
+// aren't JSON only record their media type.
+func observeOpenApiContent(content map[string]*inferredSchema, body openApiObservedBody) {
+	schema, ok := content[body.mediaType]
+	if !ok && len(content) >= maxInferredProperties {
+		return
+	}
+	if body.valid {
+		if schema == nil {
+			schema = newInferredSchema()
+		}
+		schema.observe(body.value, 0)
+	}
+	content[body.mediaType] = schema
+}
+
+// writeSpecs writes the spec of every service that's changed since they were last written
+func (i *openApiInferrer) writeSpecs() {
+	for name, service := range i.services {
+		if !service.changed {
+			continue
+		}
+		path := filepath.Join(i.directory, openApiSpecFileName(name))
+		if err := writeOpenApiSpec(path, service.document(name)); err != nil {
+			slog.Error("Failed to write inferred OpenAPI spec:", "Service", name, "Err", err.Error())
+			continue
+		}
+		service.changed = false
+		slog.Debug("Wrote inferred OpenAPI spec", "Service", name, "Path", path, "Operations", len(service.operations))
+	}
+}
+
+// openApiSpecFileName turns a service name such as "namespace/name" into a file name such as namespace.name.openapi.json
+func openApiSpecFileName(service string) string {
+	return unsafeFileNameCharacters.ReplaceAllString(strings.ReplaceAll(service, "/", "."), "_") + openApiSpecSuffix
+}
+
+// writeOpenApiSpec writes the spec to a temporary file and renames it into place, so readers never see a partial spec
+func writeOpenApiSpec(path string, doc *openapi3.T) error {
+	specBytes, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to encode OpenAPI spec: %v", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, append(specBytes, '\n'), 0o644); err != nil {
+		return fmt.Errorf("Failed to write OpenAPI spec %s: %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("Failed to rename OpenAPI spec %s: %v", tmpPath, err)
+	}
+	return nil
+}
+
+func (s *inferredService) document(name string) *openapi3.T {
+	doc := &openapi3.T{
+		OpenAPI: openApiVersion,
+		Info: &openapi3.Info{
+			Title:       name,
+			Description: "Inferred by the FireTail Kubernetes sensor from observed traffic.",
+			Version:     openApiInferredSpecVersion,
+		},
+		Paths: openapi3.Paths{},
+	}
+	hosts := make([]string, 0, len(s.hosts))
+	for host := range s.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		doc.AddServer(&openapi3.Server{URL: "http://" + host})
+	}
+	for key, operation := range s.operations {
+		doc.AddOperation(key.pathTemplate, key.method, operation.toOpenApi())
+	}
+	return doc
+}
+
+func (o *inferredOperation) toOpenApi() *openapi3.Operation {
+	operation := openapi3.NewOperation()
+	for j, schema := range o.pathParameters {
+		operation.AddParameter(openapi3.NewPathParameter(openApiPathParameterName(j)).WithSchema(schema.toOpenApi()))
+	}
+	queryNames := make([]string, 0, len(o.queryParameters))
+	for name := range o.queryParameters {
+		queryNames = append(queryNames, name)
+	}
+	sort.Strings(queryNames)
+	for _, name := range queryNames {
+		parameter := openapi3.NewQueryParameter(name).WithSchema(o.queryParameters[name].toOpenApi())
+		parameter.Required = o.queryCounts[name] == o.count
+		operation.AddParameter(parameter)
+	}
+	if len(o.requestBodies) > 0 {
+		operation.RequestBody = &openapi3.RequestBodyRef{Value: openapi3.NewRequestBody().
+			WithRequired(o.requestBodyCount == o.count).
+			WithContent(openApiContent(o.requestBodies))}
+	}
+	operation.Responses = openapi3.Responses{}
+	for statusCode, content := range o.responses {
+		description := http.StatusText(statusCode)
+		if description == "" {
+			description = "Status " + strconv.Itoa(statusCode)
+		}
+		response := openapi3.NewResponse().WithDescription(description)
+		if len(content) > 0 {
+			response.Content = openApiContent(content)
+		}
+		operation.AddResponse(statusCode, response)
+	}
+	return operation
+}
+
+// openApiContent converts inferred schemas by media type into OpenAPI content. Media types without a schema weren't
+// JSON, so they're described as strings.
+func openApiContent(schemas map[string]*inferredSchema) openapi3.Content {
+	content := openapi3.NewContent()
+	for mediaType, schema := range schemas {
+		switch {
+		case schema != nil:
+			content[mediaType] = openapi3.NewMediaType().WithSchema(schema.toOpenApi())
+		case isJsonMediaType(mediaType):
+			content[mediaType] = openapi3.NewMediaType().WithSchema(openapi3.NewSchema())
+		case isTextContentType(mediaType):
+			content[mediaType] = openapi3.NewMediaType().WithSchema(openapi3.NewStringSchema())
+		default:
+			content[mediaType] = openapi3.NewMediaType().WithSchema(openapi3.NewStringSchema().WithFormat("binary"))
+		}
+	}
+	return content
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+func TestInferPathTemplate(t *testing.T) {
+	tests := []struct {
+		path             string
+		expectedTemplate string
+		expectedValues   []string
+	}{
+		{"/users", "/users", nil},
+		{"/users/123", "/users/{id}", []string{"123"}},
+		{"/users/123/orders/8b3f0b8e-6f0d-4f7a-9d3b-2f1e8c7a6b5d", "/users/{id}/orders/{id2}", []string{"123", "8b3f0b8e-6f0d-4f7a-9d3b-2f1e8c7a6b5d"}},
+		{"/users/alice", "/users/alice", nil},
+		{"", "/", nil},
+	}
+	for _, test := range tests {
+		template, values := inferPathTemplate(test.path)
+		if template != test.expectedTemplate || len(values) != len(test.expectedValues) {
+			t.Errorf("inferPathTemplate(%q) = %q, %q, want %q, %q", test.path, template, values, test.expectedTemplate, test.expectedValues)
+		}
+	}
+}
+
+func newTestOpenApiInferrer(t *testing.T, maxEndpointsPerService int) *openApiInferrer {
+	inferrer, err := newOpenApiInferrer(openApiInferenceConfig{
+		Directory:              t.TempDir(),
+		Interval:               time.Hour,
+		MaxEndpointsPerService: maxEndpointsPerService,
+		QueueSize:              10,
+	}, newDropCounters())
+	if err != nil {
+		t.Fatalf("Failed to create inferrer: %v", err)
+	}
+	return inferrer
+}
+
+func inferFromTestTraffic(t *testing.T, inferrer *openApiInferrer, exchanges [][2]string) {
+	done := make(chan struct{})
+	go func() {
+		inferrer.run()
+		close(done)
+	}()
+	for _, exchange := range exchanges {
+		reqAndResp := newTestRequestAndResponse(t, exchange[0], exchange[1])
+		reqAndResp.dstWorkload = "shop/users"
+		inferrer.export(reqAndResp)
+	}
+	close(inferrer.observations)
+	<-done
+}
+
+func loadTestOpenApiSpec(t *testing.T, path string) *openapi3.T {
+	doc, err := openapi3.NewLoader().LoadFromFile(path)
+	if err != nil {
+		t.Fatalf("Failed to load inferred spec: %v", err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		t.Fatalf("Inferred spec isn't valid: %v", err)
+	}
+	return doc
+}
+
+func TestOpenApiInferrerWritesSpecPerService(t *testing.T) {
+	inferrer := newTestOpenApiInferrer(t, 100)
+	inferFromTestTraffic(t, inferrer, [][2]string{
+		{
+			"GET /users/1?verbose=true&limit=10 HTTP/1.1\r\nHost: users.shop.svc\r\n\r\n",
+			"HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 37\r\n\r\n" +
+				`{"id": 1, "name": "a", "email": null}`,
+		},
+		{
+			"GET /users/2?verbose=false HTTP/1.1\r\nHost: users.shop.svc\r\n\r\n",
+			"HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 22\r\n\r\n" +
+				`{"id": 2, "name": "b"}`,
+		},
+		{
+			"GET /users/3 HTTP/1.1\r\nHost: users.shop.svc\r\n\r\n",
+			"HTTP/1.1 404 Not Found\r\nContent-Type: text/plain\r\nContent-Length: 9\r\n\r\nnot found",
+		},
+		{
+			"POST /users HTTP/1.1\r\nHost: users.shop.svc:8080\r\nContent-Type: application/json\r\nContent-Length: 13\r\n\r\n" +
+				`{"name": "c"}`,
+			"HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n",
+		},
+	})
+
+	doc := loadTestOpenApiSpec(t, filepath.Join(inferrer.directory, "shop.users.openapi.json"))
+	if doc.Info.Title != "shop/users" || len(doc.Servers) != 2 {
+		t.Errorf("Info = %+v, Servers = %v, want the service name and both hosts", doc.Info, doc.Servers)
+	}
+	if len(doc.Paths) != 2 {
+		t.Fatalf("Paths = %v, want /users and /users/{id}", doc.Paths)
+	}
+
+	get := doc.Paths.Find("/users/{id}").Get
+	if get == nil {
+		t.Fatalf("No GET operation for /users/{id}")
+	}
+	id := get.Parameters.GetByInAndName("path", "id")
+	if id == nil || !id.Required || id.Schema.Value.Type != "integer" {
+		t.Errorf("id parameter = %+v, want a required integer", id)
+	}
+	verbose := get.Parameters.GetByInAndName("query", "verbose")
+	if verbose == nil || verbose.Required || verbose.Schema.Value.Type != "boolean" {
+		t.Errorf("verbose parameter = %+v, want an optional boolean", verbose)
+	}
+	user := get.Responses.Get(200).Value.Content.Get("application/json").Schema.Value
+	if user.Type != "object" || len(user.Required) != 2 || !user.Properties["email"].Value.Nullable {
+		t.Errorf("200 response schema = %+v, want an object requiring id and name, with a nullable email", user)
+	}
+	if notFound := get.Responses.Get(404); notFound == nil || notFound.Value.Content.Get("text/plain").Schema.Value.Type != "string" {
+		t.Errorf("404 response = %+v, want a text/plain string", notFound)
+	}
+
+	post := doc.Paths.Find("/users").Post
+	if post == nil || post.RequestBody == nil || !post.RequestBody.Value.Required {
+		t.Fatalf("POST /users = %+v, want a required request body", post)
+	}
+	if created := post.Responses.Get(201); created == nil || created.Value.Content != nil {
+		t.Errorf("201 response = %+v, want no content", created)
+	}
+}
+
+func TestOpenApiInferrerMaxEndpointsPerService(t *testing.T) {
+	inferrer := newTestOpenApiInferrer(t, 1)
+	inferFromTestTraffic(t, inferrer, [][2]string{
+		{"GET /a HTTP/1.1\r\nHost: users\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"},
+		{"GET /b HTTP/1.1\r\nHost: users\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"},
+		{"GET /a HTTP/1.1\r\nHost: users\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"},
+	})
+
+	doc := loadTestOpenApiSpec(t, filepath.Join(inferrer.directory, "shop.users.openapi.json"))
+	if len(doc.Paths) != 1 || doc.Paths.Find("/a") == nil {
+		t.Errorf("Paths = %v, want only /a", doc.Paths)
+	}
+	if dropped := inferrer.drops.snapshot()[dropReasonOpenApiMaxEndpoints]; dropped != 1 {
+		t.Errorf("Dropped %d endpoints, want 1", dropped)
+	}
+	if entries, _ := os.ReadDir(inferrer.directory); len(entries) != 1 {
+		t.Errorf("Directory has %d entries, want just the spec", len(entries))
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The types below are the subset of the OTLP trace and logs protocol the sensor sends. They're encoded by hand so the
+// sensor doesn't need the OpenTelemetry SDK or a gRPC stack; the JSON tags follow the OTLP/JSON mapping and the
+// field numbers in the marshalProto methods follow opentelemetry-proto v1.
+
+const (
+	otlpSpanKindServer        = 2
+	otlpStatusCodeError       = 2
+	otlpSeverityNumberInfo    = 9
+	otlpSeverityNumberWarn    = 13
+	otlpSeverityNumberError   = 17
+	otlpInstrumentationScope  = "firetail-kubernetes-sensor"
+	otlpDefaultServiceName    = "firetail-kubernetes-sensor"
+	otlpTracesHttpPath        = "/v1/traces"
+	otlpLogsHttpPath          = "/v1/logs"
+	otlpTracesGrpcMethod      = "/opentelemetry.proto.collector.trace.v1.TraceService/Export"
+	otlpLogsGrpcMethod        = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+	otlpProtocolGrpc          = "grpc"
+	otlpProtocolHttpProtobuf  = "http/protobuf"
+	otlpProtocolHttpJson      = "http/json"
+	otlpContentTypeProtobuf   = "application/x-protobuf"
+	otlpContentTypeJson       = "application/json"
+	otlpContentTypeGrpc       = "application/grpc"
+	otlpGrpcStatusOk          = "0"
+	otlpGrpcMessageHeaderSize = 5
+)
+
+type otlpTraceId [16]byte
+
+type otlpSpanId [8]byte
+
+func (id otlpTraceId) MarshalJSON() ([]byte, error) { return json.Marshal(hex.EncodeToString(id[:])) }
+
+func (id otlpSpanId) MarshalJSON() ([]byte, error) { return json.Marshal(hex.EncodeToString(id[:])) }
+
+func (id otlpSpanId) isZero() bool { return id == otlpSpanId{} }
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *int64   `json:"intValue,omitempty,string"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+func otlpString(key string, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &value}}
+}
+
+func otlpInt(key string, value int64) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{IntValue: &value}}
+}
+
+func otlpBool(key string, value bool) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{BoolValue: &value}}
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpStatus struct {
+	Code int32 `json:"code,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           otlpTraceId    `json:"traceId"`
+	SpanId            otlpSpanId     `json:"spanId"`
+	ParentSpanId      *otlpSpanId    `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int32          `json:"kind"`
+	StartTimeUnixNano uint64         `json:"startTimeUnixNano,string"`
+	EndTimeUnixNano   uint64         `json:"endTimeUnixNano,string"`
+	Attributes        []otlpKeyValue `json:"attributes"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         uint64         `json:"timeUnixNano,string"`
+	ObservedTimeUnixNano uint64         `json:"observedTimeUnixNano,string"`
+	SeverityNumber       int32          `json:"severityNumber"`
+	SeverityText         string         `json:"severityText"`
+	Body                 otlpAnyValue   `json:"body"`
+	Attributes           []otlpKeyValue `json:"attributes"`
+	TraceId              otlpTraceId    `json:"traceId"`
+	SpanId               otlpSpanId     `json:"spanId"`
+}
+
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpLogsRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope       `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+func appendProtoMessage(b []byte, num protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
+
+func appendProtoString(b []byte, num protowire.Number, value string) []byte {
+	if value == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+func appendProtoBytes(b []byte, num protowire.Number, value []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, value)
+}
+
+func appendProtoVarint(b []byte, num protowire.Number, value uint64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, value)
+}
+
+func appendProtoFixed64(b []byte, num protowire.Number, value uint64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, value)
+}
+
+func appendProtoDouble(b []byte, num protowire.Number, value float64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(value))
+}
+
+func (v otlpAnyValue) marshalProto() []byte {
+	var b []byte
+	switch {
+	case v.StringValue != nil:
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, *v.StringValue)
+	case v.BoolValue != nil:
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(*v.BoolValue))
+	case v.IntValue != nil:
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(*v.IntValue))
+	case v.DoubleValue != nil:
+		b = protowire.AppendTag(b, 4, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(*v.DoubleValue))
+	}
+	return b
+}
+
+func appendProtoAttributes(b []byte, num protowire.Number, attributes []otlpKeyValue) []byte {
+	for _, attribute := range attributes {
+		var kv []byte
+		kv = appendProtoString(kv, 1, attribute.Key)
+		kv = appendProtoMessage(kv, 2, attribute.Value.marshalProto())
+		b = appendProtoMessage(b, num, kv)
+	}
+	return b
+}
+
+func (r otlpResource) marshalProto() []byte {
+	return appendProtoAttributes(nil, 1, r.Attributes)
+}
+
+func (s otlpScope) marshalProto() []byte {
+	b := appendProtoString(nil, 1, s.Name)
+	return appendProtoString(b, 2, s.Version)
+}
+
+func (s otlpSpan) marshalProto() []byte {
+	var b []byte
+	b = appendProtoBytes(b, 1, s.TraceId[:])
+	b = appendProtoBytes(b, 2, s.SpanId[:])
+	if s.ParentSpanId != nil {
+		b = appendProtoBytes(b, 4, s.ParentSpanId[:])
+	}
+	b = appendProtoString(b, 5, s.Name)
+	b = appendProtoVarint(b, 6, uint64(s.Kind))
+	b = appendProtoFixed64(b, 7, s.StartTimeUnixNano)
+	b = appendProtoFixed64(b, 8, s.EndTimeUnixNano)
+	b = appendProtoAttributes(b, 9, s.Attributes)
+	return appendProtoMessage(b, 15, appendProtoVarint(nil, 3, uint64(s.Status.Code)))
+}
+
+func (l otlpLogRecord) marshalProto() []byte {
+	var b []byte
+	b = appendProtoFixed64(b, 1, l.TimeUnixNano)
+	b = appendProtoVarint(b, 2, uint64(l.SeverityNumber))
+	b = appendProtoString(b, 3, l.SeverityText)
+	b = appendProtoMessage(b, 5, l.Body.marshalProto())
+	b = appendProtoAttributes(b, 6, l.Attributes)
+	b = appendProtoBytes(b, 9, l.TraceId[:])
+	b = appendProtoBytes(b, 10, l.SpanId[:])
+	return appendProtoFixed64(b, 11, l.ObservedTimeUnixNano)
+}
+
+func (r otlpTracesRequest) marshalProto() []byte {
+	var b []byte
+	for _, resourceSpans := range r.ResourceSpans {
+		var rs []byte
+		rs = appendProtoMessage(rs, 1, resourceSpans.Resource.marshalProto())
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			ss := appendProtoMessage(nil, 1, scopeSpans.Scope.marshalProto())
+			for _, span := range scopeSpans.Spans {
+				ss = appendProtoMessage(ss, 2, span.marshalProto())
+			}
+			rs = appendProtoMessage(rs, 2, ss)
+		}
+		b = appendProtoMessage(b, 1, rs)
+	}
+	return b
+}
+
+func (r otlpLogsRequest) marshalProto() []byte {
+	var b []byte
+	for _, resourceLogs := range r.ResourceLogs {
+		var rl []byte
+		rl = appendProtoMessage(rl, 1, resourceLogs.Resource.marshalProto())
+		for _, scopeLogs := range resourceLogs.ScopeLogs {
+			sl := appendProtoMessage(nil, 1, scopeLogs.Scope.marshalProto())
+			for _, record := range scopeLogs.LogRecords {
+				sl = appendProtoMessage(sl, 2, record.marshalProto())
+			}
+			rl = appendProtoMessage(rl, 2, sl)
+		}
+		b = appendProtoMessage(b, 1, rl)
+	}
+	return b
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dropReasonOtlpQueueFull = "sinks.otlp.queueSize"
+
+// otlpExporter converts captured requests and responses into OTLP spans, and optionally log records with their bodies,
+// and sends them in batches to an OpenTelemetry collector over OTLP/gRPC, OTLP/HTTP with protobuf, or OTLP/HTTP with
+// JSON. A batch is sent when it has maxBatchSize spans, or when its oldest span is older than maxBatchAge.
+type otlpExporter struct {
+	endpoint     string
+	protocol     string
+	headers      map[string]string
+	exportLogs   bool
+	resource     otlpResource
+	maxBatchSize int
+	maxBatchAge  time.Duration
+	client       *http.Client
+	exchanges    chan otlpExchange
+	drops        *dropCounters
+	sendBatch    func([]otlpExchange) error
+}
+
+// otlpExchange is a captured request and response converted into a span, and a log record if logs are exported
+type otlpExchange struct {
+	span otlpSpan
+	log  *otlpLogRecord
+}
+
+func newOtlpExporter(config otlpSinkConfig, kubernetesConfig kubernetesConfig, drops *dropCounters) *otlpExporter {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.Protocol == otlpProtocolGrpc {
+		// gRPC is always HTTP/2, including over plaintext connections to collectors within the cluster
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	resourceAttributes := []otlpKeyValue{otlpString("service.name", config.ServiceName)}
+	if kubernetesConfig.NodeName != "" {
+		resourceAttributes = append(resourceAttributes, otlpString("k8s.node.name", kubernetesConfig.NodeName))
+	}
+	if kubernetesConfig.PodName != "" {
+		resourceAttributes = append(resourceAttributes, otlpString("k8s.pod.name", kubernetesConfig.PodName))
+	}
+
+	exporter := &otlpExporter{
+		endpoint:     strings.TrimSuffix(config.Endpoint, "/"),
+		protocol:     config.Protocol,
+		headers:      config.Headers,
+		exportLogs:   config.ExportLogs,
+		resource:     otlpResource{Attributes: resourceAttributes},
+		maxBatchSize: config.MaxBatchSize,
+		maxBatchAge:  config.MaxBatchAge,
+		client:       &http.Client{Timeout: config.Timeout, Transport: transport},
+		exchanges:    make(chan otlpExchange, config.QueueSize),
+		drops:        drops,
+	}
+	exporter.sendBatch = exporter.postBatch
+	return exporter
+}
+
+// export converts the request and response and queues it to be sent. If the queue is full it's dropped rather than
+// holding up the pipeline's worker.
+func (e *otlpExporter) export(reqAndResp *httpRequestAndResponse) {
+	select {
+	case e.exchanges <- e.convert(reqAndResp, time.Now()):
+	default:
+		slog.Warn("OTLP exporter queue full, dropping span")
+		e.drops.increment(dropReasonOtlpQueueFull)
+	}
+}
+
+func (e *otlpExporter) convert(reqAndResp *httpRequestAndResponse, observedTime time.Time) otlpExchange {
+	request := reqAndResp.request
+	response := reqAndResp.response
+
+	startTime := reqAndResp.requestTime
+	if startTime.IsZero() {
+		startTime = observedTime
+	}
+	endTime := reqAndResp.responseTime
+	if endTime.Before(startTime) {
+		endTime = startTime
+	}
+
+	// If the client propagated a W3C trace context the span joins its trace, so it appears alongside the app's spans
+	span := otlpSpan{Kind: otlpSpanKindServer}
+	if traceId, parentSpanId, ok := parseTraceparent(request.Header.Get("traceparent")); ok {
+		span.TraceId = traceId
+		span.ParentSpanId = &parentSpanId
+	} else {
+		rand.Read(span.TraceId[:])
+	}
+	rand.Read(span.SpanId[:])
+
+	route := normalisePath(request.URL.Path)
+	span.Name = request.Method + " " + route
+	span.StartTimeUnixNano = uint64(startTime.UnixNano())
+	span.EndTimeUnixNano = uint64(endTime.UnixNano())
+	if response.StatusCode >= 500 {
+		span.Status.Code = otlpStatusCodeError
+	}
+
+	serverAddress, serverPort := request.Host, reqAndResp.dstPort
+	if host, port, err := net.SplitHostPort(request.Host); err == nil {
+		serverAddress, serverPort = host, port
+	}
+	span.Attributes = []otlpKeyValue{
+		otlpString("http.request.method", request.Method),
+		otlpString("http.route", route),
+		otlpInt("http.response.status_code", int64(response.StatusCode)),
+		otlpString("url.scheme", requestScheme(request)),
+		otlpString("url.path", request.URL.Path),
+		otlpString("server.address", serverAddress),
+		otlpString("network.protocol.version", fmt.Sprintf("%d.%d", request.ProtoMajor, request.ProtoMinor)),
+		otlpString("client.address", reqAndResp.src),
+		otlpString("network.local.address", reqAndResp.dst),
+	}
+	if request.URL.RawQuery != "" {
+		span.Attributes = append(span.Attributes, otlpString("url.query", request.URL.RawQuery))
+	}
+	if port, err := strconv.ParseInt(serverPort, 10, 64); err == nil {
+		span.Attributes = append(span.Attributes, otlpInt("server.port", port))
+	}
+	if port, err := strconv.ParseInt(reqAndResp.srcPort, 10, 64); err == nil {
+		span.Attributes = append(span.Attributes, otlpInt("client.port", port))
+	}
+	if port, err := strconv.ParseInt(reqAndResp.dstPort, 10, 64); err == nil {
+		span.Attributes = append(span.Attributes, otlpInt("network.local.port", port))
+	}
+	if userAgent := request.UserAgent(); userAgent != "" {
+		span.Attributes = append(span.Attributes, otlpString("user_agent.original", userAgent))
+	}
+	if reqAndResp.srcWorkload != "" {
+		span.Attributes = append(span.Attributes, otlpString("firetail.source.workload", reqAndResp.srcWorkload))
+	}
+	if reqAndResp.dstWorkload != "" {
+		span.Attributes = append(span.Attributes, otlpString("firetail.destination.workload", reqAndResp.dstWorkload))
+	}
+	if reqAndResp.auth != nil {
+		span.Attributes = append(span.Attributes, otlpString("firetail.auth.schemes", strings.Join(reqAndResp.auth.Schemes, ",")))
+	}
+	if len(reqAndResp.dataClasses) > 0 {
+		span.Attributes = append(span.Attributes, otlpString("firetail.data_classes", strings.Join(reqAndResp.dataClasses, ",")))
+	}
+
+	if !e.exportLogs {
+		if request.ContentLength >= 0 {
+			span.Attributes = append(span.Attributes, otlpInt("http.request.body.size", request.ContentLength))
+		}
+		if response.ContentLength >= 0 {
+			span.Attributes = append(span.Attributes, otlpInt("http.response.body.size", response.ContentLength))
+		}
+		return otlpExchange{span: span}
+	}
+
+	requestBody, requestTruncated := readCapturedBody(request.Body)
+	responseBody, responseTruncated := readCapturedBody(response.Body)
+	requestTruncated = requestTruncated || reqAndResp.requestTruncated
+	responseTruncated = responseTruncated || reqAndResp.responseTruncated
+	span.Attributes = append(span.Attributes,
+		otlpInt("http.request.body.size", int64(len(requestBody))),
+		otlpInt("http.response.body.size", int64(len(responseBody))),
+	)
+
+	severityNumber, severityText := int32(otlpSeverityNumberInfo), "INFO"
+	switch {
+	case response.StatusCode >= 500:
+		severityNumber, severityText = otlpSeverityNumberError, "ERROR"
+	case response.StatusCode >= 400:
+		severityNumber, severityText = otlpSeverityNumberWarn, "WARN"
+	}
+	summary := fmt.Sprintf("%s %s %d", request.Method, request.URL.RequestURI(), response.StatusCode)
+	log := &otlpLogRecord{
+		TimeUnixNano:         span.StartTimeUnixNano,
+		ObservedTimeUnixNano: uint64(observedTime.UnixNano()),
+		SeverityNumber:       severityNumber,
+		SeverityText:         severityText,
+		Body:                 otlpAnyValue{StringValue: &summary},
+		Attributes: []otlpKeyValue{
+			otlpString("http.request.method", request.Method),
+			otlpString("http.route", route),
+			otlpInt("http.response.status_code", int64(response.StatusCode)),
+			otlpString("http.request.body.content", string(requestBody)),
+			otlpString("http.response.body.content", string(responseBody)),
+			otlpBool("firetail.request.truncated", requestTruncated),
+			otlpBool("firetail.response.truncated", responseTruncated),
+			otlpBool("firetail.capture.lossy", reqAndResp.lossy),
+		},
+		TraceId: span.TraceId,
+		SpanId:  span.SpanId,
+	}
+	return otlpExchange{span: span, log: log}
+}
+
+// parseTraceparent parses a W3C traceparent header, returning false if it's missing or invalid
+func parseTraceparent(traceparent string) (otlpTraceId, otlpSpanId, bool) {
+	var traceId otlpTraceId
+	var spanId otlpSpanId
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceId, spanId, false
+	}
+	if _, err := hex.Decode(traceId[:], []byte(parts[1])); err != nil {
+		return traceId, spanId, false
+	}
+	if _, err := hex.Decode(spanId[:], []byte(parts[2])); err != nil {
+		return traceId, spanId, false
+	}
+	if traceId == (otlpTraceId{}) || spanId.isZero() {
+		return traceId, spanId, false
+	}
+	return traceId, spanId, true
+}
+
+// run batches up queued spans and sends them to the collector until the exchanges channel is closed, at which point
+// any remaining spans are sent
+func (e *otlpExporter) run() {
+	batch := []otlpExchange{}
+	flushTimer := time.NewTimer(e.maxBatchAge)
+	flushTimer.Stop()
+
+	flush := func() {
+		flushTimer.Stop()
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.sendBatch(batch); err != nil {
+			slog.Error("Failed to export spans to OTLP collector:", "Err", err.Error(), "Spans", len(batch))
+		} else {
+			slog.Debug("Exported spans to OTLP collector", "Spans", len(batch))
+		}
+		batch = []otlpExchange{}
+	}
+
+	for {
+		select {
+		case exchange, ok := <-e.exchanges:
+			if !ok {
+				flush()
+				return
+			}
+			if len(batch) == 0 {
+				flushTimer.Reset(e.maxBatchAge)
+			}
+			batch = append(batch, exchange)
+			if len(batch) >= e.maxBatchSize {
+				flush()
+			}
+		case <-flushTimer.C:
+			flush()
+		}
+	}
+}
+
+func (e *otlpExporter) postBatch(batch []otlpExchange) error {
+	scope := otlpScope{Name: otlpInstrumentationScope}
+	traces := otlpTracesRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   e.resource,
+		ScopeSpans: []otlpScopeSpans{{Scope: scope, Spans: make([]otlpSpan, 0, len(batch))}},
+	}}}
+	logs := otlpLogsRequest{ResourceLogs: []otlpResourceLogs{{
+		Resource:  e.resource,
+		ScopeLogs: []otlpScopeLogs{{Scope: scope, LogRecords: []otlpLogRecord{}}},
+	}}}
+	for _, exchange := range batch {
+		traces.ResourceSpans[0].ScopeSpans[0].Spans = append(traces.ResourceSpans[0].ScopeSpans[0].Spans, exchange.span)
+		if exchange.log != nil {
+			logs.ResourceLogs[0].ScopeLogs[0].LogRecords = append(logs.ResourceLogs[0].ScopeLogs[0].LogRecords, *exchange.log)
+		}
+	}
+
+	if err := e.post(otlpTracesHttpPath, otlpTracesGrpcMethod, traces); err != nil {
+		return fmt.Errorf("Failed to export spans: %v", err)
+	}
+	if len(logs.ResourceLogs[0].ScopeLogs[0].LogRecords) == 0 {
+		return nil
+	}
+	if err := e.post(otlpLogsHttpPath, otlpLogsGrpcMethod, logs); err != nil {
+		return fmt.Errorf("Failed to export logs: %v", err)
+	}
+	return nil
+}
+
+type otlpMessage interface {
+	marshalProto() []byte
+}
+
+// post sends an export request to the collector using the configured protocol
+func (e *otlpExporter) post(httpPath string, grpcMethod string, message otlpMessage) error {
+	var body []byte
+	var contentType, requestUrl string
+	switch e.protocol {
+	case otlpProtocolGrpc:
+		// A gRPC message is prefixed with an uncompressed flag and its length
+		payload := message.marshalProto()
+		body = make([]byte, otlpGrpcMessageHeaderSize, otlpGrpcMessageHeaderSize+len(payload))
+		binary.BigEndian.PutUint32(body[1:], uint32(len(payload)))
+		body = append(body, payload...)
+		contentType, requestUrl = otlpContentTypeGrpc, e.endpoint+grpcMethod
+	case otlpProtocolHttpJson:
+		jsonBody, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		body, contentType, requestUrl = jsonBody, otlpContentTypeJson, e.endpoint+httpPath
+	default:
+		body, contentType, requestUrl = message.marshalProto(), otlpContentTypeProtobuf, e.endpoint+httpPath
+	}
+
+	req, err := http.NewRequest("POST", requestUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, value := range e.headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if e.protocol == otlpProtocolGrpc {
+		req.Header.Set("TE", "trailers")
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// The body has to be read to the end before a gRPC response's trailers are available
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	if e.protocol == otlpProtocolGrpc {
+		grpcStatus, grpcMessage := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+		if grpcStatus == "" {
+			// Trailers-only responses put the status in the headers
+			grpcStatus, grpcMessage = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+		}
+		if resp.StatusCode != http.StatusOK || grpcStatus != otlpGrpcStatusOk {
+			message, _ := url.PathUnescape(grpcMessage)
+			return fmt.Errorf("got err response from OTLP collector: %d grpc-status %q %s", resp.StatusCode, grpcStatus, message)
+		}
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("got err response from OTLP collector: %d %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func newTestOtlpExporter(endpoint string, protocol string, exportLogs bool) *otlpExporter {
+	return newOtlpExporter(
+		otlpSinkConfig{
+			Endpoint:     endpoint,
+			Protocol:     protocol,
+			Headers:      map[string]string{"api-key": "secret"},
+			Timeout:      5 * time.Second,
+			ServiceName:  "sensor",
+			ExportLogs:   exportLogs,
+			MaxBatchSize: 10,
+			MaxBatchAge:  time.Hour,
+			QueueSize:    10,
+		},
+		kubernetesConfig{NodeName: "node-1"},
+		newDropCounters(),
+	)
+}
+
+func findOtlpAttribute(attributes []otlpKeyValue, key string) *otlpAnyValue {
+	for _, attribute := range attributes {
+		if attribute.Key == key {
+			return &attribute.Value
+		}
+	}
+	return nil
+}
+
+func TestOtlpExporterConvert(t *testing.T) {
+	reqAndResp := newTestRequestAndResponse(
+		t,
+		"POST /orders/123?expand=items HTTP/1.1\r\nHost: orders.shop.svc:8080\r\n\r\n",
+		"HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\n\r\n",
+	)
+	reqAndResp.request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	reqAndResp.request.Body = io.NopCloser(strings.NewReader(`{"qty": 1}`))
+	reqAndResp.response.Body = io.NopCloser(strings.NewReader(`{"error": "unavailable"}`))
+	reqAndResp.src, reqAndResp.srcPort = "10.0.0.1", "51234"
+	reqAndResp.dst, reqAndResp.dstPort = "10.0.0.2", "8080"
+	reqAndResp.dstWorkload = "shop/orders"
+	reqAndResp.requestTime = time.Unix(100, 0)
+	reqAndResp.responseTime = time.Unix(100, int64(20*time.Millisecond))
+
+	exchange := newTestOtlpExporter("http://localhost", otlpProtocolHttpProtobuf, true).convert(reqAndResp, time.Unix(101, 0))
+	span := exchange.span
+
+	if hex.EncodeToString(span.TraceId[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("TraceId = %x, want the traceparent's trace ID", span.TraceId)
+	}
+	if span.ParentSpanId == nil || hex.EncodeToString(span.ParentSpanId[:]) != "00f067aa0ba902b7" {
+		t.Errorf("ParentSpanId = %v, want the traceparent's span ID", span.ParentSpanId)
+	}
+	if span.Name != "POST /orders/{id}" {
+		t.Errorf("Name = %q, want %q", span.Name, "POST /orders/{id}")
+	}
+	if span.EndTimeUnixNano-span.StartTimeUnixNano != uint64(20*time.Millisecond) {
+		t.Errorf("Span duration = %d, want 20ms", span.EndTimeUnixNano-span.StartTimeUnixNano)
+	}
+	if span.Status.Code != otlpStatusCodeError {
+		t.Errorf("Status.Code = %d, want %d", span.Status.Code, otlpStatusCodeError)
+	}
+	expectedStrings := map[string]string{
+		"http.request.method":           "POST",
+		"http.route":                    "/orders/{id}",
+		"url.query":                     "expand=items",
+		"server.address":                "orders.shop.svc",
+		"client.address":                "10.0.0.1",
+		"firetail.destination.workload": "shop/orders",
+	}
+	for key, expected := range expectedStrings {
+		if value := findOtlpAttribute(span.Attributes, key); value == nil || value.StringValue == nil || *value.StringValue != expected {
+			t.Errorf("Attribute %s = %v, want %q", key, value, expected)
+		}
+	}
+	expectedInts := map[string]int64{
+		"http.response.status_code": 503,
+		"server.port":               8080,
+		"client.port":               51234,
+		"http.request.body.size":    10,
+	}
+	for key, expected := range expectedInts {
+		if value := findOtlpAttribute(span.Attributes, key); value == nil || value.IntValue == nil || *value.IntValue != expected {
+			t.Errorf("Attribute %s = %v, want %d", key, value, expected)
+		}
+	}
+
+	if exchange.log == nil {
+		t.Fatalf("log = nil, want a log record when logs are exported")
+	}
+	if exchange.log.TraceId != span.TraceId || exchange.log.SpanId != span.SpanId {
+		t.Errorf("Log record isn't correlated with its span")
+	}
+	if exchange.log.SeverityNumber != otlpSeverityNumberError {
+		t.Errorf("SeverityNumber = %d, want %d", exchange.log.SeverityNumber, otlpSeverityNumberError)
+	}
+	if value := findOtlpAttribute(exchange.log.Attributes, "http.response.body.content"); value == nil || *value.StringValue != `{"error": "unavailable"}` {
+		t.Errorf("http.response.body.content = %v", value)
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		traceparent string
+		expectedOk  bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-zzzzzzzzzzzzzzzz-01", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.traceparent, func(t *testing.T) {
+			if _, _, ok := parseTraceparent(tt.traceparent); ok != tt.expectedOk {
+				t.Errorf("parseTraceparent() ok = %v, want %v", ok, tt.expectedOk)
+			}
+		})
+	}
+}
+
+// protoStrings returns every string in an encoded protobuf message, including those in nested messages, so the test
+// collector can check what was sent without the generated OTLP types
+func protoStrings(b []byte) []string {
+	strs := []string{}
+	for len(b) > 0 {
+		_, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil
+		}
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(0, typ, b)
+		if n < 0 {
+			return nil
+		}
+		if typ == protowire.BytesType {
+			value, _ := protowire.ConsumeBytes(b)
+			if nested := protoStrings(value); nested != nil && len(value) > 0 {
+				strs = append(strs, nested...)
+			}
+			if utf8.Valid(value) {
+				strs = append(strs, string(value))
+			}
+		}
+		b = b[n:]
+	}
+	return strs
+}
+
+// newTestOtlpCollector starts an in-process collector which accepts OTLP over gRPC, HTTP/protobuf and HTTP/JSON, and
+// sends the strings in each export request it receives on the returned channel, keyed by path
+func newTestOtlpCollector(t *testing.T) (*httptest.Server, chan map[string][]string) {
+	received := make(chan map[string][]string, 10)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("api-key") != "secret" {
+			t.Errorf("api-key header = %q, want %q", r.Header.Get("api-key"), "secret")
+		}
+		body, _ := io.ReadAll(r.Body)
+		var strs []string
+		switch r.Header.Get("Content-Type") {
+		case otlpContentTypeGrpc:
+			if r.ProtoMajor != 2 {
+				t.Errorf("gRPC request used HTTP/%d, want HTTP/2", r.ProtoMajor)
+			}
+			if len(body) < otlpGrpcMessageHeaderSize || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-otlpGrpcMessageHeaderSize {
+				t.Errorf("Invalid gRPC message framing")
+				return
+			}
+			strs = protoStrings(body[otlpGrpcMessageHeaderSize:])
+			w.Header().Set("Content-Type", otlpContentTypeGrpc)
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.WriteHeader(http.StatusOK)
+			w.Header().Set("Grpc-Status", "0")
+		case otlpContentTypeProtobuf:
+			strs = protoStrings(body)
+		case otlpContentTypeJson:
+			var message any
+			if err := json.Unmarshal(body, &message); err != nil {
+				t.Errorf("Invalid JSON export request: %v", err)
+			}
+			var collect func(value any)
+			collect = func(value any) {
+				switch v := value.(type) {
+				case string:
+					strs = append(strs, v)
+				case []any:
+					for _, item := range v {
+						collect(item)
+					}
+				case map[string]any:
+					for _, item := range v {
+						collect(item)
+					}
+				}
+			}
+			collect(message)
+		default:
+			t.Errorf("Unexpected Content-Type %q", r.Header.Get("Content-Type"))
+		}
+		received <- map[string][]string{r.URL.Path: strs}
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+func TestOtlpExporterProtocols(t *testing.T) {
+	tests := []struct {
+		protocol          string
+		expectedTracePath string
+		expectedLogsPath  string
+	}{
+		{otlpProtocolGrpc, otlpTracesGrpcMethod, otlpLogsGrpcMethod},
+		{otlpProtocolHttpProtobuf, otlpTracesHttpPath, otlpLogsHttpPath},
+		{otlpProtocolHttpJson, otlpTracesHttpPath, otlpLogsHttpPath},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.protocol, func(t *testing.T) {
+			server, received := newTestOtlpCollector(t)
+			exporter := newTestOtlpExporter(server.URL, tt.protocol, true)
+			done := make(chan struct{})
+			go func() {
+				exporter.run()
+				close(done)
+			}()
+
+			reqAndResp := newTestRequestAndResponse(t, "GET /users/42 HTTP/1.1\r\nHost: users.default.svc\r\n\r\n", newTestResponseBytes(200))
+			reqAndResp.response.Body = io.NopCloser(strings.NewReader(`{"name": "Alice"}`))
+			exporter.export(reqAndResp)
+			close(exporter.exchanges)
+			<-done
+
+			for _, expected := range []struct {
+				path    string
+				strings []string
+			}{
+				{tt.expectedTracePath, []string{"GET /users/{id}", "http.route", "service.name", "sensor", "node-1"}},
+				{tt.expectedLogsPath, []string{"GET /users/42 200", `{"name": "Alice"}`}},
+			} {
+				select {
+				case request := <-received:
+					strs, ok := request[expected.path]
+					if !ok {
+						t.Fatalf("Collector received %v, want a request to %s", request, expected.path)
+					}
+					for _, s := range expected.strings {
+						if !slices.Contains(strs, s) {
+							t.Errorf("Export request to %s is missing %q", expected.path, s)
+						}
+					}
+				default:
+					t.Fatalf("Collector didn't receive a request to %s", expected.path)
+				}
+			}
+		})
+	}
+}
+
+func TestOtlpExporterReportsGrpcErrors(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", otlpContentTypeGrpc)
+		w.Header().Set("Grpc-Status", "16")
+		w.Header().Set("Grpc-Message", "invalid%20api%20key")
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+
+	err := newTestOtlpExporter(server.URL, otlpProtocolGrpc, false).postBatch([]otlpExchange{{}})
+	if err == nil || !strings.Contains(err.Error(), "invalid api key") {
+		t.Errorf("postBatch() error = %v, want error containing the gRPC message", err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+const (
+	captureBackendPcap     = "pcap"
+	captureBackendAfPacket = "afpacket"
+)
+
+// packetSource is a capture on a single interface by one of the capture backends
+type packetSource interface {
+	// readPackets sends the captured packets to the packets channel until the source is closed or fails
+	readPackets(packets chan<- gopacket.Packet)
+	// compileBpfExpression checks a BPF expression compiles for the source's link type and snaplen, without applying it
+	compileBpfExpression(bpfExpression string) error
+	// setBpfExpression replaces the source's BPF filter without interrupting the capture
+	setBpfExpression(bpfExpression string) error
+	close()
+}
+
+// openPacketSourceFunc opens a packet source on an interface, or on every interface if the name is "any"
+type openPacketSourceFunc func(name string, bpfExpression string) (packetSource, error)
+
+// pcapBackend opens packet sources using libpcap
+type pcapBackend struct {
+	snaplen int
+	config  pcapConfig
+}
+
+func newPcapBackend(snaplen int, config pcapConfig) *pcapBackend {
+	return &pcapBackend{snaplen: snaplen, config: config}
+}
+
+func (b *pcapBackend) open(name string, bpfExpression string) (packetSource, error) {
+	inactive, err := pcap.NewInactiveHandle(name)
+	if err != nil {
+		return nil, err
+	}
+	defer inactive.CleanUp()
+	if err := inactive.SetSnapLen(b.snaplen); err != nil {
+		return nil, err
+	}
+	if err := inactive.SetPromisc(b.config.Promiscuous); err != nil {
+		return nil, err
+	}
+	if err := inactive.SetTimeout(pcap.BlockForever); err != nil {
+		return nil, err
+	}
+	// Zero leaves libpcap's default buffer size, which is 2MiB on Linux
+	if b.config.BufferSize > 0 {
+		if err := inactive.SetBufferSize(b.config.BufferSize); err != nil {
+			return nil, err
+		}
+	}
+	if err := inactive.SetImmediateMode(b.config.ImmediateMode); err != nil {
+		return nil, err
+	}
+	handle, err := inactive.Activate()
+	if err != nil {
+		return nil, err
+	}
+	source := &pcapPacketSource{handle: handle}
+	// The expression is compiled for the handle's own link type, which is Linux cooked capture rather than Ethernet
+	// for the any interface
+	if err := source.compileBpfExpression(bpfExpression); err != nil {
+		handle.Close()
+		return nil, err
+	}
+	if err := handle.SetBPFFilter(bpfExpression); err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return source, nil
+}
+
+type pcapPacketSource struct {
+	handle *pcap.Handle
+}
+
+func (s *pcapPacketSource) readPackets(packets chan<- gopacket.Packet) {
+	for packet := range gopacket.NewPacketSource(s.handle, s.handle.LinkType()).Packets() {
+		packets <- packet
+	}
+}
+
+func (s *pcapPacketSource) compileBpfExpression(bpfExpression string) error {
+	if _, err := s.handle.CompileBPFFilter(bpfExpression); err != nil {
+		return fmt.Errorf("BPF expression %q is invalid for link type %s: %v", bpfExpression, s.handle.LinkType(), err)
+	}
+	return nil
+}
+
+func (s *pcapPacketSource) setBpfExpression(bpfExpression string) error {
+	return s.handle.SetBPFFilter(bpfExpression)
+}
+
+func (s *pcapPacketSource) close() {
+	s.handle.Close()
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+type testPacketSource struct {
+	closed chan struct{}
+	// failed stops readPackets as though the capture had failed
+	failed        chan struct{}
+	bpfExpression string
+	// uncompilable is a BPF expression which doesn't compile for the source, and unappliable one which compiles but
+	// fails to be applied
+	uncompilable string
+	unappliable  string
+}
+
+func (s *testPacketSource) readPackets(packets chan<- gopacket.Packet) {
+	select {
+	case <-s.closed:
+	case <-s.failed:
+	}
+}
+
+func (s *testPacketSource) compileBpfExpression(bpfExpression string) error {
+	if bpfExpression == s.uncompilable {
+		return errors.New("syntax error")
+	}
+	return nil
+}
+
+func (s *testPacketSource) setBpfExpression(bpfExpression string) error {
+	if bpfExpression == s.unappliable {
+		return errors.New("invalid argument")
+	}
+	s.bpfExpression = bpfExpression
+	return nil
+}
+
+func (s *testPacketSource) close() {
+	close(s.closed)
+}
+
+func (s *testPacketSource) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestRefreshHandles(t *testing.T) {
+	available := []string{"lo", "eth0", "cali1a2b"}
+	opened := map[string]*testPacketSource{}
+	attempts := map[string]int{}
+	streamer := &httpRequestAndResponseStreamer{
+		bpfExpression: "tcp",
+		interfaces:    []string{"cali*", "eth1"},
+		handles:       map[string]packetSource{},
+		failures:      map[string]*captureFailure{},
+		wake:          make(chan struct{}, 1),
+		listInterfaces: func() ([]string, error) {
+			return available, nil
+		},
+		openPacketSource: func(name string, bpfExpression string) (packetSource, error) {
+			attempts[name]++
+			if name == "cali5e6f" {
+				return nil, errors.New("permission denied")
+			}
+			opened[name] = &testPacketSource{closed: make(chan struct{}), failed: make(chan struct{})}
+			return opened[name], nil
+		},
+	}
+	packets := make(chan gopacket.Packet)
+
+	if got := streamer.refreshHandles(packets); got != 1 {
+		t.Fatalf("refreshHandles() = %d, want 1", got)
+	}
+	if _, ok := opened["cali1a2b"]; !ok || len(opened) != 1 {
+		t.Fatalf("Opened %v, want only cali1a2b", opened)
+	}
+
+	// A pod's veth is created, another fails to open, and the first pod's veth is deleted
+	available = []string{"lo", "eth0", "cali3c4d", "cali5e6f"}
+	if got := streamer.refreshHandles(packets); got != 1 {
+		t.Errorf("refreshHandles() = %d, want 1", got)
+	}
+	if !opened["cali1a2b"].isClosed() {
+		t.Errorf("cali1a2b wasn't closed after it was deleted")
+	}
+	if source, ok := opened["cali3c4d"]; !ok || source.isClosed() {
+		t.Errorf("cali3c4d wasn't opened")
+	}
+	var handles []string
+	for name := range streamer.handles {
+		handles = append(handles, name)
+	}
+	if !reflect.DeepEqual(handles, []string{"cali3c4d"}) {
+		t.Errorf("Handles = %q, want only cali3c4d", handles)
+	}
+
+	// The interface that failed isn't retried until its backoff has passed, and then backs off for longer
+	streamer.refreshHandles(packets)
+	if attempts["cali5e6f"] != 1 {
+		t.Errorf("cali5e6f was opened %d time(s) before its backoff passed, want 1", attempts["cali5e6f"])
+	}
+	streamer.failures["cali5e6f"].retryAt = time.Now()
+	streamer.refreshHandles(packets)
+	if attempts["cali5e6f"] != 2 || streamer.failures["cali5e6f"].backoff != 2*minCaptureRetryBackoff {
+		t.Errorf("cali5e6f was opened %d time(s) with a backoff of %s, want 2 and %s", attempts["cali5e6f"], streamer.failures["cali5e6f"].backoff, 2*minCaptureRetryBackoff)
+	}
+
+	// A capture which stops is reopened after its backoff rather than straight away
+	close(opened["cali3c4d"].failed)
+	<-streamer.wake
+	streamer.refreshHandles(packets)
+	if attempts["cali3c4d"] != 1 {
+		t.Errorf("cali3c4d was reopened %d time(s) before its backoff passed, want 0", attempts["cali3c4d"]-1)
+	}
+	expectedHealth := []interfaceHealth{
+		{Interface: "cali3c4d", Failures: 1, LastError: errCaptureStopped.Error(), RetryAt: &streamer.failures["cali3c4d"].retryAt},
+		{Interface: "cali5e6f", Failures: 2, LastError: "permission denied", RetryAt: &streamer.failures["cali5e6f"].retryAt},
+	}
+	if health := streamer.captureHealth(); !reflect.DeepEqual(health, expectedHealth) {
+		t.Errorf("captureHealth() = %+v, want %+v", health, expectedHealth)
+	}
+	streamer.failures["cali3c4d"].retryAt = time.Now()
+	if got := streamer.refreshHandles(packets); got != 1 || attempts["cali3c4d"] != 2 {
+		t.Errorf("refreshHandles() = %d after cali3c4d's backoff, want it reopened", got)
+	}
+}
+
+func TestSetBpfExpression(t *testing.T) {
+	tests := []struct {
+		name                  string
+		uncompilable          string
+		unappliable           string
+		expectedError         bool
+		expectedBpfExpression string
+	}{
+		{
+			name:                  "Applied to every handle",
+			expectedBpfExpression: "tcp port 8080",
+		},
+		{
+			name:                  "Not applied to any handle if one can't compile it",
+			uncompilable:          "tcp port 8080",
+			expectedError:         true,
+			expectedBpfExpression: "tcp",
+		},
+		{
+			name:                  "Rolled back if one handle fails to apply it",
+			unappliable:           "tcp port 8080",
+			expectedError:         true,
+			expectedBpfExpression: "tcp",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources := []*testPacketSource{}
+			streamer := &httpRequestAndResponseStreamer{bpfExpression: "tcp", handles: map[string]packetSource{}}
+			for i, name := range []string{"eth0", "cali1a2b", "cali3c4d"} {
+				source := &testPacketSource{closed: make(chan struct{}), bpfExpression: "tcp"}
+				// Only one handle rejects the expression, and the handles are iterated in a random order, so
+				// others have often had it applied already
+				if i == 2 {
+					source.uncompilable = tt.uncompilable
+					source.unappliable = tt.unappliable
+				}
+				sources = append(sources, source)
+				streamer.handles[name] = source
+			}
+
+			err := streamer.setBpfExpression("tcp port 8080")
+			if (err != nil) != tt.expectedError {
+				t.Fatalf("setBpfExpression() error = %v, expectedError %v", err, tt.expectedError)
+			}
+			if streamer.bpfExpression != tt.expectedBpfExpression {
+				t.Errorf("Streamer's BPF expression = %q, want %q", streamer.bpfExpression, tt.expectedBpfExpression)
+			}
+			for _, source := range sources {
+				if source.bpfExpression != tt.expectedBpfExpression {
+					t.Errorf("Handle's BPF expression = %q, want %q", source.bpfExpression, tt.expectedBpfExpression)
+				}
+			}
+		})
+	}
+}
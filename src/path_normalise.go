@@ -0,0 +1,30 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	numericPathSegment = regexp.MustCompile(`^[0-9]+$`)
+	uuidPathSegment    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexPathSegment     = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+)
+
+// normalisePath replaces path segments that look like identifiers (numbers, UUIDs and long hex strings) with "{id}",
+// so that e.g. /users/123 and /users/456 are treated as the same endpoint
+func normalisePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if isIdentifierPathSegment(segment) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func isIdentifierPathSegment(segment string) bool {
+	return numericPathSegment.MatchString(segment) ||
+		uuidPathSegment.MatchString(segment) ||
+		hexPathSegment.MatchString(segment)
+}
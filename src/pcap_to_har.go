@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+const pcapToHarCommandName = "pcap-to-har"
+
+// pcapToHarCommand implements the pcap-to-har subcommand, which converts a pcap or pcapng file into a HAR file offline
+func pcapToHarCommand(args []string) int {
+	flags := flag.NewFlagSet(pcapToHarCommandName, flag.ContinueOnError)
+	maxContentLength := flags.Int64("max-content-length", defaultConfig().Capture.MaxContentLength, "Max bytes to read from each request or response")
+	keyLogFile := flags.String("key-log", "", "An NSS key log file (SSLKEYLOGFILE) to decrypt TLS connections with")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags] <input.pcap> <output.har>\n", os.Args[0], pcapToHarCommandName)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 || *maxContentLength <= 0 {
+		flags.Usage()
+		return 2
+	}
+	var keyLogFiles []string
+	if *keyLogFile != "" {
+		keyLogFiles = []string{*keyLogFile}
+	}
+	entries, err := convertPcapToHar(flags.Arg(0), flags.Arg(1), *maxContentLength, keyLogFiles)
+	if err != nil {
+		slog.Error("Failed to convert pcap to HAR:", "Err", err.Error())
+		return 1
+	}
+	slog.Info("Converted pcap to HAR", "Input", flags.Arg(0), "Output", flags.Arg(1), "Entries", entries)
+	return 0
+}
+
+type packetDataSource interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+}
+
+// openPcapFile opens a pcap or pcapng file with a pure Go reader, so no capture privileges or libpcap are needed
+func openPcapFile(file *os.File) (packetDataSource, error) {
+	if reader, err := pcapgo.NewReader(file); err == nil {
+		return reader, nil
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	reader, err := pcapgo.NewNgReader(file, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		return nil, errors.New("not a pcap or pcapng file")
+	}
+	return reader, nil
+}
+
+// convertPcapToHar reassembles the HTTP requests and responses in a pcap file the same way as live capture, and
+// writes them to a HAR file ordered by when each request started. TLS connections are decrypted if their secrets are
+// in one of the key log files. It returns the number of entries written.
+func convertPcapToHar(inputPath string, outputPath string, maxContentLength int64, keyLogFiles []string) (int, error) {
+	file, err := os.Open(inputPath)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to open pcap file %s: %v", inputPath, err)
+	}
+	defer file.Close()
+	source, err := openPcapFile(file)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to read pcap file %s: %v", inputPath, err)
+	}
+
+	var keyLog *tlsKeyLog
+	for _, keyLogFile := range keyLogFiles {
+		if _, err := os.Stat(keyLogFile); err != nil {
+			return 0, fmt.Errorf("Failed to read key log file %s: %v", keyLogFile, err)
+		}
+	}
+	if len(keyLogFiles) > 0 {
+		keyLogConfig := defaultConfig().Tls
+		keyLogConfig.KeyLogFiles = keyLogFiles
+		keyLog = newTlsKeyLog(keyLogConfig)
+		keyLog.refresh()
+	}
+
+	// Streams never block on a full channel, so entries are converted as they arrive rather than buffering them all
+	requestAndResponseChannel := make(chan httpRequestAndResponse, 1000)
+	var streams sync.WaitGroup
+	factory := &bidirectionalStreamFactory{
+		conns:                     &sync.Map{},
+		requestAndResponseChannel: &requestAndResponseChannel,
+		maxBodySize:               maxContentLength,
+		drops:                     newDropCounters(),
+		keyLog:                    keyLog,
+		streams:                   &streams,
+	}
+	assembler := tcpassembly.NewAssembler(tcpassembly.NewStreamPool(factory))
+
+	entries := []harEntry{}
+	converted := make(chan struct{})
+	go func() {
+		defer close(converted)
+		for requestAndResponse := range requestAndResponseChannel {
+			entries = append(entries, newHarEntry(&requestAndResponse))
+		}
+	}()
+
+	truncated := 0
+	overlayDecoder := newOverlayDecoder(defaultConfig().Capture.Decapsulation)
+	packets := gopacket.NewPacketSource(source, source.LinkType())
+	packets.DecodeOptions = gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+	for packet := range packets.Packets() {
+		network, tcp := overlayDecoder.decapsulate(packet)
+		if network == nil || tcp == nil {
+			continue
+		}
+		if packet.Metadata().CaptureLength < packet.Metadata().Length {
+			truncated++
+			factory.observeTruncated(network.NetworkFlow(), tcp.TransportFlow())
+		}
+		assembler.AssembleWithTimestamp(network.NetworkFlow(), tcp, packet.Metadata().Timestamp)
+	}
+	assembler.FlushAll()
+	factory.closeUnmatched()
+	streams.Wait()
+	close(requestAndResponseChannel)
+	<-converted
+	if truncated > 0 {
+		slog.Warn("Packets were truncated by the pcap's snaplen, requests and responses on their connections may be incomplete:", "Packets", truncated)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].StartedDateTime < entries[j].StartedDateTime })
+	return len(entries), writeHarFile(outputPath, entries)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// writeTestPcap writes a pcap file containing a single HTTP request and response on one TCP connection
+func writeTestPcap(t *testing.T, path string) {
+	writeTestPcapConnection(
+		t,
+		path,
+		80,
+		[]byte("GET /users?id=1 HTTP/1.1\r\nHost: users.default.svc\r\n\r\n"),
+		[]byte("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 15\r\n\r\n{\"name\":\"Bob\"}\n"),
+	)
+}
+
+// writeTestPcapConnection writes a pcap file containing the packets of newTestConnectionPackets
+func writeTestPcapConnection(t *testing.T, path string, serverPort layers.TCPPort, clientPayload []byte, serverPayload []byte) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create pcap file: %v", err)
+	}
+	defer file.Close()
+	writer := pcapgo.NewWriter(file)
+	if err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatalf("Failed to write pcap header: %v", err)
+	}
+	for _, packet := range newTestConnectionPackets(t, serverPort, clientPayload, serverPayload, nil) {
+		if err := writer.WritePacket(packet.Metadata().CaptureInfo, packet.Data()); err != nil {
+			t.Fatalf("Failed to write packet: %v", err)
+		}
+	}
+}
+
+// newTestConnectionPackets builds the Ethernet packets of one TCP connection to serverPort, on which the client sends
+// clientPayload 2ms after the handshake and the server replies with serverPayload 10ms later. Payloads are split into
+// segments of up to 1000 bytes. If closeFlags is set, the client then sends a final packet with those flags at 20ms.
+func newTestConnectionPackets(t *testing.T, serverPort layers.TCPPort, clientPayload []byte, serverPayload []byte, closeFlags func(*layers.TCP)) []gopacket.Packet {
+	clientIp, serverIp := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	type testPacket struct {
+		fromClient bool
+		tcp        layers.TCP
+		payload    []byte
+		offset     time.Duration
+	}
+	packets := []testPacket{
+		{true, layers.TCP{Seq: 1000, SYN: true}, nil, 0},
+		{false, layers.TCP{Seq: 5000, Ack: 1001, SYN: true, ACK: true}, nil, time.Millisecond},
+	}
+	clientSeq, serverSeq := uint32(1001), uint32(5001)
+	for len(clientPayload) > 0 {
+		segment := clientPayload[:min(1000, len(clientPayload))]
+		clientPayload = clientPayload[len(segment):]
+		packets = append(packets, testPacket{true, layers.TCP{Seq: clientSeq, Ack: serverSeq, ACK: true, PSH: true}, segment, 2 * time.Millisecond})
+		clientSeq += uint32(len(segment))
+	}
+	for len(serverPayload) > 0 {
+		segment := serverPayload[:min(1000, len(serverPayload))]
+		serverPayload = serverPayload[len(segment):]
+		packets = append(packets, testPacket{false, layers.TCP{Seq: serverSeq, Ack: clientSeq, ACK: true, PSH: true}, segment, 12 * time.Millisecond})
+		serverSeq += uint32(len(segment))
+	}
+	if closeFlags != nil {
+		tcp := layers.TCP{Seq: clientSeq, Ack: serverSeq, ACK: true}
+		closeFlags(&tcp)
+		packets = append(packets, testPacket{true, tcp, nil, 20 * time.Millisecond})
+	}
+
+	built := make([]gopacket.Packet, 0, len(packets))
+	for _, packet := range packets {
+		ip := layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: clientIp, DstIP: serverIp}
+		tcp := packet.tcp
+		tcp.SrcPort, tcp.DstPort, tcp.Window = 51234, serverPort, 65535
+		if !packet.fromClient {
+			ip.SrcIP, ip.DstIP = serverIp, clientIp
+			tcp.SrcPort, tcp.DstPort = serverPort, 51234
+		}
+		tcp.SetNetworkLayerForChecksum(&ip)
+		buffer := gopacket.NewSerializeBuffer()
+		err := gopacket.SerializeLayers(
+			buffer,
+			gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+			&layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4},
+			&ip,
+			&tcp,
+			gopacket.Payload(packet.payload),
+		)
+		if err != nil {
+			t.Fatalf("Failed to serialize packet: %v", err)
+		}
+		data := buffer.Bytes()
+		decoded := gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.Default)
+		decoded.Metadata().CaptureInfo = gopacket.CaptureInfo{Timestamp: start.Add(packet.offset), CaptureLength: len(data), Length: len(data)}
+		built = append(built, decoded)
+	}
+	return built
+}
+
+func TestConvertPcapToHar(t *testing.T) {
+	directory := t.TempDir()
+	inputPath := filepath.Join(directory, "capture.pcap")
+	outputPath := filepath.Join(directory, "capture.har")
+	writeTestPcap(t, inputPath)
+
+	entries, err := convertPcapToHar(inputPath, outputPath, 1024, nil)
+	if err != nil {
+		t.Fatalf("convertPcapToHar() error = %v", err)
+	}
+	if entries != 1 {
+		t.Fatalf("convertPcapToHar() = %d entries, want 1", entries)
+	}
+	har := readHarFile(t, outputPath)
+	entry := har.Log.Entries[0]
+	if entry.Request.URL != "http://users.default.svc/users?id=1" || entry.Response.Status != 200 {
+		t.Errorf("Entry = %s %d", entry.Request.URL, entry.Response.Status)
+	}
+	if entry.Response.Content.Text != "{\"name\":\"Bob\"}\n" {
+		t.Errorf("Response.Content.Text = %q", entry.Response.Content.Text)
+	}
+	if entry.StartedDateTime != "2025-01-01T00:00:00.002Z" || entry.Time != 10 {
+		t.Errorf("Timing = %s %vms, want request at 2ms and a 10ms wait", entry.StartedDateTime, entry.Time)
+	}
+	if entry.Connection != "10.0.0.1:51234" || entry.ServerIPAddress != "10.0.0.2" {
+		t.Errorf("Connection = %q, ServerIPAddress = %q", entry.Connection, entry.ServerIPAddress)
+	}
+}
+
+func TestConvertPcapToHarRejectsOtherFiles(t *testing.T) {
+	inputPath := filepath.Join(t.TempDir(), "not.pcap")
+	os.WriteFile(inputPath, []byte("definitely not a pcap"), 0o644)
+	if _, err := convertPcapToHar(inputPath, filepath.Join(t.TempDir(), "out.har"), 1024, nil); err == nil {
+		t.Errorf("convertPcapToHar() error = nil, want error for a file that isn't a pcap")
+	}
+}
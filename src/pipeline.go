@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// pipeline filters, samples, classifies, redacts and exports captured requests and responses. Streams enqueue onto a
+// bounded queue which is drained by a pool of workers, and if the queue is full the request and response is dropped so
+// a slow export can't stall capture.
+type pipeline struct {
+	queue            chan httpRequestAndResponse
+	workers          int
+	rules            *pipelineRulesHolder
+	ipManager        *serviceIpManager
+	workloadManager  *serviceIpManager
+	auth             *authDetector
+	conformance      *openApiConformanceChecker
+	maxContentLength int64
+	drops            *dropCounters
+	export           func(*httpRequestAndResponse)
+}
+
+// run starts the pipeline's workers and blocks until the queue is closed and they've all finished
+func (p *pipeline) run() {
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for requestAndResponse := range p.queue {
+				p.process(&requestAndResponse)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *pipeline) process(requestAndResponse *httpRequestAndResponse) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Recovered from panic in pipeline worker:", "Err", r)
+		}
+	}()
+	currentRules := p.rules.load()
+	// Decapsulated overlay traffic is addressed to the pods behind services, and only got past the streamer's packet
+	// filter because it was decapsulated, so pod IPs are let through too
+	if !(p.ipManager == nil || p.ipManager.isServiceIP(requestAndResponse.dst) || p.ipManager.isPodIP(requestAndResponse.dst)) {
+		slog.Debug(
+			"Ignoring request to non-service IP:",
+			"Src", requestAndResponse.src,
+			"Dst", requestAndResponse.dst,
+			"SrcPort", requestAndResponse.srcPort,
+			"DstPort", requestAndResponse.dstPort,
+		)
+		p.drops.increment(dropReasonNonServiceIp)
+		return
+	}
+	if p.workloadManager != nil {
+		requestAndResponse.srcWorkload = p.workloadManager.workloadName(requestAndResponse.src)
+		requestAndResponse.dstWorkload = p.workloadManager.workloadName(requestAndResponse.dst)
+	}
+	if export, ruleName := currentRules.captureRules.shouldExport(requestAndResponse); !export {
+		slog.Debug(
+			"Ignoring request excluded by capture rules:",
+			"Rule", ruleName,
+			"Method", requestAndResponse.request.Method,
+			"URL", requestAndResponse.request.URL,
+			"StatusCode", requestAndResponse.response.StatusCode,
+			"Src", requestAndResponse.src,
+			"Dst", requestAndResponse.dst,
+		)
+		p.drops.increment(dropReasonCaptureRules)
+		return
+	}
+	if currentRules.onlyLogJson && !isJson(requestAndResponse, p.maxContentLength) {
+		slog.Debug(
+			"Ignoring non-JSON request:",
+			"Src", requestAndResponse.src,
+			"Dst", requestAndResponse.dst,
+			"SrcPort", requestAndResponse.srcPort,
+			"DstPort", requestAndResponse.dstPort,
+		)
+		p.drops.increment(dropReasonOnlyLogJson)
+		return
+	}
+	if sampled, reason := currentRules.sampler.sample(requestAndResponse); !sampled {
+		slog.Debug(
+			"Ignoring request dropped by sampling:",
+			"Reason", reason,
+			"Method", requestAndResponse.request.Method,
+			"URL", requestAndResponse.request.URL,
+			"StatusCode", requestAndResponse.response.StatusCode,
+		)
+		p.drops.increment(reason)
+		return
+	}
+	// Auth detection and classification have to happen before redaction, or it would miss the values that are most likely
+	// to be sensitive
+	if p.auth != nil {
+		requestAndResponse.auth = p.auth.detect(requestAndResponse.request)
+	}
+	if currentRules.classifier != nil {
+		currentRules.classifier.classify(requestAndResponse)
+	}
+	// Conformance is checked before redaction too, as redacted values would no longer match their schemas
+	if p.conformance != nil {
+		p.conformance.check(requestAndResponse)
+	}
+	currentRules.redactor.redact(requestAndResponse)
+	slog.Debug(
+		"Captured request and response:",
+		"Method", requestAndResponse.request.Method,
+		"URL", requestAndResponse.request.URL,
+		"StatusCode", requestAndResponse.response.StatusCode,
+		"Src", requestAndResponse.src,
+		"Dst", requestAndResponse.dst,
+		"SrcPort", requestAndResponse.srcPort,
+		"DstPort", requestAndResponse.dstPort,
+	)
+	p.export(requestAndResponse)
+}
@@ -0,0 +1,47 @@
+package main
+
+import "sync/atomic"
+
+// pipelineRules holds everything the main loop uses to decide what to do with a captured request and response that
+// can be changed while the sensor is running. A pipelineRules is never modified after it is built; changes are made by
+// building a new one and swapping it into a pipelineRulesHolder, so the main loop never sees a half-applied config.
+type pipelineRules struct {
+	captureRules *captureRules
+	onlyLogJson  bool
+	sampler      *sampler
+	redactor     *redactor
+	// classifier is nil if data classification is disabled
+	classifier *dataClassifier
+}
+
+func newPipelineRules(config *sensorConfig) (*pipelineRules, error) {
+	captureRules, err := newCaptureRules(config.Filtering.Rules, config.Filtering.DefaultAction)
+	if err != nil {
+		return nil, err
+	}
+	return &pipelineRules{
+		captureRules: captureRules,
+		onlyLogJson:  config.Filtering.OnlyLogJson,
+		sampler:      newSampler(config.Sampling),
+		redactor:     newRedactor(config.Redaction),
+		classifier:   newDataClassifier(config.Classification),
+	}, nil
+}
+
+type pipelineRulesHolder struct {
+	current atomic.Pointer[pipelineRules]
+}
+
+func newPipelineRulesHolder(rules *pipelineRules) *pipelineRulesHolder {
+	holder := &pipelineRulesHolder{}
+	holder.current.Store(rules)
+	return holder
+}
+
+func (h *pipelineRulesHolder) load() *pipelineRules {
+	return h.current.Load()
+}
+
+func (h *pipelineRulesHolder) store(rules *pipelineRules) {
+	h.current.Store(rules)
+}
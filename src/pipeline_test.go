@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestPipelineRun(t *testing.T) {
+	config := defaultConfig()
+	config.Filtering.Rules = []captureRuleConfig{
+		{Name: "drop-health-checks", Action: "exclude", Paths: []string{"/healthz"}},
+	}
+	rules, err := newPipelineRules(config)
+	if err != nil {
+		t.Fatalf("newPipelineRules() error = %v", err)
+	}
+
+	var exportedMutex sync.Mutex
+	exported := []string{}
+	p := &pipeline{
+		queue:            make(chan httpRequestAndResponse, 10),
+		workers:          3,
+		rules:            newPipelineRulesHolder(rules),
+		maxContentLength: config.Capture.MaxContentLength,
+		drops:            newDropCounters(),
+		export: func(requestAndResponse *httpRequestAndResponse) {
+			exportedMutex.Lock()
+			defer exportedMutex.Unlock()
+			exported = append(exported, requestAndResponse.request.URL.Path)
+		},
+	}
+
+	for _, path := range []string{"/a", "/healthz", "/b", "/healthz", "/c"} {
+		p.queue <- *newTestRequestAndResponse(t, "GET "+path+" HTTP/1.1\r\nHost: example.com\r\n\r\n", newTestResponseBytes(200))
+	}
+	close(p.queue)
+	p.run()
+
+	if len(exported) != 3 {
+		t.Errorf("Exported %d requests, want 3: %v", len(exported), exported)
+	}
+	if drops := p.drops.snapshot()[dropReasonCaptureRules]; drops != 2 {
+		t.Errorf("Dropped %d requests by capture rules, want 2", drops)
+	}
+}
+
+func TestPipelineRecoversFromExportPanic(t *testing.T) {
+	rules, err := newPipelineRules(defaultConfig())
+	if err != nil {
+		t.Fatalf("newPipelineRules() error = %v", err)
+	}
+	exports := 0
+	p := &pipeline{
+		queue:            make(chan httpRequestAndResponse, 2),
+		workers:          1,
+		rules:            newPipelineRulesHolder(rules),
+		maxContentLength: 1024,
+		drops:            newDropCounters(),
+		export: func(requestAndResponse *httpRequestAndResponse) {
+			exports++
+			if requestAndResponse.request.URL.Path == "/panic" {
+				panic("export failed")
+			}
+		},
+	}
+	p.queue <- *newTestRequestAndResponse(t, "GET /panic HTTP/1.1\r\nHost: example.com\r\n\r\n", newTestResponseBytes(200))
+	p.queue <- *newTestRequestAndResponse(t, "GET /ok HTTP/1.1\r\nHost: example.com\r\n\r\n", newTestResponseBytes(200))
+	close(p.queue)
+	p.run()
+
+	if exports != 2 {
+		t.Errorf("Exported %d requests, want 2", exports)
+	}
+}
+
+func TestPipelineServiceIpFilter(t *testing.T) {
+	rules, err := newPipelineRules(defaultConfig())
+	if err != nil {
+		t.Fatalf("newPipelineRules() error = %v", err)
+	}
+	ipManager := &serviceIpManager{serviceIPs: &sync.Map{}, podIPs: &sync.Map{}}
+	ipManager.serviceIPs.Store("10.96.0.10", "shop/users")
+	// Decapsulated overlay traffic has been DNATed to a pod behind the service
+	ipManager.podIPs.Store("10.244.2.7", "shop/users")
+
+	exported := []string{}
+	p := &pipeline{
+		queue:            make(chan httpRequestAndResponse, 3),
+		workers:          1,
+		rules:            newPipelineRulesHolder(rules),
+		ipManager:        ipManager,
+		maxContentLength: 1024,
+		drops:            newDropCounters(),
+		export: func(requestAndResponse *httpRequestAndResponse) {
+			exported = append(exported, requestAndResponse.dst)
+		},
+	}
+	for _, dst := range []string{"10.96.0.10", "10.244.2.7", "192.168.0.2"} {
+		requestAndResponse := newTestRequestAndResponse(t, "GET / HTTP/1.1\r\nHost: users\r\n\r\n", newTestResponseBytes(200))
+		requestAndResponse.dst = dst
+		p.queue <- *requestAndResponse
+	}
+	close(p.queue)
+	p.run()
+
+	if !reflect.DeepEqual(exported, []string{"10.96.0.10", "10.244.2.7"}) {
+		t.Errorf("Exported requests to %v, want the service and pod IPs", exported)
+	}
+	if drops := p.drops.snapshot()[dropReasonNonServiceIp]; drops != 1 {
+		t.Errorf("Dropped %d requests to non-service IPs, want 1", drops)
+	}
+}
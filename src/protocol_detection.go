@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+const (
+	protocolHttp       = "http"
+	protocolHttp2      = "http2"
+	protocolTls        = "tls"
+	protocolSsh        = "ssh"
+	protocolPostgresql = "postgresql"
+	protocolMysql      = "mysql"
+	protocolRedis      = "redis"
+	protocolUnknown    = "unknown"
+
+	// streamHeadLength is how many of the first bytes of each side of a connection are kept to guess its protocol
+	streamHeadLength = 64
+
+	// maxProtocolStatsPorts is how many server ports protocols are counted for. Connections to any more are counted
+	// against protocolStatsOtherPort, so the number of series served on /metrics is bounded.
+	maxProtocolStatsPorts  = 100
+	protocolStatsOtherPort = "other"
+)
+
+// errProtocolNotParsed is why streams which protocol detection didn't recognise as HTTP weren't read
+var errProtocolNotParsed = errors.New("protocol not parsed")
+
+// httpResponsePrefix starts the status line of every HTTP/1.x response
+var httpResponsePrefix = []byte("HTTP/1.")
+
+// http2Preface is sent by HTTP/2 clients before anything else when they know the server speaks HTTP/2 in cleartext
+var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("DELETE "), []byte("PATCH "),
+	[]byte("HEAD "), []byte("OPTIONS "), []byte("CONNECT "), []byte("TRACE "),
+}
+
+// guessProtocol guesses the protocol of a TCP connection from the first bytes the client and server sent on it. Some
+// protocols, like MySQL, are recognised from the server's side as the server speaks first.
+func guessProtocol(clientHead []byte, serverHead []byte) string {
+	switch {
+	case bytes.HasPrefix(clientHead, http2Preface):
+		return protocolHttp2
+	case isTlsHandshakeRecord(clientHead):
+		return protocolTls
+	case isHttpRequestHead(clientHead) || bytes.HasPrefix(serverHead, httpResponsePrefix):
+		return protocolHttp
+	case bytes.HasPrefix(clientHead, []byte("SSH-")) || bytes.HasPrefix(serverHead, []byte("SSH-")):
+		return protocolSsh
+	case isPostgresqlStartup(clientHead):
+		return protocolPostgresql
+	case isMysqlGreeting(serverHead):
+		return protocolMysql
+	case len(clientHead) >= 4 && clientHead[0] == '*' && clientHead[1] >= '0' && clientHead[1] <= '9':
+		// Redis clients send commands as RESP arrays of bulk strings, such as "*1\r\n$4\r\nPING\r\n"
+		return protocolRedis
+	}
+	return protocolUnknown
+}
+
+func isHttpRequestHead(head []byte) bool {
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(head, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPostgresqlStartup checks for the length prefixed message PostgreSQL clients start with: a startup message for
+// protocol 3.0, or a request to upgrade to SSL or GSSAPI encryption
+func isPostgresqlStartup(head []byte) bool {
+	if len(head) < 8 || binary.BigEndian.Uint32(head) < 8 {
+		return false
+	}
+	switch binary.BigEndian.Uint32(head[4:8]) {
+	case 196608, 80877103, 80877104:
+		return true
+	}
+	return false
+}
+
+// isMysqlGreeting checks for the first packet of a MySQL server's handshake, which has sequence number 0 and protocol
+// version 10
+func isMysqlGreeting(head []byte) bool {
+	return len(head) >= 5 && head[3] == 0 && head[4] == 10 && int(head[0])|int(head[1])<<8|int(head[2])<<16 > 1
+}
+
+// knownServicePorts are ports servers commonly listen on, used to tell which end of a connection is the server's
+var knownServicePorts = map[uint16]struct{}{
+	22: {}, 80: {}, 443: {}, 3306: {}, 5432: {}, 6379: {}, 8080: {}, 8443: {},
+}
+
+// serverPort returns the port of the server's end of a TCP flow. The first direction seen isn't always the client's,
+// such as when a capture starts part way through a connection, so it's the end on a known service port, or otherwise
+// the lower port, as clients use ephemeral ports.
+func serverPort(transport gopacket.Flow) string {
+	srcPort := binary.BigEndian.Uint16(transport.Src().Raw())
+	dstPort := binary.BigEndian.Uint16(transport.Dst().Raw())
+	_, srcKnown := knownServicePorts[srcPort]
+	_, dstKnown := knownServicePorts[dstPort]
+	port := min(srcPort, dstPort)
+	if dstKnown {
+		port = dstPort
+	} else if srcKnown {
+		port = srcPort
+	}
+	return strconv.Itoa(int(port))
+}
+
+type protocolStatsKey struct {
+	port     string
+	protocol string
+}
+
+// protocolStats counts the protocols detected on connections to each server port since the sensor started, so it's
+// visible which ports carry HTTP. Only the first maxPorts ports seen are counted separately.
+type protocolStats struct {
+	counts   sync.Map
+	maxPorts int
+	portsMu  sync.Mutex
+	ports    map[string]struct{}
+}
+
+func newProtocolStats() *protocolStats {
+	return &protocolStats{maxPorts: maxProtocolStatsPorts, ports: map[string]struct{}{}}
+}
+
+func (p *protocolStats) increment(port string, protocol string) {
+	count, _ := p.counts.LoadOrStore(protocolStatsKey{p.trackedPort(port), protocol}, &atomic.Uint64{})
+	count.(*atomic.Uint64).Add(1)
+}
+
+// trackedPort returns the port to count a connection against, which is protocolStatsOtherPort once maxPorts other
+// ports are being counted
+func (p *protocolStats) trackedPort(port string) string {
+	p.portsMu.Lock()
+	defer p.portsMu.Unlock()
+	if _, ok := p.ports[port]; ok {
+		return port
+	}
+	if len(p.ports) >= p.maxPorts {
+		return protocolStatsOtherPort
+	}
+	p.ports[port] = struct{}{}
+	return port
+}
+
+// snapshot returns the number of connections seen with each protocol, by server port
+func (p *protocolStats) snapshot() map[string]map[string]uint64 {
+	counts := map[string]map[string]uint64{}
+	p.counts.Range(func(key, value any) bool {
+		k := key.(protocolStatsKey)
+		if counts[k.port] == nil {
+			counts[k.port] = map[string]uint64{}
+		}
+		counts[k.port][k.protocol] = value.(*atomic.Uint64).Load()
+		return true
+	})
+	return counts
+}
+
+// run periodically logs the protocols detected on each port since the sensor started, if any have changed
+func (p *protocolStats) run(interval time.Duration) {
+	t := time.NewTicker(interval)
+	var previous map[string]map[string]uint64
+	for range t.C {
+		current := p.snapshot()
+		changed := false
+		ports := make([]string, 0, len(current))
+		for port, protocols := range current {
+			ports = append(ports, port)
+			for protocol, count := range protocols {
+				changed = changed || previous[port][protocol] != count
+			}
+		}
+		previous = current
+		if !changed {
+			continue
+		}
+		sort.Strings(ports)
+		args := make([]any, 0, 2*len(ports))
+		for _, port := range ports {
+			args = append(args, port, current[port])
+		}
+		slog.Info("Detected protocols by port since startup:", args...)
+	}
+}
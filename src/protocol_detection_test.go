@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestGuessProtocol(t *testing.T) {
+	tests := []struct {
+		name       string
+		clientHead string
+		serverHead string
+		want       string
+	}{
+		{"HTTP request", "POST /users HTTP/1.1\r\n", "", protocolHttp},
+		{"HTTP response only", "", "HTTP/1.1 200 OK\r\n", protocolHttp},
+		{"HTTP/2 prior knowledge", "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n\x00\x00\x12\x04", "", protocolHttp2},
+		{"TLS", "\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03", "", protocolTls},
+		{"SSH", "SSH-2.0-Go\r\n", "", protocolSsh},
+		{"SSH server banner", "", "SSH-2.0-OpenSSH_9.6\r\n", protocolSsh},
+		{"PostgreSQL startup", "\x00\x00\x00\x29\x00\x03\x00\x00user\x00", "", protocolPostgresql},
+		{"PostgreSQL SSL request", "\x00\x00\x00\x08\x04\xd2\x16\x2f", "N", protocolPostgresql},
+		{"MySQL greeting", "", "\x4a\x00\x00\x00\x0a8.0.36\x00", protocolMysql},
+		{"Redis", "*1\r\n$4\r\nPING\r\n", "+PONG\r\n", protocolRedis},
+		{"Lowercase method", "get / HTTP/1.1\r\n", "", protocolUnknown},
+		{"Nothing", "", "", protocolUnknown},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := guessProtocol([]byte(test.clientHead), []byte(test.serverHead)); got != test.want {
+				t.Errorf("guessProtocol() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestServerPort(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst uint16
+		want     string
+	}{
+		{name: "Client to server", src: 51234, dst: 8080, want: "8080"},
+		{name: "Server to client", src: 8080, dst: 51234, want: "8080"},
+		{name: "Unknown ports", src: 50051, dst: 3000, want: "3000"},
+		{name: "Known port higher than the other", src: 1024, dst: 8443, want: "8443"},
+		{name: "Known port on the source", src: 5432, dst: 1024, want: "5432"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := gopacket.NewFlow(
+				layers.EndpointTCPPort,
+				binary.BigEndian.AppendUint16(nil, test.src),
+				binary.BigEndian.AppendUint16(nil, test.dst),
+			)
+			if got := serverPort(transport); got != test.want {
+				t.Errorf("serverPort(%v) = %q, want %q", transport, got, test.want)
+			}
+		})
+	}
+}
+
+func TestProtocolStatsMaxPorts(t *testing.T) {
+	stats := newProtocolStats()
+	stats.maxPorts = 2
+	for _, port := range []string{"80", "5432", "80", "3000", "3001"} {
+		stats.increment(port, protocolHttp)
+	}
+	want := map[string]map[string]uint64{
+		"80":                   {protocolHttp: 2},
+		"5432":                 {protocolHttp: 1},
+		protocolStatsOtherPort: {protocolHttp: 2},
+	}
+	if got := stats.snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot() = %v, want %v", got, want)
+	}
+}
+
+func TestReadSideDiscardsUndetectedStreams(t *testing.T) {
+	httpRequest := "POST /users HTTP/1.1\r\nHost: users\r\nContent-Length: 60\r\n\r\n" + strings.Repeat("a", 60)
+	tests := []struct {
+		name          string
+		payload       string
+		expectedBytes string
+		expectedErr   error
+	}{
+		{"HTTP is read in full", httpRequest, httpRequest, io.ErrUnexpectedEOF},
+		{"Other protocols are only read up to their head", strings.Repeat("\x00", 1000), strings.Repeat("\x00", streamHeadLength), errProtocolNotParsed},
+		{"Short streams are detected from what was sent", "SSH-2.0-Go\r\n", "SSH-2.0-Go\r\n", errProtocolNotParsed},
+		{"HTTP ending after its head", httpRequest[:streamHeadLength], httpRequest[:streamHeadLength], io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stream := &bidirectionalStream{maxBodySize: 1024, protocolStats: newProtocolStats()}
+			side := strings.NewReader(test.payload)
+			sideBytes, err := stream.readSide(side, isHttpRequestHead)
+			if string(sideBytes) != test.expectedBytes || err != test.expectedErr {
+				t.Errorf("readSide() = %q, %v, want %q, %v", sideBytes, err, test.expectedBytes, test.expectedErr)
+			}
+			if side.Len() != 0 {
+				t.Errorf("%d bytes were left unread, want the stream to be read to the end", side.Len())
+			}
+		})
+	}
+}
+
+func TestProtocolDetection(t *testing.T) {
+	requestAndResponseChannel := make(chan httpRequestAndResponse, 10)
+	stats := newProtocolStats()
+	factory := &bidirectionalStreamFactory{
+		conns:                     &sync.Map{},
+		requestAndResponseChannel: &requestAndResponseChannel,
+		maxBodySize:               1024,
+		drops:                     newDropCounters(),
+		streams:                   &sync.WaitGroup{},
+		protocolStats:             stats,
+	}
+	connections := []struct {
+		port          layers.TCPPort
+		clientPayload string
+		serverPayload string
+	}{
+		{8080, "GET /users HTTP/1.1\r\nHost: users\r\n\r\n", "HTTP/1.1 204 No Content\r\n\r\n"},
+		{8080, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", "\x00\x00\x00\x04\x00\x00\x00\x00\x00"},
+		{3000, "GET / HTTP/1.1\r\nHost: web\r\n\r\n", "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"},
+		{2222, "SSH-2.0-Go\r\n", "SSH-2.0-OpenSSH_9.6\r\n"},
+		// A legacy client whose requests Go would read as HTTP, but which detection doesn't recognise
+		{9090, "get / HTTP/1.0\r\n\r\n", "OK\r\n"},
+	}
+	for _, connection := range connections {
+		assembleTestPackets(factory, newTestConnectionPackets(t, connection.port, []byte(connection.clientPayload), []byte(connection.serverPayload), nil))
+	}
+	close(requestAndResponseChannel)
+
+	var captured []string
+	for requestAndResponse := range requestAndResponseChannel {
+		captured = append(captured, requestAndResponse.dstPort+" "+requestAndResponse.request.URL.Path)
+	}
+	if !reflect.DeepEqual(captured, []string{"8080 /users", "3000 /"}) {
+		t.Errorf("Captured %v, want only the HTTP/1.1 requests", captured)
+	}
+	want := map[string]map[string]uint64{
+		"8080": {protocolHttp: 1, protocolHttp2: 1},
+		"3000": {protocolHttp: 1},
+		"2222": {protocolSsh: 1},
+		"9090": {protocolUnknown: 1},
+	}
+	if got := stats.snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+type redactor struct {
+	headers     map[string]struct{}
+	jsonFields  map[string]struct{}
+	replacement string
+}
+
+func newRedactor(config redactionConfig) *redactor {
+	r := &redactor{
+		headers:     map[string]struct{}{},
+		jsonFields:  map[string]struct{}{},
+		replacement: config.Replacement,
+	}
+	for _, header := range config.Headers {
+		r.headers[http.CanonicalHeaderKey(strings.TrimSpace(header))] = struct{}{}
+	}
+	for _, field := range config.JsonFields {
+		r.jsonFields[strings.ToLower(strings.TrimSpace(field))] = struct{}{}
+	}
+	return r
+}
+
+func (r *redactor) isNoop() bool {
+	return len(r.headers) == 0 && len(r.jsonFields) == 0
+}
+
+// redact replaces the values of any configured headers and JSON fields in the captured request and response in
+// place, and marks it as redacted if anything was replaced. Bodies which can't be decoded, such as truncated JSON,
+// are redacted by masking the values of any matching keys found in them.
+func (r *redactor) redact(reqAndResp *httpRequestAndResponse) {
+	if r.isNoop() {
+		return
+	}
+	if r.redactHeaders(reqAndResp.request.Header) {
+		reqAndResp.redacted = true
+	}
+	if r.redactHeaders(reqAndResp.response.Header) {
+		reqAndResp.redacted = true
+	}
+	if len(r.jsonFields) == 0 {
+		return
+	}
+	var redacted, truncated bool
+	reqAndResp.request.Body, reqAndResp.request.ContentLength, redacted, truncated = r.redactBody(
+		reqAndResp.request.Body, reqAndResp.request.ContentLength,
+	)
+	reqAndResp.redacted = reqAndResp.redacted || redacted
+	reqAndResp.requestTruncated = reqAndResp.requestTruncated || truncated
+	reqAndResp.response.Body, reqAndResp.response.ContentLength, redacted, truncated = r.redactBody(
+		reqAndResp.response.Body, reqAndResp.response.ContentLength,
+	)
+	reqAndResp.redacted = reqAndResp.redacted || redacted
+	reqAndResp.responseTruncated = reqAndResp.responseTruncated || truncated
+}
+
+// redactHeaders replaces the values of any configured headers, returning true if there were any
+func (r *redactor) redactHeaders(headers http.Header) bool {
+	redacted := false
+	for key, values := range headers {
+		if _, ok := r.headers[http.CanonicalHeaderKey(key)]; !ok {
+			continue
+		}
+		for i := range values {
+			values[i] = r.replacement
+		}
+		redacted = true
+	}
+	return redacted
+}
+
+// redactBody reads a body and redacts any matching fields if it's JSON, returning a replacement for the body that
+// hasn't been read, its length, whether any fields were redacted and whether it was truncated. Numbers are kept as
+// they were captured rather than being rounded to float64.
+func (r *redactor) redactBody(body io.ReadCloser, contentLength int64) (io.ReadCloser, int64, bool, bool) {
+	if body == nil || body == http.NoBody {
+		return body, contentLength, false, false
+	}
+	bodyBytes, truncated := readCapturedBody(body)
+	value, ok := decodeJsonBody(bodyBytes)
+	if !ok {
+		redactedBytes, redacted := r.redactJsonTokens(bodyBytes)
+		return io.NopCloser(bytes.NewReader(redactedBytes)), int64(len(redactedBytes)), redacted, truncated
+	}
+	if !r.redactJsonValue(value) {
+		return io.NopCloser(bytes.NewReader(bodyBytes)), int64(len(bodyBytes)), false, truncated
+	}
+	redactedBytes, err := json.Marshal(value)
+	if err != nil {
+		return io.NopCloser(bytes.NewReader(bodyBytes)), int64(len(bodyBytes)), false, truncated
+	}
+	return io.NopCloser(bytes.NewReader(redactedBytes)), int64(len(redactedBytes)), true, truncated
+}
+
+// redactJsonValue walks a decoded JSON value, replacing the values of any matching object keys. It returns true if
+// anything was replaced.
+func (r *redactor) redactJsonValue(v interface{}) bool {
+	redacted := false
+	switch typed := v.(type) {
+	case map[string]interface{}:
+		for key, value := range typed {
+			if _, ok := r.jsonFields[strings.ToLower(key)]; ok {
+				typed[key] = r.replacement
+				redacted = true
+				continue
+			}
+			redacted = r.redactJsonValue(value) || redacted
+		}
+	case []interface{}:
+		for _, value := range typed {
+			redacted = r.redactJsonValue(value) || redacted
+		}
+	}
+	return redacted
+}
+
+// redactJsonTokens scans a body which couldn't be decoded for object keys matching the configured fields and masks
+// their values, returning the body and true if anything was replaced. Values which run to the end of the body, as
+// they do when it was truncated mid-value, are masked up to the end.
+func (r *redactor) redactJsonTokens(body []byte) ([]byte, bool) {
+	replacement, err := json.Marshal(r.replacement)
+	if err != nil {
+		return body, false
+	}
+	var redactedBytes []byte
+	last := 0
+	for i := 0; i < len(body); i++ {
+		if body[i] != '"' {
+			continue
+		}
+		keyEnd := jsonStringEnd(body, i)
+		colon := skipJsonWhitespace(body, keyEnd)
+		if keyEnd == len(body) || colon == len(body) || body[colon] != ':' || !r.isRedactedJsonKey(body[i:keyEnd]) {
+			i = keyEnd - 1
+			continue
+		}
+		valueStart := skipJsonWhitespace(body, colon+1)
+		valueEnd := jsonValueEnd(body, valueStart)
+		redactedBytes = append(append(redactedBytes, body[last:valueStart]...), replacement...)
+		last = valueEnd
+		i = valueEnd - 1
+	}
+	if redactedBytes == nil {
+		return body, false
+	}
+	return append(redactedBytes, body[last:]...), true
+}
+
+// isRedactedJsonKey returns true if a quoted JSON string is one of the configured fields
+func (r *redactor) isRedactedJsonKey(quotedKey []byte) bool {
+	var key string
+	if err := json.Unmarshal(quotedKey, &key); err != nil {
+		return false
+	}
+	_, ok := r.jsonFields[strings.ToLower(key)]
+	return ok
+}
+
+// jsonStringEnd returns the index after the closing quote of the JSON string starting at start, or the length of the
+// body if it isn't terminated
+func jsonStringEnd(body []byte, start int) int {
+	for i := start + 1; i < len(body); i++ {
+		switch body[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return len(body)
+}
+
+// jsonValueEnd returns the index after the JSON value starting at start, or the length of the body if it isn't
+// terminated
+func jsonValueEnd(body []byte, start int) int {
+	if start == len(body) {
+		return start
+	}
+	switch body[start] {
+	case '"':
+		return jsonStringEnd(body, start)
+	case '{', '[':
+		depth := 0
+		for i := start; i < len(body); i++ {
+			switch body[i] {
+			case '"':
+				i = jsonStringEnd(body, i) - 1
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1
+				}
+			}
+		}
+		return len(body)
+	}
+	for i := start; i < len(body); i++ {
+		switch body[i] {
+		case ',', '}', ']', ' ', '\t', '\r', '\n':
+			return i
+		}
+	}
+	return len(body)
+}
+
+// skipJsonWhitespace returns the index of the first non-whitespace byte from start
+func skipJsonWhitespace(body []byte, start int) int {
+	for start < len(body) && strings.IndexByte(" \t\r\n", body[start]) != -1 {
+		start++
+	}
+	return start
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRedactBodies(t *testing.T) {
+	tests := []struct {
+		name              string
+		requestBytes      string
+		expectedBody      string
+		expectedRedacted  bool
+		expectedTruncated bool
+	}{
+		{
+			name: "Large numbers keep their precision",
+			requestBytes: "POST /payments HTTP/1.1\r\nHost: payments\r\nContent-Type: application/json\r\nContent-Length: 54\r\n\r\n" +
+				`{"id": 9007199254740993, "amount": 1.10, "cvv": "123"}`,
+			expectedBody:     `{"amount":1.10,"cvv":"[REDACTED]","id":9007199254740993}`,
+			expectedRedacted: true,
+		},
+		{
+			name: "Body without matching fields is left as it was",
+			requestBytes: "POST /payments HTTP/1.1\r\nHost: payments\r\nContent-Type: application/json\r\nContent-Length: 11\r\n\r\n" +
+				`{"id": 123}`,
+			expectedBody: `{"id": 123}`,
+		},
+		{
+			name: "Truncated body is redacted and marked as truncated",
+			requestBytes: "POST /payments HTTP/1.1\r\nHost: payments\r\nContent-Type: application/json\r\nContent-Length: 100\r\n\r\n" +
+				`{"cvv": "123", "id": 1`,
+			expectedBody:      `{"cvv": "[REDACTED]", "id": 1`,
+			expectedRedacted:  true,
+			expectedTruncated: true,
+		},
+		{
+			name: "Truncated value is masked up to the end of the body",
+			requestBytes: "POST /payments HTTP/1.1\r\nHost: payments\r\nContent-Type: application/json\r\nContent-Length: 100\r\n\r\n" +
+				`{"id": 1, "card": {"CVV": {"value": "123`,
+			expectedBody:      `{"id": 1, "card": {"CVV": "[REDACTED]"`,
+			expectedRedacted:  true,
+			expectedTruncated: true,
+		},
+		{
+			name: "Quoted keys inside strings are not masked",
+			requestBytes: "POST /payments HTTP/1.1\r\nHost: payments\r\nContent-Type: application/json\r\nContent-Length: 100\r\n\r\n" +
+				`{"note": "\"cvv\": 1", "id": 1`,
+			expectedBody:      `{"note": "\"cvv\": 1", "id": 1`,
+			expectedTruncated: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqAndResp := newTestRequestAndResponse(t, tt.requestBytes, "HTTP/1.1 204 No Content\r\n\r\n")
+			newRedactor(redactionConfig{JsonFields: []string{"cvv"}, Replacement: "[REDACTED]"}).redact(reqAndResp)
+
+			body, err := io.ReadAll(reqAndResp.request.Body)
+			if err != nil {
+				t.Fatalf("Failed to read redacted body: %v", err)
+			}
+			if string(body) != tt.expectedBody || reqAndResp.request.ContentLength != int64(len(body)) {
+				t.Errorf("Body = %q with length %d, want %q", body, reqAndResp.request.ContentLength, tt.expectedBody)
+			}
+			if strings.Contains(string(body), `"123`) {
+				t.Errorf("Body = %q, want the cvv to be redacted", body)
+			}
+			if reqAndResp.redacted != tt.expectedRedacted || reqAndResp.requestTruncated != tt.expectedTruncated {
+				t.Errorf(
+					"Redacted = %v, truncated = %v, want %v, %v",
+					reqAndResp.redacted, reqAndResp.requestTruncated, tt.expectedRedacted, tt.expectedTruncated,
+				)
+			}
+		})
+	}
+}
@@ -1,57 +1,277 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/tcpassembly"
 )
 
 type httpRequestAndResponse struct {
-	request  *http.Request
-	response *http.Response
-	src      string
-	dst      string
-	srcPort  string
-	dstPort  string
+	request           *http.Request
+	response          *http.Response
+	src               string
+	dst               string
+	srcPort           string
+	dstPort           string
+	srcWorkload       string
+	dstWorkload       string
+	requestTime       time.Time
+	responseTime      time.Time
+	requestTruncated  bool
+	responseTruncated bool
+	redacted          bool
+	// lossy is true if packets of the connection were truncated when they were captured, so it may be corrupt
+	lossy bool
+	// dataClasses are the classes of sensitive data found in the request and response, if classification is enabled
+	dataClasses []string
+	// auth describes the credentials the request was made with
+	auth *requestAuth
+}
+
+// requestScheme is "https" for requests decrypted from TLS connections, which have their TLS state set, and otherwise
+// "http"
+func requestScheme(request *http.Request) string {
+	if request.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+const (
+	// minCaptureRetryBackoff and maxCaptureRetryBackoff bound how long the sensor waits before reopening the capture on
+	// an interface that failed, doubling each time it fails again
+	minCaptureRetryBackoff = time.Second
+	maxCaptureRetryBackoff = time.Minute
+)
+
+var errCaptureStopped = errors.New("capture stopped unexpectedly")
+
+// captureFailure is why the capture on an interface last failed and when it'll next be opened. It's kept once the
+// capture is reopened so that a capture which keeps failing backs off further, until it's run for maxCaptureRetryBackoff.
+type captureFailure struct {
+	err      error
+	failures int
+	backoff  time.Duration
+	retryAt  time.Time
 }
 
 type httpRequestAndResponseStreamer struct {
 	bpfExpression             string
+	interfaces                []string
+	interfaceRefreshInterval  time.Duration
+	deduplicationWindow       time.Duration
 	requestAndResponseChannel *chan httpRequestAndResponse
 	ipManager                 *serviceIpManager
 	maxBodySize               int64
+	drops                     *dropCounters
+	tlsHandshakes             *chan *tlsHandshake
+	keyLog                    *tlsKeyLog
+	connectionSummaries       *chan *connectionSummary
+	protocolStats             *protocolStats
+	openPacketSource          openPacketSourceFunc
+	overlayDecoder            *overlayDecoder
+	listInterfaces            func() ([]string, error)
+	handleMutex               sync.Mutex
+	// handles are the open packet sources, by the name of the interface they capture on
+	handles map[string]packetSource
+	// failures are the interfaces whose capture has failed, by name
+	failures map[string]*captureFailure
+	// wake interrupts the wait for the next refresh when a capture fails, so it's retried after its backoff
+	wake chan struct{}
 }
 
-func (s *httpRequestAndResponseStreamer) getHandleAndPacketsChannel() (*pcap.Handle, <-chan gopacket.Packet) {
-	handle, err := pcap.OpenLive("any", 1600, true, pcap.BlockForever)
+// refreshHandles opens a handle on each interface matching the configured interfaces which doesn't have one yet, such
+// as the veth of a pod that's just started, and closes the handles of interfaces that have gone. Interfaces whose
+// capture failed are skipped until their backoff has passed. Packets from every handle are sent to the same channel. It
+// returns the number of open handles.
+func (s *httpRequestAndResponseStreamer) refreshHandles(packets chan<- gopacket.Packet) int {
+	available, err := s.listInterfaces()
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("Failed to list network interfaces:", "Err", err.Error())
 	}
-	err = handle.SetBPFFilter(s.bpfExpression)
-	if err != nil {
-		log.Fatal(err)
+	interfaces := resolveCaptureInterfaces(s.interfaces, available)
+
+	s.handleMutex.Lock()
+	defer s.handleMutex.Unlock()
+	for name, handle := range s.handles {
+		if !slices.Contains(interfaces, name) {
+			slog.Info("Interface has gone, closing its capture...", "Interface", name)
+			delete(s.handles, name)
+			handle.close()
+		}
+	}
+	for name := range s.failures {
+		if !slices.Contains(interfaces, name) {
+			delete(s.failures, name)
+		}
+	}
+	now := time.Now()
+	for _, name := range interfaces {
+		if _, ok := s.handles[name]; ok {
+			continue
+		}
+		if failure, ok := s.failures[name]; ok && now.Before(failure.retryAt) {
+			continue
+		}
+		handle, err := s.openPacketSource(name, s.bpfExpression)
+		if err != nil {
+			failure := s.recordFailureLocked(name, err, now)
+			slog.Error(
+				"Failed to open capture on interface, retrying after backoff:",
+				"Interface", name,
+				"Backoff", failure.backoff,
+				"Err", err.Error(),
+			)
+			continue
+		}
+		slog.Info("Capturing on interface...", "Interface", name)
+		s.handles[name] = handle
+		go s.readHandle(name, handle, packets)
+	}
+	return len(s.handles)
+}
+
+// recordFailureLocked records that the capture on an interface failed and when it should next be opened. The backoff
+// starts over if the capture had been running for longer than the longest backoff.
+func (s *httpRequestAndResponseStreamer) recordFailureLocked(name string, err error, now time.Time) *captureFailure {
+	failure, ok := s.failures[name]
+	if !ok || now.Sub(failure.retryAt) > maxCaptureRetryBackoff {
+		failure = &captureFailure{backoff: minCaptureRetryBackoff}
+		s.failures[name] = failure
+	} else {
+		failure.backoff = min(2*failure.backoff, maxCaptureRetryBackoff)
+	}
+	failure.err = err
+	failure.failures++
+	failure.retryAt = now.Add(failure.backoff)
+	return failure
+}
+
+// readHandle sends the packets captured by a handle to the packets channel until the handle is closed or fails, in
+// which case it's reopened after a backoff if its interface is still there
+func (s *httpRequestAndResponseStreamer) readHandle(name string, handle packetSource, packets chan<- gopacket.Packet) {
+	handle.readPackets(packets)
+	s.handleMutex.Lock()
+	defer s.handleMutex.Unlock()
+	if s.handles[name] != handle {
+		return
+	}
+	delete(s.handles, name)
+	handle.close()
+	failure := s.recordFailureLocked(name, errCaptureStopped, time.Now())
+	slog.Warn("Capture on interface stopped, reopening it after backoff...", "Interface", name, "Backoff", failure.backoff)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// untilNextRefresh is how long to wait before the next refresh, which is sooner than the refresh interval if a failed
+// capture is due to be retried
+func (s *httpRequestAndResponseStreamer) untilNextRefresh() time.Duration {
+	s.handleMutex.Lock()
+	defer s.handleMutex.Unlock()
+	wait := s.interfaceRefreshInterval
+	for name, failure := range s.failures {
+		if _, ok := s.handles[name]; !ok {
+			wait = max(min(wait, time.Until(failure.retryAt)), 0)
+		}
+	}
+	return wait
+}
+
+// interfaceHealth is the state of the capture on an interface, as reported by the readiness endpoint
+type interfaceHealth struct {
+	Interface string     `json:"interface"`
+	Capturing bool       `json:"capturing"`
+	Failures  int        `json:"failures,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+	RetryAt   *time.Time `json:"retryAt,omitempty"`
+}
+
+// captureHealth returns the state of the capture on every interface that's open or has failed, sorted by name
+func (s *httpRequestAndResponseStreamer) captureHealth() []interfaceHealth {
+	s.handleMutex.Lock()
+	defer s.handleMutex.Unlock()
+	var names []string
+	for name := range s.handles {
+		names = append(names, name)
+	}
+	for name := range s.failures {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	health := []interfaceHealth{}
+	for _, name := range slices.Compact(names) {
+		_, capturing := s.handles[name]
+		entry := interfaceHealth{Interface: name, Capturing: capturing}
+		if failure, ok := s.failures[name]; ok {
+			entry.Failures = failure.failures
+			entry.LastError = failure.err.Error()
+			if !capturing {
+				retryAt := failure.retryAt
+				entry.RetryAt = &retryAt
+			}
+		}
+		health = append(health, entry)
+	}
+	return health
+}
+
+// setBpfExpression applies a new BPF expression to the open handles without closing them so that in-flight streams
+// aren't dropped. The expression is also used for any handles opened later. It's compiled for every handle before it's
+// applied to any, as handles with different link types need different programs, and if applying it to a handle fails
+// the handles it was already applied to are rolled back, so the handles never filter with different expressions.
+func (s *httpRequestAndResponseStreamer) setBpfExpression(bpfExpression string) error {
+	s.handleMutex.Lock()
+	defer s.handleMutex.Unlock()
+	for name, handle := range s.handles {
+		if err := handle.compileBpfExpression(bpfExpression); err != nil {
+			return fmt.Errorf("Failed to compile BPF expression for interface %s: %v", name, err)
+		}
+	}
+	applied := []string{}
+	for name, handle := range s.handles {
+		if err := handle.setBpfExpression(bpfExpression); err != nil {
+			for _, appliedName := range applied {
+				if rollbackErr := s.handles[appliedName].setBpfExpression(s.bpfExpression); rollbackErr != nil {
+					slog.Error(
+						"Failed to roll back BPF expression, closing the capture to reopen it with the previous expression:",
+						"Interface", appliedName,
+						"Err", rollbackErr.Error(),
+					)
+					s.handles[appliedName].close()
+				}
+			}
+			return fmt.Errorf("Failed to apply BPF expression to interface %s: %v", name, err)
+		}
+		applied = append(applied, name)
 	}
-	packetsChannel := gopacket.NewPacketSource(handle, handle.LinkType()).Packets()
-	return handle, packetsChannel
+	s.bpfExpression = bpfExpression
+	return nil
 }
 
 func (s *httpRequestAndResponseStreamer) start() {
-	assembler := tcpassembly.NewAssembler(
-		tcpassembly.NewStreamPool(
-			&bidirectionalStreamFactory{
-				conns:                     &sync.Map{},
-				requestAndResponseChannel: s.requestAndResponseChannel,
-				maxBodySize:               s.maxBodySize,
-			},
-		),
-	)
+	factory := &bidirectionalStreamFactory{
+		conns:                     &sync.Map{},
+		requestAndResponseChannel: s.requestAndResponseChannel,
+		maxBodySize:               s.maxBodySize,
+		drops:                     s.drops,
+		tlsHandshakes:             s.tlsHandshakes,
+		keyLog:                    s.keyLog,
+		connectionSummaries:       s.connectionSummaries,
+		protocolStats:             s.protocolStats,
+	}
+	assembler := tcpassembly.NewAssembler(tcpassembly.NewStreamPool(factory))
 
 	go func() {
 		ticker := time.Tick(time.Minute)
@@ -64,46 +284,77 @@ func (s *httpRequestAndResponseStreamer) start() {
 		}
 	}()
 
-	handler, packetsChannel := s.getHandleAndPacketsChannel()
-	for {
-		select {
-		case packet, ok := <-packetsChannel:
-			if !ok {
-				slog.Warn("Packet channel closed. Reinitializing...")
-				handler.Close()
-				handler, packetsChannel = s.getHandleAndPacketsChannel()
-			}
-			if packet.NetworkLayer() == nil || packet.TransportLayer() == nil {
-				continue
-			}
-			tcp, ok := packet.TransportLayer().(*layers.TCP)
-			if !ok {
-				continue
-			}
-			net, ok := packet.NetworkLayer().(*layers.IPv4)
-			if !ok {
-				continue
-			}
-			src := net.SrcIP.String()
-			dst := net.DstIP.String()
-			if s.ipManager != nil && !(s.ipManager.isServiceIP(dst) || s.ipManager.isServiceIP(src)) {
-				slog.Debug(
-					"Ignoring packet not destined for or originating from a service IP:",
-					"Src", src,
-					"Dst", dst,
-					"SrcPort", tcp.SrcPort.String(),
-					"DstPort", tcp.DstPort.String(),
-				)
-				continue
+	s.handleMutex.Lock()
+	s.handles = map[string]packetSource{}
+	s.failures = map[string]*captureFailure{}
+	s.wake = make(chan struct{}, 1)
+	s.handleMutex.Unlock()
+	if s.listInterfaces == nil {
+		s.listInterfaces = listInterfaceNames
+	}
+	packetsChannel := make(chan gopacket.Packet, 1000)
+	if s.refreshHandles(packetsChannel) == 0 {
+		slog.Error("Failed to open a capture on any of the configured interfaces, retrying...", "Interfaces", strings.Join(s.interfaces, ", "))
+	}
+	go func() {
+		for {
+			timer := time.NewTimer(s.untilNextRefresh())
+			select {
+			case <-timer.C:
+				s.refreshHandles(packetsChannel)
+			case <-s.wake:
+				timer.Stop()
 			}
+		}
+	}()
+
+	var deduplicator *packetDeduplicator
+	if s.deduplicationWindow > 0 {
+		deduplicator = newPacketDeduplicator(s.deduplicationWindow)
+	}
+	// The packets channel is shared by every handle and never closed, so packets read from it are never nil
+	for packet := range packetsChannel {
+		network, tcp := s.overlayDecoder.decapsulate(packet)
+		if tcp == nil {
+			continue
+		}
+		net, ok := network.(*layers.IPv4)
+		if !ok {
+			continue
+		}
+		src := net.SrcIP.String()
+		dst := net.DstIP.String()
+		// Packets between nodes are encapsulated after they've been DNATed from a service IP to a pod IP, so
+		// decapsulated packets are matched by pod IP instead
+		decapsulated := network != packet.NetworkLayer()
+		if s.ipManager != nil && !(s.ipManager.isServiceIP(dst) || s.ipManager.isServiceIP(src)) &&
+			!(decapsulated && (s.ipManager.isPodIP(dst) || s.ipManager.isPodIP(src))) {
 			slog.Debug(
-				"Captured packet:",
+				"Ignoring packet not destined for or originating from a service IP:",
 				"Src", src,
 				"Dst", dst,
 				"SrcPort", tcp.SrcPort.String(),
 				"DstPort", tcp.DstPort.String(),
 			)
-			assembler.AssembleWithTimestamp(packet.NetworkLayer().NetworkFlow(), tcp, packet.Metadata().Timestamp)
+			continue
+		}
+		slog.Debug(
+			"Captured packet:",
+			"Src", src,
+			"Dst", dst,
+			"SrcPort", tcp.SrcPort.String(),
+			"DstPort", tcp.DstPort.String(),
+		)
+		if deduplicator != nil && deduplicator.isDuplicate(net, tcp, packet.Metadata().Timestamp) {
+			continue
+		}
+		if packet.Metadata().CaptureLength < packet.Metadata().Length {
+			s.drops.increment(dropReasonSnaplen)
+			factory.observeTruncated(net.NetworkFlow(), tcp.TransportFlow())
+		}
+		if tcp.RST {
+			factory.observeReset(net.NetworkFlow(), tcp.TransportFlow())
 		}
+		assembler.AssembleWithTimestamp(net.NetworkFlow(), tcp, packet.Metadata().Timestamp)
 	}
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// sampler decides which captured requests and responses are exported, using a global sampling probability and a token
+// bucket per endpoint. Error responses can be exempted from both so they're never sampled away.
+type sampler struct {
+	probability      float64
+	alwaysKeepErrors bool
+	endpointRate     rate.Limit
+	endpointBurst    int
+	maxEndpoints     int
+	random           func() float64
+	now              func() time.Time
+	limitersMutex    sync.Mutex
+	limiters         map[string]*rate.Limiter
+}
+
+func newSampler(config samplingConfig) *sampler {
+	burst := config.EndpointBurst
+	if burst == 0 {
+		burst = int(math.Max(1, math.Ceil(config.EndpointRatePerSecond)))
+	}
+	return &sampler{
+		probability:      config.Probability,
+		alwaysKeepErrors: config.AlwaysKeepErrors,
+		endpointRate:     rate.Limit(config.EndpointRatePerSecond),
+		endpointBurst:    burst,
+		maxEndpoints:     config.MaxEndpoints,
+		random:           rand.Float64,
+		now:              time.Now,
+		limiters:         map[string]*rate.Limiter{},
+	}
+}
+
+// sample returns true if the request and response should be exported, otherwise false and the policy that dropped it
+func (s *sampler) sample(reqAndResp *httpRequestAndResponse) (bool, string) {
+	if s.alwaysKeepErrors && reqAndResp.response.StatusCode >= http.StatusBadRequest {
+		return true, ""
+	}
+	if s.probability < 1 && s.random() >= s.probability {
+		return false, dropReasonSamplingProbability
+	}
+	if s.endpointRate > 0 && !s.endpointLimiter(endpointKey(reqAndResp.request)).AllowN(s.now(), 1) {
+		return false, dropReasonEndpointRateLimit
+	}
+	return true, ""
+}
+
+func (s *sampler) endpointLimiter(key string) *rate.Limiter {
+	s.limitersMutex.Lock()
+	defer s.limitersMutex.Unlock()
+	if limiter, ok := s.limiters[key]; ok {
+		return limiter
+	}
+	if len(s.limiters) >= s.maxEndpoints {
+		s.evictIdleLimiters()
+	}
+	limiter := rate.NewLimiter(s.endpointRate, s.endpointBurst)
+	s.limiters[key] = limiter
+	return limiter
+}
+
+// evictIdleLimiters removes the limiters whose buckets have refilled, as they behave the same as a new limiter. If
+// every endpoint is busy, all the limiters are dropped rather than letting the map grow without bound.
+func (s *sampler) evictIdleLimiters() {
+	now := s.now()
+	for key, limiter := range s.limiters {
+		if limiter.TokensAt(now) >= float64(s.endpointBurst) {
+			delete(s.limiters, key)
+		}
+	}
+	if len(s.limiters) >= s.maxEndpoints {
+		s.limiters = map[string]*rate.Limiter{}
+	}
+}
+
+// endpointKey identifies an endpoint by its host, method and normalised path
+func endpointKey(request *http.Request) string {
+	path := ""
+	if request.URL != nil {
+		path = request.URL.Path
+	}
+	return request.Host + " " + request.Method + " " + normalisePath(path)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSamplerProbability(t *testing.T) {
+	tests := []struct {
+		name             string
+		probability      float64
+		alwaysKeepErrors bool
+		random           float64
+		statusCode       int
+		expectedSampled  bool
+	}{
+		{
+			name:            "Probability of 1 keeps everything",
+			probability:     1,
+			random:          0.99,
+			statusCode:      200,
+			expectedSampled: true,
+		},
+		{
+			name:            "Random value below probability is kept",
+			probability:     0.25,
+			random:          0.1,
+			statusCode:      200,
+			expectedSampled: true,
+		},
+		{
+			name:            "Random value above probability is dropped",
+			probability:     0.25,
+			random:          0.5,
+			statusCode:      200,
+			expectedSampled: false,
+		},
+		{
+			name:             "Errors are kept regardless of probability",
+			probability:      0,
+			alwaysKeepErrors: true,
+			random:           0.5,
+			statusCode:       503,
+			expectedSampled:  true,
+		},
+		{
+			name:            "Errors are dropped when not always kept",
+			probability:     0,
+			random:          0.5,
+			statusCode:      404,
+			expectedSampled: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSampler(samplingConfig{
+				Probability:      tt.probability,
+				AlwaysKeepErrors: tt.alwaysKeepErrors,
+				MaxEndpoints:     10,
+			})
+			s.random = func() float64 { return tt.random }
+			sampled, reason := s.sample(newTestRequestAndResponse(t, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", newTestResponseBytes(tt.statusCode)))
+			if sampled != tt.expectedSampled {
+				t.Errorf("sample() = %v, want %v", sampled, tt.expectedSampled)
+			}
+			if !sampled && reason != dropReasonSamplingProbability {
+				t.Errorf("sample() reason = %q, want %q", reason, dropReasonSamplingProbability)
+			}
+		})
+	}
+}
+
+func TestSamplerEndpointRateLimit(t *testing.T) {
+	now := time.Unix(0, 0)
+	s := newSampler(samplingConfig{
+		Probability:           1,
+		AlwaysKeepErrors:      true,
+		EndpointRatePerSecond: 1,
+		EndpointBurst:         2,
+		MaxEndpoints:          10,
+	})
+	s.now = func() time.Time { return now }
+
+	sample := func(path string, statusCode int) bool {
+		sampled, reason := s.sample(newTestRequestAndResponse(
+			t,
+			"GET "+path+" HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			newTestResponseBytes(statusCode),
+		))
+		if !sampled && reason != dropReasonEndpointRateLimit {
+			t.Errorf("sample() reason = %q, want %q", reason, dropReasonEndpointRateLimit)
+		}
+		return sampled
+	}
+
+	// /users/1 and /users/2 are the same endpoint, so share a bucket with a burst of 2
+	if !sample("/users/1", 200) || !sample("/users/2", 200) {
+		t.Fatalf("First two requests to an endpoint should be sampled")
+	}
+	if sample("/users/3", 200) {
+		t.Errorf("Third request within a second should be rate limited")
+	}
+	if !sample("/users/3", 500) {
+		t.Errorf("Errors should not be rate limited")
+	}
+	if !sample("/orders/3", 200) {
+		t.Errorf("Other endpoints should have their own bucket")
+	}
+	now = now.Add(time.Second)
+	if !sample("/users/4", 200) {
+		t.Errorf("Bucket should refill after a second")
+	}
+}
+
+func TestSamplerEvictsIdleLimiters(t *testing.T) {
+	now := time.Unix(0, 0)
+	s := newSampler(samplingConfig{
+		Probability:           1,
+		EndpointRatePerSecond: 1,
+		MaxEndpoints:          2,
+	})
+	s.now = func() time.Time { return now }
+	for _, path := range []string{"/a", "/b"} {
+		s.sample(newTestRequestAndResponse(t, "GET "+path+" HTTP/1.1\r\nHost: example.com\r\n\r\n", newTestResponseBytes(200)))
+	}
+	now = now.Add(time.Minute)
+	s.sample(newTestRequestAndResponse(t, "GET /c HTTP/1.1\r\nHost: example.com\r\n\r\n", newTestResponseBytes(200)))
+	if len(s.limiters) != 1 {
+		t.Errorf("len(limiters) = %d, want 1 after evicting idle limiters", len(s.limiters))
+	}
+}
+
+func TestEndpointKey(t *testing.T) {
+	tests := []struct {
+		method      string
+		url         string
+		expectedKey string
+	}{
+		{"GET", "http://example.com/users/123", "example.com GET /users/{id}"},
+		{"POST", "http://example.com/users/123/orders?page=2", "example.com POST /users/{id}/orders"},
+		{"GET", "http://example.com/things/3f2504e0-4f89-11d3-9a0c-0305e82c3301", "example.com GET /things/{id}"},
+		{"GET", "http://example.com/objects/507f1f77bcf86cd799439011", "example.com GET /objects/{id}"},
+		{"GET", "http://example.com/v1/status", "example.com GET /v1/status"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.url, nil)
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			if key := endpointKey(req); key != tt.expectedKey {
+				t.Errorf("endpointKey() = %q, want %q", key, tt.expectedKey)
+			}
+		})
+	}
+}
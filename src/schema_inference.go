@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+const (
+	// maxInferredSchemaDepth and maxInferredProperties bound how much of a JSON value is merged into a schema, so a
+	// deeply nested or map-like body can't grow it without limit
+	maxInferredSchemaDepth = 16
+	maxInferredProperties  = 256
+)
+
+// inferredSchema is a JSON schema built up from observed values. Each observation widens it: a property seen in some
+// objects but not others stops being required, an integer field that's later seen with a fraction becomes a number,
+// and a field seen with values of different types becomes a oneOf.
+type inferredSchema struct {
+	nullable bool
+	boolean  bool
+	integer  bool
+	number   bool
+	str      *inferredString
+	object   *inferredObject
+	array    *inferredSchema
+	// arraySeen is needed as well as array, as empty arrays don't tell us anything about their items
+	arraySeen bool
+}
+
+type inferredString struct {
+	// format is the format every observed string has matched, or empty if they haven't all matched the same one
+	format string
+}
+
+type inferredObject struct {
+	count          int
+	properties     map[string]*inferredSchema
+	propertyCounts map[string]int
+}
+
+func newInferredSchema() *inferredSchema {
+	return &inferredSchema{}
+}
+
+// decodeJsonBody decodes a body into a value that can be observed by a schema, returning false if it isn't valid JSON
+func decodeJsonBody(body []byte) (interface{}, bool) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, false
+	}
+	// Anything after the first value means the body isn't a single JSON document
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, false
+	}
+	return value, true
+}
+
+// observe merges a value decoded by a json.Decoder with UseNumber set into the schema
+func (s *inferredSchema) observe(value interface{}, depth int) {
+	if depth > maxInferredSchemaDepth {
+		return
+	}
+	switch value := value.(type) {
+	case nil:
+		s.nullable = true
+	case bool:
+		s.boolean = true
+	case json.Number:
+		if _, err := value.Int64(); err == nil {
+			s.integer = true
+		} else {
+			s.number = true
+		}
+	case string:
+		format := inferStringFormat(value)
+		if s.str == nil {
+			s.str = &inferredString{format: format}
+		} else if s.str.format != format {
+			s.str.format = ""
+		}
+	case []interface{}:
+		s.arraySeen = true
+		for _, item := range value {
+			if s.array == nil {
+				s.array = newInferredSchema()
+			}
+			s.array.observe(item, depth+1)
+		}
+	case map[string]interface{}:
+		if s.object == nil {
+			s.object = &inferredObject{properties: map[string]*inferredSchema{}, propertyCounts: map[string]int{}}
+		}
+		s.object.count++
+		for key, propertyValue := range value {
+			property, ok := s.object.properties[key]
+			if !ok {
+				if len(s.object.properties) >= maxInferredProperties {
+					continue
+				}
+				property = newInferredSchema()
+				s.object.properties[key] = property
+			}
+			s.object.propertyCounts[key]++
+			property.observe(propertyValue, depth+1)
+		}
+	}
+}
+
+// observeQueryValue merges a query parameter's value into the schema, treating it as a boolean or number if it can
+// be parsed as one
+func (s *inferredSchema) observeQueryValue(value string) {
+	switch {
+	case value == "true" || value == "false":
+		s.observe(value == "true", 0)
+	case isQueryNumber(value):
+		s.observe(json.Number(value), 0)
+	default:
+		s.observe(value, 0)
+	}
+}
+
+func isQueryNumber(value string) bool {
+	parsed, err := strconv.ParseFloat(value, 64)
+	return err == nil && !math.IsInf(parsed, 0) && !math.IsNaN(parsed)
+}
+
+func inferStringFormat(value string) string {
+	switch {
+	case uuidPathSegment.MatchString(value):
+		return "uuid"
+	case len(value) >= len("2006-01-02T15:04:05Z") && isRfc3339(value):
+		return "date-time"
+	case len(value) == len("2006-01-02") && isDate(value):
+		return "date"
+	}
+	return ""
+}
+
+func isRfc3339(value string) bool {
+	_, err := time.Parse(time.RFC3339Nano, value)
+	return err == nil
+}
+
+func isDate(value string) bool {
+	_, err := time.Parse(time.DateOnly, value)
+	return err == nil
+}
+
+// toOpenApi converts the schema into an OpenAPI 3.0 schema
+func (s *inferredSchema) toOpenApi() *openapi3.Schema {
+	var alternatives []*openapi3.Schema
+	if s.object != nil {
+		object := openapi3.NewObjectSchema()
+		keys := make([]string, 0, len(s.object.properties))
+		for key := range s.object.properties {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			object.Properties[key] = openapi3.NewSchemaRef("", s.object.properties[key].toOpenApi())
+			if s.object.propertyCounts[key] == s.object.count {
+				object.Required = append(object.Required, key)
+			}
+		}
+		alternatives = append(alternatives, object)
+	}
+	if s.arraySeen {
+		items := openapi3.NewSchema()
+		if s.array != nil {
+			items = s.array.toOpenApi()
+		}
+		alternatives = append(alternatives, openapi3.NewArraySchema().WithItems(items))
+	}
+	if s.str != nil {
+		alternatives = append(alternatives, openapi3.NewStringSchema().WithFormat(s.str.format))
+	}
+	switch {
+	case s.number:
+		alternatives = append(alternatives, openapi3.NewFloat64Schema())
+	case s.integer:
+		alternatives = append(alternatives, openapi3.NewIntegerSchema())
+	}
+	if s.boolean {
+		alternatives = append(alternatives, openapi3.NewBoolSchema())
+	}
+
+	var schema *openapi3.Schema
+	switch len(alternatives) {
+	case 0:
+		// Only nulls have been seen, so there's nothing to say about the type
+		schema = openapi3.NewSchema()
+	case 1:
+		schema = alternatives[0]
+	default:
+		schema = openapi3.NewOneOfSchema(alternatives...)
+	}
+	schema.Nullable = s.nullable
+	return schema
+}
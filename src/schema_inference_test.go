@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestInferredSchema(t *testing.T) {
+	tests := []struct {
+		name           string
+		bodies         []string
+		expectedSchema string
+	}{
+		{
+			name:           "Scalars",
+			bodies:         []string{`{"id": 1, "price": 2.5, "name": "a", "active": true}`},
+			expectedSchema: `{"type":"object","required":["active","id","name","price"],"properties":{"active":{"type":"boolean"},"id":{"type":"integer"},"name":{"type":"string"},"price":{"type":"number"}}}`,
+		},
+		{
+			name:           "Property missing from some objects isn't required",
+			bodies:         []string{`{"id": 1, "note": "x"}`, `{"id": 2}`},
+			expectedSchema: `{"type":"object","required":["id"],"properties":{"id":{"type":"integer"},"note":{"type":"string"}}}`,
+		},
+		{
+			name:           "Integers widen to numbers",
+			bodies:         []string{`[1, 2.5]`},
+			expectedSchema: `{"type":"array","items":{"type":"number"}}`,
+		},
+		{
+			name:           "Nulls make a field nullable",
+			bodies:         []string{`{"parent": null}`, `{"parent": "8b3f0b8e-6f0d-4f7a-9d3b-2f1e8c7a6b5d"}`},
+			expectedSchema: `{"type":"object","required":["parent"],"properties":{"parent":{"type":"string","format":"uuid","nullable":true}}}`,
+		},
+		{
+			name:           "String formats are only kept if every value matches",
+			bodies:         []string{`["2024-05-01T12:00:00Z", "2024-05-02T12:00:00.5+01:00"]`, `["2024-05-01"]`},
+			expectedSchema: `{"type":"array","items":{"type":"string"}}`,
+		},
+		{
+			name:           "Mixed types become oneOf",
+			bodies:         []string{`{"value": "a"}`, `{"value": 1}`},
+			expectedSchema: `{"type":"object","required":["value"],"properties":{"value":{"oneOf":[{"type":"string"},{"type":"integer"}]}}}`,
+		},
+		{
+			name:           "Empty arrays have unconstrained items",
+			bodies:         []string{`{"tags": []}`},
+			expectedSchema: `{"type":"object","required":["tags"],"properties":{"tags":{"type":"array","items":{}}}}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schema := newInferredSchema()
+			for _, body := range test.bodies {
+				value, ok := decodeJsonBody([]byte(body))
+				if !ok {
+					t.Fatalf("Failed to decode %s", body)
+				}
+				schema.observe(value, 0)
+			}
+			schemaJson, err := json.Marshal(schema.toOpenApi())
+			if err != nil {
+				t.Fatalf("Failed to encode schema: %v", err)
+			}
+			if !jsonEqual(t, schemaJson, []byte(test.expectedSchema)) {
+				t.Errorf("Schema = %s, want %s", schemaJson, test.expectedSchema)
+			}
+		})
+	}
+}
+
+func TestDecodeJsonBodyRejectsTrailingData(t *testing.T) {
+	for _, body := range []string{`{"a": 1} {"b": 2}`, `{"a": 1`, `not json`} {
+		if _, ok := decodeJsonBody([]byte(body)); ok {
+			t.Errorf("decodeJsonBody(%q) succeeded, want it to fail", body)
+		}
+	}
+}
+
+// jsonEqual compares two JSON documents, ignoring the order of object keys
+func jsonEqual(t *testing.T, a []byte, b []byte) bool {
+	var aValue, bValue interface{}
+	if err := json.Unmarshal(a, &aValue); err != nil {
+		t.Fatalf("Failed to decode %s: %v", a, err)
+	}
+	if err := json.Unmarshal(b, &bValue); err != nil {
+		t.Fatalf("Failed to decode %s: %v", b, err)
+	}
+	return reflect.DeepEqual(aValue, bValue)
+}
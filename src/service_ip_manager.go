@@ -4,66 +4,189 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+const (
+	// podFieldSelector has the API server leave out pods using the host network, which can't be told apart by their IP
+	podFieldSelector = "spec.hostNetwork=false"
+	// informerSyncTimeout is how long the informers have to list services and pods before they're stopped and retried
+	informerSyncTimeout = time.Minute
+)
+
+// serviceIpManager keeps track of the IPs of the services in the cluster, and optionally the pods, mapped to the name
+// of the workload they belong to in the form "namespace/name". Services and pods are watched by informers, so the
+// refresh only reads their local caches rather than listing them from the API server.
 type serviceIpManager struct {
-	serviceIPs    *sync.Map
-	getServiceIPs func() ([]string, error)
+	serviceIPs *sync.Map
+	podIPs     *sync.Map
+	// podWorkloads is whether workload names are resolved from pod IPs. Pod IPs may be tracked without it, to match
+	// decapsulated overlay traffic, which has already been DNATed from a service IP to a pod's.
+	podWorkloads    bool
+	specAnnotations atomic.Pointer[map[string]string]
+	getServiceIPs   func() (map[string]string, map[string]string, error)
+	getPodIPs       func() (map[string]string, error)
+	refreshInterval time.Duration
+	trackPodIPs     bool
 }
 
-func newServiceIpManager() *serviceIpManager {
+func newServiceIpManager(refreshInterval time.Duration, podIpLookup bool, trackPodIPs bool) *serviceIpManager {
 	newManager := &serviceIpManager{
-		serviceIPs:    &sync.Map{},
-		getServiceIPs: getServiceIPs,
+		serviceIPs:      &sync.Map{},
+		podIPs:          &sync.Map{},
+		podWorkloads:    podIpLookup,
+		refreshInterval: refreshInterval,
+		trackPodIPs:     podIpLookup || trackPodIPs,
 	}
 	go newManager.run()
 	return newManager
 }
 
+// startInformers starts watching services, and pods if they're tracked, and waits up to informerSyncTimeout for the
+// informers' caches to sync. Once synced, the informers run for the lifetime of the sensor.
+func (s *serviceIpManager) startInformers() error {
+	clientset, err := getKubernetesClientset()
+	if err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	factory := informers.NewSharedInformerFactory(clientset, 0)
+	services := factory.Core().V1().Services()
+	synced := []cache.InformerSynced{services.Informer().HasSynced}
+	var pods corelisters.PodLister
+	if s.trackPodIPs {
+		podFactory := informers.NewSharedInformerFactoryWithOptions(
+			clientset,
+			0,
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) { options.FieldSelector = podFieldSelector }),
+		)
+		podInformer := podFactory.Core().V1().Pods()
+		// Only the fields used to name a pod's workload are cached, as there can be a lot of pods
+		if err := podInformer.Informer().SetTransform(trimPod); err != nil {
+			return fmt.Errorf("Failed to set pod informer transform: %v", err)
+		}
+		pods = podInformer.Lister()
+		synced = append(synced, podInformer.Informer().HasSynced)
+		podFactory.Start(stop)
+	}
+	factory.Start(stop)
+	// The informers retry listing and watching by themselves, but are stopped if the API server can't be reached in
+	// time so the caller can report it and start again
+	ctx, cancel := context.WithTimeout(context.Background(), informerSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		close(stop)
+		return fmt.Errorf("Timed out after %s waiting for the service and pod caches to sync", informerSyncTimeout)
+	}
+	s.getServiceIPs = func() (map[string]string, map[string]string, error) { return getServiceIPs(services.Lister()) }
+	if pods != nil {
+		s.getPodIPs = func() (map[string]string, error) { return getPodIPs(pods) }
+	}
+	return nil
+}
+
 func (s *serviceIpManager) run() {
-	t := time.NewTicker(time.Second)
+	if s.getServiceIPs == nil {
+		for {
+			err := s.startInformers()
+			if err == nil {
+				break
+			}
+			slog.Error("Failed to watch Kubernetes services and pods, retrying...", "Err", err.Error())
+			time.Sleep(time.Minute)
+		}
+	}
+	t := time.NewTicker(s.refreshInterval)
 	for {
 		select {
 		case <-t.C:
-			currentServiceIPs, err := s.getServiceIPs()
+			currentServiceIPs, currentSpecAnnotations, err := s.getServiceIPs()
 			if err != nil {
 				slog.Error("Failed to get service IPs:", "Err", err.Error())
+			} else {
+				slog.Debug(
+					"Discovered service IPs",
+					"ServiceIpCount", len(currentServiceIPs),
+					"ServiceIPs", currentServiceIPs,
+				)
+				syncIpMap(s.serviceIPs, currentServiceIPs)
+				s.specAnnotations.Store(&currentSpecAnnotations)
+			}
+			if s.getPodIPs == nil {
 				continue
 			}
-			slog.Debug(
-				"Discovered service IPs",
-				"ServiceIpCount", len(currentServiceIPs),
-				"ServiceIPs", currentServiceIPs,
-			)
-			for _, ip := range currentServiceIPs {
-				s.serviceIPs.Store(ip, struct{}{})
+			currentPodIPs, err := s.getPodIPs()
+			if err != nil {
+				slog.Error("Failed to get pod IPs:", "Err", err.Error())
+				continue
 			}
-			s.serviceIPs.Range(func(key, value interface{}) bool {
-				for _, ip := range currentServiceIPs {
-					if key.(string) == ip {
-						return true
-					}
-				}
-				s.serviceIPs.Delete(key)
-				return true
-			})
+			slog.Debug("Discovered pod IPs", "PodIpCount", len(currentPodIPs))
+			syncIpMap(s.podIPs, currentPodIPs)
 		}
 	}
 }
 
+func syncIpMap(ipMap *sync.Map, currentIPs map[string]string) {
+	for ip, workload := range currentIPs {
+		ipMap.Store(ip, workload)
+	}
+	ipMap.Range(func(key, value interface{}) bool {
+		if _, ok := currentIPs[key.(string)]; !ok {
+			ipMap.Delete(key)
+		}
+		return true
+	})
+}
+
 func (s *serviceIpManager) isServiceIP(ip string) bool {
 	_, ok := s.serviceIPs.Load(ip)
 	return ok
 }
 
-func getServiceIPs() ([]string, error) {
+// isPodIP returns true if the IP belongs to a pod which doesn't use the host network
+func (s *serviceIpManager) isPodIP(ip string) bool {
+	_, ok := s.podIPs.Load(ip)
+	return ok
+}
+
+// workloadName returns the "namespace/name" of the service or pod workload with the given IP, or an empty string if
+// the IP is unknown. Service IPs take precedence over pod IPs.
+func (s *serviceIpManager) workloadName(ip string) string {
+	if workload, ok := s.serviceIPs.Load(ip); ok {
+		return workload.(string)
+	}
+	if !s.podWorkloads {
+		return ""
+	}
+	if workload, ok := s.podIPs.Load(ip); ok {
+		return workload.(string)
+	}
+	return ""
+}
+
+// openApiSpecAnnotations returns the value of the firetail.io/openapi-spec annotation of each service that has one,
+// keyed by the service's "namespace/name"
+func (s *serviceIpManager) openApiSpecAnnotations() map[string]string {
+	if annotations := s.specAnnotations.Load(); annotations != nil {
+		return *annotations
+	}
+	return nil
+}
+
+func getKubernetesClientset() (*kubernetes.Clientset, error) {
 	// Load config from inside the cluster or from kubeconfig
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -79,20 +202,83 @@ func getServiceIPs() ([]string, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create Kubernetes client: %v", err)
 	}
+	return clientset, nil
+}
 
+// getServiceIPs returns the workload of each service ClusterIP, and the OpenAPI spec annotation of each service that
+// has one
+func getServiceIPs(lister corelisters.ServiceLister) (map[string]string, map[string]string, error) {
 	// Get all services in all namespaces
-	services, err := clientset.CoreV1().Services("").List(context.TODO(), metav1.ListOptions{})
+	services, err := lister.List(labels.Everything())
 	if err != nil {
-		return nil, fmt.Errorf("Failed to list services: %v", err)
+		return nil, nil, fmt.Errorf("Failed to list services: %v", err)
 	}
 
 	// Extract service ClusterIPs
-	var serviceIPs []string
-	for _, svc := range services.Items {
+	serviceIPs := map[string]string{}
+	specAnnotations := map[string]string{}
+	for _, svc := range services {
 		if svc.Spec.ClusterIP != "" && svc.Spec.ClusterIP != "None" {
-			serviceIPs = append(serviceIPs, svc.Spec.ClusterIP)
+			serviceIPs[svc.Spec.ClusterIP] = svc.Namespace + "/" + svc.Name
+		}
+		if spec := svc.Annotations[openApiSpecAnnotation]; spec != "" {
+			specAnnotations[svc.Namespace+"/"+svc.Name] = spec
+		}
+	}
+
+	return serviceIPs, specAnnotations, nil
+}
+
+func getPodIPs(lister corelisters.PodLister) (map[string]string, error) {
+	// Get all pods in all namespaces
+	pods, err := lister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list pods: %v", err)
+	}
+
+	// Pods using the host network share the node's IP, so they can't be told apart and are skipped. They're already
+	// left out by the field selector, but are checked again in case the API server ignores it.
+	podIPs := map[string]string{}
+	for _, pod := range pods {
+		if pod.Spec.HostNetwork || pod.Status.PodIP == "" {
+			continue
 		}
+		podIPs[pod.Status.PodIP] = pod.Namespace + "/" + podWorkloadName(pod)
+	}
+
+	return podIPs, nil
+}
+
+// trimPod strips a pod down to the fields getPodIPs uses before the informer caches it
+func trimPod(object interface{}) (interface{}, error) {
+	pod, ok := object.(*corev1.Pod)
+	if !ok {
+		return object, nil
 	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            pod.Name,
+			Namespace:       pod.Namespace,
+			UID:             pod.UID,
+			ResourceVersion: pod.ResourceVersion,
+			OwnerReferences: pod.OwnerReferences,
+		},
+		Spec:   corev1.PodSpec{HostNetwork: pod.Spec.HostNetwork},
+		Status: corev1.PodStatus{PodIP: pod.Status.PodIP},
+	}, nil
+}
 
-	return serviceIPs, nil
+// podWorkloadName returns the name of the controller that owns the pod, or the pod's name if it has none. Pods owned by
+// a ReplicaSet are attributed to its Deployment by trimming the pod template hash from the ReplicaSet's name.
+func podWorkloadName(pod *corev1.Pod) string {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return pod.Name
+	}
+	if owner.Kind == "ReplicaSet" {
+		if hashIndex := strings.LastIndex(owner.Name, "-"); hashIndex > 0 {
+			return owner.Name[:hashIndex]
+		}
+	}
+	return owner.Name
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestGetPodIPs(t *testing.T) {
+	controller := true
+	pods := []*corev1.Pod{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "orders-7d9f8b6c5-x2k4p",
+				Namespace:       "shop",
+				Labels:          map[string]string{"app": "orders"},
+				OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "orders-7d9f8b6c5", Controller: &controller}},
+			},
+			Spec:   corev1.PodSpec{NodeName: "node-1", Containers: []corev1.Container{{Name: "orders"}}},
+			Status: corev1.PodStatus{PodIP: "10.0.1.5", Phase: corev1.PodRunning},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "debug", Namespace: "default"},
+			Status:     corev1.PodStatus{PodIP: "10.0.1.6"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "kube-proxy-abcde", Namespace: "kube-system"},
+			Spec:       corev1.PodSpec{HostNetwork: true},
+			Status:     corev1.PodStatus{PodIP: "192.168.0.10"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "pending", Namespace: "default"},
+		},
+	}
+
+	// Pods are trimmed as the informer would cache them, so the fields getPodIPs uses must survive it
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, pod := range pods {
+		trimmed, err := trimPod(pod)
+		if err != nil {
+			t.Fatalf("trimPod() error = %v", err)
+		}
+		if err := indexer.Add(trimmed); err != nil {
+			t.Fatalf("Failed to add pod to indexer: %v", err)
+		}
+	}
+
+	podIPs, err := getPodIPs(corelisters.NewPodLister(indexer))
+	if err != nil {
+		t.Fatalf("getPodIPs() error = %v", err)
+	}
+	expected := map[string]string{"10.0.1.5": "shop/orders", "10.0.1.6": "default/debug"}
+	if !reflect.DeepEqual(podIPs, expected) {
+		t.Errorf("getPodIPs() = %v, want %v", podIPs, expected)
+	}
+}
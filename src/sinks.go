@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"io"
+)
+
+// exportToAll returns an export func which passes each captured request and response to every sink. Bodies can only be
+// read once, so when there's more than one sink they're read into memory first and each sink gets its own copy.
+func exportToAll(sinks []func(*httpRequestAndResponse)) func(*httpRequestAndResponse) {
+	if len(sinks) == 1 {
+		return sinks[0]
+	}
+	return func(reqAndResp *httpRequestAndResponse) {
+		requestBody, requestTruncated := readCapturedBody(reqAndResp.request.Body)
+		responseBody, responseTruncated := readCapturedBody(reqAndResp.response.Body)
+		for _, export := range sinks {
+			request := reqAndResp.request.Clone(reqAndResp.request.Context())
+			request.Body = io.NopCloser(bytes.NewReader(requestBody))
+			response := *reqAndResp.response
+			response.Header = reqAndResp.response.Header.Clone()
+			response.Body = io.NopCloser(bytes.NewReader(responseBody))
+
+			copied := *reqAndResp
+			copied.request = request
+			copied.response = &response
+			copied.requestTruncated = reqAndResp.requestTruncated || requestTruncated
+			copied.responseTruncated = reqAndResp.responseTruncated || responseTruncated
+			export(&copied)
+		}
+	}
+}
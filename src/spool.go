@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spoolSegmentSuffix       = ".seg"
+	spoolTempSuffix          = ".tmp"
+	dropReasonSpoolEvicted   = "sinks.firetail.spool.maxBytes"
+	dropReasonSpoolRejected  = "sinks.firetail.spool.rejected"
+	dropReasonSpoolTooLarge  = "sinks.firetail.spool.segmentTooLarge"
+	dropReasonSpoolWriteFail = "sinks.firetail.spool.writeFailed"
+)
+
+// diskSpool is a bounded write-ahead spool of batches waiting to be sent. Each batch is written to its own segment
+// file before it is sent, and only deleted once it has been sent successfully, so batches survive API outages and
+// restarts. Segments are sent oldest first with exponential backoff between failed attempts, and when the spool is
+// full the oldest segments are evicted to make room for new ones.
+type diskSpool struct {
+	directory      string
+	maxBytes       int64
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	send           func([]byte) error
+	isRetryable    func(error) bool
+	drops          *dropCounters
+	mutex          sync.Mutex
+	segments       []spoolSegment
+	totalBytes     int64
+	nextSequence   uint64
+	wake           chan struct{}
+}
+
+type spoolSegment struct {
+	sequence uint64
+	size     int64
+}
+
+// newDiskSpool opens the spool in the given directory, creating it if necessary. Any segments left over from a
+// previous run will be sent once the spool is run.
+func newDiskSpool(config spoolConfig, send func([]byte) error, isRetryable func(error) bool, drops *dropCounters) (*diskSpool, error) {
+	if err := os.MkdirAll(config.Directory, 0o700); err != nil {
+		return nil, fmt.Errorf("Failed to create spool directory %s: %v", config.Directory, err)
+	}
+	s := &diskSpool{
+		directory:      config.Directory,
+		maxBytes:       config.MaxBytes,
+		initialBackoff: config.InitialBackoff,
+		maxBackoff:     config.MaxBackoff,
+		send:           send,
+		isRetryable:    isRetryable,
+		drops:          drops,
+		wake:           make(chan struct{}, 1),
+	}
+
+	entries, err := os.ReadDir(config.Directory)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read spool directory %s: %v", config.Directory, err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, spoolTempSuffix) {
+			// A temp file is a segment that was never fully written, so was never acknowledged to the shipper
+			os.Remove(filepath.Join(config.Directory, name))
+			continue
+		}
+		sequence, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentSuffix), 10, 64)
+		if err != nil || !strings.HasSuffix(name, spoolSegmentSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, spoolSegment{sequence: sequence, size: info.Size()})
+		s.totalBytes += info.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].sequence < s.segments[j].sequence })
+	if len(s.segments) > 0 {
+		s.nextSequence = s.segments[len(s.segments)-1].sequence + 1
+		slog.Info(
+			"Found spooled batches from a previous run, they will be replayed",
+			"Segments", len(s.segments),
+			"Bytes", s.totalBytes,
+		)
+	}
+	return s, nil
+}
+
+func (s *diskSpool) segmentPath(sequence uint64) string {
+	return filepath.Join(s.directory, fmt.Sprintf("%020d%s", sequence, spoolSegmentSuffix))
+}
+
+// write durably stores a batch in a new segment, evicting the oldest segments if needed to stay within maxBytes
+func (s *diskSpool) write(body []byte) error {
+	size := int64(len(body))
+	if size > s.maxBytes {
+		s.drops.increment(dropReasonSpoolTooLarge)
+		return fmt.Errorf("batch of %d bytes is larger than the spool's max size of %d bytes", size, s.maxBytes)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for len(s.segments) > 0 && s.totalBytes+size > s.maxBytes {
+		oldest := s.segments[0]
+		slog.Warn("Spool is full, evicting oldest batch", "Segment", oldest.sequence, "Bytes", oldest.size)
+		s.removeSegmentLocked(oldest.sequence)
+		s.drops.increment(dropReasonSpoolEvicted)
+	}
+
+	sequence := s.nextSequence
+	s.nextSequence++
+	path := s.segmentPath(sequence)
+	if err := writeFileSync(path+spoolTempSuffix, body); err != nil {
+		os.Remove(path + spoolTempSuffix)
+		s.drops.increment(dropReasonSpoolWriteFail)
+		return fmt.Errorf("Failed to write spool segment: %v", err)
+	}
+	if err := os.Rename(path+spoolTempSuffix, path); err != nil {
+		os.Remove(path + spoolTempSuffix)
+		s.drops.increment(dropReasonSpoolWriteFail)
+		return fmt.Errorf("Failed to commit spool segment: %v", err)
+	}
+	s.segments = append(s.segments, spoolSegment{sequence: sequence, size: size})
+	s.totalBytes += size
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *diskSpool) removeSegmentLocked(sequence uint64) {
+	for i, segment := range s.segments {
+		if segment.sequence == sequence {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			s.totalBytes -= segment.size
+			break
+		}
+	}
+	if err := os.Remove(s.segmentPath(sequence)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Failed to remove spool segment:", "Segment", sequence, "Err", err.Error())
+	}
+}
+
+func (s *diskSpool) oldest() (spoolSegment, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.segments) == 0 {
+		return spoolSegment{}, false
+	}
+	return s.segments[0], true
+}
+
+// run sends segments oldest first, forever
+func (s *diskSpool) run() {
+	backoff := s.initialBackoff
+	for {
+		segment, ok := s.oldest()
+		if !ok {
+			<-s.wake
+			continue
+		}
+		body, err := os.ReadFile(s.segmentPath(segment.sequence))
+		if err != nil {
+			// The segment may have been evicted while we were waiting
+			s.mutex.Lock()
+			s.removeSegmentLocked(segment.sequence)
+			s.mutex.Unlock()
+			if !errors.Is(err, os.ErrNotExist) {
+				slog.Error("Failed to read spool segment, dropping it:", "Segment", segment.sequence, "Err", err.Error())
+			}
+			continue
+		}
+
+		err = s.send(body)
+		if err != nil && s.isRetryable(err) {
+			slog.Warn(
+				"Failed to send spooled batch, retrying after backoff",
+				"Segment", segment.sequence,
+				"Backoff", backoff,
+				"Err", err.Error(),
+			)
+			// Jitter the backoff so a fleet of sensors don't all retry at the same moment
+			time.Sleep(backoff/2 + rand.N(backoff/2+1))
+			backoff = min(2*backoff, s.maxBackoff)
+			continue
+		}
+		if err != nil {
+			slog.Error("Spooled batch was rejected, dropping it:", "Segment", segment.sequence, "Err", err.Error())
+			s.drops.increment(dropReasonSpoolRejected)
+		} else {
+			slog.Debug("Sent spooled batch", "Segment", segment.sequence, "Bytes", segment.size)
+		}
+		backoff = s.initialBackoff
+		s.mutex.Lock()
+		s.removeSegmentLocked(segment.sequence)
+		s.mutex.Unlock()
+	}
+}
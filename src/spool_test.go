@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestDiskSpool(t *testing.T, directory string, maxBytes int64, send func([]byte) error) *diskSpool {
+	spool, err := newDiskSpool(
+		spoolConfig{
+			Directory:      directory,
+			MaxBytes:       maxBytes,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     5 * time.Millisecond,
+		},
+		send,
+		isRetryableFiretailError,
+		newDropCounters(),
+	)
+	if err != nil {
+		t.Fatalf("newDiskSpool() error = %v", err)
+	}
+	return spool
+}
+
+func receiveSpooled(t *testing.T, sent chan string) string {
+	select {
+	case body := <-sent:
+		return body
+	case <-time.After(time.Second):
+		t.Fatalf("Spooled batch was not sent")
+	}
+	return ""
+}
+
+func TestDiskSpoolRetriesUntilSent(t *testing.T) {
+	sent := make(chan string, 10)
+	failures := 2
+	spool := newTestDiskSpool(t, t.TempDir(), 1024, func(body []byte) error {
+		if failures > 0 {
+			failures--
+			return errors.New("connection refused")
+		}
+		sent <- string(body)
+		return nil
+	})
+	if err := spool.write([]byte("first")); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+	if err := spool.write([]byte("second")); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+	go spool.run()
+
+	// Batches must be sent in order, with the first retried until it succeeds
+	if body := receiveSpooled(t, sent); body != "first" {
+		t.Errorf("Sent %q first, want \"first\"", body)
+	}
+	if body := receiveSpooled(t, sent); body != "second" {
+		t.Errorf("Sent %q second, want \"second\"", body)
+	}
+}
+
+func TestDiskSpoolDropsRejectedBatches(t *testing.T) {
+	sent := make(chan string, 10)
+	spool := newTestDiskSpool(t, t.TempDir(), 1024, func(body []byte) error {
+		if string(body) == "bad" {
+			return &firetailApiError{statusCode: http.StatusBadRequest}
+		}
+		sent <- string(body)
+		return nil
+	})
+	spool.write([]byte("bad"))
+	spool.write([]byte("good"))
+	go spool.run()
+
+	if body := receiveSpooled(t, sent); body != "good" {
+		t.Errorf("Sent %q, want \"good\"", body)
+	}
+	if drops := spool.drops.snapshot()[dropReasonSpoolRejected]; drops != 1 {
+		t.Errorf("Dropped %d rejected batches, want 1", drops)
+	}
+}
+
+func TestDiskSpoolReplaysAfterRestart(t *testing.T) {
+	directory := t.TempDir()
+	failing := newTestDiskSpool(t, directory, 1024, func([]byte) error { return errors.New("unreachable") })
+	failing.write([]byte("first"))
+	failing.write([]byte("second"))
+	// A segment that was never fully written before the restart should be discarded
+	os.WriteFile(failing.segmentPath(failing.nextSequence)+spoolTempSuffix, []byte("partial"), 0o600)
+
+	sent := make(chan string, 10)
+	restarted := newTestDiskSpool(t, directory, 1024, func(body []byte) error {
+		sent <- string(body)
+		return nil
+	})
+	if len(restarted.segments) != 2 || restarted.totalBytes != int64(len("first")+len("second")) {
+		t.Fatalf("Restarted spool has %d segments of %d bytes, want 2 of 11", len(restarted.segments), restarted.totalBytes)
+	}
+	restarted.write([]byte("third"))
+	go restarted.run()
+
+	for _, expected := range []string{"first", "second", "third"} {
+		if body := receiveSpooled(t, sent); body != expected {
+			t.Errorf("Sent %q, want %q", body, expected)
+		}
+	}
+}
+
+func TestDiskSpoolEvictsOldestAtMaxBytes(t *testing.T) {
+	spool := newTestDiskSpool(t, t.TempDir(), 10, func([]byte) error { return nil })
+	for _, body := range []string{"aaaa", "bbbb", "cccc"} {
+		if err := spool.write([]byte(body)); err != nil {
+			t.Fatalf("write() error = %v", err)
+		}
+	}
+	if err := spool.write([]byte("this is too large")); err == nil {
+		t.Errorf("write() error = nil, want error for a batch larger than maxBytes")
+	}
+
+	if len(spool.segments) != 2 || spool.totalBytes != 8 {
+		t.Fatalf("Spool has %d segments of %d bytes, want 2 of 8", len(spool.segments), spool.totalBytes)
+	}
+	oldest, err := os.ReadFile(spool.segmentPath(spool.segments[0].sequence))
+	if err != nil || string(oldest) != "bbbb" {
+		t.Errorf("Oldest remaining segment = %q, %v, want \"bbbb\"", oldest, err)
+	}
+	if drops := spool.drops.snapshot()[dropReasonSpoolEvicted]; drops != 1 {
+		t.Errorf("Evicted %d batches, want 1", drops)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"slices"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	tlsRecordTypeChangeCipherSpec = 20
+	tlsRecordTypeAlert            = 21
+	tlsRecordTypeApplicationData  = 23
+	tlsHandshakeTypeFinished      = 20
+	tlsHandshakeTypeKeyUpdate     = 24
+)
+
+var errMissingTlsSecrets = errors.New("no secrets logged for the TLS session")
+
+// tlsCipherSuiteParameters are what's needed to derive keys for, and decrypt the records of, a cipher suite
+type tlsCipherSuiteParameters struct {
+	hash      func() hash.Hash
+	keyLength int
+	// ivLength is the length of the TLS 1.2 IV; TLS 1.3 IVs are always 12 bytes
+	ivLength int
+	// aead creates the AEAD of an AEAD cipher suite; it's nil for CBC cipher suites
+	aead func(key []byte) (cipher.AEAD, error)
+	// macLength is the length of the HMAC in each record of a CBC cipher suite
+	macLength int
+}
+
+// aesGcmCipherSuite has a 4 byte fixed IV in TLS 1.2, followed by an explicit nonce in each record
+func aesGcmCipherSuite(hash func() hash.Hash, keyLength int) tlsCipherSuiteParameters {
+	return tlsCipherSuiteParameters{hash: hash, keyLength: keyLength, ivLength: 4, aead: newAesGcm}
+}
+
+func chaCha20Poly1305CipherSuite() tlsCipherSuiteParameters {
+	return tlsCipherSuiteParameters{hash: sha256.New, keyLength: chacha20poly1305.KeySize, ivLength: chacha20poly1305.NonceSize, aead: chacha20poly1305.New}
+}
+
+func aesCbcCipherSuite(keyLength int, macLength int) tlsCipherSuiteParameters {
+	return tlsCipherSuiteParameters{hash: sha256.New, keyLength: keyLength, ivLength: aes.BlockSize, macLength: macLength}
+}
+
+func newAesGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// tlsCipherSuites are the cipher suites the sensor can decrypt: every TLS 1.3 cipher suite, and the AES-GCM,
+// ChaCha20-Poly1305 and AES-CBC cipher suites of TLS 1.2
+var tlsCipherSuites = map[uint16]tlsCipherSuiteParameters{
+	tls.TLS_AES_128_GCM_SHA256:                        aesGcmCipherSuite(sha256.New, 16),
+	tls.TLS_AES_256_GCM_SHA384:                        aesGcmCipherSuite(sha512.New384, 32),
+	tls.TLS_CHACHA20_POLY1305_SHA256:                  chaCha20Poly1305CipherSuite(),
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:               aesGcmCipherSuite(sha256.New, 16),
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:               aesGcmCipherSuite(sha512.New384, 32),
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:       aesGcmCipherSuite(sha256.New, 16),
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:       aesGcmCipherSuite(sha512.New384, 32),
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:         aesGcmCipherSuite(sha256.New, 16),
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:         aesGcmCipherSuite(sha512.New384, 32),
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256:   chaCha20Poly1305CipherSuite(),
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256: chaCha20Poly1305CipherSuite(),
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:                  aesCbcCipherSuite(16, sha1.Size),
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:                  aesCbcCipherSuite(32, sha1.Size),
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256:               aesCbcCipherSuite(16, sha256.Size),
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:          aesCbcCipherSuite(16, sha1.Size),
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:          aesCbcCipherSuite(32, sha1.Size),
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:            aesCbcCipherSuite(16, sha1.Size),
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:            aesCbcCipherSuite(32, sha1.Size),
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256:       aesCbcCipherSuite(16, sha256.Size),
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:         aesCbcCipherSuite(16, sha256.Size),
+}
+
+// decryptTlsConnection decrypts the records each side of a TLS connection sent with the secrets logged for its
+// session, and returns the application data each side sent. Both sides' streams must start at the ClientHello and
+// ServerHello. Any records after one that can't be decrypted are left out, and an error is returned if no application
+// data could be decrypted at all.
+func decryptTlsConnection(handshake *tlsHandshake, secrets *tlsSessionSecrets, clientBytes []byte, serverBytes []byte) ([]byte, []byte, error) {
+	if handshake.serverHello == nil {
+		return nil, nil, errors.New("no ServerHello captured")
+	}
+	suiteId := handshake.serverHello.cipherSuite
+	suite, ok := tlsCipherSuites[suiteId]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported cipher suite %s", tls.CipherSuiteName(suiteId))
+	}
+
+	var client, server *tlsRecordDecrypter
+	switch version := handshake.serverHello.negotiatedVersion(); version {
+	case 0x0304:
+		if secrets.clientHandshakeTrafficSecret == nil || secrets.serverHandshakeTrafficSecret == nil ||
+			secrets.clientTrafficSecret == nil || secrets.serverTrafficSecret == nil {
+			return nil, nil, errMissingTlsSecrets
+		}
+		client = newTls13RecordDecrypter(suite, secrets.clientHandshakeTrafficSecret, secrets.clientTrafficSecret)
+		server = newTls13RecordDecrypter(suite, secrets.serverHandshakeTrafficSecret, secrets.serverTrafficSecret)
+	case 0x0303:
+		if secrets.masterSecret == nil {
+			return nil, nil, errMissingTlsSecrets
+		}
+		client, server = newTls12RecordDecrypters(suite, secrets.masterSecret, handshake.clientHello.random, handshake.serverHello.random)
+		// encrypt_then_mac only applies to CBC suites, and only if the server echoed the client's extension
+		encryptThenMac := suite.aead == nil &&
+			slices.Contains(handshake.clientHello.extensions, tlsExtensionEncryptThenMac) &&
+			slices.Contains(handshake.serverHello.extensions, tlsExtensionEncryptThenMac)
+		client.encryptThenMac, server.encryptThenMac = encryptThenMac, encryptThenMac
+	default:
+		return nil, nil, fmt.Errorf("unsupported TLS version %s", tlsVersionName(version))
+	}
+
+	clientPlaintext, clientErr := client.decrypt(clientBytes)
+	serverPlaintext, serverErr := server.decrypt(serverBytes)
+	if len(clientPlaintext) == 0 && len(serverPlaintext) == 0 {
+		return nil, nil, errors.Join(errors.New("no application data decrypted"), clientErr, serverErr)
+	}
+	return clientPlaintext, serverPlaintext, nil
+}
+
+// tlsRecordDecrypter decrypts the records one side of a TLS connection sent. Records are decrypted once that side has
+// started encrypting: after its ChangeCipherSpec in TLS 1.2, or after its hello in TLS 1.3.
+type tlsRecordDecrypter struct {
+	suite    tlsCipherSuiteParameters
+	tls13    bool
+	sequence uint64
+	key, iv  []byte
+	// trafficSecret is the TLS 1.3 secret to switch to after the handshake's Finished message, or to update with
+	// KeyUpdate messages once it's in use
+	trafficSecret      []byte
+	usingTrafficSecret bool
+	encrypting         bool
+	// encryptThenMac is set if the TLS 1.2 CBC records are MACed after they're encrypted (RFC 7366)
+	encryptThenMac bool
+	// handshakeMessages buffers TLS 1.3 handshake messages split across records
+	handshakeMessages []byte
+}
+
+func newTls13RecordDecrypter(suite tlsCipherSuiteParameters, handshakeTrafficSecret []byte, trafficSecret []byte) *tlsRecordDecrypter {
+	d := &tlsRecordDecrypter{suite: suite, tls13: true, trafficSecret: trafficSecret, encrypting: true}
+	d.setTls13Secret(handshakeTrafficSecret)
+	return d
+}
+
+func (d *tlsRecordDecrypter) setTls13Secret(secret []byte) {
+	d.key = hkdfExpandLabel(d.suite.hash, secret, "key", d.suite.keyLength)
+	d.iv = hkdfExpandLabel(d.suite.hash, secret, "iv", 12)
+	d.sequence = 0
+}
+
+// newTls12RecordDecrypters derives the client's and server's keys from a TLS 1.2 session's master secret (RFC 5246
+// section 6.3)
+func newTls12RecordDecrypters(suite tlsCipherSuiteParameters, masterSecret []byte, clientRandom []byte, serverRandom []byte) (*tlsRecordDecrypter, *tlsRecordDecrypter) {
+	seed := append(append([]byte{}, serverRandom...), clientRandom...)
+	keyBlock := tls12Prf(suite.hash, masterSecret, "key expansion", seed, 2*(suite.macLength+suite.keyLength+suite.ivLength))
+	next := func(n int) []byte {
+		b := keyBlock[:n]
+		keyBlock = keyBlock[n:]
+		return b
+	}
+	next(2 * suite.macLength) // MAC keys, as MACs aren't verified
+	client := &tlsRecordDecrypter{suite: suite, key: next(suite.keyLength)}
+	server := &tlsRecordDecrypter{suite: suite, key: next(suite.keyLength)}
+	client.iv, server.iv = next(suite.ivLength), next(suite.ivLength)
+	return client, server
+}
+
+// decrypt returns the application data in a side's records, up to the first record that can't be decrypted
+func (d *tlsRecordDecrypter) decrypt(data []byte) ([]byte, error) {
+	var plaintext []byte
+	for len(data) >= 5 {
+		recordType := data[0]
+		length := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+length {
+			// The rest of the stream wasn't captured
+			break
+		}
+		header, fragment := data[:5], data[5:5+length]
+		data = data[5+length:]
+
+		switch {
+		case recordType == tlsRecordTypeChangeCipherSpec:
+			// TLS 1.3 sends these only for compatibility with middleboxes; in TLS 1.2 the records after are encrypted
+			d.encrypting = d.encrypting || !d.tls13
+			continue
+		case !d.encrypting:
+			continue
+		case d.tls13 && recordType != tlsRecordTypeApplicationData:
+			// Records are only encrypted once this side's hello has been sent
+			continue
+		}
+
+		content, err := d.decryptRecord(header, fragment)
+		if err != nil {
+			return plaintext, err
+		}
+		if d.tls13 {
+			// The real content type is the last non-zero byte of the plaintext
+			for len(content) > 0 && content[len(content)-1] == 0 {
+				content = content[:len(content)-1]
+			}
+			if len(content) == 0 {
+				return plaintext, errors.New("TLS 1.3 record has no content type")
+			}
+			recordType, content = content[len(content)-1], content[:len(content)-1]
+		}
+		switch recordType {
+		case tlsRecordTypeApplicationData:
+			plaintext = append(plaintext, content...)
+		case tlsRecordTypeAlert:
+			return plaintext, nil
+		case tlsRecordTypeHandshake:
+			if d.tls13 {
+				d.handleTls13HandshakeMessages(content)
+			}
+		}
+	}
+	return plaintext, nil
+}
+
+// handleTls13HandshakeMessages switches to the traffic secret after the Finished message that ends this side's
+// handshake, and to the next traffic secret after a KeyUpdate message
+func (d *tlsRecordDecrypter) handleTls13HandshakeMessages(content []byte) {
+	d.handshakeMessages = append(d.handshakeMessages, content...)
+	for len(d.handshakeMessages) >= 4 {
+		length := int(uint32(d.handshakeMessages[1])<<16 | uint32(d.handshakeMessages[2])<<8 | uint32(d.handshakeMessages[3]))
+		if len(d.handshakeMessages) < 4+length {
+			return
+		}
+		messageType := d.handshakeMessages[0]
+		d.handshakeMessages = d.handshakeMessages[4+length:]
+		switch {
+		case messageType == tlsHandshakeTypeFinished && !d.usingTrafficSecret:
+			d.usingTrafficSecret = true
+			d.setTls13Secret(d.trafficSecret)
+		case messageType == tlsHandshakeTypeKeyUpdate && d.usingTrafficSecret:
+			d.trafficSecret = hkdfExpandLabel(d.suite.hash, d.trafficSecret, "traffic upd", d.suite.hash().Size())
+			d.setTls13Secret(d.trafficSecret)
+		}
+	}
+}
+
+func (d *tlsRecordDecrypter) decryptRecord(header []byte, fragment []byte) ([]byte, error) {
+	sequence := d.sequence
+	d.sequence++
+	if d.suite.aead == nil {
+		return d.decryptCbcRecord(fragment)
+	}
+	aead, err := d.suite.aead(d.key)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce, additionalData []byte
+	switch {
+	case d.tls13:
+		nonce, additionalData = xorSequenceNumber(d.iv, sequence), header
+	default:
+		if len(d.iv) == 4 {
+			// AES-GCM records start with the explicit part of the nonce
+			if len(fragment) < 8 {
+				return nil, errors.New("TLS record too short")
+			}
+			nonce = append(append([]byte{}, d.iv...), fragment[:8]...)
+			fragment = fragment[8:]
+		} else {
+			nonce = xorSequenceNumber(d.iv, sequence)
+		}
+		if len(fragment) < aead.Overhead() {
+			return nil, errors.New("TLS record too short")
+		}
+		additionalData = binary.BigEndian.AppendUint64(nil, sequence)
+		additionalData = append(additionalData, header[:3]...)
+		additionalData = binary.BigEndian.AppendUint16(additionalData, uint16(len(fragment)-aead.Overhead()))
+	}
+	return aead.Open(nil, nonce, fragment, additionalData)
+}
+
+// decryptCbcRecord decrypts a TLS 1.2 CBC record, which starts with its IV. The MAC is encrypted with the plaintext
+// before the padding, unless encrypt_then_mac was negotiated, in which case it follows the ciphertext. The MAC isn't
+// checked either way, as the sensor only reads the traffic.
+func (d *tlsRecordDecrypter) decryptCbcRecord(fragment []byte) ([]byte, error) {
+	macLength := d.suite.macLength
+	if d.encryptThenMac {
+		if len(fragment) < macLength {
+			return nil, errors.New("invalid TLS CBC record length")
+		}
+		fragment = fragment[:len(fragment)-macLength]
+		macLength = 0
+	}
+	if len(fragment) < 2*aes.BlockSize || len(fragment)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid TLS CBC record length")
+	}
+	block, err := aes.NewCipher(d.key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(fragment)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, fragment[:aes.BlockSize]).CryptBlocks(plaintext, fragment[aes.BlockSize:])
+	padding := int(plaintext[len(plaintext)-1]) + 1
+	if padding+macLength > len(plaintext) {
+		return nil, errors.New("invalid TLS CBC record padding")
+	}
+	return plaintext[:len(plaintext)-padding-macLength], nil
+}
+
+func xorSequenceNumber(iv []byte, sequence uint64) []byte {
+	nonce := append([]byte{}, iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(sequence >> (8 * i))
+	}
+	return nonce
+}
+
+// hkdfExpandLabel is TLS 1.3's HKDF-Expand-Label with an empty context (RFC 8446 section 7.1)
+func hkdfExpandLabel(hash func() hash.Hash, secret []byte, label string, length int) []byte {
+	info := binary.BigEndian.AppendUint16(nil, uint16(length))
+	info = append(info, byte(len("tls13 ")+len(label)))
+	info = append(info, "tls13 "+label...)
+	info = append(info, 0)
+	expanded, err := hkdf.Expand(hash, secret, string(info), length)
+	if err != nil {
+		// Expand only fails if the length is too long for the hash, which none of the lengths used are
+		panic(err)
+	}
+	return expanded
+}
+
+// tls12Prf is TLS 1.2's pseudorandom function, P_hash (RFC 5246 section 5)
+func tls12Prf(hash func() hash.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	seed = append([]byte(label), seed...)
+	mac := hmac.New(hash, secret)
+	mac.Write(seed)
+	a := mac.Sum(nil)
+	var result []byte
+	for len(result) < length {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		result = mac.Sum(result)
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+	return result[:length]
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConvertTlsPcapToHar(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxVersion  uint16
+		cipherSuite uint16
+	}{
+		{"TLS 1.3", tls.VersionTLS13, 0},
+		{"TLS 1.2 AES-128-GCM", tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		{"TLS 1.2 AES-256-GCM", tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+		{"TLS 1.2 ChaCha20-Poly1305", tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256},
+		{"TLS 1.2 AES-128-CBC-SHA", tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
+		{"TLS 1.2 AES-128-CBC-SHA256", tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256},
+	}
+	certificate := newTestCertificate(t, "users.example.com")
+	request := []byte("GET /users/1 HTTP/1.1\r\nHost: users.example.com\r\n\r\n")
+	response := []byte("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 15\r\n\r\n{\"name\":\"Bob\"}\n")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var keyLog bytes.Buffer
+			clientConfig := &tls.Config{ServerName: "users.example.com", InsecureSkipVerify: true, MaxVersion: test.maxVersion, KeyLogWriter: &keyLog}
+			serverConfig := &tls.Config{Certificates: []tls.Certificate{certificate}}
+			if test.cipherSuite != 0 {
+				// Go's client doesn't offer every suite by default, so both ends are limited to the one being tested
+				clientConfig.CipherSuites = []uint16{test.cipherSuite}
+				serverConfig.CipherSuites = []uint16{test.cipherSuite}
+			}
+			clientBytes, serverBytes := newTestTlsConnection(t, clientConfig, serverConfig, request, response)
+
+			directory := t.TempDir()
+			inputPath := filepath.Join(directory, "capture.pcap")
+			keyLogPath := filepath.Join(directory, "keys.log")
+			writeTestPcapConnection(t, inputPath, 443, clientBytes, serverBytes)
+			if err := os.WriteFile(keyLogPath, keyLog.Bytes(), 0o600); err != nil {
+				t.Fatalf("Failed to write key log: %v", err)
+			}
+
+			outputPath := filepath.Join(directory, "capture.har")
+			if entries, err := convertPcapToHar(inputPath, outputPath, 1024*1024, nil); err != nil || entries != 0 {
+				t.Fatalf("convertPcapToHar() without a key log = %d entries, %v, want 0 entries", entries, err)
+			}
+			entries, err := convertPcapToHar(inputPath, outputPath, 1024*1024, []string{keyLogPath})
+			if err != nil {
+				t.Fatalf("convertPcapToHar() error = %v", err)
+			}
+			if entries != 1 {
+				t.Fatalf("convertPcapToHar() = %d entries, want 1", entries)
+			}
+			entry := readHarFile(t, outputPath).Log.Entries[0]
+			if entry.Request.URL != "https://users.example.com/users/1" || entry.Response.Status != 200 {
+				t.Errorf("Entry = %s %d, want https://users.example.com/users/1 200", entry.Request.URL, entry.Response.Status)
+			}
+			if entry.Response.Content.Text != "{\"name\":\"Bob\"}\n" {
+				t.Errorf("Response.Content.Text = %q", entry.Response.Content.Text)
+			}
+		})
+	}
+}
+
+func TestDecryptTlsConnectionErrors(t *testing.T) {
+	certificate := newTestCertificate(t, "users.example.com")
+	var keyLog bytes.Buffer
+	clientBytes, serverBytes := newTestTlsConnection(
+		t,
+		&tls.Config{ServerName: "users.example.com", InsecureSkipVerify: true, KeyLogWriter: &keyLog},
+		&tls.Config{Certificates: []tls.Certificate{certificate}},
+		[]byte("GET / HTTP/1.1\r\nHost: users\r\n\r\n"),
+		[]byte("HTTP/1.1 204 No Content\r\n\r\n"),
+	)
+	clientHello, err := parseTlsClientHello(clientBytes)
+	if err != nil {
+		t.Fatalf("parseTlsClientHello() error = %v", err)
+	}
+	serverHello, err := parseTlsServerHello(serverBytes)
+	if err != nil {
+		t.Fatalf("parseTlsServerHello() error = %v", err)
+	}
+	keys := newTlsKeyLog(tlsConfig{MaxKeyLogSessions: 10})
+	for _, line := range bytes.SplitAfter(keyLog.Bytes(), []byte("\n")) {
+		keys.parseLine(line)
+	}
+	secrets := keys.lookup(clientHello.random)
+	if secrets == nil {
+		t.Fatalf("lookup() = nil, want the secrets Go's TLS client logged")
+	}
+
+	tests := []struct {
+		name      string
+		handshake *tlsHandshake
+		secrets   *tlsSessionSecrets
+	}{
+		{"No ServerHello", &tlsHandshake{clientHello: clientHello}, secrets},
+		{"Missing secrets", &tlsHandshake{clientHello: clientHello, serverHello: serverHello}, &tlsSessionSecrets{masterSecret: []byte{1}}},
+		{"Wrong secrets", &tlsHandshake{clientHello: clientHello, serverHello: serverHello}, &tlsSessionSecrets{
+			clientHandshakeTrafficSecret: secrets.serverHandshakeTrafficSecret,
+			serverHandshakeTrafficSecret: secrets.clientHandshakeTrafficSecret,
+			clientTrafficSecret:          secrets.serverTrafficSecret,
+			serverTrafficSecret:          secrets.clientTrafficSecret,
+		}},
+		{"Unsupported cipher suite", &tlsHandshake{clientHello: clientHello, serverHello: &tlsServerHello{version: tls.VersionTLS12, cipherSuite: tls.TLS_RSA_WITH_RC4_128_SHA}}, secrets},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := decryptTlsConnection(test.handshake, test.secrets, clientBytes, serverBytes); err == nil {
+				t.Errorf("decryptTlsConnection() error = nil, want an error")
+			}
+		})
+	}
+
+	clientPlaintext, serverPlaintext, err := decryptTlsConnection(&tlsHandshake{clientHello: clientHello, serverHello: serverHello}, secrets, clientBytes, serverBytes)
+	if err != nil || string(clientPlaintext) != "GET / HTTP/1.1\r\nHost: users\r\n\r\n" || string(serverPlaintext) != "HTTP/1.1 204 No Content\r\n\r\n" {
+		t.Errorf("decryptTlsConnection() = %q, %q, %v", clientPlaintext, serverPlaintext, err)
+	}
+}
+
+func TestDecryptCbcRecord(t *testing.T) {
+	key := bytes.Repeat([]byte{0x11}, 16)
+	iv := bytes.Repeat([]byte{0x22}, aes.BlockSize)
+	mac := bytes.Repeat([]byte{0x33}, sha1.Size)
+	plaintext := []byte("GET / HTTP/1.1\r\n\r\n")
+	encrypt := func(data []byte) []byte {
+		padding := aes.BlockSize - len(data)%aes.BlockSize
+		data = append(data, bytes.Repeat([]byte{byte(padding - 1)}, padding)...)
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			t.Fatalf("Failed to create cipher: %v", err)
+		}
+		ciphertext := make([]byte, len(data))
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, data)
+		return append(append([]byte{}, iv...), ciphertext...)
+	}
+
+	tests := []struct {
+		name           string
+		encryptThenMac bool
+		fragment       []byte
+	}{
+		{"MAC then encrypt", false, encrypt(append(append([]byte{}, plaintext...), mac...))},
+		{"Encrypt then MAC", true, append(encrypt(append([]byte{}, plaintext...)), mac...)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decrypter := &tlsRecordDecrypter{suite: aesCbcCipherSuite(16, sha1.Size), key: key, encryptThenMac: test.encryptThenMac}
+			decrypted, err := decrypter.decryptCbcRecord(test.fragment)
+			if err != nil || !bytes.Equal(decrypted, plaintext) {
+				t.Errorf("decryptCbcRecord() = %q, %v, want %q", decrypted, err, plaintext)
+			}
+		})
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tlsRecordTypeHandshake          = 22
+	tlsHandshakeTypeClientHello     = 1
+	tlsHandshakeTypeServerHello     = 2
+	tlsExtensionServerName          = 0x0000
+	tlsExtensionSupportedGroups     = 0x000a
+	tlsExtensionPointFormats        = 0x000b
+	tlsExtensionSignatureAlgorithms = 0x000d
+	tlsExtensionAlpn                = 0x0010
+	tlsExtensionEncryptThenMac      = 0x0016
+	tlsExtensionSupportedVersions   = 0x002b
+
+	// maxTlsHandshakeBytes bounds how much of a stream is searched for a hello, which fit in a few records
+	maxTlsHandshakeBytes = 64 * 1024
+)
+
+var errNotTlsHandshake = errors.New("not a TLS handshake")
+
+// tlsClientHello is the parts of a ClientHello the sensor fingerprints and reports. Lists are in the order the
+// client sent them, including any GREASE values.
+type tlsClientHello struct {
+	version             uint16
+	random              []byte
+	cipherSuites        []uint16
+	extensions          []uint16
+	serverName          string
+	alpn                []string
+	supportedVersions   []uint16
+	supportedGroups     []uint16
+	pointFormats        []uint8
+	signatureAlgorithms []uint16
+}
+
+type tlsServerHello struct {
+	version     uint16
+	random      []byte
+	cipherSuite uint16
+	extensions  []uint16
+	// alpn is only sent in the ServerHello up to TLS 1.2; TLS 1.3 servers send it encrypted
+	alpn string
+	// supportedVersion is the version selected by a TLS 1.3 server, which sends 1.2 as its legacy version
+	supportedVersion uint16
+}
+
+// negotiatedVersion is the version the server chose
+func (h *tlsServerHello) negotiatedVersion() uint16 {
+	if h.supportedVersion != 0 {
+		return h.supportedVersion
+	}
+	return h.version
+}
+
+// tlsHandshake is the metadata of a TLS connection's handshake, seen without decrypting anything. ServerHello is nil
+// if the server's reply wasn't captured.
+type tlsHandshake struct {
+	src, dst         string
+	srcPort, dstPort string
+	time             time.Time
+	clientHello      *tlsClientHello
+	serverHello      *tlsServerHello
+}
+
+// isTlsHandshakeRecord checks whether a stream starts with a TLS handshake record, which is how TLS connections start
+func isTlsHandshakeRecord(data []byte) bool {
+	return len(data) >= 5 && data[0] == tlsRecordTypeHandshake && data[1] == 3 && data[2] <= 4
+}
+
+// readTlsHandshakeMessage reassembles the first handshake message from the handshake records at the start of a
+// stream, returning its type and body
+func readTlsHandshakeMessage(data []byte) (uint8, []byte, error) {
+	if len(data) > maxTlsHandshakeBytes {
+		data = data[:maxTlsHandshakeBytes]
+	}
+	var message []byte
+	for len(data) >= 5 {
+		if data[0] != tlsRecordTypeHandshake {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+length {
+			message = append(message, data[5:]...)
+			break
+		}
+		message = append(message, data[5:5+length]...)
+		data = data[5+length:]
+		if len(message) >= 4 && len(message) >= 4+int(uint32(message[1])<<16|uint32(message[2])<<8|uint32(message[3])) {
+			break
+		}
+	}
+	if len(message) < 4 {
+		return 0, nil, errNotTlsHandshake
+	}
+	length := int(uint32(message[1])<<16 | uint32(message[2])<<8 | uint32(message[3]))
+	if len(message) < 4+length {
+		return 0, nil, fmt.Errorf("truncated TLS handshake message: %d of %d bytes", len(message)-4, length)
+	}
+	return message[0], message[4 : 4+length], nil
+}
+
+// tlsReader reads the big endian, length prefixed fields of TLS handshake messages. Reads past the end set err and
+// return zero values, so a message can be parsed without checking every read.
+type tlsReader struct {
+	data []byte
+	err  error
+}
+
+func (r *tlsReader) bytes(n int) []byte {
+	if r.err != nil || n > len(r.data) {
+		r.err = errors.New("truncated TLS handshake message")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *tlsReader) uint8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *tlsReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *tlsReader) vector8() *tlsReader {
+	return &tlsReader{data: r.bytes(int(r.uint8())), err: r.err}
+}
+
+func (r *tlsReader) vector16() *tlsReader {
+	return &tlsReader{data: r.bytes(int(r.uint16())), err: r.err}
+}
+
+func (r *tlsReader) empty() bool {
+	return len(r.data) == 0
+}
+
+func (r *tlsReader) uint16s() []uint16 {
+	var values []uint16
+	for r.err == nil && len(r.data) >= 2 {
+		values = append(values, r.uint16())
+	}
+	return values
+}
+
+func parseTlsClientHello(data []byte) (*tlsClientHello, error) {
+	messageType, body, err := readTlsHandshakeMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	if messageType != tlsHandshakeTypeClientHello {
+		return nil, errNotTlsHandshake
+	}
+	r := &tlsReader{data: body}
+	hello := &tlsClientHello{version: r.uint16(), random: r.bytes(32)}
+	r.vector8() // session ID
+	hello.cipherSuites = r.vector16().uint16s()
+	r.vector8() // compression methods
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.empty() {
+		return hello, nil
+	}
+	extensions := r.vector16()
+	for extensions.err == nil && !extensions.empty() {
+		extensionType := extensions.uint16()
+		extension := extensions.vector16()
+		hello.extensions = append(hello.extensions, extensionType)
+		switch extensionType {
+		case tlsExtensionServerName:
+			names := extension.vector16()
+			for names.err == nil && !names.empty() {
+				nameType := names.uint8()
+				name := names.vector16()
+				if nameType == 0 && hello.serverName == "" {
+					hello.serverName = string(name.data)
+				}
+			}
+		case tlsExtensionAlpn:
+			protocols := extension.vector16()
+			for protocols.err == nil && !protocols.empty() {
+				hello.alpn = append(hello.alpn, string(protocols.vector8().data))
+			}
+		case tlsExtensionSupportedVersions:
+			hello.supportedVersions = extension.vector8().uint16s()
+		case tlsExtensionSupportedGroups:
+			hello.supportedGroups = extension.vector16().uint16s()
+		case tlsExtensionPointFormats:
+			hello.pointFormats = extension.vector8().data
+		case tlsExtensionSignatureAlgorithms:
+			hello.signatureAlgorithms = extension.vector16().uint16s()
+		}
+	}
+	if extensions.err != nil {
+		return nil, extensions.err
+	}
+	return hello, nil
+}
+
+func parseTlsServerHello(data []byte) (*tlsServerHello, error) {
+	messageType, body, err := readTlsHandshakeMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	if messageType != tlsHandshakeTypeServerHello {
+		return nil, errNotTlsHandshake
+	}
+	r := &tlsReader{data: body}
+	hello := &tlsServerHello{version: r.uint16(), random: r.bytes(32)}
+	r.vector8() // session ID
+	hello.cipherSuite = r.uint16()
+	r.uint8() // compression method
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.empty() {
+		return hello, nil
+	}
+	extensions := r.vector16()
+	for extensions.err == nil && !extensions.empty() {
+		extensionType := extensions.uint16()
+		extension := extensions.vector16()
+		hello.extensions = append(hello.extensions, extensionType)
+		switch extensionType {
+		case tlsExtensionSupportedVersions:
+			hello.supportedVersion = extension.uint16()
+		case tlsExtensionAlpn:
+			hello.alpn = string(extension.vector16().vector8().data)
+		}
+	}
+	if extensions.err != nil {
+		return nil, extensions.err
+	}
+	return hello, nil
+}
+
+// isGreaseValue checks for the reserved values clients send to keep servers tolerant of unknown values (RFC 8701),
+// which vary between connections so are left out of fingerprints
+func isGreaseValue(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+func withoutGrease(values []uint16) []uint16 {
+	filtered := make([]uint16, 0, len(values))
+	for _, value := range values {
+		if !isGreaseValue(value) {
+			filtered = append(filtered, value)
+		}
+	}
+	return filtered
+}
+
+func joinUint16s(values []uint16, separator string, format func(uint16) string) string {
+	formatted := make([]string, len(values))
+	for i, value := range values {
+		formatted[i] = format(value)
+	}
+	return strings.Join(formatted, separator)
+}
+
+func formatDecimal(value uint16) string { return strconv.Itoa(int(value)) }
+
+func formatHex4(value uint16) string { return fmt.Sprintf("%04x", value) }
+
+// ja3 returns the JA3 fingerprint of a ClientHello and its MD5 hash, which is how it's usually compared
+func (h *tlsClientHello) ja3() (string, string) {
+	pointFormats := make([]string, len(h.pointFormats))
+	for i, format := range h.pointFormats {
+		pointFormats[i] = strconv.Itoa(int(format))
+	}
+	fingerprint := strings.Join([]string{
+		strconv.Itoa(int(h.version)),
+		joinUint16s(withoutGrease(h.cipherSuites), "-", formatDecimal),
+		joinUint16s(withoutGrease(h.extensions), "-", formatDecimal),
+		joinUint16s(withoutGrease(h.supportedGroups), "-", formatDecimal),
+		strings.Join(pointFormats, "-"),
+	}, ",")
+	hash := md5.Sum([]byte(fingerprint))
+	return fingerprint, hex.EncodeToString(hash[:])
+}
+
+// ja4 returns the JA4 fingerprint of a ClientHello, which unlike JA3 doesn't change when a client randomises the
+// order of its extensions
+func (h *tlsClientHello) ja4() string {
+	version := h.version
+	if supportedVersions := withoutGrease(h.supportedVersions); len(supportedVersions) > 0 {
+		version = supportedVersions[0]
+		for _, supportedVersion := range supportedVersions {
+			version = max(version, supportedVersion)
+		}
+	}
+	versionCode := map[uint16]string{0x0304: "13", 0x0303: "12", 0x0302: "11", 0x0301: "10", 0x0300: "s3", 0x0002: "s2"}[version]
+	if versionCode == "" {
+		versionCode = "00"
+	}
+	sni := "i"
+	if h.serverName != "" {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(h.alpn) > 0 && h.alpn[0] != "" {
+		first, last := h.alpn[0][0], h.alpn[0][len(h.alpn[0])-1]
+		if isAsciiAlphanumeric(first) && isAsciiAlphanumeric(last) {
+			alpn = string([]byte{first, last})
+		} else {
+			alpn = hex.EncodeToString([]byte{first})[:1] + hex.EncodeToString([]byte{last})[1:]
+		}
+	}
+
+	cipherSuites := withoutGrease(h.cipherSuites)
+	extensions := withoutGrease(h.extensions)
+	a := fmt.Sprintf("t%s%s%02d%02d%s", versionCode, sni, min(len(cipherSuites), 99), min(len(extensions), 99), alpn)
+
+	sortedCipherSuites := append([]uint16{}, cipherSuites...)
+	sort.Slice(sortedCipherSuites, func(i, j int) bool { return sortedCipherSuites[i] < sortedCipherSuites[j] })
+	b := ja4Hash(joinUint16s(sortedCipherSuites, ",", formatHex4))
+
+	var sortedExtensions []uint16
+	for _, extension := range extensions {
+		if extension != tlsExtensionServerName && extension != tlsExtensionAlpn {
+			sortedExtensions = append(sortedExtensions, extension)
+		}
+	}
+	sort.Slice(sortedExtensions, func(i, j int) bool { return sortedExtensions[i] < sortedExtensions[j] })
+	c := joinUint16s(sortedExtensions, ",", formatHex4)
+	if signatureAlgorithms := withoutGrease(h.signatureAlgorithms); len(signatureAlgorithms) > 0 {
+		c += "_" + joinUint16s(signatureAlgorithms, ",", formatHex4)
+	}
+	if len(sortedExtensions) == 0 {
+		c = ""
+	}
+	return a + "_" + b + "_" + ja4Hash(c)
+}
+
+func ja4Hash(value string) string {
+	if value == "" {
+		return "000000000000"
+	}
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])[:12]
+}
+
+func isAsciiAlphanumeric(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+// tlsVersionName names a TLS version, such as "TLS 1.3"
+func tlsVersionName(version uint16) string {
+	if version == 0x0002 {
+		return "SSL 2.0"
+	}
+	return tls.VersionName(version)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testTlsExtension struct {
+	extensionType uint16
+	data          []byte
+}
+
+func appendUint16s(b []byte, values ...uint16) []byte {
+	for _, value := range values {
+		b = binary.BigEndian.AppendUint16(b, value)
+	}
+	return b
+}
+
+// newTestTlsRecords wraps a handshake message in handshake records of at most recordSize bytes each
+func newTestTlsRecords(messageType uint8, body []byte, recordSize int) []byte {
+	message := append([]byte{messageType, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+	var records []byte
+	for len(message) > 0 {
+		fragment := message[:min(recordSize, len(message))]
+		message = message[len(fragment):]
+		records = append(records, tlsRecordTypeHandshake, 3, 1)
+		records = appendUint16s(records, uint16(len(fragment)))
+		records = append(records, fragment...)
+	}
+	return records
+}
+
+func newTestTlsHello(messageType uint8, version uint16, cipherSuites []uint16, extensions []testTlsExtension, recordSize int) []byte {
+	body := appendUint16s(nil, version)
+	body = append(body, make([]byte, 32)...)
+	body = append(body, 0) // session ID
+	if messageType == tlsHandshakeTypeClientHello {
+		body = appendUint16s(body, uint16(2*len(cipherSuites)))
+		body = appendUint16s(body, cipherSuites...)
+		body = append(body, 1, 0) // compression methods
+	} else {
+		body = appendUint16s(body, cipherSuites[0])
+		body = append(body, 0) // compression method
+	}
+	var extensionBytes []byte
+	for _, extension := range extensions {
+		extensionBytes = appendUint16s(extensionBytes, extension.extensionType, uint16(len(extension.data)))
+		extensionBytes = append(extensionBytes, extension.data...)
+	}
+	body = appendUint16s(body, uint16(len(extensionBytes)))
+	body = append(body, extensionBytes...)
+	return newTestTlsRecords(messageType, body, recordSize)
+}
+
+func newTestAlpnExtension(protocol string) testTlsExtension {
+	data := appendUint16s(nil, uint16(len(protocol)+1))
+	data = append(data, byte(len(protocol)))
+	return testTlsExtension{tlsExtensionAlpn, append(data, protocol...)}
+}
+
+// newTestClientHello is the example ClientHello from the JA4 specification, with GREASE values added
+func newTestClientHello(recordSize int) []byte {
+	serverName := "users.example.com"
+	sni := appendUint16s(nil, uint16(len(serverName)+3))
+	sni = append(sni, 0)
+	sni = appendUint16s(sni, uint16(len(serverName)))
+	sni = append(sni, serverName...)
+
+	signatureAlgorithms := []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601}
+	supportedGroups := []uint16{0x2a2a, 0x001d, 0x0017, 0x0018}
+	extensions := []testTlsExtension{
+		{0x1a1a, nil},
+		{0x001b, nil},
+		{tlsExtensionServerName, sni},
+		{0x0033, nil},
+		newTestAlpnExtension("h2"),
+		{0x4469, nil},
+		{0x0017, nil},
+		{0x002d, nil},
+		{tlsExtensionSignatureAlgorithms, appendUint16s(appendUint16s(nil, uint16(2*len(signatureAlgorithms))), signatureAlgorithms...)},
+		{0x0005, nil},
+		{0x0023, nil},
+		{0x0012, nil},
+		{tlsExtensionSupportedVersions, appendUint16s([]byte{6}, 0x3a3a, 0x0304, 0x0303)},
+		{0xff01, nil},
+		{tlsExtensionPointFormats, []byte{1, 0}},
+		{tlsExtensionSupportedGroups, appendUint16s(appendUint16s(nil, uint16(2*len(supportedGroups))), supportedGroups...)},
+		{0x0015, nil},
+	}
+	cipherSuites := []uint16{0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035}
+	return newTestTlsHello(tlsHandshakeTypeClientHello, tls.VersionTLS12, cipherSuites, extensions, recordSize)
+}
+
+func TestParseTlsClientHello(t *testing.T) {
+	// The ClientHello should parse the same whether or not it's split across records
+	for _, recordSize := range []int{16384, 100} {
+		hello, err := parseTlsClientHello(newTestClientHello(recordSize))
+		if err != nil {
+			t.Fatalf("parseTlsClientHello() error = %v", err)
+		}
+		if hello.serverName != "users.example.com" || !reflect.DeepEqual(hello.alpn, []string{"h2"}) {
+			t.Errorf("parseTlsClientHello() server name = %q, ALPN = %v, want users.example.com, [h2]", hello.serverName, hello.alpn)
+		}
+
+		expectedJa3 := "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53," +
+			"27-0-51-16-17513-23-45-13-5-35-18-43-65281-11-10-21,29-23-24,0"
+		if ja3, ja3Hash := hello.ja3(); ja3 != expectedJa3 || ja3Hash != "c000e2caf3a25423f9de6c8a4b12a975" {
+			t.Errorf("ja3() = %q, %q, want %q, c000e2caf3a25423f9de6c8a4b12a975", ja3, ja3Hash, expectedJa3)
+		}
+		if ja4 := hello.ja4(); ja4 != "t13d1516h2_8daaf6152771_e5627efa2ab1" {
+			t.Errorf("ja4() = %q, want t13d1516h2_8daaf6152771_e5627efa2ab1", ja4)
+		}
+	}
+}
+
+func TestParseTlsHelloErrors(t *testing.T) {
+	clientHello := newTestClientHello(16384)
+	serverHello := newTestTlsHello(tlsHandshakeTypeServerHello, tls.VersionTLS12, []uint16{0x002f}, nil, 16384)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"HTTP request", []byte("GET / HTTP/1.1\r\n\r\n")},
+		{"Truncated ClientHello", clientHello[:len(clientHello)-10]},
+		{"ServerHello", serverHello},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if hello, err := parseTlsClientHello(test.data); err == nil {
+				t.Errorf("parseTlsClientHello() = %+v, want an error", hello)
+			}
+		})
+	}
+}
+
+// recordingConn records everything written to a connection
+type recordingConn struct {
+	net.Conn
+	mutex   sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	c.written.Write(b)
+	c.mutex.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *recordingConn) bytes() []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return bytes.Clone(c.written.Bytes())
+}
+
+func newTestCertificate(t *testing.T, serverName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: serverName},
+		DNSNames:     []string{serverName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{certificate}, PrivateKey: key}
+}
+
+// newTestTlsConnection makes a TLS connection between Go's TLS client and server over an in-memory pipe, and returns
+// everything each side sent. The client sends request if it's not nil, and the server replies with response.
+func newTestTlsConnection(t *testing.T, clientConfig *tls.Config, serverConfig *tls.Config, request []byte, response []byte) ([]byte, []byte) {
+	clientPipe, serverPipe := net.Pipe()
+	clientConn, serverConn := &recordingConn{Conn: clientPipe}, &recordingConn{Conn: serverPipe}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		defer serverPipe.Close()
+		server := tls.Server(serverConn, serverConfig)
+		if err := server.Handshake(); err != nil {
+			serverErr <- err
+			return
+		}
+		if request != nil {
+			received := make([]byte, len(request))
+			if _, err := server.Read(received); err != nil {
+				serverErr <- err
+				return
+			}
+			if _, err := server.Write(response); err != nil {
+				serverErr <- err
+				return
+			}
+		}
+		serverErr <- nil
+	}()
+
+	client := tls.Client(clientConn, clientConfig)
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("TLS client handshake failed: %v", err)
+	}
+	if request != nil {
+		if _, err := client.Write(request); err != nil {
+			t.Fatalf("Failed to write request: %v", err)
+		}
+		received := make([]byte, len(response))
+		if _, err := client.Read(received); err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatalf("TLS server failed: %v", err)
+	}
+	clientPipe.Close()
+	return clientConn.bytes(), serverConn.bytes()
+}
+
+func TestParseGoTlsHandshake(t *testing.T) {
+	tests := []struct {
+		name              string
+		maxVersion        uint16
+		expectedVersion   string
+		expectedSuiteName string
+		expectedAlpn      string
+	}{
+		// TLS 1.3 servers send the ALPN protocol they chose in an encrypted message, so it can't be seen
+		{"TLS 1.3", tls.VersionTLS13, "TLS 1.3", "TLS_AES_128_GCM_SHA256", ""},
+		{"TLS 1.2", tls.VersionTLS12, "TLS 1.2", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "http/1.1"},
+	}
+	certificate := newTestCertificate(t, "users.example.com")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clientBytes, serverBytes := newTestTlsConnection(
+				t,
+				&tls.Config{ServerName: "users.example.com", NextProtos: []string{"h2", "http/1.1"}, InsecureSkipVerify: true, MaxVersion: test.maxVersion},
+				&tls.Config{Certificates: []tls.Certificate{certificate}, NextProtos: []string{"http/1.1"}, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}},
+				nil, nil,
+			)
+			if !isTlsHandshakeRecord(clientBytes) || !isTlsHandshakeRecord(serverBytes) {
+				t.Fatalf("isTlsHandshakeRecord() = false, want true for both sides of a TLS connection")
+			}
+			clientHello, err := parseTlsClientHello(clientBytes)
+			if err != nil {
+				t.Fatalf("parseTlsClientHello() error = %v", err)
+			}
+			if clientHello.serverName != "users.example.com" || !reflect.DeepEqual(clientHello.alpn, []string{"h2", "http/1.1"}) {
+				t.Errorf("parseTlsClientHello() server name = %q, ALPN = %v", clientHello.serverName, clientHello.alpn)
+			}
+			serverHello, err := parseTlsServerHello(serverBytes)
+			if err != nil {
+				t.Fatalf("parseTlsServerHello() error = %v", err)
+			}
+			version, suiteName := tlsVersionName(serverHello.negotiatedVersion()), tls.CipherSuiteName(serverHello.cipherSuite)
+			if version != test.expectedVersion || suiteName != test.expectedSuiteName || serverHello.alpn != test.expectedAlpn {
+				t.Errorf(
+					"parseTlsServerHello() = %s, %s, %q, want %s, %s, %q",
+					version, suiteName, serverHello.alpn, test.expectedVersion, test.expectedSuiteName, test.expectedAlpn,
+				)
+			}
+		})
+	}
+}
+
+func TestTlsMonitor(t *testing.T) {
+	findings := newFindingsReporter(findingsConfig{ReportInterval: time.Hour, MaxFindings: 10}, newDropCounters())
+	var reported []finding
+	findings.emit = func(f finding) { reported = append(reported, f) }
+	inventory := newEndpointInventory(inventoryConfig{MaxEndpoints: 10}, nil, findings, newDropCounters())
+	monitor := &tlsMonitor{findings: findings, inventory: inventory}
+
+	clientHello, err := parseTlsClientHello(newTestClientHello(16384))
+	if err != nil {
+		t.Fatalf("parseTlsClientHello() error = %v", err)
+	}
+	for _, serverHello := range []*tlsServerHello{
+		{version: tls.VersionTLS12, supportedVersion: tls.VersionTLS13, cipherSuite: tls.TLS_AES_128_GCM_SHA256, alpn: "h2"},
+		{version: tls.VersionTLS10, cipherSuite: tls.TLS_RSA_WITH_RC4_128_SHA},
+		nil,
+	} {
+		monitor.observe(&tlsHandshake{src: "10.0.0.1", dst: "10.0.0.2", srcPort: "51234", dstPort: "443", clientHello: clientHello, serverHello: serverHello})
+	}
+
+	expectedFindings := []finding{
+		{Type: findingTypeWeakTlsVersion, Service: "users.example.com", Detail: "negotiated TLS 1.0"},
+		{Type: findingTypeWeakTlsCipher, Service: "users.example.com", Detail: "negotiated TLS_RSA_WITH_RC4_128_SHA"},
+	}
+	for i := range reported {
+		reported[i].Count, reported[i].FirstSeen, reported[i].LastSeen = 0, time.Time{}, time.Time{}
+	}
+	if !reflect.DeepEqual(reported, expectedFindings) {
+		t.Errorf("Findings = %+v, want %+v", reported, expectedFindings)
+	}
+
+	endpoints := inventory.snapshotTls()
+	if len(endpoints) != 1 {
+		t.Fatalf("snapshotTls() = %d endpoints, want 1", len(endpoints))
+	}
+	endpoint := endpoints[0]
+	endpoint.FirstSeen, endpoint.LastSeen = time.Time{}, time.Time{}
+	expectedEndpoint := &inventoryTlsEndpoint{
+		Service:      "users.example.com",
+		ServerName:   "users.example.com",
+		Port:         "443",
+		Versions:     []string{"TLS 1.0", "TLS 1.3"},
+		CipherSuites: []string{"TLS_AES_128_GCM_SHA256", "TLS_RSA_WITH_RC4_128_SHA"},
+		Alpn:         []string{"h2"},
+		Weak:         true,
+		Ja3:          []string{"c000e2caf3a25423f9de6c8a4b12a975"},
+		Ja4:          []string{"t13d1516h2_8daaf6152771_e5627efa2ab1"},
+		Count:        3,
+	}
+	if !reflect.DeepEqual(endpoint, expectedEndpoint) {
+		t.Errorf("snapshotTls() = %+v, want %+v", endpoint, expectedEndpoint)
+	}
+}
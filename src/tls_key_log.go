@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minKeyLogMissRefreshInterval bounds how often a connection with no known secrets makes the key logs be reread
+const minKeyLogMissRefreshInterval = time.Second
+
+// tlsSessionSecrets are the secrets logged for a TLS session, identified by its ClientHello's random. TLS 1.2 sessions
+// have a master secret, and TLS 1.3 sessions have traffic secrets for the handshake and application data.
+type tlsSessionSecrets struct {
+	masterSecret                 []byte
+	clientHandshakeTrafficSecret []byte
+	serverHandshakeTrafficSecret []byte
+	clientTrafficSecret          []byte
+	serverTrafficSecret          []byte
+}
+
+// tlsKeyLog holds the TLS session secrets read from key log files in the NSS key log format, which is written by
+// applications when SSLKEYLOGFILE is set. Files matching the configured globs are read as they grow, every
+// reloadInterval and whenever a connection's secrets are missing, so connections can be decrypted shortly after they
+// close. Only the maxSessions most recently logged sessions are kept.
+type tlsKeyLog struct {
+	patterns       []string
+	reloadInterval time.Duration
+	maxSessions    int
+	now            func() time.Time
+	// refreshMutex serialises reading the files, which can be slow, separately from looking up secrets
+	refreshMutex sync.Mutex
+	offsets      map[string]int64
+	lastRefresh  time.Time
+	mutex        sync.Mutex
+	sessions     map[string]*tlsSessionSecrets
+	// order is the client randoms of the sessions in the order they were first logged, so the oldest can be evicted
+	order []string
+}
+
+func newTlsKeyLog(config tlsConfig) *tlsKeyLog {
+	return &tlsKeyLog{
+		patterns:       config.KeyLogFiles,
+		reloadInterval: config.KeyLogReloadInterval,
+		maxSessions:    config.MaxKeyLogSessions,
+		now:            time.Now,
+		offsets:        map[string]int64{},
+		sessions:       map[string]*tlsSessionSecrets{},
+	}
+}
+
+func (k *tlsKeyLog) run() {
+	k.refresh()
+	ticker := time.NewTicker(k.reloadInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		k.refresh()
+	}
+}
+
+// secrets returns the secrets logged for the session with the given client random, or nil if there aren't any
+func (k *tlsKeyLog) secrets(clientRandom []byte) *tlsSessionSecrets {
+	if secrets := k.lookup(clientRandom); secrets != nil {
+		return secrets
+	}
+	k.refreshMutex.Lock()
+	stale := k.now().Sub(k.lastRefresh) >= minKeyLogMissRefreshInterval
+	k.refreshMutex.Unlock()
+	if !stale {
+		return nil
+	}
+	k.refresh()
+	return k.lookup(clientRandom)
+}
+
+// lookup returns a copy of the session's secrets, as a refresh can add to them while they're being used
+func (k *tlsKeyLog) lookup(clientRandom []byte) *tlsSessionSecrets {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	secrets, ok := k.sessions[string(clientRandom)]
+	if !ok {
+		return nil
+	}
+	copied := *secrets
+	return &copied
+}
+
+// refresh reads any lines added to the key log files since they were last read
+func (k *tlsKeyLog) refresh() {
+	k.refreshMutex.Lock()
+	defer k.refreshMutex.Unlock()
+	k.lastRefresh = k.now()
+
+	seen := map[string]struct{}{}
+	for _, pattern := range k.patterns {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			slog.Error("Invalid TLS key log file pattern:", "Pattern", pattern, "Err", err.Error())
+			continue
+		}
+		for _, path := range paths {
+			if _, ok := seen[path]; ok {
+				continue
+			}
+			seen[path] = struct{}{}
+			if err := k.readFile(path); err != nil {
+				slog.Warn("Failed to read TLS key log file:", "Path", path, "Err", err.Error())
+			}
+		}
+	}
+	// Forget the offsets of files that have gone, so they're read from the start if they come back
+	for path := range k.offsets {
+		if _, ok := seen[path]; !ok {
+			delete(k.offsets, path)
+		}
+	}
+}
+
+func (k *tlsKeyLog) readFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	offset := k.offsets[path]
+	// A file that's shrunk has been truncated or replaced, so it's read again from the start
+	if info.Size() < offset {
+		offset = 0
+	}
+	if info.Size() == offset {
+		return nil
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A line without a newline may still be being written, so it's read again next time
+			break
+		}
+		if err != nil {
+			return err
+		}
+		offset += int64(len(line))
+		if err := k.parseLine(line); err != nil {
+			slog.Debug("Ignoring invalid TLS key log line:", "Path", path, "Err", err.Error())
+		}
+	}
+	k.offsets[path] = offset
+	return nil
+}
+
+// parseLine adds the secret on a key log line, which is "<label> <client random> <secret>" in hex. Comments and labels
+// for secrets that aren't used to decrypt traffic, such as EXPORTER_SECRET, are ignored.
+func (k *tlsKeyLog) parseLine(line []byte) error {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[0] == '#' {
+		return nil
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) != 3 {
+		return fmt.Errorf("expected 3 fields, got %d", len(fields))
+	}
+	clientRandom, err := hex.DecodeString(fields[1])
+	if err != nil || len(clientRandom) != 32 {
+		return fmt.Errorf("invalid client random %q", fields[1])
+	}
+	secret, err := hex.DecodeString(fields[2])
+	if err != nil || len(secret) == 0 {
+		return fmt.Errorf("invalid secret for %s", fields[0])
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	session, ok := k.sessions[string(clientRandom)]
+	if !ok {
+		session = &tlsSessionSecrets{}
+	}
+	switch fields[0] {
+	case "CLIENT_RANDOM":
+		session.masterSecret = secret
+	case "CLIENT_HANDSHAKE_TRAFFIC_SECRET":
+		session.clientHandshakeTrafficSecret = secret
+	case "SERVER_HANDSHAKE_TRAFFIC_SECRET":
+		session.serverHandshakeTrafficSecret = secret
+	case "CLIENT_TRAFFIC_SECRET_0":
+		session.clientTrafficSecret = secret
+	case "SERVER_TRAFFIC_SECRET_0":
+		session.serverTrafficSecret = secret
+	default:
+		return nil
+	}
+	if !ok {
+		k.sessions[string(clientRandom)] = session
+		k.order = append(k.order, string(clientRandom))
+		for len(k.order) > k.maxSessions {
+			delete(k.sessions, k.order[0])
+			k.order = k.order[1:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTlsKeyLogRefresh(t *testing.T) {
+	directory := t.TempDir()
+	path := filepath.Join(directory, "service.keys")
+	random := func(b byte) string { return strings.Repeat(string("0123456789abcdef"[b]), 64) }
+	write := func(contents string) {
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatalf("Failed to write key log: %v", err)
+		}
+	}
+	randomBytes := func(b byte) []byte { return bytes.Repeat([]byte{b<<4 | b}, 32) }
+
+	keyLog := newTlsKeyLog(tlsConfig{KeyLogFiles: []string{filepath.Join(directory, "*.keys")}, MaxKeyLogSessions: 2})
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	keyLog.now = func() time.Time { return now }
+
+	// The second line is still being written, so it isn't read until it's finished
+	write("# comment\nCLIENT_RANDOM " + random(1) + " aabb\nCLIENT_TRAFFIC_SECRET_0 " + random(2))
+	keyLog.refresh()
+	if secrets := keyLog.lookup(randomBytes(1)); secrets == nil || !bytes.Equal(secrets.masterSecret, []byte{0xaa, 0xbb}) {
+		t.Errorf("lookup() = %+v, want the TLS 1.2 master secret", secrets)
+	}
+	if secrets := keyLog.lookup(randomBytes(2)); secrets != nil {
+		t.Errorf("lookup() = %+v, want nil for a partially written line", secrets)
+	}
+
+	// Secrets that are missing make the files be read again, but at most once every second
+	write("# comment\nCLIENT_RANDOM " + random(1) + " aabb\nCLIENT_TRAFFIC_SECRET_0 " + random(2) + " ccdd\nCLIENT_RANDOM " + random(3) + " eeff\n")
+	if secrets := keyLog.secrets(randomBytes(2)); secrets != nil {
+		t.Errorf("secrets() = %+v, want nil as the files were just read", secrets)
+	}
+	now = now.Add(time.Second)
+	if secrets := keyLog.secrets(randomBytes(2)); secrets == nil || !bytes.Equal(secrets.clientTrafficSecret, []byte{0xcc, 0xdd}) {
+		t.Errorf("secrets() = %+v, want the TLS 1.3 traffic secret", secrets)
+	}
+	// Only the two most recently logged sessions are kept
+	if secrets := keyLog.lookup(randomBytes(1)); secrets != nil {
+		t.Errorf("lookup() = %+v, want nil for an evicted session", secrets)
+	}
+
+	// A file that's been replaced by a shorter one is read again from the start
+	write("CLIENT_RANDOM " + random(4) + " 0102\n")
+	keyLog.refresh()
+	if secrets := keyLog.lookup(randomBytes(4)); secrets == nil || !bytes.Equal(secrets.masterSecret, []byte{1, 2}) {
+		t.Errorf("lookup() = %+v, want the secret from the replaced file", secrets)
+	}
+}
+
+func TestTlsKeyLogParseLineErrors(t *testing.T) {
+	keyLog := newTlsKeyLog(tlsConfig{MaxKeyLogSessions: 10})
+	for _, line := range []string{
+		"CLIENT_RANDOM abcd",
+		"CLIENT_RANDOM 1234 aabb",
+		"CLIENT_RANDOM " + strings.Repeat("zz", 32) + " aabb",
+		"CLIENT_RANDOM " + strings.Repeat("11", 32) + " not-hex",
+	} {
+		if err := keyLog.parseLine([]byte(line)); err == nil {
+			t.Errorf("parseLine(%q) error = nil, want an error", line)
+		}
+	}
+	if err := keyLog.parseLine([]byte("EXPORTER_SECRET " + strings.Repeat("11", 32) + " aabb")); err != nil || len(keyLog.sessions) != 0 {
+		t.Errorf("parseLine() = %v with %d sessions, want unused secrets ignored", err, len(keyLog.sessions))
+	}
+}
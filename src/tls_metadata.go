@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+)
+
+const dropReasonTlsQueueFull = "tls.queueSize"
+
+// insecureTlsCipherSuites are the cipher suites Go considers insecure, such as those using RC4 or 3DES
+var insecureTlsCipherSuites = func() map[uint16]struct{} {
+	suites := map[uint16]struct{}{}
+	for _, suite := range tls.InsecureCipherSuites() {
+		suites[suite.ID] = struct{}{}
+	}
+	return suites
+}()
+
+// tlsMonitor records the handshake metadata of TLS connections, which the sensor can't otherwise see into. Each
+// handshake is logged at debug level and added to the endpoint inventory, and connections that negotiate a version
+// older than TLS 1.2 or an insecure cipher suite are reported as findings.
+type tlsMonitor struct {
+	handshakes      chan *tlsHandshake
+	workloadManager *serviceIpManager
+	// findings and inventory are nil if TLS findings or the endpoint inventory are disabled
+	findings  *findingsReporter
+	inventory *endpointInventory
+}
+
+func (m *tlsMonitor) run() {
+	for handshake := range m.handshakes {
+		m.observe(handshake)
+	}
+}
+
+func (m *tlsMonitor) observe(handshake *tlsHandshake) {
+	// Like HTTP services, TLS endpoints are named by their workload if it's known, or otherwise the host asked for
+	service := handshake.dst
+	if handshake.clientHello.serverName != "" {
+		service = handshake.clientHello.serverName
+	}
+	if m.workloadManager != nil {
+		if workload := m.workloadManager.workloadName(handshake.dst); workload != "" {
+			service = workload
+		}
+	}
+	_, ja3 := handshake.clientHello.ja3()
+	ja4 := handshake.clientHello.ja4()
+
+	var version, cipherSuite, alpn string
+	var weakFindings []finding
+	if serverHello := handshake.serverHello; serverHello != nil {
+		version = tlsVersionName(serverHello.negotiatedVersion())
+		cipherSuite = tls.CipherSuiteName(serverHello.cipherSuite)
+		alpn = serverHello.alpn
+		if serverHello.negotiatedVersion() < tls.VersionTLS12 {
+			weakFindings = append(weakFindings, finding{Type: findingTypeWeakTlsVersion, Detail: "negotiated " + version})
+		}
+		if _, insecure := insecureTlsCipherSuites[serverHello.cipherSuite]; insecure {
+			weakFindings = append(weakFindings, finding{Type: findingTypeWeakTlsCipher, Detail: "negotiated " + cipherSuite})
+		}
+	}
+
+	slog.Debug(
+		"TLS handshake:",
+		"Src", handshake.src,
+		"Dst", handshake.dst,
+		"SrcPort", handshake.srcPort,
+		"DstPort", handshake.dstPort,
+		"Service", service,
+		"ServerName", handshake.clientHello.serverName,
+		"Version", version,
+		"CipherSuite", cipherSuite,
+		"Alpn", alpn,
+		"Ja3", ja3,
+		"Ja4", ja4,
+	)
+
+	if m.inventory != nil {
+		m.inventory.recordTls(
+			tlsInventoryKey{service, handshake.clientHello.serverName, handshake.dstPort},
+			version, cipherSuite, alpn, ja3, ja4, len(weakFindings) > 0,
+		)
+	}
+	if m.findings != nil {
+		for _, f := range weakFindings {
+			f.Service = service
+			m.findings.report(f)
+		}
+	}
+}